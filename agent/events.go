@@ -0,0 +1,105 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net"
+	"time"
+
+	eventsapi "github.com/containerd/containerd/api/services/events/v1"
+	"github.com/containerd/containerd/events"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/typeurl"
+	"github.com/pkg/errors"
+
+	"github.com/firecracker-microvm/firecracker-containerd/internal"
+)
+
+// Number of events to keep while the shim is not connected
+const eventQueueSize = 128
+
+// eventForwarder implements events.Publisher for runc shim, it queues events
+// until the shim connects to events vsock port and reads them
+type eventForwarder struct {
+	queue chan *eventsapi.Envelope
+}
+
+var _ events.Publisher = &eventForwarder{}
+
+func newEventForwarder() *eventForwarder {
+	return &eventForwarder{
+		queue: make(chan *eventsapi.Envelope, eventQueueSize),
+	}
+}
+
+// Publish queues the event, it never blocks and drops the event if the queue is full
+func (f *eventForwarder) Publish(ctx context.Context, topic string, event events.Event) error {
+	any, err := typeurl.MarshalAny(event)
+	if err != nil {
+		return errors.Wrapf(err, "failed to marshal event %q", topic)
+	}
+
+	envelope := &eventsapi.Envelope{
+		Timestamp: time.Now().UTC(),
+		Namespace: defaultNamespace,
+		Topic:     topic,
+		Event:     any,
+	}
+
+	select {
+	case f.queue <- envelope:
+		return nil
+	default:
+		log.G(ctx).WithField("topic", topic).Warn("event queue is full, dropping event")
+		return errors.Errorf("event queue is full, dropped %q", topic)
+	}
+}
+
+// serve accepts shim connections and streams queued events to them, one connection at a time
+func (f *eventForwarder) serve(ctx context.Context, listener net.Listener) error {
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+
+			return err
+		}
+
+		f.stream(ctx, conn)
+	}
+}
+
+func (f *eventForwarder) stream(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case envelope := <-f.queue:
+			if err := internal.WriteEnvelope(conn, envelope); err != nil {
+				log.G(ctx).WithError(err).WithField("topic", envelope.Topic).Error("failed to send event")
+				return
+			}
+		}
+	}
+}
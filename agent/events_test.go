@@ -0,0 +1,75 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"testing"
+
+	eventstypes "github.com/containerd/containerd/api/events"
+	"github.com/containerd/containerd/runtime"
+	"github.com/containerd/typeurl"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/firecracker-microvm/firecracker-containerd/internal"
+)
+
+func TestEventForwarder(t *testing.T) {
+	forwarder := newEventForwarder()
+
+	// Events published before shim connects are queued
+	err := forwarder.Publish(context.Background(), runtime.TaskOOMEventTopic, &eventstypes.TaskOOM{ContainerID: "test"})
+	require.NoError(t, err)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- forwarder.serve(ctx, listener)
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	envelope, err := internal.ReadEnvelope(bufio.NewReader(conn))
+	require.NoError(t, err)
+
+	assert.Equal(t, runtime.TaskOOMEventTopic, envelope.Topic)
+	assert.Equal(t, defaultNamespace, envelope.Namespace)
+
+	event, err := typeurl.UnmarshalAny(envelope.Event)
+	require.NoError(t, err)
+	assert.Equal(t, &eventstypes.TaskOOM{ContainerID: "test"}, event)
+
+	cancel()
+	assert.NoError(t, <-done)
+}
+
+func TestEventForwarderQueueFull(t *testing.T) {
+	forwarder := newEventForwarder()
+
+	for i := 0; i < eventQueueSize; i++ {
+		err := forwarder.Publish(context.Background(), runtime.TaskOOMEventTopic, &eventstypes.TaskOOM{ContainerID: "test"})
+		require.NoError(t, err)
+	}
+
+	err := forwarder.Publish(context.Background(), runtime.TaskOOMEventTopic, &eventstypes.TaskOOM{ContainerID: "test"})
+	assert.Error(t, err)
+}
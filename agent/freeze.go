@@ -0,0 +1,97 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"github.com/gogo/protobuf/types"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+
+	"github.com/firecracker-microvm/firecracker-containerd/proto"
+)
+
+const (
+	// Filesystem freeze ioctls from linux/fs.h: _IOWR('X', 119, int) and _IOWR('X', 120, int)
+	ioctlFIFREEZE = 0xC0045877
+	ioctlFITHAW   = 0xC0045878
+)
+
+var _ proto.AgentService = (*TaskService)(nil)
+
+// FreezeFilesystem flushes and freezes root filesystem of the container, so the drive backing it can be
+// snapshotted on the host in a consistent state. Writes block until ThawFilesystem is called.
+func (ts *TaskService) FreezeFilesystem(ctx context.Context, req *proto.FreezeFilesystemRequest) (*types.Empty, error) {
+	log.G(ctx).WithField("id", req.ID).Info("freeze filesystem")
+
+	rootfs, err := ts.rootfsPath(req.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ioctlFilesystem(rootfs, ioctlFIFREEZE); err != nil {
+		return nil, errors.Wrapf(err, "failed to freeze filesystem of %q", req.ID)
+	}
+
+	return &types.Empty{}, nil
+}
+
+// ThawFilesystem thaws root filesystem of the container frozen by FreezeFilesystem
+func (ts *TaskService) ThawFilesystem(ctx context.Context, req *proto.ThawFilesystemRequest) (*types.Empty, error) {
+	log.G(ctx).WithField("id", req.ID).Info("thaw filesystem")
+
+	rootfs, err := ts.rootfsPath(req.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ioctlFilesystem(rootfs, ioctlFITHAW); err != nil {
+		return nil, errors.Wrapf(err, "failed to thaw filesystem of %q", req.ID)
+	}
+
+	return &types.Empty{}, nil
+}
+
+// rootfsPath returns mount point of root filesystem of the given container
+func (ts *TaskService) rootfsPath(id string) (string, error) {
+	ts.containersMutex.Lock()
+	defer ts.containersMutex.Unlock()
+
+	if id != "" && id == ts.initialID {
+		return filepath.Join(bundleMountPath, "rootfs"), nil
+	}
+
+	if _, ok := ts.containers[id]; !ok {
+		return "", errdefs.ToGRPCf(errdefs.ErrNotFound, "container %q not found", id)
+	}
+
+	return filepath.Join(bundleMountPath, id, "rootfs"), nil
+}
+
+// ioctlFilesystem issues filesystem ioctl on the mount point
+func ioctlFilesystem(path string, request uint) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	defer dir.Close()
+
+	return unix.IoctlSetInt(int(dir.Fd()), request, 0)
+}
@@ -0,0 +1,44 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/firecracker-microvm/firecracker-containerd/proto"
+)
+
+func TestRootfsPath(t *testing.T) {
+	ts := NewTaskService(nil, func() {}, nil)
+	ts.initialID = "first"
+	ts.containers["second"] = nil
+
+	path, err := ts.rootfsPath("first")
+	require.NoError(t, err)
+	assert.Equal(t, "/container/rootfs", path)
+
+	path, err = ts.rootfsPath("second")
+	require.NoError(t, err)
+	assert.Equal(t, "/container/second/rootfs", path)
+
+	_, err = ts.rootfsPath("missing")
+	assert.Error(t, err)
+
+	_, err = ts.FreezeFilesystem(context.Background(), &proto.FreezeFilesystemRequest{ID: "missing"})
+	assert.Error(t, err)
+}
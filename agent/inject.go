@@ -0,0 +1,174 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+
+	"github.com/firecracker-microvm/firecracker-containerd/internal"
+	"github.com/firecracker-microvm/firecracker-containerd/proto"
+)
+
+// injectEnv appends environment variables to the process of the given OCI spec.
+// Spec is handled as generic JSON in order to preserve fields unknown to the agent.
+func injectEnv(jsonSpec []byte, env []string) ([]byte, error) {
+	if len(env) == 0 {
+		return jsonSpec, nil
+	}
+
+	var spec map[string]interface{}
+	if err := json.Unmarshal(jsonSpec, &spec); err != nil {
+		return nil, errors.Wrap(err, "failed to parse container spec")
+	}
+
+	process, ok := spec["process"].(map[string]interface{})
+	if !ok {
+		return nil, errors.New("container spec has no process to inject environment into")
+	}
+
+	current, _ := process["env"].([]interface{})
+	for _, kv := range env {
+		current = append(current, kv)
+	}
+
+	process["env"] = current
+	return json.Marshal(spec)
+}
+
+// injectFiles writes files to the root filesystem of the container described by the spec
+func injectFiles(bundle string, jsonSpec []byte, files []*proto.File) error {
+	if len(files) == 0 {
+		return nil
+	}
+
+	var spec struct {
+		Root struct {
+			Path string `json:"path"`
+		} `json:"root"`
+	}
+
+	if err := json.Unmarshal(jsonSpec, &spec); err != nil {
+		return errors.Wrap(err, "failed to parse container spec")
+	}
+
+	rootfs := spec.Root.Path
+	if !filepath.IsAbs(rootfs) {
+		rootfs = filepath.Join(bundle, rootfs)
+	}
+
+	size := 0
+	for _, file := range files {
+		size += len(file.Contents)
+	}
+
+	if size > internal.MaxInjectPayloadSize {
+		return errors.Errorf("injected files exceed %d bytes", internal.MaxInjectPayloadSize)
+	}
+
+	// Bundle path is trusted, unlike the contents of the image
+	if err := os.MkdirAll(rootfs, 0755); err != nil {
+		return errors.Wrapf(err, "failed to create root filesystem %q", rootfs)
+	}
+
+	for _, file := range files {
+		if err := injectFile(rootfs, file); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func injectFile(rootfs string, file *proto.File) error {
+	mode := os.FileMode(file.Mode) & os.ModePerm
+	f, err := createInRootfs(rootfs, file.Path, mode)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create %q", file.Path)
+	}
+
+	defer f.Close()
+
+	if _, err := f.Write(file.Contents); err != nil {
+		return errors.Wrapf(err, "failed to write %q", file.Path)
+	}
+
+	// Mode of existing files isn't changed on open and mode is subject to umask
+	if err := f.Chmod(mode); err != nil {
+		return errors.Wrapf(err, "failed to change mode of %q", file.Path)
+	}
+
+	if err := f.Chown(int(file.UID), int(file.GID)); err != nil {
+		return errors.Wrapf(err, "failed to change owner of %q", file.Path)
+	}
+
+	return f.Close()
+}
+
+// createInRootfs creates (or truncates) the file at path inside rootfs, creating missing parent directories.
+// Path is walked with openat and O_NOFOLLOW, so symlinks in the image (like "etc -> /") fail the walk
+// instead of redirecting the file out of rootfs.
+func createInRootfs(rootfs, path string, mode os.FileMode) (*os.File, error) {
+	// Clean relative to "/" so that ".." can't escape container's root filesystem
+	components := strings.Split(strings.TrimPrefix(filepath.Clean("/"+path), "/"), "/")
+	name := components[len(components)-1]
+	if name == "" {
+		return nil, errors.Errorf("invalid file path %q", path)
+	}
+
+	dirFd, err := unix.Open(rootfs, unix.O_DIRECTORY|unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open root filesystem %q", rootfs)
+	}
+
+	for _, component := range components[:len(components)-1] {
+		fd, err := openDirAt(dirFd, component)
+		unix.Close(dirFd)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to open parent directory %q", component)
+		}
+
+		dirFd = fd
+	}
+
+	defer unix.Close(dirFd)
+
+	fd, err := unix.Openat(dirFd, name, unix.O_WRONLY|unix.O_CREAT|unix.O_TRUNC|unix.O_NOFOLLOW|unix.O_CLOEXEC, uint32(mode))
+	if err != nil {
+		return nil, err
+	}
+
+	return os.NewFile(uintptr(fd), filepath.Join(rootfs, path)), nil
+}
+
+// openDirAt opens directory name under dirFd, creating it if missing. Fails with ELOOP if name is a symlink.
+func openDirAt(dirFd int, name string) (int, error) {
+	const flags = unix.O_DIRECTORY | unix.O_NOFOLLOW | unix.O_RDONLY | unix.O_CLOEXEC
+
+	fd, err := unix.Openat(dirFd, name, flags, 0)
+	if err != unix.ENOENT {
+		return fd, err
+	}
+
+	if err := unix.Mkdirat(dirFd, name, 0755); err != nil && err != unix.EEXIST {
+		return -1, err
+	}
+
+	return unix.Openat(dirFd, name, flags, 0)
+}
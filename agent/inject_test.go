@@ -0,0 +1,134 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/firecracker-microvm/firecracker-containerd/proto"
+)
+
+func TestInjectEnv(t *testing.T) {
+	spec := []byte(`{"ociVersion": "1.0.1", "process": {"args": ["sh"], "env": ["PATH=/bin"]}}`)
+
+	result, err := injectEnv(spec, []string{"TOKEN=abc"})
+	require.NoError(t, err)
+
+	var parsed struct {
+		OCIVersion string `json:"ociVersion"`
+		Process    struct {
+			Args []string `json:"args"`
+			Env  []string `json:"env"`
+		} `json:"process"`
+	}
+
+	err = json.Unmarshal(result, &parsed)
+	require.NoError(t, err)
+
+	assert.Equal(t, "1.0.1", parsed.OCIVersion)
+	assert.Equal(t, []string{"sh"}, parsed.Process.Args)
+	assert.Equal(t, []string{"PATH=/bin", "TOKEN=abc"}, parsed.Process.Env)
+
+	result, err = injectEnv(spec, nil)
+	require.NoError(t, err)
+	assert.Equal(t, spec, result)
+
+	_, err = injectEnv([]byte(`{}`), []string{"TOKEN=abc"})
+	assert.Error(t, err)
+}
+
+func TestInjectFiles(t *testing.T) {
+	bundle, err := ioutil.TempDir("", "agent-inject-test-")
+	require.NoError(t, err)
+
+	defer os.RemoveAll(bundle)
+
+	spec := []byte(`{"root": {"path": "rootfs"}}`)
+	files := []*proto.File{
+		{
+			Path:     "/etc/app/secret",
+			Contents: []byte("password"),
+			Mode:     0600,
+			UID:      uint32(os.Getuid()),
+			GID:      uint32(os.Getgid()),
+		},
+		{
+			Path:     "/../../escape",
+			Contents: []byte("data"),
+			Mode:     0644,
+			UID:      uint32(os.Getuid()),
+			GID:      uint32(os.Getgid()),
+		},
+	}
+
+	err = injectFiles(bundle, spec, files)
+	require.NoError(t, err)
+
+	path := filepath.Join(bundle, "rootfs", "etc", "app", "secret")
+	contents, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "password", string(contents))
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	_, err = os.Stat(filepath.Join(bundle, "rootfs", "escape"))
+	assert.NoError(t, err, "file outside of rootfs must be placed under it")
+}
+
+func TestInjectFilesSymlink(t *testing.T) {
+	bundle, err := ioutil.TempDir("", "agent-inject-test-")
+	require.NoError(t, err)
+
+	defer os.RemoveAll(bundle)
+
+	outside := filepath.Join(bundle, "outside")
+	err = os.MkdirAll(outside, 0755)
+	require.NoError(t, err)
+
+	err = os.MkdirAll(filepath.Join(bundle, "rootfs"), 0755)
+	require.NoError(t, err)
+
+	// Image links directories and files out of its root filesystem
+	err = os.Symlink(outside, filepath.Join(bundle, "rootfs", "etc"))
+	require.NoError(t, err)
+
+	err = os.Symlink(filepath.Join(outside, "target"), filepath.Join(bundle, "rootfs", "link"))
+	require.NoError(t, err)
+
+	spec := []byte(`{"root": {"path": "rootfs"}}`)
+	for _, path := range []string{"/etc/secret", "/etc/app/secret", "/link"} {
+		err = injectFiles(bundle, spec, []*proto.File{{
+			Path:     path,
+			Contents: []byte("password"),
+			Mode:     0600,
+			UID:      uint32(os.Getuid()),
+			GID:      uint32(os.Getgid()),
+		}})
+
+		assert.Error(t, err, "symlink in %q must not be followed", path)
+	}
+
+	entries, err := ioutil.ReadDir(outside)
+	require.NoError(t, err)
+	assert.Empty(t, entries, "nothing should be written outside of rootfs")
+}
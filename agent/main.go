@@ -30,6 +30,9 @@ import (
 	"github.com/sirupsen/logrus"
 	"golang.org/x/sync/errgroup"
 	"golang.org/x/sys/unix"
+
+	"github.com/firecracker-microvm/firecracker-containerd/internal"
+	"github.com/firecracker-microvm/firecracker-containerd/proto"
 )
 
 const defaultPort = 10789
@@ -69,12 +72,19 @@ func main() {
 
 	log.G(ctx).WithField("id", id).Info("creating runc shim")
 
-	runcTaskService, err := runc.New(ctx, id, nil)
+	// Events like OOM kills are streamed to the shim over vsock
+	eventForwarder := newEventForwarder()
+
+	runcTaskService, err := runc.New(ctx, id, eventForwarder)
 	if err != nil {
 		log.G(ctx).WithError(err).Fatal("failed to create runc shim")
 	}
 
-	taskService := NewTaskService(runcTaskService, cancel)
+	newShim := func(ctx context.Context, id string) (shim.Shim, error) {
+		return runc.New(ctx, id, eventForwarder)
+	}
+
+	taskService := NewTaskService(runcTaskService, cancel, newShim)
 
 	server, err := ttrpc.NewServer()
 	if err != nil {
@@ -82,6 +92,7 @@ func main() {
 	}
 
 	shimapi.RegisterTaskService(server, taskService)
+	proto.RegisterAgentService(server, taskService)
 
 	// Run ttrpc over vsock
 
@@ -95,6 +106,26 @@ func main() {
 		return server.Serve(ctx, listener)
 	})
 
+	log.G(ctx).WithField("port", internal.PortForwardPort).Info("listening to vsock for forwarded ports")
+	forwardListener, err := vsock.Listen(internal.PortForwardPort)
+	if err != nil {
+		log.G(ctx).WithError(err).Fatalf("failed to listen to vsock on port %d", internal.PortForwardPort)
+	}
+
+	group.Go(func() error {
+		return servePortForwards(ctx, forwardListener)
+	})
+
+	log.G(ctx).WithField("port", internal.EventsPort).Info("listening to vsock for event subscribers")
+	eventsListener, err := vsock.Listen(internal.EventsPort)
+	if err != nil {
+		log.G(ctx).WithError(err).Fatalf("failed to listen to vsock on port %d", internal.EventsPort)
+	}
+
+	group.Go(func() error {
+		return eventForwarder.serve(ctx, eventsListener)
+	})
+
 	group.Go(func() error {
 		defer func() {
 			log.G(ctx).Info("stopping ttrpc server")
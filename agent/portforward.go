@@ -0,0 +1,63 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net"
+	"strconv"
+
+	"github.com/containerd/containerd/log"
+
+	"github.com/firecracker-microvm/firecracker-containerd/internal"
+)
+
+// servePortForwards accepts connections forwarded by the shim and proxies them to local TCP ports
+func servePortForwards(ctx context.Context, listener net.Listener) error {
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+
+			return err
+		}
+
+		go forwardConn(ctx, conn)
+	}
+}
+
+func forwardConn(ctx context.Context, conn net.Conn) {
+	port, err := internal.ReadPortForwardHeader(conn)
+	if err != nil {
+		log.G(ctx).WithError(err).Error("failed to read port forward header")
+		conn.Close()
+		return
+	}
+
+	target, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(port))))
+	if err != nil {
+		log.G(ctx).WithError(err).WithField("port", port).Error("failed to connect to forwarded port")
+		conn.Close()
+		return
+	}
+
+	internal.ProxyConn(conn, target)
+}
@@ -0,0 +1,179 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/containerd/errdefs"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+
+	"github.com/firecracker-microvm/firecracker-containerd/internal"
+)
+
+const (
+	procPath   = "/proc"
+	cgroupPath = "/sys/fs/cgroup"
+)
+
+// vmResources represents resources available to containers in the VM
+type vmResources struct {
+	CPUCount      int
+	MemTotalBytes int64
+}
+
+// appliedResources represents cgroup limits read back from container's cgroups
+type appliedResources struct {
+	CPUQuota         int64
+	CPUPeriod        uint64
+	CPUShares        uint64
+	Cpus             string
+	MemoryLimitBytes int64
+}
+
+// getVMResources queries CPUs and memory of the VM
+func getVMResources(procDir string) (*vmResources, error) {
+	file, err := os.Open(filepath.Join(procDir, "meminfo"))
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	info := &vmResources{}
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// MemTotal:        1012852 kB
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 3 && fields[0] == "MemTotal:" {
+			kb, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to parse memory size %q", scanner.Text())
+			}
+
+			info.MemTotalBytes = kb * 1024
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if info.MemTotalBytes == 0 {
+		return nil, errors.New("failed to find MemTotal in meminfo")
+	}
+
+	// Agent isn't pinned to any CPUs, so it sees all CPUs of the VM
+	info.CPUCount = runtime.NumCPU()
+	return info, nil
+}
+
+// validateResources makes sure requested container limits fit into the VM
+func validateResources(resources *specs.LinuxResources, vm *vmResources) error {
+	if cpu := resources.CPU; cpu != nil {
+		if cpu.Quota != nil && *cpu.Quota > 0 && cpu.Period != nil && *cpu.Period > 0 {
+			if cpus := float64(*cpu.Quota) / float64(*cpu.Period); cpus > float64(vm.CPUCount) {
+				return errors.Wrapf(errdefs.ErrInvalidArgument, "CPU quota of %.2f CPUs exceeds %d CPUs of the VM", cpus, vm.CPUCount)
+			}
+		}
+
+		if cpu.Cpus != "" {
+			cpus, err := internal.ParseCPUList(cpu.Cpus)
+			if err != nil {
+				return errors.Wrap(errdefs.ErrInvalidArgument, err.Error())
+			}
+
+			if last := cpus[len(cpus)-1]; last >= vm.CPUCount {
+				return errors.Wrapf(errdefs.ErrInvalidArgument, "CPU %d is out of %d CPUs of the VM", last, vm.CPUCount)
+			}
+		}
+	}
+
+	if memory := resources.Memory; memory != nil && memory.Limit != nil {
+		if *memory.Limit > vm.MemTotalBytes {
+			return errors.Wrapf(errdefs.ErrInvalidArgument, "memory limit of %d bytes exceeds %d bytes of the VM",
+				*memory.Limit, vm.MemTotalBytes)
+		}
+	}
+
+	return nil
+}
+
+// readAppliedResources reads cgroup limits of the process (see "man 7 cgroups", cgroup v1 only)
+func readAppliedResources(procDir, cgroupDir string, pid uint32) (*appliedResources, error) {
+	data, err := ioutil.ReadFile(filepath.Join(procDir, strconv.Itoa(int(pid)), "cgroup"))
+	if err != nil {
+		return nil, err
+	}
+
+	// Each line is hierarchy-ID:controller-list:cgroup-path, like "4:cpu,cpuacct:/default/id"
+	paths := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) != 3 || parts[1] == "" {
+			continue
+		}
+
+		for _, controller := range strings.Split(parts[1], ",") {
+			paths[controller] = filepath.Join(cgroupDir, parts[1], parts[2])
+		}
+	}
+
+	var (
+		applied = &appliedResources{}
+		reads   = []struct {
+			controller string
+			file       string
+			value      interface{}
+		}{
+			{"cpu", "cpu.cfs_quota_us", &applied.CPUQuota},
+			{"cpu", "cpu.cfs_period_us", &applied.CPUPeriod},
+			{"cpu", "cpu.shares", &applied.CPUShares},
+			{"cpuset", "cpuset.cpus", &applied.Cpus},
+			{"memory", "memory.limit_in_bytes", &applied.MemoryLimitBytes},
+		}
+	)
+
+	for _, read := range reads {
+		dir, ok := paths[read.controller]
+		if !ok {
+			continue
+		}
+
+		value, err := ioutil.ReadFile(filepath.Join(dir, read.file))
+		if err != nil {
+			return nil, err
+		}
+
+		if str, ok := read.value.(*string); ok {
+			*str = strings.TrimSpace(string(value))
+			continue
+		}
+
+		if _, err := fmt.Sscan(string(value), read.value); err != nil {
+			return nil, errors.Wrapf(err, "failed to parse %s", read.file)
+		}
+	}
+
+	return applied, nil
+}
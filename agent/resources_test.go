@@ -0,0 +1,115 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/containerd/errdefs"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateResources(t *testing.T) {
+	vm := &vmResources{CPUCount: 2, MemTotalBytes: 512 * 1024 * 1024}
+
+	var (
+		quota     int64  = 150000
+		period    uint64 = 100000
+		bigQuota  int64  = 300000
+		limit     int64  = 256 * 1024 * 1024
+		bigLimit  int64  = 1024 * 1024 * 1024
+		noLimit   int64  = -1
+		validCPUs        = "0-1"
+	)
+
+	valid := []*specs.LinuxResources{
+		{},
+		{CPU: &specs.LinuxCPU{Quota: &quota, Period: &period, Cpus: validCPUs}},
+		{CPU: &specs.LinuxCPU{Quota: &noLimit, Period: &period}},
+		{Memory: &specs.LinuxMemory{Limit: &limit}},
+	}
+
+	for _, resources := range valid {
+		assert.NoError(t, validateResources(resources, vm))
+	}
+
+	invalid := []*specs.LinuxResources{
+		{CPU: &specs.LinuxCPU{Quota: &bigQuota, Period: &period}},
+		{CPU: &specs.LinuxCPU{Cpus: "1-2"}},
+		{CPU: &specs.LinuxCPU{Cpus: "x"}},
+		{Memory: &specs.LinuxMemory{Limit: &bigLimit}},
+	}
+
+	for _, resources := range invalid {
+		err := validateResources(resources, vm)
+		require.Error(t, err)
+		assert.Equal(t, errdefs.ErrInvalidArgument, errors.Cause(err))
+	}
+}
+
+func TestGetVMResources(t *testing.T) {
+	procDir, err := ioutil.TempDir("", "proc")
+	require.NoError(t, err)
+	defer os.RemoveAll(procDir)
+
+	meminfo := "MemTotal:        1012852 kB\nMemFree:          900000 kB\n"
+	err = ioutil.WriteFile(filepath.Join(procDir, "meminfo"), []byte(meminfo), 0644)
+	require.NoError(t, err)
+
+	vm, err := getVMResources(procDir)
+	require.NoError(t, err)
+	assert.EqualValues(t, 1012852*1024, vm.MemTotalBytes)
+	assert.NotZero(t, vm.CPUCount)
+}
+
+func TestReadAppliedResources(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "cgroup")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	var (
+		procDir   = filepath.Join(tempDir, "proc")
+		cgroupDir = filepath.Join(tempDir, "cgroup")
+		files     = map[string]string{
+			"proc/42/cgroup": "5:memory:/default/test\n4:cpu,cpuacct:/default/test\n3:cpuset:/default/test\n1:name=systemd:/\n",
+			"cgroup/cpu,cpuacct/default/test/cpu.cfs_quota_us":  "150000\n",
+			"cgroup/cpu,cpuacct/default/test/cpu.cfs_period_us": "100000\n",
+			"cgroup/cpu,cpuacct/default/test/cpu.shares":        "1024\n",
+			"cgroup/cpuset/default/test/cpuset.cpus":            "0-1\n",
+			"cgroup/memory/default/test/memory.limit_in_bytes":  "268435456\n",
+		}
+	)
+
+	for path, contents := range files {
+		path = filepath.Join(tempDir, path)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, ioutil.WriteFile(path, []byte(contents), 0644))
+	}
+
+	applied, err := readAppliedResources(procDir, cgroupDir, 42)
+	require.NoError(t, err)
+	assert.Equal(t, &appliedResources{
+		CPUQuota:         150000,
+		CPUPeriod:        100000,
+		CPUShares:        1024,
+		Cpus:             "0-1",
+		MemoryLimitBytes: 268435456,
+	}, applied)
+}
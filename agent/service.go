@@ -15,14 +15,17 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"io"
 	"io/ioutil"
 	"net"
 	"os"
 	"path/filepath"
+	"sync"
 	"syscall"
 
 	"github.com/containerd/containerd/cio"
+	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/log"
 	"github.com/containerd/containerd/namespaces"
 	"github.com/containerd/containerd/runtime/v2/shim"
@@ -30,6 +33,8 @@ import (
 	"github.com/containerd/fifo"
 	"github.com/gogo/protobuf/types"
 	"github.com/mdlayher/vsock"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 
 	"github.com/firecracker-microvm/firecracker-containerd/internal"
@@ -50,50 +55,102 @@ type TaskService struct {
 	runc    shim.Shim
 	cancels []context.CancelFunc
 	io      *cio.FIFOSet
+
+	execMutex   sync.Mutex
+	execCancels map[string]context.CancelFunc
+
+	// The first container created is served by runc shim passed to NewTaskService,
+	// additional containers of a VM group get their own runc shims
+	containersMutex sync.Mutex
+	initialID       string
+	containers      map[string]shim.Shim
+	newShim         func(ctx context.Context, id string) (shim.Shim, error)
 }
 
-func NewTaskService(runc shim.Shim, cancel context.CancelFunc) shimapi.TaskService {
+func NewTaskService(runc shim.Shim, cancel context.CancelFunc, newShim func(ctx context.Context, id string) (shim.Shim, error)) *TaskService {
 	return &TaskService{
-		runc:    runc,
-		cancels: []context.CancelFunc{cancel},
+		runc:        runc,
+		cancels:     []context.CancelFunc{cancel},
+		execCancels: make(map[string]context.CancelFunc),
+		containers:  make(map[string]shim.Shim),
+		newShim:     newShim,
 	}
 }
 
+// shimFor returns runc shim serving the given container
+func (ts *TaskService) shimFor(id string) (shim.Shim, error) {
+	ts.containersMutex.Lock()
+	defer ts.containersMutex.Unlock()
+
+	if id == ts.initialID {
+		return ts.runc, nil
+	}
+
+	runc, ok := ts.containers[id]
+	if !ok {
+		return nil, errdefs.ToGRPCf(errdefs.ErrNotFound, "container %q not found", id)
+	}
+
+	return runc, nil
+}
+
 func (ts *TaskService) Create(ctx context.Context, req *shimapi.CreateTaskRequest) (*shimapi.CreateTaskResponse, error) {
 	log.G(ctx).WithFields(logrus.Fields{"id": req.ID, "bundle": req.Bundle}).Info("create")
 
+	runc, bundle, err := ts.addContainer(ctx, req.ID)
+	if err != nil {
+		return nil, err
+	}
+
 	// Passthrough runcOptions
-	opts, err := unpackBundle(filepath.Join(bundleMountPath, "config.json"), req.Options)
+	opts, err := unpackBundle(filepath.Join(bundle, "config.json"), req.Options)
 	if err != nil {
+		ts.removeContainer(req.ID)
 		return nil, err
 	}
 	req.Options = opts
 	// Use mount path instead of bundle path inside the VM
-	req.Bundle = bundleMountPath
+	req.Bundle = bundle
+
+	if runc == ts.runc {
+		// Do not pass any mounts to runc, everything is already mounted for us
+		req.Rootfs = nil
+	}
+	// Shim passes guest drive to mount as rootfs for additional containers of a VM group
 
-	// Do not pass any mounts to runc, everything is already mounted for us
-	req.Rootfs = nil
 	// handle STDIO
-	ts.io, err = cio.NewFIFOSetInDir(defaultStdioPath, req.ID, req.Terminal)
+	stdinPort := stdioPort(req.Stdin, internal.StdinPort)
+	stdoutPort := stdioPort(req.Stdout, internal.StdoutPort)
+	stderrPort := stdioPort(req.Stderr, internal.StderrPort)
+
+	containerIO, err := cio.NewFIFOSetInDir(defaultStdioPath, req.ID, req.Terminal)
 	if err != nil {
 		log.G(ctx).WithError(err).Error("error proxying io")
+		ts.removeContainer(req.ID)
 		return nil, err
 	}
-	req.Stdin = ts.io.Stdin
-	req.Stderr = ts.io.Stderr
-	req.Stdout = ts.io.Stdout
+	if runc == ts.runc {
+		ts.io = containerIO
+	}
+	req.Stdin = containerIO.Stdin
+	req.Stderr = containerIO.Stderr
+	req.Stdout = containerIO.Stdout
 	ioctx, cancel := context.WithCancel(ctx)
 	ts.cancels = append(ts.cancels, cancel)
-	ts.proxyStdio(ioctx, req.Stdin, req.Stdout, req.Stderr)
+	go proxyIO(ioctx, req.Stdin, stdinPort, true)
+	go proxyIO(ioctx, req.Stdout, stdoutPort, false)
+	go proxyIO(ioctx, req.Stderr, stderrPort, false)
 	ctx = namespaces.WithNamespace(ctx, defaultNamespace)
 	// before create call ensure we remove any existing .init.pid file
 	// We can ignore errors since it's valid for the file to not be present
 	os.Remove(".init.pid")
 	log.G(ctx).Debug("calling runc create")
-	resp, err := ts.runc.Create(ctx, req)
+	resp, err := runc.Create(ctx, req)
 
 	if err != nil {
 		log.G(ctx).WithError(err).Error("error creating container")
+		cancel()
+		ts.removeContainer(req.ID)
 		return nil, err
 	}
 
@@ -101,10 +158,58 @@ func (ts *TaskService) Create(ctx context.Context, req *shimapi.CreateTaskReques
 	return resp, nil
 }
 
-func (ts *TaskService) proxyStdio(ctx context.Context, stdin, stdout, stderr string) {
-	go proxyIO(ctx, stdin, internal.StdinPort, true)
-	go proxyIO(ctx, stdout, internal.StdoutPort, false)
-	go proxyIO(ctx, stderr, internal.StderrPort, false)
+// addContainer returns runc shim and bundle directory to use for a new container.
+// The first container uses pre-mounted bundle, the following ones get own bundle directories.
+func (ts *TaskService) addContainer(ctx context.Context, id string) (shim.Shim, string, error) {
+	ts.containersMutex.Lock()
+	defer ts.containersMutex.Unlock()
+
+	if ts.initialID == "" || ts.initialID == id {
+		ts.initialID = id
+		return ts.runc, bundleMountPath, nil
+	}
+
+	if _, ok := ts.containers[id]; ok {
+		return nil, "", errdefs.ToGRPCf(errdefs.ErrAlreadyExists, "container %q already exists", id)
+	}
+
+	bundle := filepath.Join(bundleMountPath, id)
+	if err := os.MkdirAll(filepath.Join(bundle, "rootfs"), 0700); err != nil {
+		return nil, "", errors.Wrapf(err, "failed to create bundle directory for %q", id)
+	}
+
+	runc, err := ts.newShim(ctx, id)
+	if err != nil {
+		os.RemoveAll(bundle)
+		return nil, "", errors.Wrapf(err, "failed to create runc shim for %q", id)
+	}
+
+	ts.containers[id] = runc
+	return runc, bundle, nil
+}
+
+// removeContainer forgets runc shim of additional container and removes its bundle directory
+func (ts *TaskService) removeContainer(id string) {
+	ts.containersMutex.Lock()
+	defer ts.containersMutex.Unlock()
+
+	if id == ts.initialID {
+		return
+	}
+
+	// runc shim has no way to stop it without exiting the process, so its goroutines are left idle
+	delete(ts.containers, id)
+	os.RemoveAll(filepath.Join(bundleMountPath, id))
+}
+
+// stdioPort returns vsock port to proxy the given stdio stream over.
+// Shim passes port numbers for all but the first container of a VM, which uses default ports.
+func stdioPort(path string, defaultPort uint32) uint32 {
+	if port, ok := internal.ParseVsockStdioPath(path); ok {
+		return port
+	}
+
+	return defaultPort
 }
 
 func proxyIO(ctx context.Context, path string, port uint32, in bool) {
@@ -124,6 +229,12 @@ func proxyIO(ctx context.Context, path string, port uint32, in bool) {
 		return
 	}
 
+	// Shim never dials if the process failed to start, closing the listener unblocks Accept
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
 	var conn net.Conn
 	for {
 		// accept is non-blocking so try to accept until we get
@@ -132,6 +243,10 @@ func proxyIO(ctx context.Context, path string, port uint32, in bool) {
 		// transient errors from permanent ones.
 		conn, err = listener.Accept()
 		if err != nil {
+			if ctx.Err() != nil {
+				f.Close()
+				return
+			}
 			continue
 		}
 		break
@@ -160,8 +275,16 @@ func unpackBundle(path string, bundle *types.Any) (*types.Any, error) {
 	if err != nil {
 		return nil, err
 	}
+	jsonSpec, err := injectEnv(extraData.JsonSpec, extraData.Env)
+	if err != nil {
+		return nil, err
+	}
 	// write bundle/config.json bytes
-	err = ioutil.WriteFile(path, extraData.JsonSpec, 0644)
+	err = ioutil.WriteFile(path, jsonSpec, 0644)
+	if err != nil {
+		return nil, err
+	}
+	err = injectFiles(filepath.Dir(path), jsonSpec, extraData.Files)
 	if err != nil {
 		return nil, err
 	}
@@ -172,7 +295,12 @@ func (ts *TaskService) State(ctx context.Context, req *shimapi.StateRequest) (*s
 	log.G(ctx).WithFields(logrus.Fields{"id": req.ID, "exec_id": req.ExecID}).Debug("state")
 
 	ctx = namespaces.WithNamespace(ctx, defaultNamespace)
-	resp, err := ts.runc.State(ctx, req)
+	runc, err := ts.shimFor(req.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := runc.State(ctx, req)
 	if err != nil {
 		log.G(ctx).WithError(err).Error("state failed")
 		return nil, err
@@ -191,7 +319,12 @@ func (ts *TaskService) Start(ctx context.Context, req *shimapi.StartRequest) (*s
 	log.G(ctx).WithFields(logrus.Fields{"id": req.ID, "exec_id": req.ExecID}).Debug("start")
 
 	ctx = namespaces.WithNamespace(ctx, defaultNamespace)
-	resp, err := ts.runc.Start(ctx, req)
+	runc, err := ts.shimFor(req.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := runc.Start(ctx, req)
 	if err != nil {
 		log.G(ctx).WithError(err).Error("start failed")
 		return nil, err
@@ -205,12 +338,23 @@ func (ts *TaskService) Delete(ctx context.Context, req *shimapi.DeleteRequest) (
 	log.G(ctx).WithFields(logrus.Fields{"id": req.ID, "exec_id": req.ExecID}).Debug("delete")
 
 	ctx = namespaces.WithNamespace(ctx, defaultNamespace)
-	resp, err := ts.runc.Delete(ctx, req)
+	runc, err := ts.shimFor(req.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := runc.Delete(ctx, req)
 	if err != nil {
 		log.G(ctx).WithError(err).Error("delete failed")
 		return nil, err
 	}
 
+	if req.ExecID != "" {
+		ts.cancelExec(req.ID, req.ExecID)
+	} else {
+		ts.removeContainer(req.ID)
+	}
+
 	log.G(ctx).WithFields(logrus.Fields{
 		"pid":         resp.Pid,
 		"exit_status": resp.ExitStatus,
@@ -222,7 +366,12 @@ func (ts *TaskService) Pids(ctx context.Context, req *shimapi.PidsRequest) (*shi
 	log.G(ctx).WithField("id", req.ID).Debug("pids")
 
 	ctx = namespaces.WithNamespace(ctx, defaultNamespace)
-	resp, err := ts.runc.Pids(ctx, req)
+	runc, err := ts.shimFor(req.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := runc.Pids(ctx, req)
 	if err != nil {
 		log.G(ctx).WithError(err).Error("pids failed")
 		return nil, err
@@ -236,7 +385,12 @@ func (ts *TaskService) Pause(ctx context.Context, req *shimapi.PauseRequest) (*t
 	log.G(ctx).WithField("id", req.ID).Debug("pause")
 
 	ctx = namespaces.WithNamespace(ctx, defaultNamespace)
-	resp, err := ts.runc.Pause(ctx, req)
+	runc, err := ts.shimFor(req.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := runc.Pause(ctx, req)
 	if err != nil {
 		log.G(ctx).WithError(err).Error("pause failed")
 		return nil, err
@@ -250,7 +404,12 @@ func (ts *TaskService) Resume(ctx context.Context, req *shimapi.ResumeRequest) (
 	log.G(ctx).WithField("id", req.ID).Debug("resume")
 
 	ctx = namespaces.WithNamespace(ctx, defaultNamespace)
-	resp, err := ts.runc.Resume(ctx, req)
+	runc, err := ts.shimFor(req.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := runc.Resume(ctx, req)
 	if err != nil {
 		log.G(ctx).WithError(err).Debug("resume failed")
 		return nil, err
@@ -264,7 +423,12 @@ func (ts *TaskService) Checkpoint(ctx context.Context, req *shimapi.CheckpointTa
 	log.G(ctx).WithFields(logrus.Fields{"id": req.ID, "path": req.Path}).Info("checkpoint")
 
 	ctx = namespaces.WithNamespace(ctx, defaultNamespace)
-	resp, err := ts.runc.Checkpoint(ctx, req)
+	runc, err := ts.shimFor(req.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := runc.Checkpoint(ctx, req)
 	if err != nil {
 		log.G(ctx).WithError(err).Error("checkout failed")
 		return nil, err
@@ -278,7 +442,12 @@ func (ts *TaskService) Kill(ctx context.Context, req *shimapi.KillRequest) (*typ
 	log.G(ctx).WithFields(logrus.Fields{"id": req.ID, "exec_id": req.ExecID}).Debug("kill")
 
 	ctx = namespaces.WithNamespace(ctx, defaultNamespace)
-	resp, err := ts.runc.Kill(ctx, req)
+	runc, err := ts.shimFor(req.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := runc.Kill(ctx, req)
 	if err != nil {
 		log.G(ctx).WithError(err).Error("kill failed")
 		return nil, err
@@ -291,10 +460,47 @@ func (ts *TaskService) Kill(ctx context.Context, req *shimapi.KillRequest) (*typ
 func (ts *TaskService) Exec(ctx context.Context, req *shimapi.ExecProcessRequest) (*types.Empty, error) {
 	log.G(ctx).WithFields(logrus.Fields{"id": req.ID, "exec_id": req.ExecID}).Debug("exec")
 
+	runc, err := ts.shimFor(req.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Shim passes vsock ports instead of stdio paths, create fifos for the process and proxy them
+	stdinPort, hasStdin := internal.ParseVsockStdioPath(req.Stdin)
+	stdoutPort, hasStdout := internal.ParseVsockStdioPath(req.Stdout)
+	stderrPort, hasStderr := internal.ParseVsockStdioPath(req.Stderr)
+
+	execIO, err := cio.NewFIFOSetInDir(defaultStdioPath, req.ExecID, req.Terminal)
+	if err != nil {
+		log.G(ctx).WithError(err).Error("error proxying exec io")
+		return nil, err
+	}
+
+	req.Stdin, req.Stdout, req.Stderr = "", "", ""
+	if hasStdin {
+		req.Stdin = execIO.Stdin
+	}
+
+	if hasStdout {
+		req.Stdout = execIO.Stdout
+	}
+
+	if hasStderr {
+		req.Stderr = execIO.Stderr
+	}
+
+	ioctx, cancel := context.WithCancel(ctx)
+	ts.addExec(req.ID, req.ExecID, cancel)
+
+	go proxyIO(ioctx, req.Stdin, stdinPort, true)
+	go proxyIO(ioctx, req.Stdout, stdoutPort, false)
+	go proxyIO(ioctx, req.Stderr, stderrPort, false)
+
 	ctx = namespaces.WithNamespace(ctx, defaultNamespace)
-	resp, err := ts.runc.Exec(ctx, req)
+	resp, err := runc.Exec(ctx, req)
 	if err != nil {
 		log.G(ctx).WithError(err).Error("exec failed")
+		ts.cancelExec(req.ID, req.ExecID)
 		return nil, err
 	}
 
@@ -302,11 +508,40 @@ func (ts *TaskService) Exec(ctx context.Context, req *shimapi.ExecProcessRequest
 	return resp, nil
 }
 
+// execKey identifies exec'd process among all containers of the VM, exec IDs are only unique per container
+func execKey(id, execID string) string {
+	return id + "/" + execID
+}
+
+func (ts *TaskService) addExec(id, execID string, cancel context.CancelFunc) {
+	ts.execMutex.Lock()
+	defer ts.execMutex.Unlock()
+
+	ts.execCancels[execKey(id, execID)] = cancel
+}
+
+// cancelExec stops stdio proxying of the exec'd process
+func (ts *TaskService) cancelExec(id, execID string) {
+	ts.execMutex.Lock()
+	defer ts.execMutex.Unlock()
+
+	key := execKey(id, execID)
+	if cancel, ok := ts.execCancels[key]; ok {
+		cancel()
+		delete(ts.execCancels, key)
+	}
+}
+
 func (ts *TaskService) ResizePty(ctx context.Context, req *shimapi.ResizePtyRequest) (*types.Empty, error) {
 	log.G(ctx).WithFields(logrus.Fields{"id": req.ID, "exec_id": req.ExecID}).Debug("resize_pty")
 
 	ctx = namespaces.WithNamespace(ctx, defaultNamespace)
-	resp, err := ts.runc.ResizePty(ctx, req)
+	runc, err := ts.shimFor(req.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := runc.ResizePty(ctx, req)
 	if err != nil {
 		log.G(ctx).WithError(err).Error("resize_pty failed")
 		return nil, err
@@ -320,7 +555,12 @@ func (ts *TaskService) CloseIO(ctx context.Context, req *shimapi.CloseIORequest)
 	log.G(ctx).WithFields(logrus.Fields{"id": req.ID, "exec_id": req.ExecID}).Debug("close_io")
 
 	ctx = namespaces.WithNamespace(ctx, defaultNamespace)
-	resp, err := ts.runc.CloseIO(ctx, req)
+	runc, err := ts.shimFor(req.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := runc.CloseIO(ctx, req)
 	if err != nil {
 		log.G(ctx).WithError(err).Error("close io failed")
 		return nil, err
@@ -334,12 +574,50 @@ func (ts *TaskService) Update(ctx context.Context, req *shimapi.UpdateTaskReques
 	log.G(ctx).WithField("id", req.ID).Debug("update")
 
 	ctx = namespaces.WithNamespace(ctx, defaultNamespace)
-	resp, err := ts.runc.Update(ctx, req)
+	runc, err := ts.shimFor(req.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.Resources != nil {
+		var resources specs.LinuxResources
+		if err := json.Unmarshal(req.Resources.Value, &resources); err != nil {
+			return nil, errors.Wrap(errdefs.ErrInvalidArgument, "failed to unmarshal resources")
+		}
+
+		vm, err := getVMResources(procPath)
+		if err != nil {
+			log.G(ctx).WithError(err).Error("failed to query VM resources")
+			return nil, err
+		}
+
+		if err := validateResources(&resources, vm); err != nil {
+			log.G(ctx).WithError(err).Error("invalid resources")
+			return nil, err
+		}
+	}
+
+	resp, err := runc.Update(ctx, req)
 	if err != nil {
 		log.G(ctx).WithError(err).Error("update failed")
 		return nil, err
 	}
 
+	// Update response carries no data, so report limits actually applied by cgroups in the log
+	if state, err := runc.State(ctx, &shimapi.StateRequest{ID: req.ID}); err != nil {
+		log.G(ctx).WithError(err).Warn("failed to query container state")
+	} else if applied, err := readAppliedResources(procPath, cgroupPath, state.Pid); err != nil {
+		log.G(ctx).WithError(err).Warn("failed to read applied resources")
+	} else {
+		log.G(ctx).WithFields(logrus.Fields{
+			"cpu_quota":    applied.CPUQuota,
+			"cpu_period":   applied.CPUPeriod,
+			"cpu_shares":   applied.CPUShares,
+			"cpus":         applied.Cpus,
+			"memory_limit": applied.MemoryLimitBytes,
+		}).Info("applied resources")
+	}
+
 	log.G(ctx).Debug("update succeeded")
 	return resp, nil
 }
@@ -348,7 +626,12 @@ func (ts *TaskService) Wait(ctx context.Context, req *shimapi.WaitRequest) (*shi
 	log.G(ctx).WithFields(logrus.Fields{"id": req.ID, "exec_id": req.ExecID}).Debug("wait")
 
 	ctx = namespaces.WithNamespace(ctx, defaultNamespace)
-	resp, err := ts.runc.Wait(ctx, req)
+	runc, err := ts.shimFor(req.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := runc.Wait(ctx, req)
 	if err != nil {
 		log.G(ctx).WithError(err).Error("wait failed")
 		return nil, err
@@ -362,7 +645,12 @@ func (ts *TaskService) Stats(ctx context.Context, req *shimapi.StatsRequest) (*s
 	log.G(ctx).WithField("id", req.ID).Debug("stats")
 
 	ctx = namespaces.WithNamespace(ctx, defaultNamespace)
-	resp, err := ts.runc.Stats(ctx, req)
+	runc, err := ts.shimFor(req.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := runc.Stats(ctx, req)
 	if err != nil {
 		log.G(ctx).WithError(err).Error("stats failed")
 		return nil, err
@@ -376,7 +664,12 @@ func (ts *TaskService) Connect(ctx context.Context, req *shimapi.ConnectRequest)
 	log.G(ctx).WithField("id", req.ID).Debug("connect")
 
 	ctx = namespaces.WithNamespace(ctx, defaultNamespace)
-	resp, err := ts.runc.Connect(ctx, req)
+	runc, err := ts.shimFor(req.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := runc.Connect(ctx, req)
 	if err != nil {
 		log.G(ctx).WithError(err).Error("connect failed")
 		return nil, err
@@ -409,7 +702,7 @@ func (ts *TaskService) Shutdown(ctx context.Context, req *shimapi.ShutdownReques
 
 func (ts *TaskService) cancelAll() {
 	// cancel LIFO order
-	for i := len(ts.cancels); i >= 0; i-- {
+	for i := len(ts.cancels) - 1; i >= 0; i-- {
 		log.G(context.Background()).Debug("Cancelling ", i)
 		ts.cancels[i]()
 	}
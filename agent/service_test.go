@@ -0,0 +1,54 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/containerd/containerd/runtime/v2/shim"
+	shimapi "github.com/containerd/containerd/runtime/v2/task"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testShim struct {
+	shim.Shim
+}
+
+func (s *testShim) Delete(ctx context.Context, req *shimapi.DeleteRequest) (*shimapi.DeleteResponse, error) {
+	return &shimapi.DeleteResponse{}, nil
+}
+
+func TestDeleteExecSameIDInTwoContainers(t *testing.T) {
+	ts := NewTaskService(&testShim{}, func() {}, nil)
+	ts.initialID = "container-a"
+	ts.containers["container-b"] = &testShim{}
+
+	ctxA, cancelA := context.WithCancel(context.Background())
+	ctxB, cancelB := context.WithCancel(context.Background())
+	defer cancelA()
+	defer cancelB()
+
+	// Exec IDs are only unique per container, containers of a VM group share the agent
+	ts.addExec("container-a", "exec1", cancelA)
+	ts.addExec("container-b", "exec1", cancelB)
+
+	_, err := ts.Delete(context.Background(), &shimapi.DeleteRequest{ID: "container-b", ExecID: "exec1"})
+	require.NoError(t, err)
+
+	assert.Error(t, ctxB.Err(), "stdio of deleted exec should be closed")
+	assert.NoError(t, ctxA.Err(), "exec of the other container should keep proxying stdio")
+	assert.Len(t, ts.execCancels, 1)
+}
@@ -13,12 +13,45 @@
 
 package internal
 
+import (
+	"strconv"
+	"strings"
+)
+
 const (
 	// vsock ports to use for stdio
 	StdinPort  = 11000
 	StdoutPort = 11001
 	StderrPort = 11002
 
+	// First vsock port to use for stdio of exec'd processes, each process takes 3 consecutive ports
+	ExecStdioPortBase = 11003
+
 	// Default buffer size for io in bytes
 	DefaultBufferSize = 1024
+
+	// Max total size in bytes of environment variables and files injected into a container at create
+	MaxInjectPayloadSize = 1024 * 1024
+
+	// Prefix of stdio paths that should be proxied over vsock port instead of fifo (like "vsock:11003")
+	vsockStdioPrefix = "vsock:"
 )
+
+// VsockStdioPath makes a stdio path which tells the agent to proxy the stream over the given vsock port
+func VsockStdioPath(port uint32) string {
+	return vsockStdioPrefix + strconv.FormatUint(uint64(port), 10)
+}
+
+// ParseVsockStdioPath extracts vsock port from a path made by VsockStdioPath
+func ParseVsockStdioPath(path string) (uint32, bool) {
+	if !strings.HasPrefix(path, vsockStdioPrefix) {
+		return 0, false
+	}
+
+	port, err := strconv.ParseUint(strings.TrimPrefix(path, vsockStdioPrefix), 10, 32)
+	if err != nil {
+		return 0, false
+	}
+
+	return uint32(port), true
+}
@@ -0,0 +1,57 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package internal
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ParseCPUList parses list of CPUs in cpuset format (like "0-3,6") and returns sorted unique CPU numbers
+func ParseCPUList(value string) ([]int, error) {
+	seen := make(map[int]bool)
+
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+
+		bounds := strings.SplitN(item, "-", 2)
+		first, err := strconv.Atoi(bounds[0])
+		if err != nil || first < 0 {
+			return nil, errors.Errorf("invalid CPU %q in CPU list %q", item, value)
+		}
+
+		last := first
+		if len(bounds) == 2 {
+			last, err = strconv.Atoi(bounds[1])
+			if err != nil || last < first {
+				return nil, errors.Errorf("invalid CPU range %q in CPU list %q", item, value)
+			}
+		}
+
+		for cpu := first; cpu <= last; cpu++ {
+			seen[cpu] = true
+		}
+	}
+
+	cpus := make([]int, 0, len(seen))
+	for cpu := range seen {
+		cpus = append(cpus, cpu)
+	}
+
+	sort.Ints(cpus)
+	return cpus, nil
+}
@@ -0,0 +1,32 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCPUList(t *testing.T) {
+	cpus, err := ParseCPUList("0-3,6, 2,8-8")
+	require.NoError(t, err)
+	assert.Equal(t, []int{0, 1, 2, 3, 6, 8}, cpus)
+
+	for _, value := range []string{"", "a", "3-1", "-1", "1-", "1,,2"} {
+		_, err := ParseCPUList(value)
+		assert.Error(t, err, value)
+	}
+}
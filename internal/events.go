@@ -0,0 +1,73 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package internal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+
+	eventsapi "github.com/containerd/containerd/api/services/events/v1"
+	"github.com/gogo/protobuf/proto"
+	"github.com/pkg/errors"
+)
+
+const (
+	// EventsPort is vsock port the agent streams events from inside the VM on
+	EventsPort = 10901
+
+	// Max size of a single event envelope in bytes
+	maxEnvelopeSize = 64 * 1024
+)
+
+// WriteEnvelope writes length-prefixed event envelope to w
+func WriteEnvelope(w io.Writer, envelope *eventsapi.Envelope) error {
+	data, err := proto.Marshal(envelope)
+	if err != nil {
+		return err
+	}
+
+	var header [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(header[:], uint64(len(data)))
+
+	if _, err := w.Write(append(header[:n], data...)); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ReadEnvelope reads event envelope written by WriteEnvelope
+func ReadEnvelope(r *bufio.Reader) (*eventsapi.Envelope, error) {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if size > maxEnvelopeSize {
+		return nil, errors.Errorf("event envelope of %d bytes exceeds limit", size)
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+
+	envelope := &eventsapi.Envelope{}
+	if err := proto.Unmarshal(data, envelope); err != nil {
+		return nil, err
+	}
+
+	return envelope, nil
+}
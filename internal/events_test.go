@@ -0,0 +1,58 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	eventsapi "github.com/containerd/containerd/api/services/events/v1"
+	ptypes "github.com/gogo/protobuf/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+
+	envelopes := []*eventsapi.Envelope{
+		{
+			Timestamp: time.Unix(100, 0).UTC(),
+			Namespace: "default",
+			Topic:     "/tasks/oom",
+			Event:     &ptypes.Any{TypeUrl: "test", Value: []byte("data")},
+		},
+		{
+			Timestamp: time.Unix(200, 0).UTC(),
+			Topic:     "/tasks/exit",
+		},
+	}
+
+	for _, envelope := range envelopes {
+		require.NoError(t, WriteEnvelope(&buf, envelope))
+	}
+
+	reader := bufio.NewReader(&buf)
+	for _, expected := range envelopes {
+		actual, err := ReadEnvelope(reader)
+		require.NoError(t, err)
+		assert.Equal(t, expected, actual)
+	}
+
+	_, err := ReadEnvelope(reader)
+	assert.Equal(t, io.EOF, err)
+}
@@ -0,0 +1,61 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package internal
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+)
+
+// PortForwardPort is vsock port the agent accepts forwarded connections on.
+// Each connection starts with a header holding guest TCP port to connect to.
+const PortForwardPort = 10900
+
+// WritePortForwardHeader tells the agent which guest port the connection is forwarded to
+func WritePortForwardHeader(w io.Writer, port uint16) error {
+	return binary.Write(w, binary.BigEndian, port)
+}
+
+// ReadPortForwardHeader reads guest port written by WritePortForwardHeader
+func ReadPortForwardHeader(r io.Reader) (uint16, error) {
+	var port uint16
+	err := binary.Read(r, binary.BigEndian, &port)
+	return port, err
+}
+
+// ProxyConn copies data between two connections in both directions until either side is done, then closes both
+func ProxyConn(a, b net.Conn) {
+	var (
+		once  sync.Once
+		wg    sync.WaitGroup
+		close = func() {
+			a.Close()
+			b.Close()
+		}
+	)
+
+	copyConn := func(dst, src net.Conn) {
+		defer wg.Done()
+		buf := make([]byte, DefaultBufferSize)
+		io.CopyBuffer(dst, src, buf)
+		once.Do(close)
+	}
+
+	wg.Add(2)
+	go copyConn(a, b)
+	go copyConn(b, a)
+	wg.Wait()
+}
@@ -0,0 +1,61 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package internal
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPortForwardHeader(t *testing.T) {
+	var buf bytes.Buffer
+
+	err := WritePortForwardHeader(&buf, 8080)
+	require.NoError(t, err)
+	assert.Equal(t, 2, buf.Len())
+
+	port, err := ReadPortForwardHeader(&buf)
+	require.NoError(t, err)
+	assert.EqualValues(t, 8080, port)
+
+	_, err = ReadPortForwardHeader(&buf)
+	assert.Error(t, err)
+}
+
+func TestProxyConn(t *testing.T) {
+	client, proxyIn := net.Pipe()
+	proxyOut, server := net.Pipe()
+
+	done := make(chan struct{})
+	go func() {
+		ProxyConn(proxyIn, proxyOut)
+		close(done)
+	}()
+
+	go func() {
+		client.Write([]byte("ping"))
+		client.Close()
+	}()
+
+	data, err := ioutil.ReadAll(server)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(data))
+
+	<-done
+}
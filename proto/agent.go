@@ -0,0 +1,77 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package proto
+
+import (
+	"context"
+
+	"github.com/containerd/ttrpc"
+	"github.com/gogo/protobuf/types"
+)
+
+// AgentServiceName is ttrpc name of the Agent service defined in types.proto
+const AgentServiceName = "firecracker.containerd.Agent"
+
+// AgentService is served by the agent next to containerd task API, and proxied by the runtime
+type AgentService interface {
+	FreezeFilesystem(ctx context.Context, req *FreezeFilesystemRequest) (*types.Empty, error)
+	ThawFilesystem(ctx context.Context, req *ThawFilesystemRequest) (*types.Empty, error)
+}
+
+// RegisterAgentService registers Agent service methods on ttrpc server
+func RegisterAgentService(srv *ttrpc.Server, svc AgentService) {
+	srv.Register(AgentServiceName, map[string]ttrpc.Method{
+		"FreezeFilesystem": func(ctx context.Context, unmarshal func(interface{}) error) (interface{}, error) {
+			var req FreezeFilesystemRequest
+			if err := unmarshal(&req); err != nil {
+				return nil, err
+			}
+			return svc.FreezeFilesystem(ctx, &req)
+		},
+		"ThawFilesystem": func(ctx context.Context, unmarshal func(interface{}) error) (interface{}, error) {
+			var req ThawFilesystemRequest
+			if err := unmarshal(&req); err != nil {
+				return nil, err
+			}
+			return svc.ThawFilesystem(ctx, &req)
+		},
+	})
+}
+
+type agentClient struct {
+	client *ttrpc.Client
+}
+
+// NewAgentClient returns Agent service client over the given ttrpc connection
+func NewAgentClient(client *ttrpc.Client) AgentService {
+	return &agentClient{
+		client: client,
+	}
+}
+
+func (c *agentClient) FreezeFilesystem(ctx context.Context, req *FreezeFilesystemRequest) (*types.Empty, error) {
+	var resp types.Empty
+	if err := c.client.Call(ctx, AgentServiceName, "FreezeFilesystem", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (c *agentClient) ThawFilesystem(ctx context.Context, req *ThawFilesystemRequest) (*types.Empty, error) {
+	var resp types.Empty
+	if err := c.client.Call(ctx, AgentServiceName, "ThawFilesystem", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
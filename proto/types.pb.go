@@ -23,6 +23,8 @@ const _ = proto.GoGoProtoPackageIsVersion2 // please upgrade the proto package
 type ExtraData struct {
 	JsonSpec             []byte     `protobuf:"bytes,1,opt,name=JsonSpec,proto3" json:"JsonSpec,omitempty"`
 	RuncOptions          *types.Any `protobuf:"bytes,2,opt,name=RuncOptions" json:"RuncOptions,omitempty"`
+	Env                  []string   `protobuf:"bytes,3,rep,name=Env" json:"Env,omitempty"`
+	Files                []*File    `protobuf:"bytes,4,rep,name=Files" json:"Files,omitempty"`
 	XXX_NoUnkeyedLiteral struct{}   `json:"-"`
 	XXX_unrecognized     []byte     `json:"-"`
 	XXX_sizecache        int32      `json:"-"`
@@ -32,7 +34,7 @@ func (m *ExtraData) Reset()         { *m = ExtraData{} }
 func (m *ExtraData) String() string { return proto.CompactTextString(m) }
 func (*ExtraData) ProtoMessage()    {}
 func (*ExtraData) Descriptor() ([]byte, []int) {
-	return fileDescriptor_types_fd1a0f9dde9f57da, []int{0}
+	return fileDescriptor_types_b23931fdb9ed019e, []int{0}
 }
 func (m *ExtraData) XXX_Unmarshal(b []byte) error {
 	return xxx_messageInfo_ExtraData.Unmarshal(m, b)
@@ -66,24 +68,485 @@ func (m *ExtraData) GetRuncOptions() *types.Any {
 	return nil
 }
 
+func (m *ExtraData) GetEnv() []string {
+	if m != nil {
+		return m.Env
+	}
+	return nil
+}
+
+func (m *ExtraData) GetFiles() []*File {
+	if m != nil {
+		return m.Files
+	}
+	return nil
+}
+
+// File to create in container's root filesystem before start
+type File struct {
+	Path                 string   `protobuf:"bytes,1,opt,name=Path,proto3" json:"Path,omitempty"`
+	Contents             []byte   `protobuf:"bytes,2,opt,name=Contents,proto3" json:"Contents,omitempty"`
+	Mode                 uint32   `protobuf:"varint,3,opt,name=Mode,proto3" json:"Mode,omitempty"`
+	UID                  uint32   `protobuf:"varint,4,opt,name=UID,proto3" json:"UID,omitempty"`
+	GID                  uint32   `protobuf:"varint,5,opt,name=GID,proto3" json:"GID,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *File) Reset()         { *m = File{} }
+func (m *File) String() string { return proto.CompactTextString(m) }
+func (*File) ProtoMessage()    {}
+func (*File) Descriptor() ([]byte, []int) {
+	return fileDescriptor_types_b23931fdb9ed019e, []int{1}
+}
+func (m *File) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_File.Unmarshal(m, b)
+}
+func (m *File) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_File.Marshal(b, m, deterministic)
+}
+func (dst *File) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_File.Merge(dst, src)
+}
+func (m *File) XXX_Size() int {
+	return xxx_messageInfo_File.Size(m)
+}
+func (m *File) XXX_DiscardUnknown() {
+	xxx_messageInfo_File.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_File proto.InternalMessageInfo
+
+func (m *File) GetPath() string {
+	if m != nil {
+		return m.Path
+	}
+	return ""
+}
+
+func (m *File) GetContents() []byte {
+	if m != nil {
+		return m.Contents
+	}
+	return nil
+}
+
+func (m *File) GetMode() uint32 {
+	if m != nil {
+		return m.Mode
+	}
+	return 0
+}
+
+func (m *File) GetUID() uint32 {
+	if m != nil {
+		return m.UID
+	}
+	return 0
+}
+
+func (m *File) GetGID() uint32 {
+	if m != nil {
+		return m.GID
+	}
+	return 0
+}
+
+// Durations of VM boot phases, published once VM is ready
+type BootTiming struct {
+	VMID                 string       `protobuf:"bytes,1,opt,name=VMID,proto3" json:"VMID,omitempty"`
+	Phases               []*BootPhase `protobuf:"bytes,2,rep,name=Phases" json:"Phases,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}     `json:"-"`
+	XXX_unrecognized     []byte       `json:"-"`
+	XXX_sizecache        int32        `json:"-"`
+}
+
+func (m *BootTiming) Reset()         { *m = BootTiming{} }
+func (m *BootTiming) String() string { return proto.CompactTextString(m) }
+func (*BootTiming) ProtoMessage()    {}
+func (*BootTiming) Descriptor() ([]byte, []int) {
+	return fileDescriptor_types_b23931fdb9ed019e, []int{2}
+}
+func (m *BootTiming) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_BootTiming.Unmarshal(m, b)
+}
+func (m *BootTiming) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_BootTiming.Marshal(b, m, deterministic)
+}
+func (dst *BootTiming) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_BootTiming.Merge(dst, src)
+}
+func (m *BootTiming) XXX_Size() int {
+	return xxx_messageInfo_BootTiming.Size(m)
+}
+func (m *BootTiming) XXX_DiscardUnknown() {
+	xxx_messageInfo_BootTiming.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_BootTiming proto.InternalMessageInfo
+
+func (m *BootTiming) GetVMID() string {
+	if m != nil {
+		return m.VMID
+	}
+	return ""
+}
+
+func (m *BootTiming) GetPhases() []*BootPhase {
+	if m != nil {
+		return m.Phases
+	}
+	return nil
+}
+
+// Single phase of VM boot
+type BootPhase struct {
+	Name                 string   `protobuf:"bytes,1,opt,name=Name,proto3" json:"Name,omitempty"`
+	DurationNanos        int64    `protobuf:"varint,2,opt,name=DurationNanos,proto3" json:"DurationNanos,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *BootPhase) Reset()         { *m = BootPhase{} }
+func (m *BootPhase) String() string { return proto.CompactTextString(m) }
+func (*BootPhase) ProtoMessage()    {}
+func (*BootPhase) Descriptor() ([]byte, []int) {
+	return fileDescriptor_types_b23931fdb9ed019e, []int{3}
+}
+func (m *BootPhase) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_BootPhase.Unmarshal(m, b)
+}
+func (m *BootPhase) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_BootPhase.Marshal(b, m, deterministic)
+}
+func (dst *BootPhase) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_BootPhase.Merge(dst, src)
+}
+func (m *BootPhase) XXX_Size() int {
+	return xxx_messageInfo_BootPhase.Size(m)
+}
+func (m *BootPhase) XXX_DiscardUnknown() {
+	xxx_messageInfo_BootPhase.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_BootPhase proto.InternalMessageInfo
+
+func (m *BootPhase) GetName() string {
+	if m != nil {
+		return m.Name
+	}
+	return ""
+}
+
+func (m *BootPhase) GetDurationNanos() int64 {
+	if m != nil {
+		return m.DurationNanos
+	}
+	return 0
+}
+
+// Freezes root filesystem of the container in the guest
+type FreezeFilesystemRequest struct {
+	ID                   string   `protobuf:"bytes,1,opt,name=ID,proto3" json:"ID,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *FreezeFilesystemRequest) Reset()         { *m = FreezeFilesystemRequest{} }
+func (m *FreezeFilesystemRequest) String() string { return proto.CompactTextString(m) }
+func (*FreezeFilesystemRequest) ProtoMessage()    {}
+func (*FreezeFilesystemRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_types_b23931fdb9ed019e, []int{4}
+}
+func (m *FreezeFilesystemRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_FreezeFilesystemRequest.Unmarshal(m, b)
+}
+func (m *FreezeFilesystemRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_FreezeFilesystemRequest.Marshal(b, m, deterministic)
+}
+func (dst *FreezeFilesystemRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_FreezeFilesystemRequest.Merge(dst, src)
+}
+func (m *FreezeFilesystemRequest) XXX_Size() int {
+	return xxx_messageInfo_FreezeFilesystemRequest.Size(m)
+}
+func (m *FreezeFilesystemRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_FreezeFilesystemRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_FreezeFilesystemRequest proto.InternalMessageInfo
+
+func (m *FreezeFilesystemRequest) GetID() string {
+	if m != nil {
+		return m.ID
+	}
+	return ""
+}
+
+// Thaws root filesystem of the container frozen by FreezeFilesystemRequest
+type ThawFilesystemRequest struct {
+	ID                   string   `protobuf:"bytes,1,opt,name=ID,proto3" json:"ID,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *ThawFilesystemRequest) Reset()         { *m = ThawFilesystemRequest{} }
+func (m *ThawFilesystemRequest) String() string { return proto.CompactTextString(m) }
+func (*ThawFilesystemRequest) ProtoMessage()    {}
+func (*ThawFilesystemRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_types_b23931fdb9ed019e, []int{5}
+}
+func (m *ThawFilesystemRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_ThawFilesystemRequest.Unmarshal(m, b)
+}
+func (m *ThawFilesystemRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_ThawFilesystemRequest.Marshal(b, m, deterministic)
+}
+func (dst *ThawFilesystemRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ThawFilesystemRequest.Merge(dst, src)
+}
+func (m *ThawFilesystemRequest) XXX_Size() int {
+	return xxx_messageInfo_ThawFilesystemRequest.Size(m)
+}
+func (m *ThawFilesystemRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_ThawFilesystemRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_ThawFilesystemRequest proto.InternalMessageInfo
+
+func (m *ThawFilesystemRequest) GetID() string {
+	if m != nil {
+		return m.ID
+	}
+	return ""
+}
+
+// Number of VMs running on the host and their limit, published on VM admission
+type VMCount struct {
+	Running              uint32   `protobuf:"varint,1,opt,name=Running,proto3" json:"Running,omitempty"`
+	Limit                uint32   `protobuf:"varint,2,opt,name=Limit,proto3" json:"Limit,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *VMCount) Reset()         { *m = VMCount{} }
+func (m *VMCount) String() string { return proto.CompactTextString(m) }
+func (*VMCount) ProtoMessage()    {}
+func (*VMCount) Descriptor() ([]byte, []int) {
+	return fileDescriptor_types_b23931fdb9ed019e, []int{6}
+}
+func (m *VMCount) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_VMCount.Unmarshal(m, b)
+}
+func (m *VMCount) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_VMCount.Marshal(b, m, deterministic)
+}
+func (dst *VMCount) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_VMCount.Merge(dst, src)
+}
+func (m *VMCount) XXX_Size() int {
+	return xxx_messageInfo_VMCount.Size(m)
+}
+func (m *VMCount) XXX_DiscardUnknown() {
+	xxx_messageInfo_VMCount.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_VMCount proto.InternalMessageInfo
+
+func (m *VMCount) GetRunning() uint32 {
+	if m != nil {
+		return m.Running
+	}
+	return 0
+}
+
+func (m *VMCount) GetLimit() uint32 {
+	if m != nil {
+		return m.Limit
+	}
+	return 0
+}
+
+// Guest kernel panic with its trace from serial console, published before VM is stopped
+type GuestPanic struct {
+	VMID                 string   `protobuf:"bytes,1,opt,name=VMID,proto3" json:"VMID,omitempty"`
+	Trace                string   `protobuf:"bytes,2,opt,name=Trace,proto3" json:"Trace,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *GuestPanic) Reset()         { *m = GuestPanic{} }
+func (m *GuestPanic) String() string { return proto.CompactTextString(m) }
+func (*GuestPanic) ProtoMessage()    {}
+func (*GuestPanic) Descriptor() ([]byte, []int) {
+	return fileDescriptor_types_b23931fdb9ed019e, []int{7}
+}
+func (m *GuestPanic) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_GuestPanic.Unmarshal(m, b)
+}
+func (m *GuestPanic) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_GuestPanic.Marshal(b, m, deterministic)
+}
+func (dst *GuestPanic) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_GuestPanic.Merge(dst, src)
+}
+func (m *GuestPanic) XXX_Size() int {
+	return xxx_messageInfo_GuestPanic.Size(m)
+}
+func (m *GuestPanic) XXX_DiscardUnknown() {
+	xxx_messageInfo_GuestPanic.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_GuestPanic proto.InternalMessageInfo
+
+func (m *GuestPanic) GetVMID() string {
+	if m != nil {
+		return m.VMID
+	}
+	return ""
+}
+
+func (m *GuestPanic) GetTrace() string {
+	if m != nil {
+		return m.Trace
+	}
+	return ""
+}
+
+// Thin-pool space usage, published by devmapper snapshotter once usage reaches low space threshold
+type PoolSpace struct {
+	PoolName             string   `protobuf:"bytes,1,opt,name=PoolName,proto3" json:"PoolName,omitempty"`
+	UsedDataBlocks       uint64   `protobuf:"varint,2,opt,name=UsedDataBlocks,proto3" json:"UsedDataBlocks,omitempty"`
+	TotalDataBlocks      uint64   `protobuf:"varint,3,opt,name=TotalDataBlocks,proto3" json:"TotalDataBlocks,omitempty"`
+	UsedMetadataBlocks   uint64   `protobuf:"varint,4,opt,name=UsedMetadataBlocks,proto3" json:"UsedMetadataBlocks,omitempty"`
+	TotalMetadataBlocks  uint64   `protobuf:"varint,5,opt,name=TotalMetadataBlocks,proto3" json:"TotalMetadataBlocks,omitempty"`
+	Threshold            float64  `protobuf:"fixed64,6,opt,name=Threshold,proto3" json:"Threshold,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *PoolSpace) Reset()         { *m = PoolSpace{} }
+func (m *PoolSpace) String() string { return proto.CompactTextString(m) }
+func (*PoolSpace) ProtoMessage()    {}
+func (*PoolSpace) Descriptor() ([]byte, []int) {
+	return fileDescriptor_types_b23931fdb9ed019e, []int{8}
+}
+func (m *PoolSpace) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_PoolSpace.Unmarshal(m, b)
+}
+func (m *PoolSpace) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_PoolSpace.Marshal(b, m, deterministic)
+}
+func (dst *PoolSpace) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_PoolSpace.Merge(dst, src)
+}
+func (m *PoolSpace) XXX_Size() int {
+	return xxx_messageInfo_PoolSpace.Size(m)
+}
+func (m *PoolSpace) XXX_DiscardUnknown() {
+	xxx_messageInfo_PoolSpace.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_PoolSpace proto.InternalMessageInfo
+
+func (m *PoolSpace) GetPoolName() string {
+	if m != nil {
+		return m.PoolName
+	}
+	return ""
+}
+
+func (m *PoolSpace) GetUsedDataBlocks() uint64 {
+	if m != nil {
+		return m.UsedDataBlocks
+	}
+	return 0
+}
+
+func (m *PoolSpace) GetTotalDataBlocks() uint64 {
+	if m != nil {
+		return m.TotalDataBlocks
+	}
+	return 0
+}
+
+func (m *PoolSpace) GetUsedMetadataBlocks() uint64 {
+	if m != nil {
+		return m.UsedMetadataBlocks
+	}
+	return 0
+}
+
+func (m *PoolSpace) GetTotalMetadataBlocks() uint64 {
+	if m != nil {
+		return m.TotalMetadataBlocks
+	}
+	return 0
+}
+
+func (m *PoolSpace) GetThreshold() float64 {
+	if m != nil {
+		return m.Threshold
+	}
+	return 0
+}
+
 func init() {
 	proto.RegisterType((*ExtraData)(nil), "firecracker.containerd.ExtraData")
+	proto.RegisterType((*File)(nil), "firecracker.containerd.File")
+	proto.RegisterType((*BootTiming)(nil), "firecracker.containerd.BootTiming")
+	proto.RegisterType((*BootPhase)(nil), "firecracker.containerd.BootPhase")
+	proto.RegisterType((*FreezeFilesystemRequest)(nil), "firecracker.containerd.FreezeFilesystemRequest")
+	proto.RegisterType((*ThawFilesystemRequest)(nil), "firecracker.containerd.ThawFilesystemRequest")
+	proto.RegisterType((*VMCount)(nil), "firecracker.containerd.VMCount")
+	proto.RegisterType((*GuestPanic)(nil), "firecracker.containerd.GuestPanic")
+	proto.RegisterType((*PoolSpace)(nil), "firecracker.containerd.PoolSpace")
 }
 
-func init() { proto.RegisterFile("proto/types.proto", fileDescriptor_types_fd1a0f9dde9f57da) }
-
-var fileDescriptor_types_fd1a0f9dde9f57da = []byte{
-	// 188 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xe2, 0x12, 0x2c, 0x28, 0xca, 0x2f,
-	0xc9, 0xd7, 0x2f, 0xa9, 0x2c, 0x48, 0x2d, 0xd6, 0x03, 0xb3, 0x85, 0xc4, 0xd2, 0x32, 0x8b, 0x52,
-	0x93, 0x8b, 0x12, 0x93, 0xb3, 0x53, 0x8b, 0xf4, 0x92, 0xf3, 0xf3, 0x4a, 0x12, 0x33, 0xf3, 0x52,
-	0x8b, 0x52, 0xa4, 0x24, 0xd3, 0xf3, 0xf3, 0xd3, 0x73, 0x52, 0xf5, 0xc1, 0xaa, 0x92, 0x4a, 0xd3,
-	0xf4, 0x13, 0xf3, 0x2a, 0x21, 0x5a, 0x94, 0xe2, 0xb9, 0x38, 0x5d, 0x2b, 0x4a, 0x8a, 0x12, 0x5d,
-	0x12, 0x4b, 0x12, 0x85, 0xa4, 0xb8, 0x38, 0xbc, 0x8a, 0xf3, 0xf3, 0x82, 0x0b, 0x52, 0x93, 0x25,
-	0x18, 0x15, 0x18, 0x35, 0x78, 0x82, 0xe0, 0x7c, 0x21, 0x33, 0x2e, 0xee, 0xa0, 0xd2, 0xbc, 0x64,
-	0xff, 0x82, 0x92, 0xcc, 0xfc, 0xbc, 0x62, 0x09, 0x26, 0x05, 0x46, 0x0d, 0x6e, 0x23, 0x11, 0x3d,
-	0x88, 0xc9, 0x7a, 0x30, 0x93, 0xf5, 0x1c, 0xf3, 0x2a, 0x83, 0x90, 0x15, 0x3a, 0xd9, 0x46, 0x59,
-	0xa7, 0x67, 0x96, 0x64, 0x94, 0x26, 0xe9, 0x25, 0xe7, 0xe7, 0xea, 0x23, 0x39, 0x50, 0x37, 0x37,
-	0x33, 0xb9, 0x28, 0xbf, 0x0c, 0x55, 0x0c, 0xe1, 0x68, 0xa8, 0x63, 0xd9, 0xc0, 0x94, 0x31, 0x20,
-	0x00, 0x00, 0xff, 0xff, 0xad, 0x88, 0x4e, 0x21, 0xee, 0x00, 0x00, 0x00,
+func init() { proto.RegisterFile("proto/types.proto", fileDescriptor_types_b23931fdb9ed019e) }
+
+var fileDescriptor_types_b23931fdb9ed019e = []byte{
+	// 555 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x84, 0x53, 0x5d, 0x6f, 0xd3, 0x30,
+	0x14, 0x55, 0x96, 0x74, 0x23, 0xb7, 0xeb, 0x00, 0x53, 0x20, 0x4c, 0x7b, 0x08, 0x11, 0x82, 0xf0,
+	0x40, 0x8a, 0x8a, 0x34, 0x69, 0x42, 0x3c, 0xd0, 0xa5, 0xab, 0x8a, 0xe8, 0xa8, 0xbc, 0x6e, 0x0f,
+	0xf0, 0xe4, 0xa5, 0x5e, 0x63, 0x2d, 0xb1, 0x8b, 0xe3, 0x0c, 0xca, 0xff, 0xe1, 0x47, 0xf2, 0x86,
+	0xec, 0xac, 0x1f, 0xab, 0x8a, 0x78, 0xea, 0xb9, 0xc7, 0xe7, 0x1e, 0x1f, 0xdf, 0xde, 0xc0, 0xc3,
+	0xa9, 0x14, 0x4a, 0xb4, 0xd4, 0x6c, 0x4a, 0x8b, 0xc8, 0x60, 0xf4, 0xe4, 0x8a, 0x49, 0x9a, 0x48,
+	0x92, 0x5c, 0x53, 0x19, 0x25, 0x82, 0x2b, 0xc2, 0x38, 0x95, 0xe3, 0xfd, 0x67, 0x13, 0x21, 0x26,
+	0x19, 0x6d, 0x19, 0xd5, 0x65, 0x79, 0xd5, 0x22, 0x7c, 0x56, 0xb5, 0x04, 0xbf, 0x2d, 0x70, 0xbb,
+	0x3f, 0x95, 0x24, 0x31, 0x51, 0x04, 0xed, 0xc3, 0xbd, 0x4f, 0x85, 0xe0, 0x67, 0x53, 0x9a, 0x78,
+	0x96, 0x6f, 0x85, 0xbb, 0x78, 0x51, 0xa3, 0x43, 0xa8, 0xe3, 0x92, 0x27, 0x5f, 0xa6, 0x8a, 0x09,
+	0x5e, 0x78, 0x5b, 0xbe, 0x15, 0xd6, 0xdb, 0xcd, 0xa8, 0xb2, 0x8e, 0xe6, 0xd6, 0xd1, 0x47, 0x3e,
+	0xc3, 0xab, 0x42, 0xf4, 0x00, 0xec, 0x2e, 0xbf, 0xf1, 0x6c, 0xdf, 0x0e, 0x5d, 0xac, 0x21, 0x6a,
+	0x43, 0xed, 0x84, 0x65, 0xb4, 0xf0, 0x1c, 0xdf, 0x0e, 0xeb, 0xed, 0x83, 0x68, 0x73, 0xec, 0x48,
+	0x8b, 0x70, 0x25, 0x0d, 0x38, 0x38, 0x1a, 0x20, 0x04, 0xce, 0x90, 0xa8, 0xd4, 0xa4, 0x73, 0xb1,
+	0xc1, 0x3a, 0xf5, 0xb1, 0xe0, 0x8a, 0x72, 0x55, 0xc5, 0xda, 0xc5, 0x8b, 0x5a, 0xeb, 0x07, 0x62,
+	0x4c, 0x3d, 0xdb, 0xb7, 0xc2, 0x06, 0x36, 0x58, 0x27, 0x3a, 0xef, 0xc7, 0x9e, 0x63, 0x28, 0x0d,
+	0x35, 0xd3, 0xeb, 0xc7, 0x5e, 0xad, 0x62, 0x7a, 0xfd, 0x38, 0xf8, 0x06, 0xd0, 0x11, 0x42, 0x8d,
+	0x58, 0xce, 0xf8, 0x44, 0xbb, 0x5c, 0x0c, 0xfa, 0xf1, 0xfc, 0x56, 0x8d, 0xd1, 0x11, 0x6c, 0x0f,
+	0x53, 0x52, 0x50, 0x7d, 0xa7, 0x7e, 0xc6, 0xf3, 0x7f, 0x3d, 0x43, 0xfb, 0x18, 0x25, 0xbe, 0x6d,
+	0x08, 0xba, 0xe0, 0x2e, 0x48, 0xed, 0x7d, 0x4a, 0x72, 0x3a, 0xf7, 0xd6, 0x18, 0xbd, 0x80, 0x46,
+	0x5c, 0x4a, 0xa2, 0x07, 0x78, 0x4a, 0xb8, 0xa8, 0x9e, 0x65, 0xe3, 0xbb, 0x64, 0xf0, 0x1a, 0x9e,
+	0x9e, 0x48, 0x4a, 0x7f, 0x51, 0x33, 0xa2, 0x59, 0xa1, 0x68, 0x8e, 0xe9, 0xf7, 0x92, 0x16, 0x0a,
+	0xed, 0xc1, 0xd6, 0x22, 0xee, 0x56, 0x3f, 0x0e, 0x5e, 0xc1, 0xe3, 0x51, 0x4a, 0x7e, 0xfc, 0x5f,
+	0x78, 0x04, 0x3b, 0x17, 0x83, 0x63, 0x51, 0x72, 0x85, 0x3c, 0xd8, 0xc1, 0x25, 0xe7, 0x8c, 0x4f,
+	0xcc, 0x79, 0x03, 0xcf, 0x4b, 0xd4, 0x84, 0xda, 0x67, 0x96, 0x33, 0x65, 0x62, 0x35, 0x70, 0x55,
+	0x04, 0x87, 0x00, 0x3d, 0xed, 0x39, 0x24, 0x9c, 0x25, 0x1b, 0x47, 0xd6, 0x84, 0xda, 0x48, 0x92,
+	0x84, 0x9a, 0x3e, 0x17, 0x57, 0x45, 0xf0, 0xc7, 0x02, 0x77, 0x28, 0x44, 0x76, 0x36, 0x25, 0x09,
+	0xd5, 0x7f, 0xa6, 0x2e, 0x56, 0x46, 0xb2, 0xa8, 0xd1, 0x4b, 0xd8, 0x3b, 0x2f, 0xe8, 0x58, 0xaf,
+	0x6a, 0x27, 0x13, 0xc9, 0x75, 0x35, 0x17, 0x07, 0xaf, 0xb1, 0x28, 0x84, 0xfb, 0x23, 0xa1, 0x48,
+	0xb6, 0x22, 0xb4, 0x8d, 0x70, 0x9d, 0x46, 0x11, 0x20, 0xdd, 0x3b, 0xa0, 0x8a, 0x8c, 0x97, 0x62,
+	0xc7, 0x88, 0x37, 0x9c, 0xa0, 0xb7, 0xf0, 0xc8, 0x58, 0xac, 0x35, 0xd4, 0x4c, 0xc3, 0xa6, 0x23,
+	0x74, 0x00, 0xee, 0x28, 0x95, 0xb4, 0x48, 0x45, 0x36, 0xf6, 0xb6, 0x7d, 0x2b, 0xb4, 0xf0, 0x92,
+	0xe8, 0x7c, 0xf8, 0xfa, 0x7e, 0xc2, 0x54, 0x5a, 0x5e, 0x46, 0x89, 0xc8, 0x5b, 0x2b, 0x0b, 0xf4,
+	0x26, 0x67, 0x89, 0x14, 0x37, 0x77, 0xb9, 0xe5, 0x52, 0xdd, 0x7e, 0xca, 0xdb, 0xe6, 0xe7, 0xdd,
+	0xdf, 0x01, 0x00, 0x7c, 0x82, 0xce, 0x1d, 0x0c, 0x04, 0x00, 0x00,
 }
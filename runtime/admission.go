@@ -0,0 +1,241 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sys/unix"
+
+	"github.com/firecracker-microvm/firecracker-containerd/proto"
+)
+
+const (
+	// Each running VM holds a lock on one of the slot files in this directory,
+	// locks are released by the kernel even if the runtime crashes
+	defaultVMSlotsDir = "/run/firecracker-containerd/vm-slots"
+
+	// Topic of the event published with number of running VMs when a VM is admitted or rejected
+	vmCountTopic = "/firecracker/vm/count"
+
+	// Lock file in VM slots directory serializing updates of vm_metrics_file
+	vmMetricsLockName = "metrics.lock"
+)
+
+// errTooManyVMs is returned when the host already runs max_vms VMs
+var errTooManyVMs = errors.Wrap(errdefs.ErrUnavailable, "maximum number of VMs reached")
+
+// vmSlotPath returns path of the slot file with the given index
+func vmSlotPath(dir string, index int) string {
+	return filepath.Join(dir, fmt.Sprintf("slot-%d", index))
+}
+
+// lockVMSlot tries to take the slot without waiting, returns nil file if the slot is taken by another VM.
+// Slots are open file description locks, so they can be checked with F_OFD_GETLK without taking them.
+func lockVMSlot(path string) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open VM slot %q", path)
+	}
+
+	lock := unix.Flock_t{Type: unix.F_WRLCK, Whence: io.SeekStart}
+	if err := unix.FcntlFlock(file.Fd(), unix.F_OFD_SETLK, &lock); err != nil {
+		file.Close()
+		if err == unix.EAGAIN || err == unix.EACCES {
+			return nil, nil
+		}
+
+		return nil, errors.Wrapf(err, "failed to lock VM slot %q", path)
+	}
+
+	return file, nil
+}
+
+// vmSlotTaken checks whether a VM holds the slot, the slot isn't locked meanwhile
+func vmSlotTaken(path string) (bool, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to open VM slot %q", path)
+	}
+
+	defer file.Close()
+
+	lock := unix.Flock_t{Type: unix.F_WRLCK, Whence: io.SeekStart}
+	if err := unix.FcntlFlock(file.Fd(), unix.F_OFD_GETLK, &lock); err != nil {
+		return false, errors.Wrapf(err, "failed to check lock of VM slot %q", path)
+	}
+
+	return lock.Type != unix.F_UNLCK, nil
+}
+
+// acquireVMSlot takes the first free of limit slots in the directory for the lifetime of the VM,
+// it's released by closing the returned file. Returns errTooManyVMs if all slots are taken.
+func acquireVMSlot(dir string, limit int) (*os.File, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrapf(err, "failed to create VM slots directory %q", dir)
+	}
+
+	for i := 0; i < limit; i++ {
+		file, err := lockVMSlot(vmSlotPath(dir, i))
+		if err != nil {
+			return nil, err
+		}
+
+		if file != nil {
+			return file, nil
+		}
+	}
+
+	return nil, errTooManyVMs
+}
+
+// countRunningVMs returns number of taken slots out of limit ones. Slots aren't locked while counting,
+// so concurrent acquireVMSlot of another runtime doesn't see them as taken.
+func countRunningVMs(dir string, limit int) (int, error) {
+	running := 0
+	for i := 0; i < limit; i++ {
+		taken, err := vmSlotTaken(vmSlotPath(dir, i))
+		if err != nil {
+			return 0, err
+		}
+
+		if taken {
+			running++
+		}
+	}
+
+	return running, nil
+}
+
+// writeVMMetrics counts running VMs and writes the count and limit to path in Prometheus text format, for instance
+// for node_exporter textfile collector. Runtimes of all VMs update the file, so updates are serialized with a lock
+// file in the slots directory, and the last one written has the current count.
+func writeVMMetrics(path, dir string, limit int) error {
+	lockPath := filepath.Join(dir, vmMetricsLockName)
+	lockFile, err := os.OpenFile(lockPath, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open %q", lockPath)
+	}
+
+	defer lockFile.Close()
+
+	if err := unix.Flock(int(lockFile.Fd()), unix.LOCK_EX); err != nil {
+		return errors.Wrapf(err, "failed to lock %q", lockPath)
+	}
+
+	running, err := countRunningVMs(dir, limit)
+	if err != nil {
+		return err
+	}
+
+	runningGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "firecracker_containerd",
+		Name:      "vms_running",
+		Help:      "Number of VMs running on the host",
+	})
+
+	limitGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "firecracker_containerd",
+		Name:      "vms_limit",
+		Help:      "Maximum number of VMs allowed on the host (max_vms)",
+	})
+
+	runningGauge.Set(float64(running))
+	limitGauge.Set(float64(limit))
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(runningGauge, limitGauge)
+
+	return prometheus.WriteToTextfile(path, registry)
+}
+
+// vmSlotsDir returns directory with VM slots, vm_slots_dir or the default one
+func (s *service) vmSlotsDir() string {
+	if s.config.VMSlotsDir != "" {
+		return s.config.VMSlotsDir
+	}
+
+	return defaultVMSlotsDir
+}
+
+// updateVMMetrics writes vm_metrics_file if it's configured, failure is only logged
+func (s *service) updateVMMetrics(ctx context.Context) {
+	if s.config.VMMetricsFile == "" {
+		return
+	}
+
+	if err := writeVMMetrics(s.config.VMMetricsFile, s.vmSlotsDir(), s.config.MaxVMs); err != nil {
+		log.G(ctx).WithError(err).Warn("failed to write VM metrics")
+	}
+}
+
+// admitVM takes a VM slot if number of VMs on the host is limited and publishes the current count
+// (as event and to vm_metrics_file). The slot is kept until the runtime exits.
+func (s *service) admitVM(ctx context.Context) error {
+	if s.config.MaxVMs <= 0 {
+		return nil
+	}
+
+	dir := s.vmSlotsDir()
+	slot, admitErr := acquireVMSlot(dir, s.config.MaxVMs)
+	if admitErr == nil {
+		s.vmSlot = slot
+	}
+
+	running, err := countRunningVMs(dir, s.config.MaxVMs)
+	if err != nil {
+		log.G(ctx).WithError(err).Warn("failed to count running VMs")
+	} else {
+		count := &proto.VMCount{Running: uint32(running), Limit: uint32(s.config.MaxVMs)}
+		log.G(ctx).Infof("%d of %d VMs running", count.Running, count.Limit)
+
+		if err := s.publish.Publish(ctx, vmCountTopic, count); err != nil {
+			log.G(ctx).WithError(err).Warn("failed to publish VM count")
+		}
+	}
+
+	s.updateVMMetrics(ctx)
+
+	if admitErr == errTooManyVMs {
+		return errdefs.ToGRPCf(errdefs.ErrUnavailable, "can't start VM: all %d VMs allowed on the host are running", s.config.MaxVMs)
+	}
+
+	return admitErr
+}
+
+// releaseVM frees the VM slot taken by admitVM
+func (s *service) releaseVM(ctx context.Context) {
+	if s.vmSlot == nil {
+		return
+	}
+
+	if err := s.vmSlot.Close(); err != nil {
+		log.G(ctx).WithError(err).Warn("failed to release VM slot")
+	}
+
+	s.vmSlot = nil
+	s.updateVMMetrics(ctx)
+}
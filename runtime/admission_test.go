@@ -0,0 +1,113 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVMSlots(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vm-slots-test-")
+	require.NoError(t, err)
+
+	defer os.RemoveAll(dir)
+
+	const limit = 2
+
+	first, err := acquireVMSlot(dir, limit)
+	require.NoError(t, err)
+
+	second, err := acquireVMSlot(dir, limit)
+	require.NoError(t, err)
+	defer second.Close()
+
+	running, err := countRunningVMs(dir, limit)
+	require.NoError(t, err)
+	assert.Equal(t, 2, running)
+
+	_, err = acquireVMSlot(dir, limit)
+	assert.Equal(t, errTooManyVMs, err)
+
+	// Stopped VM frees its slot for a new one
+	require.NoError(t, first.Close())
+
+	running, err = countRunningVMs(dir, limit)
+	require.NoError(t, err)
+	assert.Equal(t, 1, running)
+
+	third, err := acquireVMSlot(dir, limit)
+	require.NoError(t, err)
+	third.Close()
+}
+
+func TestCountRunningVMsDoesntTakeSlots(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vm-slots-test-")
+	require.NoError(t, err)
+
+	defer os.RemoveAll(dir)
+
+	const limit = 2
+
+	first, err := acquireVMSlot(dir, limit)
+	require.NoError(t, err)
+	defer first.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+
+			countRunningVMs(dir, limit)
+		}
+	}()
+
+	// Counting in another runtime never makes the free slot look taken
+	for i := 0; i < 1000; i++ {
+		slot, err := acquireVMSlot(dir, limit)
+		require.NoError(t, err)
+		require.NoError(t, slot.Close())
+	}
+}
+
+func TestWriteVMMetrics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vm-slots-test-")
+	require.NoError(t, err)
+
+	defer os.RemoveAll(dir)
+
+	slot, err := acquireVMSlot(dir, 3)
+	require.NoError(t, err)
+	defer slot.Close()
+
+	path := filepath.Join(dir, "vms.prom")
+	err = writeVMMetrics(path, dir, 3)
+	require.NoError(t, err)
+
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "firecracker_containerd_vms_running 1\n")
+	assert.Contains(t, string(data), "firecracker_containerd_vms_limit 3\n")
+}
@@ -0,0 +1,203 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	"github.com/firecracker-microvm/firecracker-go-sdk"
+	"github.com/pkg/errors"
+)
+
+const (
+	// Files created in runtime's working directory (the bundle) when failed VM artifacts are kept
+	consoleLogName   = "console.log"
+	vmConfigFileName = "vm-config.json"
+
+	defaultFailedVMRetention = 10
+
+	failedVMTimeFormat = "20060102T150405.000000000Z"
+)
+
+// vmArtifacts tracks files describing a VM, which are copied to debug directory if the VM fails
+type vmArtifacts struct {
+	dir        string
+	retention  int
+	console    *os.File
+	files      []string
+	rootfs     []string
+	keepRootfs bool
+}
+
+// vmConfigDump is saved as VM configuration artifact
+type vmConfigDump struct {
+	Runtime     *Config            `json:"runtime"`
+	Firecracker firecracker.Config `json:"firecracker"`
+}
+
+// newVMArtifacts starts collecting artifacts of the VM being created: saves its configuration and
+// opens a file to capture serial console to. Returns nil if failed VM artifacts aren't kept.
+func newVMArtifacts(vmConfig *Config, cfg firecracker.Config) (*vmArtifacts, error) {
+	if vmConfig.FailedVMDir == "" {
+		return nil, nil
+	}
+
+	data, err := json.MarshalIndent(vmConfigDump{Runtime: vmConfig, Firecracker: cfg}, "", "  ")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal VM configuration")
+	}
+
+	if err := ioutil.WriteFile(vmConfigFileName, data, 0600); err != nil {
+		return nil, errors.Wrap(err, "failed to save VM configuration")
+	}
+
+	console, err := os.OpenFile(consoleLogName, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create console log")
+	}
+
+	retention := vmConfig.FailedVMRetention
+	if retention == 0 {
+		retention = defaultFailedVMRetention
+	}
+
+	artifacts := &vmArtifacts{
+		dir:        vmConfig.FailedVMDir,
+		retention:  retention,
+		console:    console,
+		files:      []string{vmConfigFileName, consoleLogName, bootTimingFileName},
+		keepRootfs: vmConfig.KeepFailedVMRootfs,
+	}
+
+	// Logs might go to a pipe from configuration instead of a file of the VM
+	if cfg.FifoLogWriter != nil {
+		artifacts.files = append(artifacts.files, vmConfig.LogPath)
+	}
+
+	return artifacts, nil
+}
+
+// keep copies artifacts of the failed VM to a new directory named after failure time and VM ID,
+// and removes the oldest directories beyond retention limit. Returns the directory created.
+func (a *vmArtifacts) keep(vmID string, reason error) (string, error) {
+	if err := os.MkdirAll(a.dir, 0700); err != nil {
+		return "", errors.Wrapf(err, "failed to create directory %q", a.dir)
+	}
+
+	dir := filepath.Join(a.dir, time.Now().UTC().Format(failedVMTimeFormat)+"-"+vmID)
+	if err := os.Mkdir(dir, 0700); err != nil {
+		return "", errors.Wrapf(err, "failed to create directory %q", dir)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "failure.txt"), []byte(reason.Error()+"\n"), 0600); err != nil {
+		return "", errors.Wrap(err, "failed to save failure reason")
+	}
+
+	for _, path := range a.files {
+		if err := copyFile(path, filepath.Join(dir, filepath.Base(path))); err != nil && !os.IsNotExist(errors.Cause(err)) {
+			return "", err
+		}
+	}
+
+	if a.keepRootfs {
+		for i, path := range a.rootfs {
+			if err := copyFile(path, filepath.Join(dir, fmt.Sprintf("rootfs-%d.img", i))); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	return dir, pruneFailedVMs(a.dir, a.retention)
+}
+
+// close closes console log, it's kept in the bundle until containerd removes it
+func (a *vmArtifacts) close() error {
+	return a.console.Close()
+}
+
+// pruneFailedVMs keeps the given number of the most recent failed VM directories.
+// Directory names start with failure time, so the oldest ones go first when sorted.
+func pruneFailedVMs(dir string, retention int) error {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return errors.Wrapf(err, "failed to list %q", dir)
+	}
+
+	var names []string
+	for _, info := range infos {
+		if info.IsDir() {
+			names = append(names, info.Name())
+		}
+	}
+
+	sort.Strings(names)
+
+	for len(names) > retention {
+		if err := os.RemoveAll(filepath.Join(dir, names[0])); err != nil {
+			return errors.Wrapf(err, "failed to remove %q", names[0])
+		}
+
+		names = names[1:]
+	}
+
+	return nil
+}
+
+// copyFile copies contents of a file or block device to a new file
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open %q", src)
+	}
+
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create %q", dst)
+	}
+
+	defer out.Close()
+
+	if _, err := io.Copy(out, in); err != nil {
+		return errors.Wrapf(err, "failed to copy %q to %q", src, dst)
+	}
+
+	return nil
+}
+
+// keepFailedVMArtifacts saves artifacts of the VM for post-mortem if configured to
+func (s *service) keepFailedVMArtifacts(ctx context.Context, reason error) {
+	if s.artifacts == nil {
+		return
+	}
+
+	dir, err := s.artifacts.keep(s.id, reason)
+	if err != nil {
+		log.G(ctx).WithError(err).Error("failed to keep failed VM artifacts")
+	}
+
+	if dir != "" {
+		log.G(ctx).Infof("failed VM artifacts kept at %q", dir)
+	}
+}
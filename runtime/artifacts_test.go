@@ -0,0 +1,81 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/firecracker-microvm/firecracker-go-sdk"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVMArtifacts(t *testing.T) {
+	bundle, err := ioutil.TempDir("", "vm-artifacts-test-")
+	require.NoError(t, err)
+
+	defer os.RemoveAll(bundle)
+
+	cwd, err := os.Getwd()
+	require.NoError(t, err)
+
+	require.NoError(t, os.Chdir(bundle))
+	defer os.Chdir(cwd)
+
+	artifacts, err := newVMArtifacts(&Config{}, firecracker.Config{})
+	require.NoError(t, err)
+	assert.Nil(t, artifacts, "artifacts shouldn't be collected unless configured")
+
+	failedDir := filepath.Join(bundle, "failed")
+	vmConfig := &Config{FailedVMDir: failedDir, FailedVMRetention: 2, KernelImagePath: "vmlinux"}
+
+	artifacts, err = newVMArtifacts(vmConfig, firecracker.Config{KernelImagePath: "vmlinux"})
+	require.NoError(t, err)
+	require.NotNil(t, artifacts)
+
+	defer artifacts.close()
+
+	_, err = artifacts.console.WriteString("Kernel panic\n")
+	require.NoError(t, err)
+
+	var dirs []string
+	for i := 0; i < 3; i++ {
+		dir, err := artifacts.keep("vm-1", errors.New("VM crashed"))
+		require.NoError(t, err)
+
+		dirs = append(dirs, dir)
+	}
+
+	// Boot timing is missing as VM didn't boot, that's fine
+	console, err := ioutil.ReadFile(filepath.Join(dirs[2], consoleLogName))
+	require.NoError(t, err)
+	assert.Equal(t, "Kernel panic\n", string(console))
+
+	reason, err := ioutil.ReadFile(filepath.Join(dirs[2], "failure.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "VM crashed\n", string(reason))
+
+	_, err = os.Stat(filepath.Join(dirs[2], vmConfigFileName))
+	assert.NoError(t, err)
+
+	infos, err := ioutil.ReadDir(failedDir)
+	require.NoError(t, err)
+	require.Len(t, infos, 2, "only the most recent directories should be kept")
+	assert.Equal(t, filepath.Base(dirs[1]), infos[0].Name())
+	assert.Equal(t, filepath.Base(dirs[2]), infos[1].Name())
+}
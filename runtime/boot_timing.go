@@ -0,0 +1,134 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	"github.com/firecracker-microvm/firecracker-go-sdk"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/firecracker-microvm/firecracker-containerd/proto"
+)
+
+const (
+	// Topic of the event published with boot timing once VM is ready
+	bootTimingTopic = "/firecracker/vm/boot"
+	// File in bundle directory with boot timing of the VM
+	bootTimingFileName = "boot-timing.json"
+)
+
+// Boot phases, in order
+const (
+	// Preparing configuration and drives of the VM
+	bootPhasePrepare = "prepare"
+	// Spawning firecracker process until its API socket is available
+	bootPhaseVMMSpawn = "vmm_spawn"
+	// Configuring VM via firecracker API
+	bootPhaseVMMConfig = "vmm_config"
+	// InstanceStart API call
+	bootPhaseInstanceStart = "instance_start"
+	// Binding firecracker threads to CPUs, only if cpu_affinity is set
+	bootPhaseCPUPinning = "cpu_pinning"
+	// Guest kernel boot and agent init until the agent accepts connections
+	bootPhaseGuestBoot = "guest_boot"
+)
+
+// bootTimer records durations of consecutive boot phases
+type bootTimer struct {
+	last   time.Time
+	phases []*proto.BootPhase
+}
+
+func newBootTimer() *bootTimer {
+	return &bootTimer{last: time.Now()}
+}
+
+// mark ends the current phase with the given name and starts the next one
+func (t *bootTimer) mark(name string) {
+	now := time.Now()
+	t.phases = append(t.phases, &proto.BootPhase{Name: name, DurationNanos: int64(now.Sub(t.last))})
+	t.last = now
+}
+
+// total returns the time spent in all phases
+func (t *bootTimer) total() time.Duration {
+	var total time.Duration
+	for _, phase := range t.phases {
+		total += time.Duration(phase.DurationNanos)
+	}
+
+	return total
+}
+
+func (t *bootTimer) timing(vmID string) *proto.BootTiming {
+	return &proto.BootTiming{VMID: vmID, Phases: t.phases}
+}
+
+// instrumentHandlers marks the end of firecracker process spawn and its configuration
+func (t *bootTimer) instrumentHandlers(handlers *firecracker.Handlers) {
+	handlers.FcInit = handlers.FcInit.Swap(firecracker.Handler{
+		Name: firecracker.StartVMMHandlerName,
+		Fn: func(ctx context.Context, m *firecracker.Machine) error {
+			err := firecracker.StartVMMHandler.Fn(ctx, m)
+			t.mark(bootPhaseVMMSpawn)
+			return err
+		},
+	})
+
+	handlers.FcInit = handlers.FcInit.Append(firecracker.Handler{
+		Name: "fccontainerd.BootTiming",
+		Fn: func(ctx context.Context, m *firecracker.Machine) error {
+			t.mark(bootPhaseVMMConfig)
+			return nil
+		},
+	})
+}
+
+// reportBootTiming logs, saves and publishes boot timing of the VM
+func (s *service) reportBootTiming(ctx context.Context, timing *proto.BootTiming) {
+	fields := logrus.Fields{}
+	for _, phase := range timing.Phases {
+		fields[phase.Name] = time.Duration(phase.DurationNanos).String()
+	}
+
+	log.G(ctx).WithFields(fields).Info("VM boot timing")
+
+	if err := writeBootTiming(bootTimingFileName, timing); err != nil {
+		log.G(ctx).WithError(err).Warn("failed to save boot timing")
+	}
+
+	if err := s.publish.Publish(ctx, bootTimingTopic, timing); err != nil {
+		log.G(ctx).WithError(err).Warn("failed to publish boot timing")
+	}
+}
+
+// writeBootTiming saves boot timing to a file, so it can be queried after VM started
+func writeBootTiming(path string, timing *proto.BootTiming) error {
+	data, err := json.MarshalIndent(timing, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		return errors.Wrap(err, "failed to write boot timing")
+	}
+
+	return nil
+}
@@ -0,0 +1,88 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/firecracker-microvm/firecracker-go-sdk"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/firecracker-microvm/firecracker-containerd/proto"
+)
+
+func TestBootTimer(t *testing.T) {
+	timer := newBootTimer()
+
+	time.Sleep(time.Millisecond)
+	timer.mark(bootPhasePrepare)
+	timer.mark(bootPhaseGuestBoot)
+
+	timing := timer.timing("vm-1")
+	assert.Equal(t, "vm-1", timing.VMID)
+	require.Len(t, timing.Phases, 2)
+	assert.Equal(t, bootPhasePrepare, timing.Phases[0].Name)
+	assert.True(t, time.Duration(timing.Phases[0].DurationNanos) >= time.Millisecond)
+	assert.Equal(t, bootPhaseGuestBoot, timing.Phases[1].Name)
+	assert.True(t, timer.total() >= time.Millisecond)
+}
+
+func TestBootTimerHandlers(t *testing.T) {
+	timer := newBootTimer()
+
+	handlers := firecracker.Handlers{
+		FcInit: firecracker.HandlerList{}.Append(firecracker.Handler{
+			Name: firecracker.StartVMMHandlerName,
+			Fn: func(context.Context, *firecracker.Machine) error {
+				return nil
+			},
+		}),
+	}
+
+	timer.instrumentHandlers(&handlers)
+	assert.Equal(t, 2, handlers.FcInit.Len())
+	assert.True(t, handlers.FcInit.Has(firecracker.StartVMMHandlerName))
+}
+
+func TestWriteBootTiming(t *testing.T) {
+	dir, err := ioutil.TempDir("", "boot-timing-test-")
+	require.NoError(t, err)
+
+	defer os.RemoveAll(dir)
+
+	expected := &proto.BootTiming{
+		VMID:   "vm-1",
+		Phases: []*proto.BootPhase{{Name: bootPhaseVMMSpawn, DurationNanos: 1000}},
+	}
+
+	path := filepath.Join(dir, bootTimingFileName)
+	err = writeBootTiming(path, expected)
+	require.NoError(t, err)
+
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+
+	var actual proto.BootTiming
+	err = json.Unmarshal(data, &actual)
+	require.NoError(t, err)
+	assert.Equal(t, expected.VMID, actual.VMID)
+	assert.Equal(t, expected.Phases[0].DurationNanos, actual.Phases[0].DurationNanos)
+}
@@ -17,16 +17,44 @@ import (
 	"encoding/json"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
 )
 
 const (
 	configPathEnvName = "FIRECRACKER_CONTAINERD_RUNTIME_CONFIG_PATH"
 	defaultConfigPath = "/etc/containerd/firecracker-runtime.json"
+
+	defaultFirecrackerBinaryPath = "./firecracker"
+)
+
+// Container spec annotations which override runtime configuration for a particular VM
+const (
+	vmAnnotationPrefix = "aws.firecracker.vm."
+
+	firecrackerBinaryPathAnnotation = vmAnnotationPrefix + "firecracker_binary_path"
+	firecrackerVersionAnnotation    = vmAnnotationPrefix + "firecracker_version"
+	portForwardsAnnotation          = vmAnnotationPrefix + "port_forwards"
+	cpuAffinityAnnotation           = vmAnnotationPrefix + "cpu_affinity"
+	stopOnOOMAnnotation             = vmAnnotationPrefix + "stop_on_oom"
+	maxContainersAnnotation         = vmAnnotationPrefix + "max_containers"
+	scratchSizeAnnotation           = vmAnnotationPrefix + "scratch_size"
+	scratchPathAnnotation           = vmAnnotationPrefix + "scratch_path"
+	dataImagesAnnotation            = vmAnnotationPrefix + "data_images"
+	logPathAnnotation               = vmAnnotationPrefix + "log_path"
+	logLevelAnnotation              = vmAnnotationPrefix + "log_level"
+	driveQueueSizeAnnotation        = vmAnnotationPrefix + "drive_queue_size"
+	qosClassAnnotation              = vmAnnotationPrefix + "qos_class"
 )
 
 type Config struct {
 	FirecrackerBinaryPath string            `json:"firecracker_binary_path"`
+	FirecrackerVersion    string            `json:"firecracker_version"`
 	SocketPath            string            `json:"socket_path"`
+	SocketDir             string            `json:"socket_dir"`
 	KernelImagePath       string            `json:"kernel_image_path"`
 	KernelArgs            string            `json:"kernel_args"`
 	RootDrive             string            `json:"root_drive"`
@@ -35,9 +63,28 @@ type Config struct {
 	AdditionalDrives      map[string]string `json:"additional_drives"`
 	LogFifo               string            `json:"log_fifo"`
 	LogLevel              string            `json:"log_level"`
+	LogPath               string            `json:"log_path"`
 	MetricsFifo           string            `json:"metrics_fifo"`
 	HtEnabled             bool              `json:"ht_enabled"`
 	Debug                 bool              `json:"debug"`
+	PortForwards          []string          `json:"port_forwards"`
+	CPUAffinity           string            `json:"cpu_affinity"`
+	StopOnOOM             bool              `json:"stop_on_oom"`
+	MaxContainers         int               `json:"max_containers"`
+	ScratchSize           string            `json:"scratch_size"`
+	ScratchPath           string            `json:"scratch_path"`
+	DataImages            []string          `json:"data_images"`
+	FailedVMDir           string            `json:"failed_vm_dir"`
+	FailedVMRetention     int               `json:"failed_vm_retention"`
+	KeepFailedVMRootfs    bool              `json:"keep_failed_vm_rootfs"`
+	MaxVMs                int               `json:"max_vms"`
+	VMSlotsDir            string            `json:"vm_slots_dir"`
+	VMMetricsFile         string            `json:"vm_metrics_file"`
+	DriveQueueSize        int               `json:"drive_queue_size"`
+	QoSClass              string            `json:"qos_class"`
+	InjectSourceDir       string            `json:"inject_source_dir"`
+
+	RateLimitPresets map[string]RateLimitPreset `json:"rate_limit_presets"`
 }
 
 func LoadConfig(path string) (*Config, error) {
@@ -61,3 +108,86 @@ func LoadConfig(path string) (*Config, error) {
 
 	return &cfg, nil
 }
+
+// vmConfig returns a copy of runtime configuration with per-VM overrides applied from the given bundle spec annotations
+func (c *Config) vmConfig(bundle string) (*Config, error) {
+	annotations, err := loadSpecAnnotations(filepath.Join(bundle, "config.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := *c
+
+	for key, value := range annotations {
+		if !strings.HasPrefix(key, vmAnnotationPrefix) {
+			continue
+		}
+
+		switch key {
+		case firecrackerBinaryPathAnnotation:
+			cfg.FirecrackerBinaryPath = value
+		case firecrackerVersionAnnotation:
+			cfg.FirecrackerVersion = value
+		case portForwardsAnnotation:
+			cfg.PortForwards = strings.Split(value, ",")
+		case cpuAffinityAnnotation:
+			cfg.CPUAffinity = value
+		case stopOnOOMAnnotation:
+			if cfg.StopOnOOM, err = strconv.ParseBool(value); err != nil {
+				return nil, errors.Wrapf(err, "invalid value of %q annotation", key)
+			}
+		case maxContainersAnnotation:
+			if cfg.MaxContainers, err = strconv.Atoi(value); err != nil {
+				return nil, errors.Wrapf(err, "invalid value of %q annotation", key)
+			}
+		case scratchSizeAnnotation:
+			cfg.ScratchSize = value
+		case scratchPathAnnotation:
+			cfg.ScratchPath = value
+		case dataImagesAnnotation:
+			cfg.DataImages = strings.Split(value, ",")
+		case logPathAnnotation:
+			cfg.LogPath = value
+		case logLevelAnnotation:
+			cfg.LogLevel = value
+		case driveQueueSizeAnnotation:
+			if cfg.DriveQueueSize, err = strconv.Atoi(value); err != nil {
+				return nil, errors.Wrapf(err, "invalid value of %q annotation", key)
+			}
+		case qosClassAnnotation:
+			cfg.QoSClass = value
+		}
+	}
+
+	if cfg.FirecrackerBinaryPath == "" {
+		cfg.FirecrackerBinaryPath = defaultFirecrackerBinaryPath
+	}
+
+	if cfg.ScratchPath == "" {
+		cfg.ScratchPath = defaultScratchPath
+	}
+
+	if cfg.LogPath == "" {
+		cfg.LogPath = defaultLogPath
+	}
+
+	return &cfg, nil
+}
+
+// loadSpecAnnotations reads annotations from bundle/config.json
+func loadSpecAnnotations(path string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var spec struct {
+		Annotations map[string]string `json:"annotations"`
+	}
+
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return nil, err
+	}
+
+	return spec.Annotations, nil
+}
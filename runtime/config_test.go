@@ -0,0 +1,87 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVMConfig(t *testing.T) {
+	bundle, err := ioutil.TempDir("", "runtime-config-test-")
+	require.NoError(t, err)
+
+	defer os.RemoveAll(bundle)
+
+	spec := `{
+		"annotations": {
+			"aws.firecracker.vm.firecracker_binary_path": "/opt/firecracker-v0.12",
+			"aws.firecracker.vm.firecracker_version": "0.12",
+			"aws.firecracker.vm.stop_on_oom": "true",
+			"aws.firecracker.vm.scratch_size": "1GB",
+			"aws.firecracker.vm.log_level": "Debug",
+			"aws.firecracker.vm.drive_queue_size": "512",
+			"aws.firecracker.vm.qos_class": "burstable",
+			"unrelated": "value"
+		}
+	}`
+
+	err = ioutil.WriteFile(filepath.Join(bundle, "config.json"), []byte(spec), 0644)
+	require.NoError(t, err)
+
+	config := &Config{
+		FirecrackerBinaryPath: "/usr/bin/firecracker",
+		KernelImagePath:       "vmlinux",
+	}
+
+	vmConfig, err := config.vmConfig(bundle)
+	require.NoError(t, err)
+
+	assert.Equal(t, "/opt/firecracker-v0.12", vmConfig.FirecrackerBinaryPath)
+	assert.Equal(t, "0.12", vmConfig.FirecrackerVersion)
+	assert.Equal(t, "vmlinux", vmConfig.KernelImagePath)
+	assert.True(t, vmConfig.StopOnOOM)
+	assert.Equal(t, "1GB", vmConfig.ScratchSize)
+	assert.Equal(t, defaultScratchPath, vmConfig.ScratchPath)
+	assert.Equal(t, "Debug", vmConfig.LogLevel)
+	assert.Equal(t, defaultLogPath, vmConfig.LogPath)
+	assert.Equal(t, 512, vmConfig.DriveQueueSize)
+	assert.Equal(t, "burstable", vmConfig.QoSClass)
+
+	// Runtime config should stay intact
+	assert.Equal(t, "/usr/bin/firecracker", config.FirecrackerBinaryPath)
+	assert.Empty(t, config.FirecrackerVersion)
+}
+
+func TestVMConfigDefaults(t *testing.T) {
+	bundle, err := ioutil.TempDir("", "runtime-config-test-")
+	require.NoError(t, err)
+
+	defer os.RemoveAll(bundle)
+
+	err = ioutil.WriteFile(filepath.Join(bundle, "config.json"), []byte("{}"), 0644)
+	require.NoError(t, err)
+
+	vmConfig, err := (&Config{}).vmConfig(bundle)
+	require.NoError(t, err)
+	assert.Equal(t, defaultFirecrackerBinaryPath, vmConfig.FirecrackerBinaryPath)
+
+	_, err = (&Config{}).vmConfig(filepath.Join(bundle, "missing"))
+	assert.Error(t, err)
+}
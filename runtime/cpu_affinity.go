@@ -0,0 +1,135 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/containerd/log"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const procPath = "/proc"
+
+// Firecracker names vCPU threads like "fc_vcpu 0"
+var vcpuThreadNameRegexp = regexp.MustCompile(`^fc_vcpu ?(\d+)$`)
+
+// checkCPUsAvailable makes sure the runtime itself is allowed to run on requested CPUs,
+// otherwise pinning of child processes to them will fail
+func checkCPUsAvailable(cpus []int) error {
+	var allowed unix.CPUSet
+	if err := unix.SchedGetaffinity(0, &allowed); err != nil {
+		return errors.Wrap(err, "failed to query CPU affinity of runtime")
+	}
+
+	for _, cpu := range cpus {
+		if !allowed.IsSet(cpu) {
+			return errors.Errorf("CPU %d is not available", cpu)
+		}
+	}
+
+	return nil
+}
+
+// vcpuThreadIDs returns thread IDs of firecracker process vCPUs indexed by vCPU number
+func vcpuThreadIDs(procDir string, pid int) (map[int]int, error) {
+	taskDir := filepath.Join(procDir, strconv.Itoa(pid), "task")
+	tasks, err := ioutil.ReadDir(taskDir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list threads of process %d", pid)
+	}
+
+	threads := make(map[int]int)
+	for _, task := range tasks {
+		tid, err := strconv.Atoi(task.Name())
+		if err != nil {
+			continue
+		}
+
+		comm, err := ioutil.ReadFile(filepath.Join(taskDir, task.Name(), "comm"))
+		if err != nil {
+			// Thread may exit in the meantime
+			continue
+		}
+
+		match := vcpuThreadNameRegexp.FindStringSubmatch(strings.TrimSpace(string(comm)))
+		if match == nil {
+			continue
+		}
+
+		vcpu, _ := strconv.Atoi(match[1])
+		threads[vcpu] = tid
+	}
+
+	return threads, nil
+}
+
+// pinFirecracker binds all threads of firecracker process to the given CPUs.
+// If there are enough CPUs, each vCPU thread gets dedicated CPU in order, so vCPUs don't contend with each other.
+func pinFirecracker(ctx context.Context, pid int, cpus []int, vcpuCount int) error {
+	var all unix.CPUSet
+	for _, cpu := range cpus {
+		all.Set(cpu)
+	}
+
+	tasks, err := ioutil.ReadDir(filepath.Join(procPath, strconv.Itoa(pid), "task"))
+	if err != nil {
+		return errors.Wrapf(err, "failed to list threads of process %d", pid)
+	}
+
+	for _, task := range tasks {
+		tid, err := strconv.Atoi(task.Name())
+		if err != nil {
+			continue
+		}
+
+		if err := unix.SchedSetaffinity(tid, &all); err != nil {
+			return errors.Wrapf(err, "failed to set CPU affinity of thread %d", tid)
+		}
+	}
+
+	if len(cpus) < vcpuCount {
+		log.G(ctx).Warnf("not enough CPUs to dedicate one per vCPU (%d < %d), sharing", len(cpus), vcpuCount)
+		return nil
+	}
+
+	threads, err := vcpuThreadIDs(procPath, pid)
+	if err != nil {
+		return err
+	}
+
+	if len(threads) != vcpuCount {
+		return errors.Errorf("found %d vCPU threads, expected %d", len(threads), vcpuCount)
+	}
+
+	for vcpu, tid := range threads {
+		var set unix.CPUSet
+		set.Set(cpus[vcpu])
+
+		if err := unix.SchedSetaffinity(tid, &set); err != nil {
+			return errors.Wrapf(err, "failed to pin vCPU %d (thread %d)", vcpu, tid)
+		}
+
+		log.G(ctx).WithFields(logrus.Fields{"vcpu": vcpu, "tid": tid, "cpu": cpus[vcpu]}).Debug("pinned vCPU")
+	}
+
+	return nil
+}
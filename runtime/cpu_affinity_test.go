@@ -0,0 +1,51 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckCPUsAvailable(t *testing.T) {
+	assert.NoError(t, checkCPUsAvailable(nil))
+	assert.Error(t, checkCPUsAvailable([]int{1023}))
+}
+
+func TestVCPUThreadIDs(t *testing.T) {
+	procDir, err := ioutil.TempDir("", "runtime-proc-test-")
+	require.NoError(t, err)
+
+	defer os.RemoveAll(procDir)
+
+	for tid, comm := range map[string]string{
+		"100": "firecracker\n",
+		"101": "fc_api\n",
+		"102": "fc_vcpu 0\n",
+		"103": "fc_vcpu 1\n",
+	} {
+		dir := filepath.Join(procDir, "100", "task", tid)
+		require.NoError(t, os.MkdirAll(dir, 0755))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "comm"), []byte(comm), 0644))
+	}
+
+	threads, err := vcpuThreadIDs(procDir, 100)
+	require.NoError(t, err)
+	assert.Equal(t, map[int]int{0: 102, 1: 103}, threads)
+}
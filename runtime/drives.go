@@ -0,0 +1,168 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/containerd/containerd/log"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+)
+
+const (
+	// Image backing scratch drive, created in runtime's working directory (the bundle)
+	scratchDriveName = "scratch.img"
+	// Default path of scratch space in container
+	defaultScratchPath = "/scratch"
+
+	// ext4 superblock starts at 1024 bytes, magic number is at offset 0x38 in it
+	ext4MagicOffset = 1024 + 0x38
+	ext4Magic       = 0xEF53
+
+	// Virtio requires queue size to be a power of two not exceeding 32768
+	maxDriveQueueSize = 32768
+)
+
+// dataImage represents prebuilt file system image attached to VM as read-only drive
+type dataImage struct {
+	HostPath      string
+	ContainerPath string
+}
+
+// parseDataImage parses data image mapping in "host_path:container_path" format
+func parseDataImage(value string) (dataImage, error) {
+	parts := strings.Split(value, ":")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return dataImage{}, errors.Errorf("invalid data image %q, expected host_path:container_path", value)
+	}
+
+	image := dataImage{HostPath: parts[0], ContainerPath: parts[1]}
+
+	if !filepath.IsAbs(image.HostPath) || !filepath.IsAbs(image.ContainerPath) {
+		return dataImage{}, errors.Errorf("invalid data image %q, paths must be absolute", value)
+	}
+
+	return image, nil
+}
+
+// checkDataImage makes sure the image (a file or a block device) can be read and has ext4 file system,
+// so it can be mounted without writing to it
+func checkDataImage(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open data image %q", path)
+	}
+
+	defer file.Close()
+
+	magic := make([]byte, 2)
+	if _, err := file.ReadAt(magic, ext4MagicOffset); err != nil {
+		if err == io.EOF {
+			return errors.Errorf("data image %q is too small to have a file system", path)
+		}
+
+		return errors.Wrapf(err, "failed to read data image %q", path)
+	}
+
+	if binary.LittleEndian.Uint16(magic) != ext4Magic {
+		return errors.Errorf("data image %q doesn't have %s file system", path, supportedMountFSType)
+	}
+
+	return nil
+}
+
+// checkDriveQueueSize makes sure virtio-blk queue size is valid, zero means VMM's default
+func checkDriveQueueSize(size int) error {
+	if size == 0 {
+		return nil
+	}
+
+	if size < 0 || size > maxDriveQueueSize || size&(size-1) != 0 {
+		return errors.Errorf("invalid drive queue size %d, expected a power of two up to %d", size, maxDriveQueueSize)
+	}
+
+	return nil
+}
+
+// driveQueueSizeSupported tells whether the given firecracker version accepts queue size in drive configuration.
+// None of the versions the runtime works with do (and SDK's models.Drive has no field for it yet),
+// so configured queue size is validated, but drives are attached with the default one.
+func driveQueueSizeSupported(version string) bool {
+	return false
+}
+
+// createScratchDrive creates a sparse file of the given size with ext4 file system on it.
+// Blocks are allocated on host only when the guest writes to them.
+func createScratchDrive(ctx context.Context, path string, sizeBytes int64) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0600)
+	if err != nil {
+		return errors.Wrap(err, "failed to create scratch drive")
+	}
+
+	if err := file.Truncate(sizeBytes); err != nil {
+		file.Close()
+		return errors.Wrap(err, "failed to resize scratch drive")
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	// Don't discard or initialize inode tables in advance, it would allocate the whole file
+	output, err := exec.CommandContext(ctx, "mkfs.ext4", "-F", "-q", "-E", "nodiscard,lazy_itable_init=1", path).CombinedOutput()
+	if err != nil {
+		return errors.Wrapf(err, "failed to make file system on scratch drive: %s", string(output))
+	}
+
+	log.G(ctx).WithField("path", path).Debugf("created %d bytes scratch drive", sizeBytes)
+	return nil
+}
+
+// removeScratchDrive removes scratch drive image, it's not an error if it doesn't exist
+func removeScratchDrive(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "failed to remove scratch drive")
+	}
+
+	return nil
+}
+
+// addSpecMounts appends mounts to container spec, other fields of the spec are kept as is.
+// runc mounts block devices listed in spec itself, so drives just need to be known in the guest.
+func addSpecMounts(jsonSpec []byte, mounts []specs.Mount) ([]byte, error) {
+	if len(mounts) == 0 {
+		return jsonSpec, nil
+	}
+
+	var spec map[string]interface{}
+	if err := json.Unmarshal(jsonSpec, &spec); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal spec")
+	}
+
+	existing, _ := spec["mounts"].([]interface{})
+	for _, mount := range mounts {
+		existing = append(existing, mount)
+	}
+
+	spec["mounts"] = existing
+	return json.Marshal(spec)
+}
@@ -0,0 +1,117 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAddSpecMounts(t *testing.T) {
+	spec := []byte(`{"ociVersion": "1.0.1", "mounts": [{"destination": "/proc", "type": "proc", "source": "proc"}]}`)
+
+	result, err := addSpecMounts(spec, nil)
+	require.NoError(t, err)
+	assert.Equal(t, spec, result)
+
+	result, err = addSpecMounts(spec, []specs.Mount{
+		{Destination: "/scratch", Type: "ext4", Source: "/dev/vdc", Options: []string{"rw"}},
+	})
+	require.NoError(t, err)
+
+	var parsed specs.Spec
+	err = json.Unmarshal(result, &parsed)
+	require.NoError(t, err)
+
+	assert.Equal(t, "1.0.1", parsed.Version)
+	require.Len(t, parsed.Mounts, 2)
+	assert.Equal(t, "/proc", parsed.Mounts[0].Destination)
+	assert.Equal(t, specs.Mount{Destination: "/scratch", Type: "ext4", Source: "/dev/vdc", Options: []string{"rw"}}, parsed.Mounts[1])
+}
+
+func TestCreateScratchDrive(t *testing.T) {
+	if _, err := exec.LookPath("mkfs.ext4"); err != nil {
+		t.Skip("mkfs.ext4 is not available")
+	}
+
+	dir, err := ioutil.TempDir("", "scratch-drive-test-")
+	require.NoError(t, err)
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, scratchDriveName)
+	err = createScratchDrive(context.Background(), path, 16*1024*1024)
+	require.NoError(t, err)
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.EqualValues(t, 16*1024*1024, info.Size())
+
+	require.NoError(t, removeScratchDrive(path))
+	assert.NoError(t, removeScratchDrive(path), "removing missing drive should succeed")
+}
+
+func TestParseDataImage(t *testing.T) {
+	image, err := parseDataImage("/var/lib/images/models.ext4:/models")
+	require.NoError(t, err)
+	assert.Equal(t, dataImage{HostPath: "/var/lib/images/models.ext4", ContainerPath: "/models"}, image)
+
+	for _, value := range []string{"", "/models.ext4", "models.ext4:/models", "/models.ext4:models", "/a:/b:/c"} {
+		_, err := parseDataImage(value)
+		assert.Error(t, err, value)
+	}
+}
+
+func TestCheckDataImage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "data-image-test-")
+	require.NoError(t, err)
+
+	defer os.RemoveAll(dir)
+
+	empty := filepath.Join(dir, "empty.img")
+	err = ioutil.WriteFile(empty, make([]byte, 4096), 0600)
+	require.NoError(t, err)
+
+	assert.Error(t, checkDataImage(empty), "image without file system")
+	assert.Error(t, checkDataImage(filepath.Join(dir, "missing.img")))
+
+	if _, err := exec.LookPath("mkfs.ext4"); err != nil {
+		t.Skip("mkfs.ext4 is not available")
+	}
+
+	image := filepath.Join(dir, "data.img")
+	err = createScratchDrive(context.Background(), image, 16*1024*1024)
+	require.NoError(t, err)
+
+	assert.NoError(t, checkDataImage(image))
+}
+
+func TestCheckDriveQueueSize(t *testing.T) {
+	for _, size := range []int{0, 1, 256, 1024, maxDriveQueueSize} {
+		assert.NoError(t, checkDriveQueueSize(size), "size %d", size)
+	}
+
+	for _, size := range []int{-256, 3, 100, 1000, maxDriveQueueSize * 2} {
+		assert.Error(t, checkDriveQueueSize(size), "size %d", size)
+	}
+}
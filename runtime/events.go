@@ -0,0 +1,79 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"syscall"
+
+	eventstypes "github.com/containerd/containerd/api/events"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/runtime"
+	taskAPI "github.com/containerd/containerd/runtime/v2/task"
+	"github.com/containerd/typeurl"
+
+	"github.com/firecracker-microvm/firecracker-containerd/internal"
+)
+
+// forwardGuestEvents reads events published by the agent and republishes the ones containerd can't otherwise
+// observe from the host (like OOM kills inside the VM). If stopOnOOM is set, the container is killed on OOM,
+// so its exit is reported and restart policy can handle it.
+func (s *service) forwardGuestEvents(ctx context.Context, conn net.Conn, client taskAPI.TaskService, stopOnOOM bool) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	for {
+		envelope, err := internal.ReadEnvelope(reader)
+		if err != nil {
+			if err != io.EOF && ctx.Err() == nil {
+				log.G(ctx).WithError(err).Error("failed to read guest event")
+			}
+
+			return
+		}
+
+		if envelope.Topic != runtime.TaskOOMEventTopic {
+			continue
+		}
+
+		event, err := typeurl.UnmarshalAny(envelope.Event)
+		if err != nil {
+			log.G(ctx).WithError(err).Error("failed to unmarshal guest OOM event")
+			continue
+		}
+
+		oom, ok := event.(*eventstypes.TaskOOM)
+		if !ok {
+			continue
+		}
+
+		log.G(ctx).WithField("id", oom.ContainerID).Warn("guest OOM killer was triggered for container")
+
+		if err := s.publish.Publish(ctx, runtime.TaskOOMEventTopic, oom); err != nil {
+			log.G(ctx).WithError(err).Error("failed to publish OOM event")
+		}
+
+		if !stopOnOOM {
+			continue
+		}
+
+		log.G(ctx).WithField("id", oom.ContainerID).Info("stopping container after OOM")
+		if _, err := client.Kill(ctx, &taskAPI.KillRequest{ID: oom.ContainerID, Signal: uint32(syscall.SIGKILL), All: true}); err != nil {
+			log.G(ctx).WithError(err).Error("failed to stop container after OOM")
+		}
+	}
+}
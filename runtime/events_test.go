@@ -0,0 +1,106 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	eventstypes "github.com/containerd/containerd/api/events"
+	eventsapi "github.com/containerd/containerd/api/services/events/v1"
+	"github.com/containerd/containerd/events"
+	"github.com/containerd/containerd/runtime"
+	taskAPI "github.com/containerd/containerd/runtime/v2/task"
+	"github.com/containerd/typeurl"
+	ptypes "github.com/gogo/protobuf/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/firecracker-microvm/firecracker-containerd/internal"
+)
+
+type testPublisher struct {
+	topics []string
+	events []events.Event
+}
+
+func (p *testPublisher) Publish(ctx context.Context, topic string, event events.Event) error {
+	p.topics = append(p.topics, topic)
+	p.events = append(p.events, event)
+	return nil
+}
+
+type testTaskService struct {
+	taskAPI.TaskService
+	kills []*taskAPI.KillRequest
+}
+
+func (ts *testTaskService) Kill(ctx context.Context, req *taskAPI.KillRequest) (*ptypes.Empty, error) {
+	ts.kills = append(ts.kills, req)
+	return &ptypes.Empty{}, nil
+}
+
+func sendGuestEvents(t *testing.T, conn net.Conn, topic string, evts ...events.Event) {
+	for _, event := range evts {
+		any, err := typeurl.MarshalAny(event)
+		require.NoError(t, err)
+
+		err = internal.WriteEnvelope(conn, &eventsapi.Envelope{Timestamp: time.Now(), Topic: topic, Event: any})
+		require.NoError(t, err)
+	}
+
+	conn.Close()
+}
+
+func TestForwardGuestEvents(t *testing.T) {
+	publisher := &testPublisher{}
+	client := &testTaskService{}
+	s := &service{publish: publisher}
+
+	guest, host := net.Pipe()
+	go func() {
+		sendGuestEvents(t, guest, runtime.TaskExitEventTopic, &eventstypes.TaskExit{ContainerID: "test"})
+	}()
+
+	s.forwardGuestEvents(context.Background(), host, client, false)
+	assert.Empty(t, publisher.topics, "only OOM events should be forwarded")
+
+	guest, host = net.Pipe()
+	go func() {
+		sendGuestEvents(t, guest, runtime.TaskOOMEventTopic, &eventstypes.TaskOOM{ContainerID: "test"})
+	}()
+
+	s.forwardGuestEvents(context.Background(), host, client, false)
+	assert.Equal(t, []string{runtime.TaskOOMEventTopic}, publisher.topics)
+	assert.Equal(t, []events.Event{&eventstypes.TaskOOM{ContainerID: "test"}}, publisher.events)
+	assert.Empty(t, client.kills)
+}
+
+func TestForwardGuestEventsStopOnOOM(t *testing.T) {
+	publisher := &testPublisher{}
+	client := &testTaskService{}
+	s := &service{publish: publisher}
+
+	guest, host := net.Pipe()
+	go func() {
+		sendGuestEvents(t, guest, runtime.TaskOOMEventTopic, &eventstypes.TaskOOM{ContainerID: "test"})
+	}()
+
+	s.forwardGuestEvents(context.Background(), host, client, true)
+	require.Len(t, client.kills, 1)
+	assert.Equal(t, "test", client.kills[0].ID)
+	assert.True(t, client.kills[0].All)
+}
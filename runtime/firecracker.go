@@ -0,0 +1,55 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os/exec"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var firecrackerVersionRegexp = regexp.MustCompile(`v?(\d+\.\d+\.\d+\S*)`)
+
+// firecrackerVersion runs "firecracker --version" and extracts version number from its output
+func firecrackerVersion(ctx context.Context, binaryPath string) (string, error) {
+	output, err := exec.CommandContext(ctx, binaryPath, "--version").CombinedOutput()
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to query version of %q: %s", binaryPath, string(output))
+	}
+
+	return parseFirecrackerVersion(string(output))
+}
+
+func parseFirecrackerVersion(output string) (string, error) {
+	match := firecrackerVersionRegexp.FindStringSubmatch(output)
+	if match == nil {
+		return "", errors.Errorf("failed to parse firecracker version from %q", strings.TrimSpace(output))
+	}
+
+	return match[1], nil
+}
+
+// checkFirecrackerVersion makes sure actual version satisfies the required one.
+// Required version might be either exact ("0.12.0") or a prefix on component boundary ("0.12").
+func checkFirecrackerVersion(actual, required string) error {
+	required = strings.TrimPrefix(required, "v")
+	if required == "" || actual == required || strings.HasPrefix(actual, required+".") {
+		return nil
+	}
+
+	return errors.Errorf("firecracker version mismatch: required %q, but binary reports %q", required, actual)
+}
@@ -0,0 +1,45 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseFirecrackerVersion(t *testing.T) {
+	version, err := parseFirecrackerVersion("Firecracker v0.12.0\n\n")
+	require.NoError(t, err)
+	assert.Equal(t, "0.12.0", version)
+
+	version, err = parseFirecrackerVersion("Firecracker v0.13.0-rc1")
+	require.NoError(t, err)
+	assert.Equal(t, "0.13.0-rc1", version)
+
+	_, err = parseFirecrackerVersion("unknown option")
+	assert.Error(t, err)
+}
+
+func TestCheckFirecrackerVersion(t *testing.T) {
+	assert.NoError(t, checkFirecrackerVersion("0.12.0", ""))
+	assert.NoError(t, checkFirecrackerVersion("0.12.0", "0.12.0"))
+	assert.NoError(t, checkFirecrackerVersion("0.12.0", "v0.12.0"))
+	assert.NoError(t, checkFirecrackerVersion("0.12.0", "0.12"))
+
+	assert.Error(t, checkFirecrackerVersion("0.12.0", "0.13.0"))
+	assert.Error(t, checkFirecrackerVersion("0.12.0", "0.1"))
+	assert.Error(t, checkFirecrackerVersion("0.120.0", "0.12"))
+}
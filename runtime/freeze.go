@@ -0,0 +1,73 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"github.com/gogo/protobuf/types"
+	"github.com/pkg/errors"
+
+	"github.com/firecracker-microvm/firecracker-containerd/proto"
+)
+
+// Socket in runtime's working directory (the bundle) serving agent RPCs which aren't part of containerd task API
+const agentSocketName = "agent.sock"
+
+var _ proto.AgentService = (*service)(nil)
+
+// FreezeFilesystem freezes root filesystem of the container in the guest, so its drive can be snapshotted
+// on the host (see devmapper.WithFreeze) in a consistent state
+func (s *service) FreezeFilesystem(ctx context.Context, req *proto.FreezeFilesystemRequest) (*types.Empty, error) {
+	log.G(ctx).WithField("id", req.ID).Debug("freeze filesystem")
+	if s.agentFS == nil {
+		return nil, errdefs.ToGRPCf(errdefs.ErrFailedPrecondition, "VM is not running")
+	}
+
+	return s.agentFS.FreezeFilesystem(ctx, req)
+}
+
+// ThawFilesystem thaws root filesystem of the container frozen by FreezeFilesystem
+func (s *service) ThawFilesystem(ctx context.Context, req *proto.ThawFilesystemRequest) (*types.Empty, error) {
+	log.G(ctx).WithField("id", req.ID).Debug("thaw filesystem")
+	if s.agentFS == nil {
+		return nil, errdefs.ToGRPCf(errdefs.ErrFailedPrecondition, "VM is not running")
+	}
+
+	return s.agentFS.ThawFilesystem(ctx, req)
+}
+
+// serveAgentSocket serves Agent service of the runtime on a socket in the bundle
+func (s *service) serveAgentSocket(ctx context.Context) error {
+	if err := os.Remove(agentSocketName); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "failed to remove stale socket %q", agentSocketName)
+	}
+
+	listener, err := net.Listen("unix", agentSocketName)
+	if err != nil {
+		return errors.Wrapf(err, "failed to listen on %q", agentSocketName)
+	}
+
+	go func() {
+		if err := s.server.Serve(ctx, listener); err != nil {
+			log.G(ctx).WithError(err).Debug("agent socket server stopped")
+		}
+	}()
+
+	return nil
+}
@@ -0,0 +1,166 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+
+	"github.com/firecracker-microvm/firecracker-containerd/internal"
+	"github.com/firecracker-microvm/firecracker-containerd/proto"
+)
+
+// Container spec annotations describing environment variables and files to inject into the container at create
+const (
+	// JSON array of "KEY=VALUE" strings
+	injectEnvAnnotation = "aws.firecracker.inject.env"
+	// JSON array of injectFile objects
+	injectFilesAnnotation = "aws.firecracker.inject.files"
+
+	defaultInjectFileMode = 0644
+)
+
+// injectFile describes a host file to copy into container's root filesystem
+type injectFile struct {
+	Source string `json:"source"`
+	Path   string `json:"path"`
+	Mode   uint32 `json:"mode"`
+	UID    uint32 `json:"uid"`
+	GID    uint32 `json:"gid"`
+}
+
+// loadInjectData reads environment variables and file contents requested by annotations. Runtime runs as root,
+// so sources of injected files are only read from sourceDir (inject_source_dir of runtime config).
+func loadInjectData(annotations map[string]string, sourceDir string) ([]string, []*proto.File, error) {
+	var (
+		env       []string
+		requested []injectFile
+		files     []*proto.File
+		size      int
+	)
+
+	if value, ok := annotations[injectEnvAnnotation]; ok {
+		if err := json.Unmarshal([]byte(value), &env); err != nil {
+			return nil, nil, errors.Wrapf(err, "failed to parse %q annotation", injectEnvAnnotation)
+		}
+
+		for _, kv := range env {
+			if strings.IndexByte(kv, '=') <= 0 {
+				// Don't print the value, it may be a secret
+				return nil, nil, errors.Errorf("invalid environment variable in %q annotation, expected KEY=VALUE", injectEnvAnnotation)
+			}
+
+			size += len(kv)
+		}
+	}
+
+	if value, ok := annotations[injectFilesAnnotation]; ok {
+		if err := json.Unmarshal([]byte(value), &requested); err != nil {
+			return nil, nil, errors.Wrapf(err, "failed to parse %q annotation", injectFilesAnnotation)
+		}
+	}
+
+	for _, spec := range requested {
+		if !filepath.IsAbs(spec.Path) {
+			return nil, nil, errors.Errorf("path of injected file %q must be absolute", spec.Path)
+		}
+
+		contents, err := readInjectSource(sourceDir, spec.Source)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		size += len(contents)
+		if size > internal.MaxInjectPayloadSize {
+			break
+		}
+
+		mode := spec.Mode
+		if mode == 0 {
+			mode = defaultInjectFileMode
+		}
+
+		files = append(files, &proto.File{
+			Path:     spec.Path,
+			Contents: contents,
+			Mode:     mode,
+			UID:      spec.UID,
+			GID:      spec.GID,
+		})
+	}
+
+	if size > internal.MaxInjectPayloadSize {
+		return nil, nil, errors.Errorf("injected environment and files exceed %d bytes", internal.MaxInjectPayloadSize)
+	}
+
+	return env, files, nil
+}
+
+// readInjectSource reads source of injected file, which has to be a regular file in sourceDir once symlinks are
+// resolved. Relative source is taken relative to sourceDir.
+func readInjectSource(sourceDir, source string) ([]byte, error) {
+	if sourceDir == "" {
+		return nil, errors.Errorf("can't inject file %q, inject_source_dir is not set in runtime config", source)
+	}
+
+	root, err := filepath.EvalSymlinks(sourceDir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to resolve inject source directory %q", sourceDir)
+	}
+
+	path := source
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(root, path)
+	}
+
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to resolve injected file %q", source)
+	}
+
+	rel, err := filepath.Rel(root, resolved)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil, errors.Errorf("injected file %q is outside of %q", source, sourceDir)
+	}
+
+	// Resolved path could be replaced with a symlink meanwhile, don't follow it
+	file, err := os.OpenFile(resolved, os.O_RDONLY|unix.O_NOFOLLOW|unix.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open injected file %q", source)
+	}
+
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to stat injected file %q", source)
+	}
+
+	if !info.Mode().IsRegular() {
+		return nil, errors.Errorf("injected file %q is not a regular file", source)
+	}
+
+	contents, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read injected file %q", source)
+	}
+
+	return contents, nil
+}
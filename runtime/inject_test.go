@@ -0,0 +1,141 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/firecracker-microvm/firecracker-containerd/internal"
+	"github.com/firecracker-microvm/firecracker-containerd/proto"
+)
+
+func TestLoadInjectData(t *testing.T) {
+	dir, err := ioutil.TempDir("", "runtime-inject-test-")
+	require.NoError(t, err)
+
+	defer os.RemoveAll(dir)
+
+	source := filepath.Join(dir, "secret")
+	err = ioutil.WriteFile(source, []byte("password"), 0600)
+	require.NoError(t, err)
+
+	annotations := map[string]string{
+		injectEnvAnnotation:   `["TOKEN=abc", "EMPTY="]`,
+		injectFilesAnnotation: fmt.Sprintf(`[{"source": %q, "path": "/etc/secret", "mode": 384, "uid": 1000, "gid": 1000}, {"source": %q, "path": "/etc/copy"}]`, source, source),
+	}
+
+	env, files, err := loadInjectData(annotations, dir)
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"TOKEN=abc", "EMPTY="}, env)
+	require.Len(t, files, 2)
+
+	assert.Equal(t, "/etc/secret", files[0].Path)
+	assert.Equal(t, []byte("password"), files[0].Contents)
+	assert.EqualValues(t, 0600, files[0].Mode)
+	assert.EqualValues(t, 1000, files[0].UID)
+	assert.EqualValues(t, 1000, files[0].GID)
+
+	assert.EqualValues(t, defaultInjectFileMode, files[1].Mode)
+}
+
+func TestLoadInjectDataEmpty(t *testing.T) {
+	env, files, err := loadInjectData(map[string]string{"unrelated": "value"}, "")
+	require.NoError(t, err)
+	assert.Empty(t, env)
+	assert.Empty(t, files)
+}
+
+func TestLoadInjectDataInvalid(t *testing.T) {
+	_, _, err := loadInjectData(map[string]string{injectEnvAnnotation: `["NOVALUE"]`}, "")
+	assert.Error(t, err)
+	assert.NotContains(t, err.Error(), "NOVALUE")
+
+	_, _, err = loadInjectData(map[string]string{injectFilesAnnotation: `[{"source": "/etc/hostname", "path": "relative"}]`}, "/etc")
+	assert.Error(t, err)
+
+	_, _, err = loadInjectData(map[string]string{injectFilesAnnotation: `not json`}, "")
+	assert.Error(t, err)
+}
+
+func TestLoadInjectDataTooLarge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "runtime-inject-test-")
+	require.NoError(t, err)
+
+	defer os.RemoveAll(dir)
+
+	source := filepath.Join(dir, "large")
+	err = ioutil.WriteFile(source, make([]byte, internal.MaxInjectPayloadSize+1), 0600)
+	require.NoError(t, err)
+
+	_, _, err = loadInjectData(map[string]string{
+		injectFilesAnnotation: fmt.Sprintf(`[{"source": %q, "path": "/large"}]`, source),
+	}, dir)
+
+	assert.Error(t, err)
+}
+
+func TestLoadInjectDataSourceDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "runtime-inject-test-")
+	require.NoError(t, err)
+
+	defer os.RemoveAll(dir)
+
+	sourceDir := filepath.Join(dir, "sources")
+	err = os.Mkdir(sourceDir, 0700)
+	require.NoError(t, err)
+
+	err = ioutil.WriteFile(filepath.Join(sourceDir, "allowed"), []byte("allowed"), 0600)
+	require.NoError(t, err)
+
+	outside := filepath.Join(dir, "outside")
+	err = ioutil.WriteFile(outside, []byte("outside"), 0600)
+	require.NoError(t, err)
+
+	err = os.Symlink(outside, filepath.Join(sourceDir, "escape"))
+	require.NoError(t, err)
+
+	err = os.Symlink("allowed", filepath.Join(sourceDir, "link"))
+	require.NoError(t, err)
+
+	load := func(source, sourceDir string) ([]*proto.File, error) {
+		_, files, err := loadInjectData(map[string]string{
+			injectFilesAnnotation: fmt.Sprintf(`[{"source": %q, "path": "/file"}]`, source),
+		}, sourceDir)
+		return files, err
+	}
+
+	// Relative sources and symlinks staying in the directory are allowed
+	for _, source := range []string{filepath.Join(sourceDir, "allowed"), "allowed", "link"} {
+		files, err := load(source, sourceDir)
+		require.NoError(t, err, source)
+		require.Len(t, files, 1)
+		assert.Equal(t, []byte("allowed"), files[0].Contents)
+	}
+
+	for _, source := range []string{outside, "../outside", "escape", "/etc/shadow", sourceDir} {
+		_, err := load(source, sourceDir)
+		assert.Error(t, err, source)
+	}
+
+	_, err = load(filepath.Join(sourceDir, "allowed"), "")
+	assert.Error(t, err, "files can't be injected without inject_source_dir")
+}
@@ -0,0 +1,154 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	"github.com/pkg/errors"
+
+	"github.com/firecracker-microvm/firecracker-containerd/proto"
+)
+
+const (
+	// Topic of the event published when guest kernel panics
+	guestPanicTopic = "/firecracker/vm/panic"
+
+	// Exit status reported for tasks of the VM which guest kernel panicked
+	guestPanicExitStatus = 255
+
+	// Kernel prints these on panic, the trace ends with panicEndSignature
+	panicSignature    = "Kernel panic - not syncing"
+	panicEndSignature = "---[ end Kernel panic"
+
+	// Console lines kept before the panic (oops and call trace are printed before panic message)
+	// and the most lines collected after it
+	panicContextLines = 50
+	maxPanicLines     = 100
+
+	// How long to wait for the rest of the trace once panic is seen
+	panicTraceTimeout = time.Second
+)
+
+// panicWatcher passes serial console output through and calls onPanic once with the panic trace
+// when guest kernel panics
+type panicWatcher struct {
+	out     io.Writer
+	onPanic func(trace string)
+
+	mu       sync.Mutex
+	partial  []byte
+	lines    []string
+	panicked bool
+	reported bool
+}
+
+func newPanicWatcher(out io.Writer, onPanic func(trace string)) *panicWatcher {
+	return &panicWatcher{out: out, onPanic: onPanic}
+}
+
+// Write implements io.Writer, output is never blocked or failed by panic detection
+func (w *panicWatcher) Write(p []byte) (int, error) {
+	w.scan(p)
+	return w.out.Write(p)
+}
+
+func (w *panicWatcher) scan(p []byte) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.reported {
+		return
+	}
+
+	w.partial = append(w.partial, p...)
+	for {
+		idx := bytes.IndexByte(w.partial, '\n')
+		if idx < 0 {
+			break
+		}
+
+		line := strings.TrimRight(string(w.partial[:idx]), "\r")
+		w.partial = w.partial[idx+1:]
+
+		if w.addLine(line) {
+			w.report()
+			return
+		}
+	}
+}
+
+// addLine records console line and tells whether the whole panic trace has been collected
+func (w *panicWatcher) addLine(line string) bool {
+	w.lines = append(w.lines, line)
+
+	if !w.panicked {
+		if len(w.lines) > panicContextLines {
+			w.lines = w.lines[1:]
+		}
+
+		if !strings.Contains(line, panicSignature) {
+			return false
+		}
+
+		w.panicked = true
+
+		// Guest may hang before printing the end of the trace
+		time.AfterFunc(panicTraceTimeout, func() {
+			w.mu.Lock()
+			defer w.mu.Unlock()
+			w.report()
+		})
+	}
+
+	return strings.Contains(line, panicEndSignature) || len(w.lines) >= panicContextLines+maxPanicLines
+}
+
+// report calls onPanic once, the lock must be held
+func (w *panicWatcher) report() {
+	if w.reported {
+		return
+	}
+
+	w.reported = true
+	trace := strings.Join(w.lines, "\n")
+	w.lines = nil
+	w.partial = nil
+
+	go w.onPanic(trace)
+}
+
+// handleGuestPanic stops the VM which guest kernel panicked, so its tasks are reported as failed
+// and restart policy can recover them, publishes panic event and keeps VM artifacts with the trace
+func (s *service) handleGuestPanic(ctx context.Context, trace string) {
+	log.G(ctx).Errorf("guest kernel panicked:\n%s", trace)
+
+	atomic.StoreInt32(&s.guestPanicked, 1)
+	if err := s.stopVM(); err != nil {
+		log.G(ctx).WithError(err).Error("failed to stop VM after guest panic")
+	}
+
+	if err := s.publish.Publish(ctx, guestPanicTopic, &proto.GuestPanic{VMID: s.id, Trace: trace}); err != nil {
+		log.G(ctx).WithError(err).Warn("failed to publish guest panic")
+	}
+
+	s.keepFailedVMArtifacts(ctx, errors.Errorf("guest kernel panic:\n%s", trace))
+}
@@ -0,0 +1,90 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPanicWatcher(t *testing.T) {
+	var out bytes.Buffer
+	traces := make(chan string, 2)
+	w := newPanicWatcher(&out, func(trace string) { traces <- trace })
+
+	console := []string{
+		"[    0.500000] Run /sbin/init as init process\n",
+		"[    1.000000] BUG: unable to handle kernel NULL pointer dereference\n",
+		"[    1.000001] Kernel panic - not sync", // split across writes
+		"ing: Fatal exception\r\n",
+		"[    1.000002] ---[ end Kernel panic - not syncing: Fatal exception ]---\n",
+		"[    1.000003] after trace\n",
+	}
+
+	for _, data := range console {
+		n, err := w.Write([]byte(data))
+		require.NoError(t, err)
+		assert.Equal(t, len(data), n)
+	}
+
+	select {
+	case trace := <-traces:
+		assert.Contains(t, trace, "Run /sbin/init")
+		assert.Contains(t, trace, "NULL pointer dereference")
+		assert.Contains(t, trace, "Kernel panic - not syncing: Fatal exception")
+		assert.Contains(t, trace, "end Kernel panic")
+		assert.NotContains(t, trace, "after trace")
+	case <-time.After(time.Second):
+		t.Fatal("panic wasn't reported")
+	}
+
+	// Console output is passed through as is
+	assert.Contains(t, out.String(), "not sync"+"ing: Fatal exception\r\n")
+
+	// Reported only once, timer must not report again
+	time.Sleep(panicTraceTimeout + 100*time.Millisecond)
+	assert.Empty(t, traces)
+}
+
+func TestPanicWatcherTimeout(t *testing.T) {
+	traces := make(chan string, 1)
+	w := newPanicWatcher(&bytes.Buffer{}, func(trace string) { traces <- trace })
+
+	_, err := w.Write([]byte("Kernel panic - not syncing: VFS: Unable to mount root fs\n"))
+	require.NoError(t, err)
+
+	select {
+	case trace := <-traces:
+		assert.Contains(t, trace, "Unable to mount root fs")
+	case <-time.After(panicTraceTimeout + time.Second):
+		t.Fatal("panic wasn't reported without end of trace")
+	}
+}
+
+func TestPanicWatcherNoPanic(t *testing.T) {
+	traces := make(chan string, 1)
+	w := newPanicWatcher(&bytes.Buffer{}, func(trace string) { traces <- trace })
+
+	for i := 0; i < panicContextLines*2; i++ {
+		_, err := w.Write([]byte("regular console output\n"))
+		require.NoError(t, err)
+	}
+
+	assert.Len(t, w.lines, panicContextLines)
+	assert.Empty(t, traces)
+}
@@ -0,0 +1,146 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/containerd/log"
+	"github.com/mdlayher/vsock"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/firecracker-microvm/firecracker-containerd/internal"
+)
+
+const defaultPortForwardHost = "127.0.0.1"
+
+// portForward describes a host address to listen on and a guest TCP port to forward connections to
+type portForward struct {
+	HostAddress string
+	GuestPort   uint16
+}
+
+// parsePortForward parses port mapping in "[host_ip:]host_port:guest_port[/tcp]" format
+func parsePortForward(value string) (portForward, error) {
+	mapping := value
+	if idx := strings.LastIndexByte(mapping, '/'); idx >= 0 {
+		if proto := mapping[idx+1:]; proto != "tcp" {
+			return portForward{}, errors.Errorf("unsupported protocol %q in port forward %q, only tcp is supported", proto, value)
+		}
+
+		mapping = mapping[:idx]
+	}
+
+	sep := strings.LastIndexByte(mapping, ':')
+	if sep < 0 {
+		return portForward{}, errors.Errorf("invalid port forward %q, expected [host_ip:]host_port:guest_port", value)
+	}
+
+	guestPort, err := strconv.ParseUint(mapping[sep+1:], 10, 16)
+	if err != nil || guestPort == 0 {
+		return portForward{}, errors.Errorf("invalid guest port in port forward %q", value)
+	}
+
+	host := mapping[:sep]
+	if !strings.Contains(host, ":") {
+		host = net.JoinHostPort(defaultPortForwardHost, host)
+	}
+
+	_, hostPort, err := net.SplitHostPort(host)
+	if err != nil {
+		return portForward{}, errors.Wrapf(err, "invalid host address in port forward %q", value)
+	}
+
+	if _, err := strconv.ParseUint(hostPort, 10, 16); err != nil {
+		return portForward{}, errors.Errorf("invalid host port in port forward %q", value)
+	}
+
+	return portForward{HostAddress: host, GuestPort: uint16(guestPort)}, nil
+}
+
+// startPortForwards listens on host addresses and forwards accepted connections to the guest agent over vsock.
+// Listeners are closed when ctx is done.
+func startPortForwards(ctx context.Context, mappings []string, CID uint32) error {
+	var listeners []net.Listener
+
+	closeAll := func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}
+
+	for _, mapping := range mappings {
+		forward, err := parsePortForward(mapping)
+		if err != nil {
+			closeAll()
+			return err
+		}
+
+		listener, err := net.Listen("tcp", forward.HostAddress)
+		if err != nil {
+			closeAll()
+			return errors.Wrapf(err, "failed to listen on %s", forward.HostAddress)
+		}
+
+		log.G(ctx).WithFields(logrus.Fields{
+			"host":  forward.HostAddress,
+			"guest": forward.GuestPort,
+		}).Info("forwarding port")
+
+		listeners = append(listeners, listener)
+		go acceptPortForward(ctx, listener, CID, forward.GuestPort)
+	}
+
+	go func() {
+		<-ctx.Done()
+		closeAll()
+	}()
+
+	return nil
+}
+
+func acceptPortForward(ctx context.Context, listener net.Listener, CID uint32, guestPort uint16) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				log.G(ctx).WithError(err).Error("port forward listener failed")
+			}
+
+			return
+		}
+
+		go func() {
+			guestConn, err := vsock.Dial(CID, internal.PortForwardPort)
+			if err != nil {
+				log.G(ctx).WithError(err).Error("unable to dial agent vsock")
+				conn.Close()
+				return
+			}
+
+			if err := internal.WritePortForwardHeader(guestConn, guestPort); err != nil {
+				log.G(ctx).WithError(err).Error("failed to send port forward header")
+				conn.Close()
+				guestConn.Close()
+				return
+			}
+
+			internal.ProxyConn(conn, guestConn)
+		}()
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePortForward(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected portForward
+	}{
+		{"8080:80", portForward{HostAddress: "127.0.0.1:8080", GuestPort: 80}},
+		{"8080:80/tcp", portForward{HostAddress: "127.0.0.1:8080", GuestPort: 80}},
+		{"0.0.0.0:8443:443", portForward{HostAddress: "0.0.0.0:8443", GuestPort: 443}},
+		{"[::1]:8080:80", portForward{HostAddress: "[::1]:8080", GuestPort: 80}},
+	}
+
+	for _, test := range tests {
+		forward, err := parsePortForward(test.value)
+		require.NoError(t, err, test.value)
+		assert.Equal(t, test.expected, forward, test.value)
+	}
+}
+
+func TestParsePortForwardInvalid(t *testing.T) {
+	for _, value := range []string{
+		"",
+		"80",
+		"8080:80/udp",
+		"8080:0",
+		"8080:70000",
+		"abc:80",
+		"localhost:abc:80",
+	} {
+		_, err := parsePortForward(value)
+		assert.Error(t, err, value)
+	}
+}
@@ -0,0 +1,48 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	models "github.com/firecracker-microvm/firecracker-go-sdk/client/models"
+	"github.com/go-openapi/strfmt"
+	"github.com/pkg/errors"
+)
+
+// RateLimitPreset holds token bucket configuration applied to VMs of a QoS class
+type RateLimitPreset struct {
+	Drive *models.RateLimiter `json:"drive"`
+}
+
+// driveRateLimiter returns rate limiter for drives of the VM from the preset of its QoS class.
+// Returns nil if the VM has no QoS class or its preset doesn't limit drives.
+func driveRateLimiter(cfg *Config) (*models.RateLimiter, error) {
+	if cfg.QoSClass == "" {
+		return nil, nil
+	}
+
+	preset, ok := cfg.RateLimitPresets[cfg.QoSClass]
+	if !ok {
+		return nil, errors.Errorf("no rate limit preset for QoS class %q", cfg.QoSClass)
+	}
+
+	if preset.Drive == nil {
+		return nil, nil
+	}
+
+	if err := preset.Drive.Validate(strfmt.Default); err != nil {
+		return nil, errors.Wrapf(err, "invalid drive rate limiter of QoS class %q", cfg.QoSClass)
+	}
+
+	return preset.Drive, nil
+}
@@ -0,0 +1,67 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDriveRateLimiter(t *testing.T) {
+	var cfg Config
+	err := json.Unmarshal([]byte(`{
+		"rate_limit_presets": {
+			"guaranteed": {},
+			"burstable": {
+				"drive": {
+					"bandwidth": {"size": 104857600, "refill_time": 1000, "one_time_burst": 524288000},
+					"ops": {"size": 1000, "refill_time": 1000}
+				}
+			},
+			"invalid": {
+				"drive": {"ops": {"size": -1, "refill_time": 1000}}
+			}
+		}
+	}`), &cfg)
+	require.NoError(t, err)
+
+	limiter, err := driveRateLimiter(&cfg)
+	require.NoError(t, err)
+	assert.Nil(t, limiter, "no QoS class, no limits")
+
+	cfg.QoSClass = "guaranteed"
+	limiter, err = driveRateLimiter(&cfg)
+	require.NoError(t, err)
+	assert.Nil(t, limiter, "preset doesn't limit drives")
+
+	cfg.QoSClass = "burstable"
+	limiter, err = driveRateLimiter(&cfg)
+	require.NoError(t, err)
+	require.NotNil(t, limiter)
+	assert.EqualValues(t, 104857600, *limiter.Bandwidth.Size)
+	assert.EqualValues(t, 524288000, *limiter.Bandwidth.OneTimeBurst)
+	assert.EqualValues(t, 1000, *limiter.Ops.Size)
+	assert.Nil(t, limiter.Ops.OneTimeBurst)
+
+	cfg.QoSClass = "invalid"
+	_, err = driveRateLimiter(&cfg)
+	assert.Error(t, err)
+
+	cfg.QoSClass = "unknown"
+	_, err = driveRateLimiter(&cfg)
+	assert.Error(t, err)
+}
@@ -23,6 +23,8 @@ import (
 	"os/exec"
 	"path/filepath"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 	"unsafe"
@@ -37,10 +39,12 @@ import (
 	taskAPI "github.com/containerd/containerd/runtime/v2/task"
 	"github.com/containerd/fifo"
 	"github.com/containerd/ttrpc"
+	"github.com/docker/go-units"
 	"github.com/firecracker-microvm/firecracker-go-sdk"
 	models "github.com/firecracker-microvm/firecracker-go-sdk/client/models"
 	ptypes "github.com/gogo/protobuf/types"
 	"github.com/mdlayher/vsock"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/sys/unix"
@@ -62,11 +66,43 @@ type service struct {
 
 	agentStarted bool
 	agentClient  taskAPI.TaskService
+	agentFS      proto.AgentService
 	config       *Config
 	machine      *firecracker.Machine
 	machineCID   uint32
 	ctx          context.Context
 	cancel       context.CancelFunc
+
+	createMutex sync.Mutex
+
+	execMutex    sync.Mutex
+	execPortNext uint32
+	execCancels  map[string]context.CancelFunc
+
+	portForwardCancel context.CancelFunc
+
+	// Mounts of drives attached for the VM to add to the first container's spec
+	vmMounts []specs.Mount
+
+	// Firecracker API socket of the VM
+	socketPath string
+
+	// Set if VM can run more than one container
+	group            *vmGroup
+	placeholderDrive string
+
+	// Firecracker log of the VM, nil if logging to a pipe from configuration
+	vmLog *os.File
+
+	// Files to keep if VM fails, nil if not configured
+	artifacts *vmArtifacts
+	// Set once VM is being stopped by the runtime, so its exit isn't treated as a failure
+	vmStopping int32
+	// Set once guest kernel panicked, so tasks are reported as failed when agent is gone
+	guestPanicked int32
+
+	// Locked slot file which counts the VM towards max_vms
+	vmSlot *os.File
 }
 
 var (
@@ -93,12 +129,16 @@ func NewService(ctx context.Context, id string, publisher events.Publisher) (shi
 	}
 
 	s := &service{
-		server:  server,
-		id:      id,
-		publish: publisher,
-		config:  config,
+		server:       server,
+		id:           id,
+		publish:      publisher,
+		config:       config,
+		execPortNext: internal.ExecStdioPortBase,
+		execCancels:  make(map[string]context.CancelFunc),
 	}
 
+	proto.RegisterAgentService(server, s)
+
 	return s, nil
 }
 
@@ -108,14 +148,32 @@ func (s *service) StartShim(ctx context.Context, id, containerdBinary, container
 		return "", err
 	}
 
-	address, err := shim.SocketAddress(ctx, id)
+	// "shim start" runs in the bundle directory unless bundle path is given explicitly
+	bundle := ctx.Value(shim.OptsKey{}).(shim.Opts).BundlePath
+	if bundle == "" {
+		if bundle, err = os.Getwd(); err != nil {
+			return "", err
+		}
+	}
+
+	socketID := shimSocketID(id, bundle)
+	address, err := shim.SocketAddress(ctx, socketID)
 	if err != nil {
 		return "", err
 	}
 
 	socket, err := shim.NewSocket(address)
 	if err != nil {
-		return "", err
+		// Shim of the VM group is already running (or was just started for another task of the group), reuse it
+		if socketID == id || !shimRunning(address) {
+			return "", err
+		}
+
+		if err := shim.WriteAddress("address", address); err != nil {
+			return "", err
+		}
+
+		return address, nil
 	}
 
 	defer socket.Close()
@@ -167,22 +225,35 @@ func (s *service) Create(ctx context.Context, request *taskAPI.CreateTaskRequest
 		"checkpoint": request.Checkpoint,
 	}).Debug("creating task")
 
-	// TODO: should there be a lock here
-	if !s.agentStarted {
-		client, err := s.startVM(ctx, request)
-		if err != nil {
-			log.G(ctx).WithError(err).Error("failed to start VM")
-			return nil, err
-		}
+	s.createMutex.Lock()
+	defer s.createMutex.Unlock()
 
-		s.agentClient = client
-		s.agentStarted = true
+	if s.agentStarted {
+		// Joining VM of a VM group
+		log.G(ctx).Infof("creating task '%s'", request.ID)
+		return s.createGroupTask(ctx, request)
 	}
 
+	if err := s.admitVM(ctx); err != nil {
+		log.G(ctx).WithError(err).Error("VM rejected")
+		return nil, err
+	}
+
+	client, err := s.startVM(ctx, request)
+	if err != nil {
+		log.G(ctx).WithError(err).Error("failed to start VM")
+		s.releaseVM(ctx)
+		s.keepFailedVMArtifacts(ctx, err)
+		s.closeVMLog(ctx, false)
+		return nil, err
+	}
+
+	s.agentClient = client
+	s.agentStarted = true
+
 	log.G(ctx).Infof("creating task '%s'", request.ID)
 
-	// Generate new anyData with bundle/config.json packed inside
-	anyData, err := packBundle(filepath.Join(request.Bundle, "config.json"), request.Options)
+	anyData, err := packCreateOptions(ctx, request, s.vmMounts, s.config.InjectSourceDir)
 	if err != nil {
 		return nil, err
 	}
@@ -196,10 +267,39 @@ func (s *service) Create(ctx context.Context, request *taskAPI.CreateTaskRequest
 	}
 	s.ctx, s.cancel = context.WithCancel(ctx)
 	go s.proxyStdio(s.ctx, request.Stdin, request.Stdout, request.Stderr, s.machineCID)
+
+	// Filesystem freeze is only needed for host snapshots, containers can run without it
+	if err := s.serveAgentSocket(s.ctx); err != nil {
+		log.G(ctx).WithError(err).Warn("failed to serve agent socket, filesystem freeze won't be available")
+	}
+
 	log.G(ctx).Infof("successfully created task with pid %d", resp.Pid)
 	return resp, nil
 }
 
+// packCreateOptions packs bundle spec (with extra mounts added), runc options and injected data of create request for the agent
+func packCreateOptions(ctx context.Context, request *taskAPI.CreateTaskRequest, mounts []specs.Mount, injectSourceDir string) (*ptypes.Any, error) {
+	bundleSpecPath := filepath.Join(request.Bundle, "config.json")
+	annotations, err := loadSpecAnnotations(bundleSpecPath)
+	if err != nil {
+		return nil, err
+	}
+
+	env, files, err := loadInjectData(annotations, injectSourceDir)
+	if err != nil {
+		log.G(ctx).WithError(err).Error("failed to load injected data")
+		return nil, err
+	}
+
+	if len(env) > 0 || len(files) > 0 {
+		// Only log counts, contents may be secrets
+		log.G(ctx).WithFields(logrus.Fields{"env": len(env), "files": len(files)}).Debug("injecting data into container")
+	}
+
+	// Generate new anyData with bundle/config.json packed inside
+	return packBundle(bundleSpecPath, request.Options, env, files, mounts)
+}
+
 func (s *service) Start(ctx context.Context, req *taskAPI.StartRequest) (*taskAPI.StartResponse, error) {
 	log.G(ctx).WithFields(logrus.Fields{"id": req.ID, "exec_id": req.ExecID}).Debug("start")
 	resp, err := s.agentClient.Start(ctx, req)
@@ -226,22 +326,47 @@ func (s *service) monitorState(ctx context.Context, id, execID string, pid uint3
 			}
 			resp, err := s.agentClient.State(ctx, req)
 			if err != nil {
-				log.G(ctx).WithError(err).Error("error monitoring state")
+				if atomic.LoadInt32(&s.guestPanicked) == 0 {
+					log.G(ctx).WithError(err).Error("error monitoring state")
+					continue
+				}
+
+				// Guest is dead, report the process failed
+				resp = &taskAPI.StateResponse{Status: task.StatusStopped, ExitStatus: guestPanicExitStatus}
+			}
+			if resp.Status != task.StatusStopped {
 				continue
 			}
-			// if ending state, stop vm and break
-			if resp.Status == task.StatusStopped {
+
+			// Exec'd process exited, report its exit code and keep VM running
+			if execID != "" {
 				s.publish.Publish(ctx, runtime.TaskExitEventTopic, &eventstypes.TaskExit{
 					ContainerID: s.id,
-					ID:          s.id,
+					ID:          execID,
 					Pid:         pid,
 					ExitStatus:  resp.ExitStatus,
 					ExitedAt:    time.Now(),
 				})
-				s.Shutdown(ctx, &taskAPI.ShutdownRequest{ID: id})
-				s.server.Close()
 				return
 			}
+
+			// if ending state, stop vm and break
+			s.publish.Publish(ctx, runtime.TaskExitEventTopic, &eventstypes.TaskExit{
+				ContainerID: id,
+				ID:          id,
+				Pid:         pid,
+				ExitStatus:  resp.ExitStatus,
+				ExitedAt:    time.Now(),
+			})
+
+			// VM is shared with other containers of a VM group, keep it running
+			if s.group != nil && (id != s.id || s.group.count() > 0) {
+				return
+			}
+
+			s.Shutdown(ctx, &taskAPI.ShutdownRequest{ID: id})
+			s.server.Close()
+			return
 		}
 
 	}
@@ -294,20 +419,82 @@ func (s *service) Delete(ctx context.Context, req *taskAPI.DeleteRequest) (*task
 		return nil, err
 	}
 
+	if req.ExecID != "" {
+		s.execMutex.Lock()
+		key := execKey(req.ID, req.ExecID)
+		if cancel, ok := s.execCancels[key]; ok {
+			cancel()
+			delete(s.execCancels, key)
+		}
+		s.execMutex.Unlock()
+	} else if s.group != nil {
+		if req.ID == s.id {
+			s.group.removePrimary()
+		} else {
+			s.releaseGroupTask(ctx, req.ID)
+		}
+	}
+
 	return resp, nil
 }
 
 // Exec an additional process inside the container
 func (s *service) Exec(ctx context.Context, req *taskAPI.ExecProcessRequest) (*ptypes.Empty, error) {
 	log.G(ctx).WithFields(logrus.Fields{"id": req.ID, "exec_id": req.ExecID}).Debug("exec")
+
+	// Stdio paths are only valid on the host, so ask agent to proxy process stdio over vsock instead
+	var (
+		hostStdin  = req.Stdin
+		hostStdout = req.Stdout
+		hostStderr = req.Stderr
+		basePort   = s.allocateExecPorts()
+	)
+
+	req.Stdin = vsockStdioPath(hostStdin, basePort)
+	req.Stdout = vsockStdioPath(hostStdout, basePort+1)
+	req.Stderr = vsockStdioPath(hostStderr, basePort+2)
+
 	resp, err := s.agentClient.Exec(ctx, req)
 	if err != nil {
 		return nil, err
 	}
 
+	ioCtx, cancel := context.WithCancel(s.ctx)
+
+	s.execMutex.Lock()
+	s.execCancels[execKey(req.ID, req.ExecID)] = cancel
+	s.execMutex.Unlock()
+
+	go proxyIO(ioCtx, hostStdin, s.machineCID, basePort, true)
+	go proxyIO(ioCtx, hostStdout, s.machineCID, basePort+1, false)
+	go proxyIO(ioCtx, hostStderr, s.machineCID, basePort+2, false)
+
 	return resp, nil
 }
 
+// execKey identifies exec'd process among all tasks of the VM group, exec IDs are only unique per task
+func execKey(id, execID string) string {
+	return id + "/" + execID
+}
+
+// allocateExecPorts reserves 3 consecutive vsock ports for stdio of exec'd process and returns the first one
+func (s *service) allocateExecPorts() uint32 {
+	s.execMutex.Lock()
+	defer s.execMutex.Unlock()
+
+	port := s.execPortNext
+	s.execPortNext += 3
+	return port
+}
+
+func vsockStdioPath(hostPath string, port uint32) string {
+	if hostPath == "" {
+		return ""
+	}
+
+	return internal.VsockStdioPath(port)
+}
+
 // ResizePty of a process
 func (s *service) ResizePty(ctx context.Context, req *taskAPI.ResizePtyRequest) (*ptypes.Empty, error) {
 	log.G(ctx).WithFields(logrus.Fields{"id": req.ID, "exec_id": req.ExecID}).Debug("resize_pty")
@@ -417,14 +604,37 @@ func (s *service) Connect(ctx context.Context, req *taskAPI.ConnectRequest) (*ta
 
 func (s *service) Shutdown(ctx context.Context, req *taskAPI.ShutdownRequest) (*ptypes.Empty, error) {
 	log.G(ctx).WithFields(logrus.Fields{"id": req.ID, "now": req.Now}).Debug("shutdown")
+	if s.group != nil && !req.Now {
+		if active := s.group.active(); active > 0 {
+			log.G(ctx).Debugf("VM still runs %d containers, keeping it", active)
+			return &ptypes.Empty{}, nil
+		}
+	}
 	if _, err := s.agentClient.Shutdown(ctx, req); err != nil {
 		log.G(ctx).WithError(err).Error("failed to shutdown agent")
 	}
+	if s.portForwardCancel != nil {
+		log.G(ctx).Debug("closing port forward listeners")
+		s.portForwardCancel()
+	}
 	log.G(ctx).Debug("stopping VM")
 	if err := s.stopVM(); err != nil {
 		log.G(ctx).WithError(err).Error("failed to stop VM")
 		return nil, err
 	}
+	if err := removeScratchDrive(scratchDriveName); err != nil {
+		log.G(ctx).WithError(err).Error("failed to remove scratch drive")
+	}
+	if err := removeSocket(s.socketPath); err != nil {
+		log.G(ctx).WithError(err).Error("failed to remove firecracker socket")
+	}
+	s.closeVMLog(ctx, true)
+	s.releaseVM(ctx)
+	if s.artifacts != nil {
+		if err := s.artifacts.close(); err != nil {
+			log.G(ctx).WithError(err).Error("failed to close console log")
+		}
+	}
 	s.cancel()
 	// Exit to avoid 'zombie' shim processes
 	defer os.Exit(0)
@@ -466,8 +676,20 @@ func (s *service) Wait(ctx context.Context, req *taskAPI.WaitRequest) (*taskAPI.
 
 func (s *service) Cleanup(ctx context.Context) (*taskAPI.DeleteResponse, error) {
 	log.G(ctx).Debug("cleanup")
-	// Destroy VM/etc here?
-	// copied from runcs impl, nothing to cleanup atm
+	// Runtime crashed or was killed, remove what it left in the bundle
+	if err := removeScratchDrive(scratchDriveName); err != nil {
+		log.G(ctx).WithError(err).Error("failed to remove scratch drive")
+	}
+
+	// Sockets outside of the bundle aren't removed by containerd
+	if s.config.SocketDir != "" {
+		if path, err := firecrackerSocketPath(s.config, s.id); err == nil {
+			if err := removeSocket(path); err != nil {
+				log.G(ctx).WithError(err).Error("failed to remove firecracker socket")
+			}
+		}
+	}
+
 	return &taskAPI.DeleteResponse{
 		ExitedAt:   time.Now(),
 		ExitStatus: 128 + uint32(unix.SIGKILL),
@@ -593,6 +815,65 @@ func findNextAvailableVsockCID(ctx context.Context) (uint32, error) {
 
 func (s *service) startVM(ctx context.Context, request *taskAPI.CreateTaskRequest) (taskAPI.TaskService, error) {
 	log.G(ctx).Info("starting VM")
+	timer := newBootTimer()
+
+	vmConfig, err := s.config.vmConfig(request.Bundle)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load VM configuration")
+	}
+
+	version, err := firecrackerVersion(ctx, vmConfig.FirecrackerBinaryPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkFirecrackerVersion(version, vmConfig.FirecrackerVersion); err != nil {
+		return nil, err
+	}
+
+	log.G(ctx).WithFields(logrus.Fields{
+		"binary":  vmConfig.FirecrackerBinaryPath,
+		"version": version,
+	}).Info("using firecracker")
+
+	if err := checkDriveQueueSize(vmConfig.DriveQueueSize); err != nil {
+		return nil, err
+	}
+
+	if vmConfig.DriveQueueSize != 0 && !driveQueueSizeSupported(version) {
+		log.G(ctx).WithField("queue_size", vmConfig.DriveQueueSize).Warnf(
+			"firecracker %s doesn't support drive queue size, using default one", version)
+	}
+
+	var cpus []int
+	if vmConfig.CPUAffinity != "" {
+		cpus, err = internal.ParseCPUList(vmConfig.CPUAffinity)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := checkCPUsAvailable(cpus); err != nil {
+			return nil, errors.Wrap(err, "invalid CPU affinity")
+		}
+	}
+
+	logLevel, err := parseLogLevel(vmConfig.LogLevel)
+	if err != nil {
+		return nil, err
+	}
+
+	socketPath, err := firecrackerSocketPath(vmConfig, s.id)
+	if err != nil {
+		return nil, err
+	}
+
+	if vmConfig.SocketDir != "" {
+		if err := os.MkdirAll(vmConfig.SocketDir, 0700); err != nil {
+			return nil, errors.Wrapf(err, "failed to create socket directory %q", vmConfig.SocketDir)
+		}
+	}
+
+	s.socketPath = socketPath
 
 	cid, err := findNextAvailableVsockCID(ctx)
 	if err != nil {
@@ -600,26 +881,43 @@ func (s *service) startVM(ctx context.Context, request *taskAPI.CreateTaskReques
 	}
 
 	cfg := firecracker.Config{
-		SocketPath:      s.config.SocketPath,
+		SocketPath:      socketPath,
 		VsockDevices:    []firecracker.VsockDevice{{Path: "root", CID: cid}},
-		KernelImagePath: s.config.KernelImagePath,
-		KernelArgs:      s.config.KernelArgs,
+		KernelImagePath: vmConfig.KernelImagePath,
+		KernelArgs:      vmConfig.KernelArgs,
 		MachineCfg: models.MachineConfiguration{
-			VcpuCount:   int64(s.config.CPUCount),
-			CPUTemplate: models.CPUTemplate(s.config.CPUTemplate),
+			VcpuCount:   int64(vmConfig.CPUCount),
+			CPUTemplate: models.CPUTemplate(vmConfig.CPUTemplate),
 			MemSizeMib:  256,
 		},
-		LogFifo:     s.config.LogFifo,
-		LogLevel:    s.config.LogLevel,
-		MetricsFifo: s.config.MetricsFifo,
-		Debug:       s.config.Debug,
+		LogFifo:     vmConfig.LogFifo,
+		LogLevel:    logLevel,
+		MetricsFifo: vmConfig.MetricsFifo,
+		Debug:       vmConfig.Debug,
+	}
+
+	// Unless logs go to a pipe from configuration, write them to a file of this VM
+	if cfg.LogFifo == "" {
+		if cfg.MetricsFifo == "" {
+			cfg.MetricsFifo = metricsFifoName
+		}
+
+		s.vmLog, err = openVMLog(vmConfig.LogPath)
+		if err != nil {
+			return nil, err
+		}
+
+		cfg.LogFifo = logFifoName
+		cfg.FifoLogWriter = s.vmLog
+
+		log.G(ctx).WithField("level", logLevel).Infof("writing firecracker log to %q", vmConfig.LogPath)
 	}
 
 	idx := strconv.Itoa(1)
 	cfg.Drives = append(cfg.Drives,
 		models.Drive{
 			DriveID:      &idx,
-			PathOnHost:   &s.config.RootDrive,
+			PathOnHost:   &vmConfig.RootDrive,
 			IsRootDevice: firecracker.Bool(true),
 			IsReadOnly:   firecracker.Bool(false),
 		})
@@ -639,10 +937,138 @@ func (s *service) startVM(ctx context.Context, request *taskAPI.CreateTaskReques
 			})
 	}
 
-	cmd := firecracker.VMCommandBuilder{}.
-		WithBin(s.config.FirecrackerBinaryPath).
-		WithSocketPath(s.config.SocketPath).
-		Build(ctx)
+	// Attach prebuilt images shared between VMs, read-only so they can't be modified by any of them
+	for _, value := range vmConfig.DataImages {
+		image, err := parseDataImage(value)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := checkDataImage(image.HostPath); err != nil {
+			return nil, err
+		}
+
+		driveIndex := len(cfg.Drives) + 1
+		idx := strconv.Itoa(driveIndex)
+		cfg.Drives = append(cfg.Drives,
+			models.Drive{
+				DriveID:      &idx,
+				PathOnHost:   firecracker.String(image.HostPath),
+				IsRootDevice: firecracker.Bool(false),
+				IsReadOnly:   firecracker.Bool(true),
+			})
+
+		s.vmMounts = append(s.vmMounts, specs.Mount{
+			Destination: image.ContainerPath,
+			Type:        supportedMountFSType,
+			Source:      guestDrivePath(driveIndex),
+			Options:     []string{"ro"},
+		})
+	}
+
+	// Attach scratch space, it's discarded with the VM
+	if vmConfig.ScratchSize != "" {
+		sizeBytes, err := units.RAMInBytes(vmConfig.ScratchSize)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse scratch size %q", vmConfig.ScratchSize)
+		}
+
+		path, err := filepath.Abs(scratchDriveName)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := createScratchDrive(ctx, path, sizeBytes); err != nil {
+			return nil, err
+		}
+
+		driveIndex := len(cfg.Drives) + 1
+		idx := strconv.Itoa(driveIndex)
+		cfg.Drives = append(cfg.Drives,
+			models.Drive{
+				DriveID:      &idx,
+				PathOnHost:   firecracker.String(path),
+				IsRootDevice: firecracker.Bool(false),
+				IsReadOnly:   firecracker.Bool(false),
+			})
+
+		s.vmMounts = append(s.vmMounts, specs.Mount{
+			Destination: vmConfig.ScratchPath,
+			Type:        supportedMountFSType,
+			Source:      guestDrivePath(driveIndex),
+			Options:     []string{"rw"},
+		})
+	}
+
+	// Reserve drives for containers which may join the VM later
+	if vmConfig.MaxContainers > 1 {
+		firstSlot := len(cfg.Drives) + 1
+		slots := vmConfig.MaxContainers - 1
+		if firstSlot+slots-1 > maxVMGroupDrives {
+			return nil, errors.Errorf("max_containers %d exceeds number of drives VM can have", vmConfig.MaxContainers)
+		}
+
+		placeholder, err := filepath.Abs(placeholderDriveName)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := createPlaceholderDrive(placeholder); err != nil {
+			return nil, err
+		}
+
+		for i := 0; i < slots; i++ {
+			idx := strconv.Itoa(firstSlot + i)
+			cfg.Drives = append(cfg.Drives,
+				models.Drive{
+					DriveID:      &idx,
+					PathOnHost:   firecracker.String(placeholder),
+					IsRootDevice: firecracker.Bool(false),
+					IsReadOnly:   firecracker.Bool(false),
+				})
+		}
+
+		s.group = newVMGroup(firstSlot, slots)
+		s.placeholderDrive = placeholder
+	}
+
+	rateLimiter, err := driveRateLimiter(vmConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	if rateLimiter != nil {
+		log.G(ctx).WithField("qos_class", vmConfig.QoSClass).Info("limiting drive rate")
+		for i := range cfg.Drives {
+			cfg.Drives[i].RateLimiter = rateLimiter
+		}
+	}
+
+	s.artifacts, err = newVMArtifacts(vmConfig, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	cmdBuilder := firecracker.VMCommandBuilder{}.
+		WithBin(vmConfig.FirecrackerBinaryPath).
+		WithSocketPath(socketPath)
+
+	// Serial console is written to firecracker's output
+	var console io.Writer = os.Stdout
+	if s.artifacts != nil {
+		for _, mnt := range request.Rootfs {
+			s.artifacts.rootfs = append(s.artifacts.rootfs, mnt.Source)
+		}
+
+		console = s.artifacts.console
+	}
+
+	ns, _ := namespaces.Namespace(ctx)
+	panicCtx := namespaces.WithNamespace(context.Background(), ns)
+	console = newPanicWatcher(console, func(trace string) { s.handleGuestPanic(panicCtx, trace) })
+	cmdBuilder = cmdBuilder.WithStdout(console).WithStderr(console)
+
+	cmd := cmdBuilder.Build(ctx)
 	machineOpts := []firecracker.Opt{
 		firecracker.WithProcessRunner(cmd),
 	}
@@ -655,11 +1081,26 @@ func (s *service) startVM(ctx context.Context, request *taskAPI.CreateTaskReques
 	}
 	s.machineCID = cid
 
+	timer.instrumentHandlers(&s.machine.Handlers)
+	timer.mark(bootPhasePrepare)
+
 	log.G(ctx).Info("starting instance")
 	if err := s.machine.Start(vmmCtx); err != nil {
 		return nil, err
 	}
 
+	timer.mark(bootPhaseInstanceStart)
+
+	if len(cpus) > 0 {
+		log.G(ctx).WithField("cpus", vmConfig.CPUAffinity).Info("pinning firecracker to CPUs")
+		if err := pinFirecracker(ctx, cmd.Process.Pid, cpus, vmConfig.CPUCount); err != nil {
+			s.stopVM()
+			return nil, err
+		}
+
+		timer.mark(bootPhaseCPUPinning)
+	}
+
 	log.G(ctx).Info("calling agent")
 	conn, err := dialVsock(ctx, cid, defaultVsockPort)
 	if err != nil {
@@ -667,19 +1108,67 @@ func (s *service) startVM(ctx context.Context, request *taskAPI.CreateTaskReques
 		return nil, err
 	}
 
+	timer.mark(bootPhaseGuestBoot)
+	s.reportBootTiming(ctx, timer.timing(request.ID))
+	log.G(ctx).Infof("VM is ready in %s", timer.total())
+
+	if len(vmConfig.PortForwards) > 0 {
+		forwardCtx, forwardCancel := context.WithCancel(context.Background())
+		if err := startPortForwards(forwardCtx, vmConfig.PortForwards, cid); err != nil {
+			forwardCancel()
+			conn.Close()
+			s.stopVM()
+			return nil, err
+		}
+
+		s.portForwardCancel = forwardCancel
+	}
+
 	log.G(ctx).Info("creating clients")
 	rpcClient := ttrpc.NewClient(conn)
 	rpcClient.OnClose(func() { conn.Close() })
 	apiClient := taskAPI.NewTaskClient(rpcClient)
+	s.agentFS = proto.NewAgentClient(rpcClient)
+
+	// All agent RPCs are multiplexed over this single connection, make sure it's not reused once VM is gone
+	go s.closeOnVMExit(ctx, rpcClient)
+
+	// Events are not essential for running containers, so don't fail if they can't be received
+	if eventsConn, err := dialVsock(ctx, cid, internal.EventsPort); err != nil {
+		log.G(ctx).WithError(err).Warn("failed to connect to agent events, guest OOM kills won't be reported")
+	} else {
+		eventsCtx := namespaces.WithNamespace(context.Background(), ns)
+		go s.forwardGuestEvents(eventsCtx, eventsConn, apiClient, vmConfig.StopOnOOM)
+	}
 
 	return apiClient, nil
 }
 
+// closeOnVMExit closes agent client once firecracker process exits, so pending and
+// future agent calls fail immediately instead of hanging on a stale vsock connection
+func (s *service) closeOnVMExit(ctx context.Context, client *ttrpc.Client) {
+	err := s.machine.Wait(context.Background())
+	log.G(ctx).WithError(err).Info("firecracker process exited, closing agent connection")
+
+	if atomic.LoadInt32(&s.vmStopping) == 0 {
+		if err == nil {
+			err = errors.New("firecracker exited unexpectedly")
+		}
+
+		s.keepFailedVMArtifacts(ctx, errors.Wrap(err, "VM crashed"))
+	}
+
+	if err := client.Close(); err != nil {
+		log.G(ctx).WithError(err).Debug("failed to close agent connection")
+	}
+}
+
 func (s *service) stopVM() error {
+	atomic.StoreInt32(&s.vmStopping, 1)
 	return s.machine.StopVMM()
 }
 
-func packBundle(path string, options *ptypes.Any) (*ptypes.Any, error) {
+func packBundle(path string, options *ptypes.Any, env []string, files []*proto.File, mounts []specs.Mount) (*ptypes.Any, error) {
 	// Add the bundle/config.json to the request so it can be recreated
 	// inside the vm:
 	// Read bundle json
@@ -688,6 +1177,11 @@ func packBundle(path string, options *ptypes.Any) (*ptypes.Any, error) {
 		return nil, err
 	}
 
+	jsonBytes, err = addSpecMounts(jsonBytes, mounts)
+	if err != nil {
+		return nil, err
+	}
+
 	var opts *ptypes.Any
 	if options != nil {
 		// Copy values of existing options over
@@ -703,6 +1197,8 @@ func packBundle(path string, options *ptypes.Any) (*ptypes.Any, error) {
 	extraData := &proto.ExtraData{
 		JsonSpec:    jsonBytes,
 		RuncOptions: opts,
+		Env:         env,
+		Files:       files,
 	}
 	return ptypes.MarshalAny(extraData)
 }
@@ -18,6 +18,9 @@ import (
 	"syscall"
 	"testing"
 
+	taskAPI "github.com/containerd/containerd/runtime/v2/task"
+	ptypes "github.com/gogo/protobuf/types"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
@@ -40,3 +43,41 @@ func TestFindNextAvailableVsockCID(t *testing.T) {
 	_, err = findNextAvailableVsockCID(ctx)
 	require.Equal(t, context.Canceled, err)
 }
+
+type execTaskService struct {
+	taskAPI.TaskService
+}
+
+func (ts *execTaskService) Exec(ctx context.Context, req *taskAPI.ExecProcessRequest) (*ptypes.Empty, error) {
+	return &ptypes.Empty{}, nil
+}
+
+func (ts *execTaskService) Delete(ctx context.Context, req *taskAPI.DeleteRequest) (*taskAPI.DeleteResponse, error) {
+	return &taskAPI.DeleteResponse{}, nil
+}
+
+func TestExecSameIDInTwoContainers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := &service{
+		ctx:         ctx,
+		agentClient: &execTaskService{},
+		execCancels: make(map[string]context.CancelFunc),
+	}
+
+	// Exec IDs are only unique per task, containers of a VM group share the shim
+	for _, id := range []string{"container-a", "container-b"} {
+		_, err := s.Exec(ctx, &taskAPI.ExecProcessRequest{ID: id, ExecID: "exec1"})
+		require.NoError(t, err)
+	}
+
+	require.Len(t, s.execCancels, 2)
+
+	_, err := s.Delete(ctx, &taskAPI.DeleteRequest{ID: "container-a", ExecID: "exec1"})
+	require.NoError(t, err)
+
+	_, ok := s.execCancels[execKey("container-b", "exec1")]
+	assert.Len(t, s.execCancels, 1)
+	assert.True(t, ok, "exec of the other container should keep proxying stdio")
+}
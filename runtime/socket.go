@@ -0,0 +1,62 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// Unix socket path can't be longer than sun_path of sockaddr_un without terminating NUL
+	maxSocketPathLen = len(unix.RawSockaddrUnix{}.Path) - 1
+
+	socketNameSuffix = ".sock"
+	// Number of hex digits of VM ID hash in socket names of long IDs
+	socketHashLen = 16
+)
+
+// firecrackerSocketPath returns path of Firecracker API socket for the VM. Unless socket directory is configured
+// the socket path from configuration is used as is. Otherwise the socket is named after VM ID, or after its
+// hash if the name wouldn't fit. The name only depends on VM ID, so teardown finds the socket of the VM.
+func firecrackerSocketPath(cfg *Config, vmID string) (string, error) {
+	path := cfg.SocketPath
+	if cfg.SocketDir != "" {
+		path = filepath.Join(cfg.SocketDir, vmID+socketNameSuffix)
+		if len(path) > maxSocketPathLen {
+			sum := sha256.Sum256([]byte(vmID))
+			path = filepath.Join(cfg.SocketDir, hex.EncodeToString(sum[:])[:socketHashLen]+socketNameSuffix)
+		}
+	}
+
+	if len(path) > maxSocketPathLen {
+		return "", errors.Errorf("firecracker socket path %q is longer than %d bytes allowed for unix sockets", path, maxSocketPathLen)
+	}
+
+	return path, nil
+}
+
+// removeSocket removes Firecracker API socket, it's not an error if it doesn't exist
+func removeSocket(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "failed to remove socket %q", path)
+	}
+
+	return nil
+}
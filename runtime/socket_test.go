@@ -0,0 +1,53 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFirecrackerSocketPath(t *testing.T) {
+	path, err := firecrackerSocketPath(&Config{SocketPath: "./firecracker.sock"}, "vm-1")
+	require.NoError(t, err)
+	assert.Equal(t, "./firecracker.sock", path)
+
+	cfg := &Config{SocketPath: "./firecracker.sock", SocketDir: "/run/firecracker"}
+
+	path, err = firecrackerSocketPath(cfg, "vm-1")
+	require.NoError(t, err)
+	assert.Equal(t, "/run/firecracker/vm-1.sock", path)
+
+	longID := strings.Repeat("a", 128)
+	path, err = firecrackerSocketPath(cfg, longID)
+	require.NoError(t, err)
+	assert.Len(t, path, len("/run/firecracker/")+socketHashLen+len(socketNameSuffix))
+
+	again, err := firecrackerSocketPath(cfg, longID)
+	require.NoError(t, err)
+	assert.Equal(t, path, again, "socket name should only depend on VM ID")
+
+	other, err := firecrackerSocketPath(cfg, strings.Repeat("b", 128))
+	require.NoError(t, err)
+	assert.NotEqual(t, path, other)
+
+	_, err = firecrackerSocketPath(&Config{SocketDir: "/" + strings.Repeat("d", 120)}, "vm-1")
+	assert.Error(t, err, "socket directory is too long for any socket name")
+
+	_, err = firecrackerSocketPath(&Config{SocketPath: "/" + longID}, "vm-1")
+	assert.Error(t, err)
+}
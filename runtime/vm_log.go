@@ -0,0 +1,102 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containerd/containerd/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	// Default Firecracker log, relative paths are created in runtime's working directory (the bundle)
+	defaultLogPath  = "firecracker.log"
+	defaultLogLevel = "Warning"
+
+	// Firecracker only logs to named pipes, these are created in the bundle and log pipe is copied to log file
+	logFifoName     = "firecracker-log.fifo"
+	metricsFifoName = "firecracker-metrics.fifo"
+)
+
+// firecrackerLogLevels maps accepted log level names (case insensitive) to ones understood by Firecracker
+var firecrackerLogLevels = map[string]string{
+	"error":   "Error",
+	"warn":    "Warning",
+	"warning": "Warning",
+	"info":    "Info",
+	"debug":   "Debug",
+}
+
+// parseLogLevel converts log level from configuration to Firecracker's one, empty level means default
+func parseLogLevel(level string) (string, error) {
+	if level == "" {
+		return defaultLogLevel, nil
+	}
+
+	value, ok := firecrackerLogLevels[strings.ToLower(level)]
+	if !ok {
+		return "", errors.Errorf("invalid log level %q, expected one of Error, Warn, Info or Debug", level)
+	}
+
+	return value, nil
+}
+
+// openVMLog opens Firecracker log file of the VM for appending, creating parent directories if needed.
+// Leftover pipes of a previous run are removed, as Firecracker SDK fails if they exist.
+func openVMLog(path string) (*os.File, error) {
+	for _, name := range []string{logFifoName, metricsFifoName} {
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			return nil, errors.Wrapf(err, "failed to remove stale pipe %q", name)
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, errors.Wrapf(err, "failed to create log directory for %q", path)
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open firecracker log %q", path)
+	}
+
+	return file, nil
+}
+
+// closeVMLog closes Firecracker log of the VM. The log is removed after VM is stopped normally,
+// otherwise it's kept to diagnose what went wrong.
+func (s *service) closeVMLog(ctx context.Context, remove bool) {
+	if s.vmLog == nil {
+		return
+	}
+
+	path := s.vmLog.Name()
+	if err := s.vmLog.Close(); err != nil {
+		log.G(ctx).WithError(err).Warnf("failed to close firecracker log %q", path)
+	}
+
+	s.vmLog = nil
+
+	if !remove {
+		log.G(ctx).Infof("keeping firecracker log at %q", path)
+		return
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		log.G(ctx).WithError(err).Warnf("failed to remove firecracker log %q", path)
+	}
+}
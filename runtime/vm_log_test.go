@@ -0,0 +1,78 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLogLevel(t *testing.T) {
+	for input, expected := range map[string]string{
+		"":        defaultLogLevel,
+		"Error":   "Error",
+		"warn":    "Warning",
+		"Warning": "Warning",
+		"INFO":    "Info",
+		"debug":   "Debug",
+	} {
+		level, err := parseLogLevel(input)
+		assert.NoError(t, err, input)
+		assert.Equal(t, expected, level, input)
+	}
+
+	_, err := parseLogLevel("trace")
+	assert.Error(t, err)
+}
+
+func TestVMLog(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "vm-log-test-")
+	require.NoError(t, err)
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "logs", "vm.log")
+
+	s := &service{}
+	s.vmLog, err = openVMLog(path)
+	require.NoError(t, err)
+
+	_, err = s.vmLog.WriteString("boot failed\n")
+	require.NoError(t, err)
+
+	s.closeVMLog(ctx, false)
+	assert.Nil(t, s.vmLog)
+
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err, "log should be kept")
+	assert.Equal(t, "boot failed\n", string(data))
+
+	s.vmLog, err = openVMLog(path)
+	require.NoError(t, err)
+
+	s.closeVMLog(ctx, true)
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err), "log should be removed")
+
+	// Nothing to do if VM didn't have a log
+	s.closeVMLog(ctx, true)
+}
@@ -0,0 +1,348 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/api/types"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/runtime/v2/shim"
+	taskAPI "github.com/containerd/containerd/runtime/v2/task"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// Container spec annotation with ID of a VM group, tasks of the same group share one VM
+	vmGroupAnnotation = "aws.firecracker.vm.group"
+
+	// Empty image attached to drive slots reserved for containers which are not created yet
+	placeholderDriveName = "placeholder.img"
+	placeholderDriveSize = 1024 * 1024
+
+	// Firecracker has no drive hotplug, so there is a limit of virtio block devices known at boot
+	maxVMGroupDrives = 24
+
+	// How long to wait for connection to shim socket of the VM group
+	shimDialTimeout = time.Second
+)
+
+// vmGroup tracks additional containers running in the same VM as the first one.
+// Firecracker can't attach drives after boot, so a slot (drive) is reserved at boot for each container
+// which may join the VM later, and container's rootfs is swapped in when it's created.
+type vmGroup struct {
+	mutex sync.Mutex
+	// Drive index (1-based, like drive IDs) of the first reserved slot
+	firstDrive int
+	// Container IDs using the slots, empty if slot is free
+	slots []string
+	// Cancels stdio proxying of containers
+	cancels map[string]context.CancelFunc
+	// Whether the first container, which VM was booted for, is not deleted yet
+	primaryActive bool
+}
+
+func newVMGroup(firstDrive, size int) *vmGroup {
+	return &vmGroup{
+		firstDrive:    firstDrive,
+		slots:         make([]string, size),
+		cancels:       make(map[string]context.CancelFunc),
+		primaryActive: true,
+	}
+}
+
+// acquire reserves a free drive slot for the container and returns drive index
+func (g *vmGroup) acquire(id string) (int, error) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	free := -1
+	for i, slot := range g.slots {
+		if slot == id {
+			return 0, errors.Errorf("container %q already exists in VM", id)
+		}
+
+		if slot == "" && free < 0 {
+			free = i
+		}
+	}
+
+	if free < 0 {
+		return 0, errors.Errorf("VM is full, all %d container slots are taken", len(g.slots))
+	}
+
+	g.slots[free] = id
+	return g.firstDrive + free, nil
+}
+
+// release frees drive slot taken by the container and returns its drive index
+func (g *vmGroup) release(id string) (int, bool) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if cancel, ok := g.cancels[id]; ok {
+		cancel()
+		delete(g.cancels, id)
+	}
+
+	for i, slot := range g.slots {
+		if slot == id {
+			g.slots[i] = ""
+			return g.firstDrive + i, true
+		}
+	}
+
+	return 0, false
+}
+
+func (g *vmGroup) setCancel(id string, cancel context.CancelFunc) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	g.cancels[id] = cancel
+}
+
+// count returns the number of additional containers in the group
+func (g *vmGroup) count() int {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	n := 0
+	for _, slot := range g.slots {
+		if slot != "" {
+			n++
+		}
+	}
+
+	return n
+}
+
+// removePrimary marks the first container of the VM as deleted
+func (g *vmGroup) removePrimary() {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	g.primaryActive = false
+}
+
+// active returns the number of containers in the VM including the first one
+func (g *vmGroup) active() int {
+	n := g.count()
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if g.primaryActive {
+		n++
+	}
+
+	return n
+}
+
+// guestDrivePath returns device path of drive inside the VM, drives are enumerated as /dev/vda, /dev/vdb, ...
+func guestDrivePath(driveIndex int) string {
+	return fmt.Sprintf("/dev/vd%c", 'a'+driveIndex-1)
+}
+
+// createPlaceholderDrive creates a small sparse file to back reserved drive slots
+func createPlaceholderDrive(path string) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return errors.Wrap(err, "failed to create placeholder drive")
+	}
+
+	defer file.Close()
+
+	return file.Truncate(placeholderDriveSize)
+}
+
+// swapDrive points drive of running VM to a new host file and makes the guest pick up the change
+func swapDrive(ctx context.Context, socketPath string, driveIndex int, pathOnHost string) error {
+	driveID := strconv.Itoa(driveIndex)
+
+	partialDrive := map[string]string{
+		"drive_id":     driveID,
+		"path_on_host": pathOnHost,
+	}
+
+	if err := firecrackerRequest(ctx, socketPath, http.MethodPatch, "/drives/"+driveID, partialDrive); err != nil {
+		return errors.Wrapf(err, "failed to update drive %s", driveID)
+	}
+
+	rescan := map[string]string{
+		"action_type": "BlockDeviceRescan",
+		"payload":     driveID,
+	}
+
+	if err := firecrackerRequest(ctx, socketPath, http.MethodPut, "/actions", rescan); err != nil {
+		return errors.Wrapf(err, "failed to rescan drive %s", driveID)
+	}
+
+	return nil
+}
+
+// firecrackerRequest sends JSON request to firecracker API socket.
+// The SDK used doesn't wrap drive updates, so this is done directly.
+func firecrackerRequest(ctx context.Context, socketPath, method, path string, body interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", socketPath)
+			},
+		},
+	}
+
+	req, err := http.NewRequest(method, "http://localhost"+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		output, _ := ioutil.ReadAll(resp.Body)
+		return errors.Errorf("firecracker returned %s: %s", resp.Status, string(output))
+	}
+
+	return nil
+}
+
+// shimSocketID returns ID to derive shim socket address from. Tasks of a VM group share one shim (and VM),
+// so the group ID is used if spec of the given bundle has one.
+func shimSocketID(id, bundle string) string {
+	annotations, err := loadSpecAnnotations(filepath.Join(bundle, "config.json"))
+	if err != nil {
+		return id
+	}
+
+	if group := annotations[vmGroupAnnotation]; group != "" {
+		return group
+	}
+
+	return id
+}
+
+// shimRunning checks whether a shim already serves the given address, like shim of the VM group started
+// for its first task. The socket is bound before shim is started, so a connect succeeds as soon as it exists.
+func shimRunning(address string) bool {
+	conn, err := shim.AnonDialer(address, shimDialTimeout)
+	if err != nil {
+		return false
+	}
+
+	conn.Close()
+	return true
+}
+
+// createGroupTask creates additional container in already running VM of a VM group
+func (s *service) createGroupTask(ctx context.Context, request *taskAPI.CreateTaskRequest) (*taskAPI.CreateTaskResponse, error) {
+	if s.group == nil {
+		return nil, errors.Errorf("VM already runs a container, set max_containers to run more than one")
+	}
+
+	if len(request.Rootfs) != 1 {
+		return nil, errors.Errorf("expected exactly one rootfs mount, got %d", len(request.Rootfs))
+	}
+
+	mnt := request.Rootfs[0]
+	if mnt.Type != supportedMountFSType {
+		return nil, errors.Errorf("unsupported mount type '%s', expected '%s'", mnt.Type, supportedMountFSType)
+	}
+
+	driveIndex, err := s.group.acquire(request.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	log.G(ctx).WithFields(logrus.Fields{"id": request.ID, "drive": driveIndex}).Info("attaching container rootfs to running VM")
+	if err := swapDrive(ctx, s.socketPath, driveIndex, mnt.Source); err != nil {
+		s.group.release(request.ID)
+		return nil, err
+	}
+
+	options, err := packCreateOptions(ctx, request, nil, s.config.InjectSourceDir)
+	if err != nil {
+		s.releaseGroupTask(ctx, request.ID)
+		return nil, err
+	}
+
+	var (
+		hostStdin  = request.Stdin
+		hostStdout = request.Stdout
+		hostStderr = request.Stderr
+		basePort   = s.allocateExecPorts()
+	)
+
+	agentRequest := *request
+	agentRequest.Options = options
+	agentRequest.Rootfs = []*types.Mount{{Type: mnt.Type, Source: guestDrivePath(driveIndex), Options: mnt.Options}}
+	agentRequest.Stdin = vsockStdioPath(hostStdin, basePort)
+	agentRequest.Stdout = vsockStdioPath(hostStdout, basePort+1)
+	agentRequest.Stderr = vsockStdioPath(hostStderr, basePort+2)
+
+	resp, err := s.agentClient.Create(ctx, &agentRequest)
+	if err != nil {
+		log.G(ctx).WithError(err).Error("create failed")
+		s.releaseGroupTask(ctx, request.ID)
+		return nil, err
+	}
+
+	ioCtx, cancel := context.WithCancel(s.ctx)
+	s.group.setCancel(request.ID, cancel)
+
+	go proxyIO(ioCtx, hostStdin, s.machineCID, basePort, true)
+	go proxyIO(ioCtx, hostStdout, s.machineCID, basePort+1, false)
+	go proxyIO(ioCtx, hostStderr, s.machineCID, basePort+2, false)
+
+	log.G(ctx).Infof("successfully created task with pid %d", resp.Pid)
+	return resp, nil
+}
+
+// releaseGroupTask detaches rootfs of additional container from VM and frees its slot
+func (s *service) releaseGroupTask(ctx context.Context, id string) {
+	driveIndex, ok := s.group.release(id)
+	if !ok {
+		return
+	}
+
+	// Make sure VM doesn't keep snapshot device open after container is gone
+	if err := swapDrive(ctx, s.socketPath, driveIndex, s.placeholderDrive); err != nil {
+		log.G(ctx).WithError(err).WithField("id", id).Error("failed to detach container rootfs")
+	}
+}
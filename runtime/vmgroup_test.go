@@ -0,0 +1,105 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/containerd/runtime/v2/shim"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVMGroupSlots(t *testing.T) {
+	group := newVMGroup(3, 2)
+
+	first, err := group.acquire("a")
+	require.NoError(t, err)
+	assert.Equal(t, 3, first)
+
+	_, err = group.acquire("a")
+	assert.Error(t, err, "container can't take two slots")
+
+	second, err := group.acquire("b")
+	require.NoError(t, err)
+	assert.Equal(t, 4, second)
+
+	_, err = group.acquire("c")
+	assert.Error(t, err, "all slots are taken")
+	assert.Equal(t, 2, group.count())
+	assert.Equal(t, 3, group.active())
+
+	driveIndex, ok := group.release("a")
+	assert.True(t, ok)
+	assert.Equal(t, 3, driveIndex)
+
+	_, ok = group.release("a")
+	assert.False(t, ok)
+
+	reused, err := group.acquire("c")
+	require.NoError(t, err)
+	assert.Equal(t, 3, reused)
+
+	group.removePrimary()
+	assert.Equal(t, 2, group.active())
+}
+
+func TestVMGroupReleaseCancels(t *testing.T) {
+	group := newVMGroup(2, 1)
+
+	_, err := group.acquire("a")
+	require.NoError(t, err)
+
+	canceled := false
+	group.setCancel("a", func() { canceled = true })
+
+	group.release("a")
+	assert.True(t, canceled)
+}
+
+func TestGuestDrivePath(t *testing.T) {
+	assert.Equal(t, "/dev/vda", guestDrivePath(1))
+	assert.Equal(t, "/dev/vdc", guestDrivePath(3))
+}
+
+func TestShimSocketID(t *testing.T) {
+	bundle, err := ioutil.TempDir("", "bundle-")
+	require.NoError(t, err)
+	defer os.RemoveAll(bundle)
+
+	assert.Equal(t, "task-1", shimSocketID("task-1", bundle), "bundle without spec")
+
+	spec := `{"annotations": {"` + vmGroupAnnotation + `": "group-1"}}`
+	err = ioutil.WriteFile(filepath.Join(bundle, "config.json"), []byte(spec), 0600)
+	require.NoError(t, err)
+
+	assert.Equal(t, "group-1", shimSocketID("task-1", bundle))
+}
+
+func TestShimRunning(t *testing.T) {
+	address := fmt.Sprintf("firecracker-containerd-test/%d/shim.sock", os.Getpid())
+	assert.False(t, shimRunning(address))
+
+	socket, err := shim.NewSocket(address)
+	require.NoError(t, err)
+
+	assert.True(t, shimRunning(address), "bound socket accepts connections before shim serves it")
+
+	socket.Close()
+	assert.False(t, shimRunning(address))
+}
@@ -30,8 +30,15 @@ const (
 )
 
 func main() {
-	var configPath string
+	var (
+		configPath        string
+		containerdAddress string
+		containerdBinary  string
+	)
+
 	flag.StringVar(&configPath, "config", "", "Path to devmapper configuration file")
+	flag.StringVar(&containerdAddress, "containerd-address", "", "Address of containerd to publish pool events to, events aren't published if empty")
+	flag.StringVar(&containerdBinary, "containerd-binary", "containerd", "Path to containerd binary used to publish events")
 
 	snapshotter.Run(func(ctx context.Context) (snapshots.Snapshotter, error) {
 		// Flags parsing happens inside Run, so we can't make this checks earlier.
@@ -43,6 +50,11 @@ func main() {
 			configPath = defaultConfigPath
 		}
 
-		return devmapper.NewSnapshotter(ctx, configPath)
+		var opts []devmapper.Opt
+		if containerdAddress != "" {
+			opts = append(opts, devmapper.WithEventPublisher(snapshotter.NewRemotePublisher(containerdAddress, containerdBinary)))
+		}
+
+		return devmapper.NewSnapshotter(ctx, configPath, opts...)
 	})
 }
@@ -14,8 +14,14 @@
 package devmapper
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
 
 	"github.com/docker/go-units"
 	"github.com/hashicorp/go-multierror"
@@ -30,6 +36,36 @@ const (
 	dataBlockMaxSize = 2097152
 )
 
+const (
+	// Default directory of device-mapper nodes
+	defaultDeviceDir = "/dev/mapper"
+
+	// Default filesystem of fresh thin devices
+	defaultFilesystemType = "ext4"
+
+	// Default mkfs.ext4 arguments, we don't want any zeroing in advance when running mkfs on thin devices (see "man mkfs.ext4")
+	defaultMkfsOptions = "-E nodiscard,lazy_itable_init=0,lazy_journal_init=0 {{.DevicePath}}"
+
+	// Default mkfs.xfs arguments, -K skips discarding blocks for the same reason (see "man mkfs.xfs")
+	defaultXfsMkfsOptions = "-K {{.DevicePath}}"
+)
+
+// Supported udev synchronization modes
+const (
+	// UdevSyncAuto lets dmsetup wait for udev to process device events (default)
+	UdevSyncAuto = "auto"
+	// UdevSyncDisabled bypasses udev synchronization, useful on hosts without udevd running
+	UdevSyncDisabled = "disabled"
+)
+
+// Supported handling of devices exceeding max_device_size_ratio
+const (
+	// DeviceSizeCheckWarn logs a warning and creates the device (default)
+	DeviceSizeCheckWarn = "warn"
+	// DeviceSizeCheckError fails creating the device with ErrDeviceTooLarge
+	DeviceSizeCheckError = "error"
+)
+
 var (
 	errInvalidBlockSize      = errors.Errorf("block size should be between %d and %d", dataBlockMinSize, dataBlockMaxSize)
 	errInvalidBlockAlignment = errors.Errorf("block size should be multiple of %d sectors", dataBlockMinSize)
@@ -50,6 +86,14 @@ type Config struct {
 	// Path to metadata volume to be used by thin-pool
 	MetadataDevice string `json:"meta_device"`
 
+	// Sizes of sparse data and metadata files (like "100GB" and "1GB") allocated under root directory and attached
+	// as loop devices to back the pool, instead of data_device and meta_device. Files are grown if sizes are raised,
+	// but never shrunk. The pool is removed and loop devices are detached on shutdown, files are kept.
+	LoopbackDataSize          string `json:"loopback_data_size"`
+	LoopbackDataSizeBytes     uint64 `json:"-"`
+	LoopbackMetadataSize      string `json:"loopback_meta_size"`
+	LoopbackMetadataSizeBytes uint64 `json:"-"`
+
 	// The size of allocation chunks in data file.
 	// Must be between 128 sectors (64KB) and 2097152 sectors (1GB) and a multiple of 128 sectors (64KB)
 	// Block size can't be changed after pool created.
@@ -60,6 +104,97 @@ type Config struct {
 	// Defines how much space to allocate when creating base image for container
 	BaseImageSize      string `json:"base_image_size"`
 	BaseImageSizeBytes uint64 `json:"-"`
+
+	// Filesystem created on fresh thin devices and mounted from snapshots, "ext4" (default) or "xfs".
+	// Snapshots keep the filesystem of their parent, so it shouldn't be changed for a pool with snapshots.
+	FilesystemType string `json:"fs_type"`
+
+	// Template of mkfs arguments used when creating a filesystem on a fresh thin device.
+	// The template may refer to {{.DevicePath}} and {{.SizeBytes}} of the device being formatted,
+	// for example "-i 8192 -L rootfs {{.DevicePath}}". Device path must be passed exactly once.
+	// Defaults depend on fs_type and skip discarding blocks of the fresh device.
+	MkfsOptions         string             `json:"mkfs_options"`
+	MkfsOptionsTemplate *template.Template `json:"-"`
+
+	// Defines whether device-mapper operations should wait for udev to settle ("auto", default) or bypass it ("disabled")
+	UdevSyncMode string `json:"udev_sync_mode"`
+
+	// Free data space of the pool (like "2GB") at which kernel raises a dm event, so WaitPoolEvent and
+	// auto extend can react before the pool is full. Rounded down to whole data blocks, 32768 blocks by default.
+	LowWaterMark       string `json:"low_water_mark"`
+	LowWaterMarkBlocks uint64 `json:"-"`
+
+	// Additional thin-pool features to enable (like "error_if_no_space"), appended to "skip_block_zeroing".
+	// Supported features depend on the kernel, see thin-provisioning.txt for the list.
+	ExtraFeatures []string `json:"extra_features"`
+
+	// Limits the sum of virtual sizes of all thin devices to this multiple of data volume size
+	// (like 2.5 for 250%), creating new devices fails with ErrOverProvisioned beyond it.
+	// Zero (default) doesn't limit over-provisioning.
+	OverProvisioningRatio float64 `json:"over_provisioning_ratio"`
+
+	// Virtual size of a single device, as a multiple of data volume size (like 10 for 1000%), above which
+	// creating the device logs a warning, or fails with ErrDeviceTooLarge if device_size_check is "error".
+	// Thin devices are meant to be over-provisioned, so it's a guard against mistyped sizes rather than a cap.
+	// Zero (default) disables the check.
+	MaxDeviceSizeRatio float64 `json:"max_device_size_ratio"`
+
+	// How devices larger than max_device_size_ratio are handled, "warn" (default) or "error"
+	DeviceSizeCheck string `json:"device_size_check"`
+
+	// Limits the number of thin devices and snapshots in the pool, creating more fails with ErrPoolAtCapacity.
+	// Zero (default) doesn't limit it beyond 24-bit device ID space.
+	MaxDevices int `json:"max_devices"`
+
+	// Directory with device-mapper device nodes, "/dev/mapper" by default.
+	// Useful when running inside a chroot (like jailer) with device nodes in a different location.
+	DeviceDir string `json:"device_dir"`
+
+	// How many times removal of a busy device is retried, 3 by default. Negative value disables retries.
+	// Activation failed while udev is busy with device nodes is retried the same way.
+	RemoveRetries int `json:"remove_retries"`
+
+	// Delay before the first retry of busy device removal ("500ms" by default).
+	// Each next delay is doubled (up to 30s) and randomized, so concurrent removals don't retry in lockstep.
+	RemoveRetryDelay         string        `json:"remove_retry_delay"`
+	RemoveRetryDelayDuration time.Duration `json:"-"`
+
+	// Limits total time spent retrying removal of a single device (like "10s"), not limited by default
+	RemoveRetryTimeout         string        `json:"remove_retry_timeout"`
+	RemoveRetryTimeoutDuration time.Duration `json:"-"`
+
+	// How often pool usage is sampled in the background (like "30s"), disabled by default.
+	// Thresholds below are checked against the latest sample, so they need the monitor enabled.
+	PoolMonitorInterval         string        `json:"pool_monitor_interval"`
+	PoolMonitorIntervalDuration time.Duration `json:"-"`
+
+	// Data or metadata usage percentage (like 80) at which a warning is logged and PoolSpace event is published,
+	// zero disables it
+	LowSpaceThreshold float64 `json:"low_space_threshold"`
+
+	// Data or metadata usage percentage (like 95) at which Prepare is refused with "unavailable" error,
+	// zero disables it. Views and snapshots being removed are not affected.
+	RefusePrepareThreshold float64 `json:"refuse_prepare_threshold"`
+
+	// Data usage percentage at which the data volume is grown by auto_extend_size (like "10GB").
+	// Only data volumes on loop devices can be extended, the image file is grown and the pool reloaded.
+	AutoExtendThreshold float64 `json:"auto_extend_threshold"`
+	AutoExtendSize      string  `json:"auto_extend_size"`
+	AutoExtendSizeBytes uint64  `json:"-"`
+
+	// Mounts active snapshots with "discard" option, so blocks freed by deleted files go back to the pool right away.
+	// Online discard slows down deletes, fstrim_interval returns the space in batches instead.
+	MountDiscard bool `json:"mount_discard"`
+
+	// How often fstrim is run on filesystems of active snapshots mounted on the host (like "1h"), disabled by default
+	FstrimInterval         string        `json:"fstrim_interval"`
+	FstrimIntervalDuration time.Duration `json:"-"`
+}
+
+// mkfsParams represents values available for substitution in mkfs options template
+type mkfsParams struct {
+	DevicePath string
+	SizeBytes  uint64
 }
 
 // LoadConfig reads devmapper configuration file JSON format from disk
@@ -94,15 +229,134 @@ func (c *Config) parse() error {
 		c.DataBlockSizeSectors = uint32(blockSize / dmsetup.SectorSize)
 	}
 
+	if c.LowWaterMark != "" {
+		if lowWaterMark, err := units.RAMInBytes(c.LowWaterMark); err != nil {
+			result = multierror.Append(result, errors.Wrapf(err, "failed to parse low water mark: %q", c.LowWaterMark))
+		} else if lowWaterMark <= 0 {
+			result = multierror.Append(result, errors.Errorf("low water mark must be positive: %q", c.LowWaterMark))
+		} else if c.DataBlockSizeSectors > 0 {
+			c.LowWaterMarkBlocks = uint64(lowWaterMark) / (uint64(c.DataBlockSizeSectors) * dmsetup.SectorSize)
+		}
+	}
+
 	if baseImageSize, err := units.RAMInBytes(c.BaseImageSize); err != nil {
 		result = multierror.Append(result, errors.Wrapf(err, "failed to parse base image size: %q", c.BaseImageSize))
 	} else {
 		c.BaseImageSizeBytes = uint64(baseImageSize)
 	}
 
+	sizes := []struct {
+		value  string
+		result *uint64
+		name   string
+	}{
+		{c.LoopbackDataSize, &c.LoopbackDataSizeBytes, "loopback_data_size"},
+		{c.LoopbackMetadataSize, &c.LoopbackMetadataSizeBytes, "loopback_meta_size"},
+	}
+
+	for _, size := range sizes {
+		if size.value == "" {
+			continue
+		}
+
+		if bytes, err := units.RAMInBytes(size.value); err != nil {
+			result = multierror.Append(result, errors.Wrapf(err, "failed to parse %s: %q", size.name, size.value))
+		} else if bytes <= 0 {
+			result = multierror.Append(result, errors.Errorf("%s must be positive: %q", size.name, size.value))
+		} else {
+			*size.result = uint64(bytes)
+		}
+	}
+
+	if c.AutoExtendSize != "" {
+		if size, err := units.RAMInBytes(c.AutoExtendSize); err != nil {
+			result = multierror.Append(result, errors.Wrapf(err, "failed to parse auto extend size: %q", c.AutoExtendSize))
+		} else if size <= 0 {
+			result = multierror.Append(result, errors.Errorf("auto extend size must be positive: %q", c.AutoExtendSize))
+		} else {
+			c.AutoExtendSizeBytes = uint64(size)
+		}
+	}
+
+	if c.UdevSyncMode == "" {
+		c.UdevSyncMode = UdevSyncAuto
+	}
+
+	if c.DeviceSizeCheck == "" {
+		c.DeviceSizeCheck = DeviceSizeCheckWarn
+	}
+
+	if c.DeviceDir == "" {
+		c.DeviceDir = defaultDeviceDir
+	}
+
+	if c.FilesystemType == "" {
+		c.FilesystemType = defaultFilesystemType
+	}
+
+	if c.MkfsOptions == "" {
+		if c.FilesystemType == "xfs" {
+			c.MkfsOptions = defaultXfsMkfsOptions
+		} else {
+			c.MkfsOptions = defaultMkfsOptions
+		}
+	}
+
+	durations := []struct {
+		value  string
+		result *time.Duration
+		name   string
+	}{
+		{c.RemoveRetryDelay, &c.RemoveRetryDelayDuration, "remove_retry_delay"},
+		{c.RemoveRetryTimeout, &c.RemoveRetryTimeoutDuration, "remove_retry_timeout"},
+		{c.PoolMonitorInterval, &c.PoolMonitorIntervalDuration, "pool_monitor_interval"},
+		{c.FstrimInterval, &c.FstrimIntervalDuration, "fstrim_interval"},
+	}
+
+	for _, d := range durations {
+		if d.value == "" {
+			continue
+		}
+
+		if duration, err := time.ParseDuration(d.value); err != nil {
+			result = multierror.Append(result, errors.Wrapf(err, "failed to parse %s: %q", d.name, d.value))
+		} else {
+			*d.result = duration
+		}
+	}
+
+	if tmpl, err := template.New("mkfs").Option("missingkey=error").Parse(c.MkfsOptions); err != nil {
+		result = multierror.Append(result, errors.Wrapf(err, "failed to parse mkfs options: %q", c.MkfsOptions))
+	} else {
+		c.MkfsOptionsTemplate = tmpl
+	}
+
 	return result.ErrorOrNil()
 }
 
+// mkfsArgs substitutes device parameters into mkfs options template and validates the resulting command line
+func (c *Config) mkfsArgs(devicePath string, sizeBytes uint64) ([]string, error) {
+	var buf bytes.Buffer
+	if err := c.MkfsOptionsTemplate.Execute(&buf, mkfsParams{DevicePath: devicePath, SizeBytes: sizeBytes}); err != nil {
+		return nil, errors.Wrapf(err, "failed to execute mkfs options template: %q", c.MkfsOptions)
+	}
+
+	args := strings.Fields(buf.String())
+
+	count := 0
+	for _, arg := range args {
+		if arg == devicePath {
+			count++
+		}
+	}
+
+	if count != 1 {
+		return nil, errors.Errorf("mkfs options must refer to device path exactly once: %q", c.MkfsOptions)
+	}
+
+	return args, nil
+}
+
 func (c *Config) validate() error {
 	var result *multierror.Error
 
@@ -112,8 +366,13 @@ func (c *Config) validate() error {
 	}{
 		{c.PoolName, "pool_name"},
 		{c.RootPath, "root_path"},
-		{c.DataDevice, "data_device"},
-		{c.MetadataDevice, "meta_device"},
+	}
+
+	// Devices of loopback backed pool are known once loop devices are attached
+	if !c.usesLoopback() {
+		strChecks = append(strChecks,
+			struct{ field, name string }{c.DataDevice, "data_device"},
+			struct{ field, name string }{c.MetadataDevice, "meta_device"})
 	}
 
 	for _, check := range strChecks {
@@ -122,13 +381,198 @@ func (c *Config) validate() error {
 		}
 	}
 
-	if c.DataBlockSizeSectors < dataBlockMinSize || c.DataBlockSizeSectors > dataBlockMaxSize {
+	if c.usesLoopback() {
+		if c.LoopbackDataSize == "" || c.LoopbackMetadataSize == "" {
+			result = multierror.Append(result, errors.New("loopback_data_size and loopback_meta_size must be set together"))
+		}
+
+		if c.DataDevice != "" || c.MetadataDevice != "" {
+			result = multierror.Append(result, errors.New("data_device and meta_device can't be set with loopback sizes"))
+		}
+	}
+
+	if err := validateDataBlockSize(c.DataBlockSizeSectors); err != nil {
+		result = multierror.Append(result, err)
+	}
+
+	if c.LowWaterMark != "" && c.LowWaterMarkBlocks == 0 {
+		result = multierror.Append(result, errors.Errorf("low_water_mark %q is smaller than data block", c.LowWaterMark))
+	}
+
+	if c.UdevSyncMode != "" && c.UdevSyncMode != UdevSyncAuto && c.UdevSyncMode != UdevSyncDisabled {
+		result = multierror.Append(result, errors.Errorf("invalid udev_sync_mode %q, expected %q or %q",
+			c.UdevSyncMode, UdevSyncAuto, UdevSyncDisabled))
+	}
+
+	if c.DeviceDir != "" && !filepath.IsAbs(c.DeviceDir) {
+		result = multierror.Append(result, errors.Errorf("device_dir must be an absolute path: %q", c.DeviceDir))
+	}
+
+	if c.OverProvisioningRatio < 0 {
+		result = multierror.Append(result, errors.Errorf("over_provisioning_ratio can't be negative: %g", c.OverProvisioningRatio))
+	}
+
+	if c.MaxDeviceSizeRatio < 0 {
+		result = multierror.Append(result, errors.Errorf("max_device_size_ratio can't be negative: %g", c.MaxDeviceSizeRatio))
+	}
+
+	if c.DeviceSizeCheck != "" && c.DeviceSizeCheck != DeviceSizeCheckWarn && c.DeviceSizeCheck != DeviceSizeCheckError {
+		result = multierror.Append(result, errors.Errorf("invalid device_size_check %q, expected %q or %q",
+			c.DeviceSizeCheck, DeviceSizeCheckWarn, DeviceSizeCheckError))
+	}
+
+	if c.MaxDevices < 0 {
+		result = multierror.Append(result, errors.Errorf("max_devices can't be negative: %d", c.MaxDevices))
+	}
+
+	if c.RemoveRetryDelayDuration < 0 {
+		result = multierror.Append(result, errors.Errorf("remove_retry_delay can't be negative: %s", c.RemoveRetryDelayDuration))
+	}
+
+	if c.RemoveRetryTimeoutDuration < 0 {
+		result = multierror.Append(result, errors.Errorf("remove_retry_timeout can't be negative: %s", c.RemoveRetryTimeoutDuration))
+	}
+
+	if c.PoolMonitorIntervalDuration < 0 {
+		result = multierror.Append(result, errors.Errorf("pool_monitor_interval can't be negative: %s", c.PoolMonitorIntervalDuration))
+	}
+
+	if c.FstrimIntervalDuration < 0 {
+		result = multierror.Append(result, errors.Errorf("fstrim_interval can't be negative: %s", c.FstrimIntervalDuration))
+	}
+
+	thresholds := []struct {
+		value float64
+		name  string
+	}{
+		{c.LowSpaceThreshold, "low_space_threshold"},
+		{c.RefusePrepareThreshold, "refuse_prepare_threshold"},
+		{c.AutoExtendThreshold, "auto_extend_threshold"},
+	}
+
+	for _, threshold := range thresholds {
+		if threshold.value < 0 || threshold.value > 100 {
+			result = multierror.Append(result, errors.Errorf("%s must be in [0, 100] range: %g", threshold.name, threshold.value))
+		} else if threshold.value > 0 && c.PoolMonitorIntervalDuration == 0 {
+			result = multierror.Append(result, errors.Errorf("%s requires pool_monitor_interval", threshold.name))
+		}
+	}
+
+	if (c.AutoExtendThreshold > 0) != (c.AutoExtendSize != "") {
+		result = multierror.Append(result, errors.New("auto_extend_threshold and auto_extend_size must be set together"))
+	}
+
+	for _, feature := range c.ExtraFeatures {
+		if !dmsetup.IsThinPoolFeature(feature) {
+			result = multierror.Append(result, errors.Errorf("unknown thin-pool feature %q in extra_features", feature))
+		}
+	}
+
+	if _, ok := mkfsTools[c.FilesystemType]; c.FilesystemType != "" && !ok {
+		result = multierror.Append(result, errors.Errorf("invalid fs_type %q, expected \"ext4\" or \"xfs\"", c.FilesystemType))
+	}
+
+	if c.MkfsOptionsTemplate != nil {
+		if _, err := c.mkfsArgs(dmsetup.GetFullDevicePath("validate"), c.BaseImageSizeBytes); err != nil {
+			result = multierror.Append(result, err)
+		}
+	}
+
+	return result.ErrorOrNil()
+}
+
+// usesLoopback tells whether the pool is backed by loop devices the snapshotter attaches itself
+func (c *Config) usesLoopback() bool {
+	return c.LoopbackDataSize != "" || c.LoopbackMetadataSize != ""
+}
+
+// validateDataBlockSize checks that block size is within the range supported by dm-thin and is aligned
+func validateDataBlockSize(sectors uint32) error {
+	var result *multierror.Error
+
+	if sectors < dataBlockMinSize || sectors > dataBlockMaxSize {
 		result = multierror.Append(result, errInvalidBlockSize)
 	}
 
-	if c.DataBlockSizeSectors%dataBlockMinSize != 0 {
+	if sectors%dataBlockMinSize != 0 {
 		result = multierror.Append(result, errInvalidBlockAlignment)
 	}
 
 	return result.ErrorOrNil()
 }
+
+// reloadDiff compares configuration with the next one loaded from the same file. It returns descriptions of
+// changes that can be applied to running snapshotter and fails if fields requiring restart are changed
+func (c *Config) reloadDiff(next *Config) ([]string, error) {
+	var result *multierror.Error
+
+	fixedChecks := []struct {
+		field   string
+		current interface{}
+		next    interface{}
+	}{
+		{"root_path", c.RootPath, next.RootPath},
+		{"pool_name", c.PoolName, next.PoolName},
+		{"data_device", c.DataDevice, next.DataDevice},
+		{"meta_device", c.MetadataDevice, next.MetadataDevice},
+		{"loopback_data_size", c.LoopbackDataSizeBytes, next.LoopbackDataSizeBytes},
+		{"loopback_meta_size", c.LoopbackMetadataSizeBytes, next.LoopbackMetadataSizeBytes},
+		{"data_block_size", c.DataBlockSizeSectors, next.DataBlockSizeSectors},
+		{"low_water_mark", c.LowWaterMarkBlocks, next.LowWaterMarkBlocks},
+		{"base_image_size", c.BaseImageSizeBytes, next.BaseImageSizeBytes},
+		{"fs_type", c.FilesystemType, next.FilesystemType},
+		{"udev_sync_mode", c.UdevSyncMode, next.UdevSyncMode},
+		{"extra_features", strings.Join(c.ExtraFeatures, " "), strings.Join(next.ExtraFeatures, " ")},
+		{"device_dir", c.DeviceDir, next.DeviceDir},
+		{"max_devices", c.MaxDevices, next.MaxDevices},
+		{"max_device_size_ratio", c.MaxDeviceSizeRatio, next.MaxDeviceSizeRatio},
+		{"device_size_check", c.DeviceSizeCheck, next.DeviceSizeCheck},
+		{"pool_monitor_interval", c.PoolMonitorIntervalDuration, next.PoolMonitorIntervalDuration},
+		{"auto_extend_threshold", c.AutoExtendThreshold, next.AutoExtendThreshold},
+		{"auto_extend_size", c.AutoExtendSizeBytes, next.AutoExtendSizeBytes},
+		{"fstrim_interval", c.FstrimIntervalDuration, next.FstrimIntervalDuration},
+	}
+
+	for _, check := range fixedChecks {
+		if check.current != check.next {
+			result = multierror.Append(result, errors.Errorf("%s can't be changed without restart (%v -> %v)",
+				check.field, check.current, check.next))
+		}
+	}
+
+	var changes []string
+
+	if c.MkfsOptions != next.MkfsOptions {
+		changes = append(changes, fmt.Sprintf("mkfs_options: %q -> %q", c.MkfsOptions, next.MkfsOptions))
+	}
+
+	if c.OverProvisioningRatio != next.OverProvisioningRatio {
+		changes = append(changes, fmt.Sprintf("over_provisioning_ratio: %g -> %g", c.OverProvisioningRatio, next.OverProvisioningRatio))
+	}
+
+	if c.RefusePrepareThreshold != next.RefusePrepareThreshold {
+		changes = append(changes, fmt.Sprintf("refuse_prepare_threshold: %g -> %g", c.RefusePrepareThreshold, next.RefusePrepareThreshold))
+	}
+
+	if c.LowSpaceThreshold != next.LowSpaceThreshold {
+		changes = append(changes, fmt.Sprintf("low_space_threshold: %g -> %g", c.LowSpaceThreshold, next.LowSpaceThreshold))
+	}
+
+	if c.MountDiscard != next.MountDiscard {
+		changes = append(changes, fmt.Sprintf("mount_discard: %t -> %t", c.MountDiscard, next.MountDiscard))
+	}
+
+	if c.RemoveRetries != next.RemoveRetries {
+		changes = append(changes, fmt.Sprintf("remove_retries: %d -> %d", c.RemoveRetries, next.RemoveRetries))
+	}
+
+	if c.RemoveRetryDelayDuration != next.RemoveRetryDelayDuration {
+		changes = append(changes, fmt.Sprintf("remove_retry_delay: %s -> %s", c.RemoveRetryDelayDuration, next.RemoveRetryDelayDuration))
+	}
+
+	if c.RemoveRetryTimeoutDuration != next.RemoveRetryTimeoutDuration {
+		changes = append(changes, fmt.Sprintf("remove_retry_timeout: %s -> %s", c.RemoveRetryTimeoutDuration, next.RemoveRetryTimeoutDuration))
+	}
+
+	return changes, result.ErrorOrNil()
+}
@@ -19,6 +19,7 @@ import (
 	"os"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/hashicorp/go-multierror"
 	"github.com/stretchr/testify/assert"
@@ -106,3 +107,430 @@ func TestFieldValidation(t *testing.T) {
 	assert.Equal(t, multErr.Errors[4], errInvalidBlockSize)
 	assert.Equal(t, multErr.Errors[5], errInvalidBlockAlignment)
 }
+
+func TestValidateDataBlockSize(t *testing.T) {
+	for _, sectors := range []uint32{128, 256, 2097024, 2097152} {
+		assert.NoError(t, validateDataBlockSize(sectors), "%d sectors", sectors)
+	}
+
+	for _, sectors := range []uint32{0, 127, 2097152 + 128} {
+		err := validateDataBlockSize(sectors)
+		require.Error(t, err)
+		assert.Contains(t, err.(*multierror.Error).Errors, errInvalidBlockSize, "%d sectors is out of range", sectors)
+	}
+
+	for _, sectors := range []uint32{129, 192, 2097151} {
+		err := validateDataBlockSize(sectors)
+		require.Error(t, err)
+		assert.Contains(t, err.(*multierror.Error).Errors, errInvalidBlockAlignment, "%d sectors isn't aligned", sectors)
+	}
+}
+
+func TestMkfsOptions(t *testing.T) {
+	config := Config{
+		DataBlockSize: "64Kb",
+		BaseImageSize: "16Mb",
+		MkfsOptions:   "-i 8192 -L size-{{.SizeBytes}} {{.DevicePath}}",
+	}
+
+	err := config.parse()
+	require.NoError(t, err)
+
+	args, err := config.mkfsArgs("/dev/mapper/test", 1024)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"-i", "8192", "-L", "size-1024", "/dev/mapper/test"}, args)
+}
+
+func TestMkfsOptionsDefault(t *testing.T) {
+	config := Config{
+		DataBlockSize: "64Kb",
+		BaseImageSize: "16Mb",
+	}
+
+	err := config.parse()
+	require.NoError(t, err)
+
+	args, err := config.mkfsArgs("/dev/mapper/test", 1024)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"-E", "nodiscard,lazy_itable_init=0,lazy_journal_init=0", "/dev/mapper/test"}, args)
+}
+
+func TestMkfsOptionsInvalid(t *testing.T) {
+	for _, options := range []string{
+		"-L test",
+		"{{.DevicePath}} {{.DevicePath}}",
+		"{{.Unknown}} {{.DevicePath}}",
+	} {
+		config := Config{DataBlockSize: "64Kb", BaseImageSize: "16Mb", MkfsOptions: options}
+
+		err := config.parse()
+		require.NoError(t, err)
+
+		_, err = config.mkfsArgs("/dev/mapper/test", 1024)
+		assert.Errorf(t, err, "mkfs options %q should be rejected", options)
+	}
+
+	config := Config{DataBlockSize: "64Kb", BaseImageSize: "16Mb", MkfsOptions: "{{.DevicePath"}
+	err := config.parse()
+	assert.Error(t, err)
+}
+
+func TestFilesystemType(t *testing.T) {
+	config := Config{DataBlockSize: "64Kb", BaseImageSize: "16Mb"}
+	err := config.parse()
+	require.NoError(t, err)
+	assert.Equal(t, "ext4", config.FilesystemType)
+
+	config = Config{DataBlockSize: "64Kb", BaseImageSize: "16Mb", FilesystemType: "xfs"}
+	err = config.parse()
+	require.NoError(t, err)
+
+	args, err := config.mkfsArgs("/dev/mapper/test", 1024)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"-K", "/dev/mapper/test"}, args, "xfs should get its own default options")
+
+	config = Config{
+		PoolName:             "test",
+		RootPath:             "/tmp",
+		DataDevice:           "/dev/loop0",
+		MetadataDevice:       "/dev/loop1",
+		DataBlockSizeSectors: 128,
+		FilesystemType:       "btrfs",
+	}
+
+	err = config.validate()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `invalid fs_type "btrfs"`)
+}
+
+func TestRemoveRetryConfig(t *testing.T) {
+	config := Config{DataBlockSize: "64Kb", BaseImageSize: "16Mb", RemoveRetryDelay: "250ms", RemoveRetryTimeout: "10s"}
+	err := config.parse()
+	require.NoError(t, err)
+	assert.Equal(t, 250*time.Millisecond, config.RemoveRetryDelayDuration)
+	assert.Equal(t, 10*time.Second, config.RemoveRetryTimeoutDuration)
+
+	config = Config{DataBlockSize: "64Kb", BaseImageSize: "16Mb", RemoveRetryDelay: "soon"}
+	err = config.parse()
+	assert.Error(t, err)
+
+	config = Config{
+		PoolName:                   "test",
+		RootPath:                   "/tmp",
+		DataDevice:                 "/dev/loop0",
+		MetadataDevice:             "/dev/loop1",
+		DataBlockSizeSectors:       128,
+		RemoveRetryTimeoutDuration: -time.Second,
+	}
+
+	err = config.validate()
+	assert.Error(t, err)
+}
+
+func TestLowWaterMark(t *testing.T) {
+	config := Config{DataBlockSize: "64Kb", BaseImageSize: "16Mb"}
+	err := config.parse()
+	require.NoError(t, err)
+	assert.Zero(t, config.LowWaterMarkBlocks, "default is picked by dmsetup")
+
+	config = Config{DataBlockSize: "128Kb", BaseImageSize: "16Mb", LowWaterMark: "1Gb"}
+	err = config.parse()
+	require.NoError(t, err)
+	assert.EqualValues(t, 8192, config.LowWaterMarkBlocks)
+
+	config = Config{DataBlockSize: "64Kb", BaseImageSize: "16Mb", LowWaterMark: "0"}
+	err = config.parse()
+	assert.Error(t, err)
+
+	config = Config{
+		PoolName:             "test",
+		RootPath:             "/tmp",
+		DataDevice:           "/dev/loop0",
+		MetadataDevice:       "/dev/loop1",
+		DataBlockSize:        "64Kb",
+		BaseImageSize:        "16Mb",
+		LowWaterMark:         "32Kb",
+		DataBlockSizeSectors: 128,
+	}
+
+	err = config.parse()
+	require.NoError(t, err)
+
+	err = config.validate()
+	assert.Error(t, err, "low water mark smaller than a block")
+}
+
+func TestMaxDevices(t *testing.T) {
+	config := Config{
+		PoolName:             "test",
+		RootPath:             "/tmp",
+		DataDevice:           "/dev/loop0",
+		MetadataDevice:       "/dev/loop1",
+		DataBlockSizeSectors: 128,
+		MaxDevices:           100,
+	}
+
+	err := config.validate()
+	assert.NoError(t, err)
+
+	config.MaxDevices = -1
+	err = config.validate()
+	assert.Error(t, err)
+}
+
+func TestUdevSyncMode(t *testing.T) {
+	config := Config{DataBlockSize: "64Kb", BaseImageSize: "16Mb"}
+	err := config.parse()
+	require.NoError(t, err)
+	assert.Equal(t, UdevSyncAuto, config.UdevSyncMode)
+
+	config = Config{
+		PoolName:             "test",
+		RootPath:             "/tmp",
+		DataDevice:           "/dev/loop0",
+		MetadataDevice:       "/dev/loop1",
+		DataBlockSizeSectors: 128,
+		UdevSyncMode:         UdevSyncDisabled,
+	}
+
+	err = config.validate()
+	assert.NoError(t, err)
+
+	config.UdevSyncMode = "always"
+	err = config.validate()
+	assert.Error(t, err)
+}
+
+func TestExtraFeatures(t *testing.T) {
+	config := Config{
+		PoolName:             "test",
+		RootPath:             "/tmp",
+		DataDevice:           "/dev/loop0",
+		MetadataDevice:       "/dev/loop1",
+		DataBlockSizeSectors: 128,
+		ExtraFeatures:        []string{"error_if_no_space", "no_discard_passdown"},
+	}
+
+	err := config.validate()
+	assert.NoError(t, err)
+
+	config.ExtraFeatures = append(config.ExtraFeatures, "queue_if_no_space")
+	err = config.validate()
+	assert.Error(t, err)
+}
+
+func TestDeviceSizeCheck(t *testing.T) {
+	config := Config{DataBlockSize: "64Kb", BaseImageSize: "16Mb"}
+	err := config.parse()
+	require.NoError(t, err)
+	assert.Equal(t, DeviceSizeCheckWarn, config.DeviceSizeCheck)
+
+	config = Config{
+		PoolName:             "test",
+		RootPath:             "/tmp",
+		DataDevice:           "/dev/loop0",
+		MetadataDevice:       "/dev/loop1",
+		DataBlockSizeSectors: 128,
+		MaxDeviceSizeRatio:   10,
+		DeviceSizeCheck:      DeviceSizeCheckError,
+	}
+
+	err = config.validate()
+	assert.NoError(t, err)
+
+	config.DeviceSizeCheck = "fail"
+	err = config.validate()
+	assert.Error(t, err)
+
+	config.DeviceSizeCheck = DeviceSizeCheckWarn
+	config.MaxDeviceSizeRatio = -1
+	err = config.validate()
+	assert.Error(t, err)
+}
+
+func TestPoolMonitorConfig(t *testing.T) {
+	config := Config{
+		DataBlockSize:       "64Kb",
+		BaseImageSize:       "16Mb",
+		PoolMonitorInterval: "30s",
+		AutoExtendSize:      "1GB",
+	}
+
+	err := config.parse()
+	require.NoError(t, err)
+	assert.Equal(t, 30*time.Second, config.PoolMonitorIntervalDuration)
+	assert.EqualValues(t, 1024*1024*1024, config.AutoExtendSizeBytes)
+
+	config = Config{
+		PoolName:                    "test",
+		RootPath:                    "/tmp",
+		DataDevice:                  "/dev/loop0",
+		MetadataDevice:              "/dev/loop1",
+		DataBlockSizeSectors:        128,
+		PoolMonitorIntervalDuration: 30 * time.Second,
+		LowSpaceThreshold:           80,
+		RefusePrepareThreshold:      95,
+		AutoExtendThreshold:         90,
+		AutoExtendSize:              "1GB",
+	}
+
+	err = config.validate()
+	assert.NoError(t, err)
+
+	config.RefusePrepareThreshold = 101
+	err = config.validate()
+	assert.Error(t, err)
+
+	config.RefusePrepareThreshold = 95
+	config.AutoExtendSize = ""
+	err = config.validate()
+	assert.Error(t, err, "auto extend needs the size to extend by")
+
+	config.AutoExtendThreshold = 0
+	config.PoolMonitorIntervalDuration = 0
+	err = config.validate()
+	assert.Error(t, err, "thresholds are checked by the monitor")
+
+	config.LowSpaceThreshold = 0
+	config.RefusePrepareThreshold = 0
+	err = config.validate()
+	assert.NoError(t, err)
+}
+
+func TestFstrimConfig(t *testing.T) {
+	config := Config{DataBlockSize: "64Kb", BaseImageSize: "16Mb", FstrimInterval: "1h"}
+	err := config.parse()
+	require.NoError(t, err)
+	assert.Equal(t, time.Hour, config.FstrimIntervalDuration)
+
+	config = Config{DataBlockSize: "64Kb", BaseImageSize: "16Mb", FstrimInterval: "hourly"}
+	err = config.parse()
+	assert.Error(t, err)
+
+	config = Config{
+		PoolName:               "test",
+		RootPath:               "/tmp",
+		DataDevice:             "/dev/loop0",
+		MetadataDevice:         "/dev/loop1",
+		DataBlockSizeSectors:   128,
+		FstrimIntervalDuration: -time.Second,
+	}
+
+	err = config.validate()
+	assert.Error(t, err)
+}
+
+func TestLoopbackConfig(t *testing.T) {
+	config := Config{
+		DataBlockSize:        "64Kb",
+		BaseImageSize:        "16Mb",
+		LoopbackDataSize:     "10GB",
+		LoopbackMetadataSize: "100MB",
+	}
+
+	err := config.parse()
+	require.NoError(t, err)
+	assert.EqualValues(t, 10*1024*1024*1024, config.LoopbackDataSizeBytes)
+	assert.EqualValues(t, 100*1024*1024, config.LoopbackMetadataSizeBytes)
+
+	config.PoolName = "test"
+	config.RootPath = "/tmp"
+	err = config.validate()
+	assert.NoError(t, err, "devices aren't needed with loopback sizes")
+
+	config.DataDevice = "/dev/loop0"
+	err = config.validate()
+	assert.Error(t, err)
+
+	config.DataDevice = ""
+	config.LoopbackMetadataSize = ""
+	err = config.validate()
+	assert.Error(t, err, "both loopback sizes should be set")
+
+	config = Config{LoopbackDataSize: "-1"}
+	err = config.parse()
+	assert.Error(t, err)
+}
+
+func TestDeviceDir(t *testing.T) {
+	config := Config{DataBlockSize: "64Kb", BaseImageSize: "16Mb"}
+	err := config.parse()
+	require.NoError(t, err)
+	assert.Equal(t, defaultDeviceDir, config.DeviceDir)
+
+	config = Config{
+		PoolName:             "test",
+		RootPath:             "/tmp",
+		DataDevice:           "/dev/loop0",
+		MetadataDevice:       "/dev/loop1",
+		DataBlockSizeSectors: 128,
+		DeviceDir:            "dev/mapper",
+	}
+
+	err = config.validate()
+	assert.Error(t, err, "relative device dir should be rejected")
+}
+
+func TestReloadDiff(t *testing.T) {
+	current := Config{
+		RootPath:             "/tmp",
+		PoolName:             "test",
+		DataDevice:           "/dev/loop0",
+		MetadataDevice:       "/dev/loop1",
+		DataBlockSizeSectors: 128,
+		BaseImageSizeBytes:   16 * 1024 * 1024,
+		MkfsOptions:          defaultMkfsOptions,
+	}
+
+	next := current
+	changes, err := current.reloadDiff(&next)
+	require.NoError(t, err)
+	assert.Empty(t, changes)
+
+	next.MkfsOptions = "-i 8192 {{.DevicePath}}"
+	next.OverProvisioningRatio = 2.5
+	next.RefusePrepareThreshold = 95
+	next.LowSpaceThreshold = 80
+	next.MountDiscard = true
+	changes, err = current.reloadDiff(&next)
+	require.NoError(t, err)
+	require.Len(t, changes, 5)
+	assert.Contains(t, changes[0], "mkfs_options")
+	assert.Contains(t, changes[1], "over_provisioning_ratio: 0 -> 2.5")
+	assert.Contains(t, changes[2], "refuse_prepare_threshold: 0 -> 95")
+	assert.Contains(t, changes[3], "low_space_threshold: 0 -> 80")
+	assert.Contains(t, changes[4], "mount_discard: false -> true")
+
+	next.DataBlockSizeSectors = 256
+	next.MetadataDevice = "/dev/loop2"
+	next.ExtraFeatures = []string{"error_if_no_space"}
+	next.DeviceDir = "/dev/other"
+	next.LowWaterMarkBlocks = 1024
+	next.FilesystemType = "xfs"
+	next.FstrimIntervalDuration = time.Hour
+	_, err = current.reloadDiff(&next)
+	require.Error(t, err)
+
+	merr, ok := err.(*multierror.Error)
+	require.True(t, ok)
+	assert.Len(t, merr.Errors, 7)
+
+	// Retries of busy devices are replaced in running pool
+	next = current
+	next.RemoveRetries = 10
+	next.RemoveRetryDelayDuration = time.Second
+	next.RemoveRetryTimeoutDuration = time.Minute
+	changes, err = current.reloadDiff(&next)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"remove_retries: 0 -> 10",
+		"remove_retry_delay: 0s -> 1s",
+		"remove_retry_timeout: 0s -> 1m0s",
+	}, changes)
+
+	// Empty and missing features are the same
+	next = current
+	next.ExtraFeatures = []string{}
+	_, err = current.reloadDiff(&next)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,205 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package devmapper
+
+import (
+	"context"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	"github.com/pkg/errors"
+)
+
+// deleteQueue deletes devices marked with DeleteDeviceDeferred in the background. Failed deletion is retried
+// with backoff of remove retry settings until it succeeds. Marks are kept in metadata store, so devices left
+// by the previous run are picked up once the queue is started again.
+type deleteQueue struct {
+	pool *PoolDevice
+
+	// Failed attempts by device name, only accessed by the queue goroutine
+	attempts map[string]*deleteAttempts
+
+	wake   chan struct{}
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+type deleteAttempts struct {
+	failures int
+	next     time.Time
+}
+
+func startDeleteQueue(ctx context.Context, pool *PoolDevice) *deleteQueue {
+	ctx, cancel := context.WithCancel(ctx)
+
+	q := &deleteQueue{
+		pool:     pool,
+		attempts: make(map[string]*deleteAttempts),
+		wake:     make(chan struct{}, 1),
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+
+	go q.run(ctx)
+	return q
+}
+
+// notify makes the queue pick up newly marked devices without waiting for pending retries
+func (q *deleteQueue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *deleteQueue) run(ctx context.Context) {
+	defer close(q.done)
+
+	for {
+		var (
+			timer *time.Timer
+			retry <-chan time.Time
+		)
+
+		if delay := q.deletePending(ctx); delay > 0 {
+			timer = time.NewTimer(delay)
+			retry = timer.C
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-q.wake:
+		case <-retry:
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// deletePending deletes marked devices which are due and returns delay until the next retry, zero if nothing
+// is left to retry
+func (q *deleteQueue) deletePending(ctx context.Context) time.Duration {
+	names, err := q.pool.pendingDeletes(ctx)
+	if err != nil {
+		log.G(ctx).WithError(err).Warn("failed to query devices pending deletion")
+		return q.pool.currentRemoveRetry().delay
+	}
+
+	var (
+		next    time.Duration
+		pending = make(map[string]bool, len(names))
+	)
+
+	for _, name := range names {
+		if ctx.Err() != nil {
+			return 0
+		}
+
+		pending[name] = true
+
+		attempts := q.attempts[name]
+		if attempts != nil && time.Now().Before(attempts.next) {
+			next = minDelay(next, time.Until(attempts.next))
+			continue
+		}
+
+		err := q.pool.DeleteDevice(ctx, name)
+		if err == nil || errors.Is(err, ErrNotFound) {
+			log.G(ctx).Debugf("deleted device %q pending deletion", name)
+			delete(q.attempts, name)
+			continue
+		}
+
+		if attempts == nil {
+			attempts = &deleteAttempts{}
+			q.attempts[name] = attempts
+		}
+
+		delay := q.pool.currentRemoveRetry().backoff(attempts.failures)
+		attempts.failures++
+		attempts.next = time.Now().Add(delay)
+
+		log.G(ctx).WithError(err).Warnf("failed to delete device %q (attempt %d), retrying in %s", name, attempts.failures, delay)
+		next = minDelay(next, delay)
+	}
+
+	// Devices might have been deleted with DeleteDevice meanwhile
+	for name := range q.attempts {
+		if !pending[name] {
+			delete(q.attempts, name)
+		}
+	}
+
+	return next
+}
+
+func minDelay(current, delay time.Duration) time.Duration {
+	if current == 0 || delay < current {
+		return delay
+	}
+
+	return current
+}
+
+// Close stops the queue and waits for deletion in progress, devices left are deleted after the pool is reopened
+func (q *deleteQueue) Close() {
+	q.cancel()
+	<-q.done
+}
+
+// DeleteDeviceDeferred marks the device for deletion and returns without waiting for device-mapper. The device
+// is deactivated and deleted in the background, retrying with backoff while it's busy (for example while udev
+// or a mount scanner still holds it) until deletion succeeds. Marked device can't be activated or snapshotted.
+// The mark is kept in metadata store, so deletion is resumed after restart.
+func (p *PoolDevice) DeleteDeviceDeferred(ctx context.Context, deviceName string) error {
+	err := p.metadata.UpdateDevice(ctx, deviceName, func(info *DeviceInfo) error {
+		info.DeletePending = true
+		return nil
+	})
+
+	if err != nil {
+		return errors.Wrapf(err, "failed to mark device %q for deletion", deviceName)
+	}
+
+	log.G(ctx).Debugf("marked device %q for deletion", deviceName)
+
+	if p.deletes != nil {
+		p.deletes.notify()
+	}
+
+	return nil
+}
+
+// pendingDeletes returns names of devices marked with DeleteDeviceDeferred
+func (p *PoolDevice) pendingDeletes(ctx context.Context) ([]string, error) {
+	infos, err := p.metadata.GetDevices(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, info := range infos {
+		if info.DeletePending {
+			names = append(names, info.Name)
+		}
+	}
+
+	return names, nil
+}
@@ -0,0 +1,139 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package devmapper
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// waitDeleted polls metadata until the device is gone, as deletion runs in the background
+func waitDeleted(t *testing.T, pool *PoolDevice, deviceName string) {
+	ctx := context.Background()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if _, err := pool.metadata.GetDevice(ctx, deviceName); errors.Is(err, ErrNotFound) {
+			return
+		}
+	}
+
+	t.Fatalf("device %q wasn't deleted in time", deviceName)
+}
+
+func TestFakeDeleteDeviceDeferred(t *testing.T) {
+	pool, dm, cleanup := newFakePool(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	pool.removeRetry = removeRetry{retries: -1, delay: time.Millisecond}
+
+	id, err := pool.CreateThinDevice(ctx, "thin-1", device1Size, WithDeviceNodeTimeout(0))
+	require.NoError(t, err)
+
+	_, err = pool.CreateThinDevice(ctx, "thin-2", device1Size, WithDeviceNodeTimeout(0))
+	require.NoError(t, err)
+
+	// Marked device is kept until the queue runs and can't be used meanwhile
+	err = pool.DeleteDeviceDeferred(ctx, "thin-1")
+	require.NoError(t, err)
+
+	info, err := pool.metadata.GetDevice(ctx, "thin-1")
+	require.NoError(t, err)
+	assert.True(t, info.DeletePending)
+
+	_, err = pool.CreateSnapshotDevice(ctx, "thin-1", "snap-1", device1Size, WithDeviceNodeTimeout(0))
+	assert.True(t, errors.Is(err, ErrDeletePending), "pending device can't be snapshotted")
+
+	err = pool.RemoveDevice(ctx, "thin-1", false)
+	require.NoError(t, err)
+
+	err = pool.ReactivateDevice(ctx, "thin-1")
+	assert.True(t, errors.Is(err, ErrDeletePending), "pending device can't be activated")
+
+	err = pool.DeleteDeviceDeferred(ctx, "missing")
+	assert.True(t, errors.Is(err, ErrNotFound))
+
+	// Busy device is retried until released
+	dm.setBusy("thin-2", 3)
+	err = pool.DeleteDeviceDeferred(ctx, "thin-2")
+	require.NoError(t, err)
+
+	pool.deletes = startDeleteQueue(ctx, pool)
+	defer pool.deletes.Close()
+
+	waitDeleted(t, pool, "thin-1")
+	assert.False(t, dm.hasThinID(id))
+
+	waitDeleted(t, pool, "thin-2")
+	assert.False(t, dm.isActive("thin-2"))
+	assert.Equal(t, 5, dm.callCount("RemoveDevice"), "busy device should be retried by the queue after thin-1 was deactivated")
+}
+
+func TestFakeDeleteQueueBackoff(t *testing.T) {
+	pool, dm, cleanup := newFakePool(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	pool.removeRetry = removeRetry{retries: -1, delay: time.Hour}
+
+	_, err := pool.CreateThinDevice(ctx, "thin-1", device1Size, WithDeviceNodeTimeout(0))
+	require.NoError(t, err)
+
+	err = pool.DeleteDeviceDeferred(ctx, "thin-1")
+	require.NoError(t, err)
+
+	// Queue is driven with deletePending, delays are long enough not to elapse during the test
+	q := &deleteQueue{pool: pool, attempts: make(map[string]*deleteAttempts)}
+
+	dm.setBusy("thin-1", 1)
+	delay := q.deletePending(ctx)
+	assert.True(t, delay >= maxRemoveRetryDelay/2 && delay <= maxRemoveRetryDelay, "retry delay should be capped")
+	require.Contains(t, q.attempts, "thin-1")
+	assert.Equal(t, 1, q.attempts["thin-1"].failures)
+
+	// Device in backoff isn't touched
+	calls := dm.callCount("RemoveDevice")
+	assert.True(t, q.deletePending(ctx) > 0)
+	assert.Equal(t, calls, dm.callCount("RemoveDevice"))
+
+	// Device deleted meanwhile is forgotten
+	err = pool.DeleteDevice(ctx, "thin-1")
+	require.NoError(t, err)
+	assert.Zero(t, q.deletePending(ctx))
+	assert.Empty(t, q.attempts)
+}
+
+func TestFakeDeleteQueueResumed(t *testing.T) {
+	pool, dm, cleanup := newFakePool(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	id, err := pool.CreateThinDevice(ctx, "thin-1", device1Size, WithDeviceNodeTimeout(0))
+	require.NoError(t, err)
+
+	// Marked before restart with the pool gone before the queue could delete it
+	err = pool.DeleteDeviceDeferred(ctx, "thin-1")
+	require.NoError(t, err)
+
+	pool.deletes = startDeleteQueue(ctx, pool)
+	defer pool.deletes.Close()
+
+	waitDeleted(t, pool, "thin-1")
+	assert.False(t, dm.hasThinID(id))
+}
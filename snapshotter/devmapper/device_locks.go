@@ -0,0 +1,114 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package devmapper
+
+import (
+	"sort"
+	"sync"
+)
+
+// deviceLocks serializes device-mapper operations on the same device by name,
+// while operations on different devices run in parallel
+type deviceLocks struct {
+	mu    sync.Mutex
+	locks map[string]*deviceLock
+}
+
+type deviceLock struct {
+	sync.Mutex
+	refs int
+}
+
+// lock acquires locks of the given devices and returns a function to release them.
+// Names are locked in sorted order, so operations locking several devices don't deadlock.
+func (l *deviceLocks) lock(names ...string) func() {
+	unlocks := l.lockEach(names...)
+
+	return func() {
+		for i := len(unlocks) - 1; i >= 0; i-- {
+			unlocks[i]()
+		}
+	}
+}
+
+// lockEach acquires locks of the given devices like lock, but returns a function per name to release its lock,
+// so a lock which is no longer needed can be released early. Functions may be called more than once,
+// the one of a repeated name does nothing.
+func (l *deviceLocks) lockEach(names ...string) []func() {
+	sorted := make([]string, 0, len(names))
+	seen := make(map[string]bool, len(names))
+	for _, name := range names {
+		if !seen[name] {
+			seen[name] = true
+			sorted = append(sorted, name)
+		}
+	}
+
+	sort.Strings(sorted)
+
+	unlockByName := make(map[string]func(), len(sorted))
+	for _, name := range sorted {
+		name, lock := name, l.acquire(name)
+		lock.Lock()
+
+		var once sync.Once
+		unlockByName[name] = func() {
+			once.Do(func() {
+				lock.Unlock()
+				l.release(name, lock)
+			})
+		}
+	}
+
+	unlocks := make([]func(), len(names))
+	for i, name := range names {
+		if unlock, ok := unlockByName[name]; ok {
+			unlocks[i] = unlock
+			delete(unlockByName, name)
+		} else {
+			unlocks[i] = func() {}
+		}
+	}
+
+	return unlocks
+}
+
+func (l *deviceLocks) acquire(name string) *deviceLock {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.locks == nil {
+		l.locks = make(map[string]*deviceLock)
+	}
+
+	lock, ok := l.locks[name]
+	if !ok {
+		lock = &deviceLock{}
+		l.locks[name] = lock
+	}
+
+	lock.refs++
+	return lock
+}
+
+// release drops lock of the device once nobody is waiting for it, so the map doesn't grow with every device ever seen
+func (l *deviceLocks) release(name string, lock *deviceLock) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	lock.refs--
+	if lock.refs == 0 {
+		delete(l.locks, name)
+	}
+}
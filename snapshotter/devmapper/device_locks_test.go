@@ -0,0 +1,117 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package devmapper
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeviceLocks(t *testing.T) {
+	var locks deviceLocks
+
+	// Same device is serialized
+	var (
+		wg         sync.WaitGroup
+		holders    int32
+		overlapped int32
+	)
+
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			unlock := locks.lock("thin-1")
+			defer unlock()
+
+			if atomic.AddInt32(&holders, 1) > 1 {
+				atomic.StoreInt32(&overlapped, 1)
+			}
+
+			time.Sleep(time.Millisecond)
+			atomic.AddInt32(&holders, -1)
+		}()
+	}
+
+	wg.Wait()
+	assert.Zero(t, overlapped, "device lock should be held by one caller at a time")
+	assert.Empty(t, locks.locks, "released locks should be dropped")
+
+	// Different devices don't block each other
+	unlock1 := locks.lock("thin-1")
+	done := make(chan struct{})
+	go func() {
+		unlock2 := locks.lock("thin-2")
+		unlock2()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("lock of another device is blocked")
+	}
+
+	unlock1()
+
+	// Locking several devices in different order doesn't deadlock
+	for i := 0; i < 50; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			locks.lock("a", "b", "a")()
+		}()
+		go func() {
+			defer wg.Done()
+			locks.lock("b", "a")()
+		}()
+	}
+
+	wg.Wait()
+	assert.Empty(t, locks.locks)
+}
+
+func TestDeviceLocksEach(t *testing.T) {
+	var locks deviceLocks
+
+	unlocks := locks.lockEach("thin-2", "thin-1", "thin-2")
+	assert.Len(t, unlocks, 3)
+
+	// Lock released early can be taken while the other one is held
+	unlocks[0]()
+	unlocks[0]()
+
+	done := make(chan struct{})
+	go func() {
+		locks.lock("thin-2")()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("released lock is still held")
+	}
+
+	assert.Len(t, locks.locks, 1)
+
+	unlocks[1]()
+	unlocks[2]()
+	assert.Empty(t, locks.locks)
+}
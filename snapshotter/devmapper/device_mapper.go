@@ -0,0 +1,138 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package devmapper
+
+import (
+	"context"
+
+	"github.com/firecracker-microvm/firecracker-containerd/snapshotter/pkg/dmsetup"
+)
+
+// DeviceMapper is the set of device-mapper calls PoolDevice makes on the pool and its thin devices.
+// Default implementation runs "dmsetup", which requires root and kernel devices. Other implementations
+// (like in-memory fakes in tests) are set with WithDeviceMapper.
+//
+// Errors are expected to match dmsetup ones where PoolDevice checks them: CreateDevice and CreateSnapshot
+// return unix.EEXIST (not wrapped) if device ID is taken, RemoveDevice returns error caused by unix.EBUSY
+// if device is open.
+//
+// Thin provisioning tools (thin_check, thin_dump, etc.) read metadata volume directly and aren't part of it.
+type DeviceMapper interface {
+	CreatePool(poolName, dataFile, metaFile string, blockSizeSectors uint32, lowWaterMarkBlocks uint64, zeroNewBlocks bool, extraFeatures ...string) error
+	ReloadPool(poolName, dataFile, metaFile string, blockSizeSectors uint32, lowWaterMarkBlocks uint64, zeroNewBlocks bool, extraFeatures ...string) error
+	GetThinPoolTable(poolName string) (*dmsetup.ThinPoolTable, error)
+	GetPoolStatus(poolName string) (*dmsetup.PoolStatus, error)
+	WaitEvent(ctx context.Context, poolName string, eventNumber uint32) error
+	ReserveMetadataSnapshot(poolName string) error
+	ReleaseMetadataSnapshot(poolName string) error
+
+	CreateDevice(poolName string, deviceID uint32) error
+	CreateSnapshot(poolName string, deviceID uint32, baseDeviceID uint32) error
+	DeleteDevice(poolName string, deviceID uint32) error
+
+	ActivateDevice(poolName string, deviceName string, deviceID uint32, size uint64, external string, opts ...dmsetup.ActivateDeviceOpt) error
+	ReloadDevice(poolName string, deviceName string, deviceID uint32, size uint64, external string, opts ...dmsetup.ActivateDeviceOpt) error
+	SuspendDevice(deviceName string, opts ...dmsetup.SuspendDeviceOpt) error
+	ResumeDevice(deviceName string) error
+	RenameDevice(deviceName, newName string) error
+	ClearTable(deviceName string) error
+	RemoveDevice(ctx context.Context, deviceName string, opts ...dmsetup.RemoveDeviceOpt) error
+
+	// Info returns info of the device, or of all devices if deviceName is empty
+	Info(deviceName string) ([]*dmsetup.DeviceInfo, error)
+
+	// ListThinDevices returns tables of active thin devices by device name
+	ListThinDevices() (map[string]string, error)
+}
+
+// dmsetupMapper is the default DeviceMapper running "dmsetup" commands
+type dmsetupMapper struct{}
+
+var _ DeviceMapper = dmsetupMapper{}
+
+func (dmsetupMapper) CreatePool(poolName, dataFile, metaFile string, blockSizeSectors uint32, lowWaterMarkBlocks uint64, zeroNewBlocks bool, extraFeatures ...string) error {
+	return dmsetup.CreatePool(poolName, dataFile, metaFile, blockSizeSectors, lowWaterMarkBlocks, zeroNewBlocks, extraFeatures...)
+}
+
+func (dmsetupMapper) ReloadPool(poolName, dataFile, metaFile string, blockSizeSectors uint32, lowWaterMarkBlocks uint64, zeroNewBlocks bool, extraFeatures ...string) error {
+	return dmsetup.ReloadPool(poolName, dataFile, metaFile, blockSizeSectors, lowWaterMarkBlocks, zeroNewBlocks, extraFeatures...)
+}
+
+func (dmsetupMapper) GetThinPoolTable(poolName string) (*dmsetup.ThinPoolTable, error) {
+	return dmsetup.GetThinPoolTable(poolName)
+}
+
+func (dmsetupMapper) GetPoolStatus(poolName string) (*dmsetup.PoolStatus, error) {
+	return dmsetup.GetPoolStatus(poolName)
+}
+
+func (dmsetupMapper) WaitEvent(ctx context.Context, poolName string, eventNumber uint32) error {
+	return dmsetup.WaitEvent(ctx, poolName, eventNumber)
+}
+
+func (dmsetupMapper) ReserveMetadataSnapshot(poolName string) error {
+	return dmsetup.ReserveMetadataSnapshot(poolName)
+}
+
+func (dmsetupMapper) ReleaseMetadataSnapshot(poolName string) error {
+	return dmsetup.ReleaseMetadataSnapshot(poolName)
+}
+
+func (dmsetupMapper) CreateDevice(poolName string, deviceID uint32) error {
+	return dmsetup.CreateDevice(poolName, deviceID)
+}
+
+func (dmsetupMapper) CreateSnapshot(poolName string, deviceID uint32, baseDeviceID uint32) error {
+	return dmsetup.CreateSnapshot(poolName, deviceID, baseDeviceID)
+}
+
+func (dmsetupMapper) DeleteDevice(poolName string, deviceID uint32) error {
+	return dmsetup.DeleteDevice(poolName, int(deviceID))
+}
+
+func (dmsetupMapper) ActivateDevice(poolName string, deviceName string, deviceID uint32, size uint64, external string, opts ...dmsetup.ActivateDeviceOpt) error {
+	return dmsetup.ActivateDevice(poolName, deviceName, deviceID, size, external, opts...)
+}
+
+func (dmsetupMapper) ReloadDevice(poolName string, deviceName string, deviceID uint32, size uint64, external string, opts ...dmsetup.ActivateDeviceOpt) error {
+	return dmsetup.ReloadDevice(poolName, deviceName, deviceID, size, external, opts...)
+}
+
+func (dmsetupMapper) SuspendDevice(deviceName string, opts ...dmsetup.SuspendDeviceOpt) error {
+	return dmsetup.SuspendDevice(deviceName, opts...)
+}
+
+func (dmsetupMapper) ResumeDevice(deviceName string) error {
+	return dmsetup.ResumeDevice(deviceName)
+}
+
+func (dmsetupMapper) RenameDevice(deviceName, newName string) error {
+	return dmsetup.RenameDevice(deviceName, newName)
+}
+
+func (dmsetupMapper) ClearTable(deviceName string) error {
+	return dmsetup.ClearTable(deviceName)
+}
+
+func (dmsetupMapper) RemoveDevice(ctx context.Context, deviceName string, opts ...dmsetup.RemoveDeviceOpt) error {
+	return dmsetup.RemoveDevice(ctx, deviceName, opts...)
+}
+
+func (dmsetupMapper) Info(deviceName string) ([]*dmsetup.DeviceInfo, error) {
+	return dmsetup.Info(deviceName)
+}
+
+func (dmsetupMapper) ListThinDevices() (map[string]string, error) {
+	return dmsetup.ListThinDevices()
+}
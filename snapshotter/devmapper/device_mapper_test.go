@@ -0,0 +1,1578 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package devmapper
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+
+	"github.com/firecracker-microvm/firecracker-containerd/snapshotter/pkg/dmsetup"
+)
+
+// fakeDeviceMapper keeps thin-pool state in memory. Like the kernel, it fails with unix.EEXIST to create
+// a device with ID which is taken, with unix.ENXIO to use a device which doesn't exist and with unix.EBUSY
+// to remove a device which is open.
+type fakeDeviceMapper struct {
+	mu sync.Mutex
+
+	poolName   string
+	poolExists bool
+
+	// Set while metadata snapshot is reserved
+	metadataSnap bool
+
+	// Device IDs of thin devices in the pool, activated devices by name
+	thinIDs map[uint32]bool
+	active  map[string]*fakeDevice
+
+	// Errors to return from the next calls of a method, by method name
+	errs map[string][]error
+
+	// Number of calls by method name
+	calls map[string]int
+
+	// Used blocks reported by GetPoolStatus, out of 1024 data and metadata blocks
+	usedDataBlocks     uint64
+	usedMetadataBlocks uint64
+
+	// How long each call takes, like a dmsetup process would. Calls don't hold the mutex meanwhile,
+	// so concurrent calls take it in parallel.
+	latency time.Duration
+}
+
+type fakeDevice struct {
+	deviceID  uint32
+	size      uint64
+	readOnly  bool
+	suspended bool
+
+	// Thin table the device was activated or reloaded with
+	table string
+
+	// Number of removals failing with EBUSY before the device is released
+	busy int
+}
+
+// Activated devices of the fake have this major number and device ID as minor number
+const fakeDeviceMajor = 253
+
+var _ DeviceMapper = &fakeDeviceMapper{}
+
+func newFakeDeviceMapper(poolName string) *fakeDeviceMapper {
+	return &fakeDeviceMapper{
+		poolName:   poolName,
+		poolExists: true,
+		thinIDs:    make(map[uint32]bool),
+		active:     make(map[string]*fakeDevice),
+		errs:       make(map[string][]error),
+		calls:      make(map[string]int),
+	}
+}
+
+// failNext makes the next calls of the method return the given errors, one per call
+func (f *fakeDeviceMapper) failNext(method string, errs ...error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.errs[method] = append(f.errs[method], errs...)
+}
+
+// setBusy makes the next n removals of activated device fail with EBUSY
+func (f *fakeDeviceMapper) setBusy(deviceName string, n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.active[deviceName].busy = n
+}
+
+func (f *fakeDeviceMapper) callCount(method string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.calls[method]
+}
+
+func (f *fakeDeviceMapper) hasThinID(deviceID uint32) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.thinIDs[deviceID]
+}
+
+// table returns thin table of activated device, empty if it's not activated
+func (f *fakeDeviceMapper) table(deviceName string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if dev, ok := f.active[deviceName]; ok {
+		return dev.table
+	}
+
+	return ""
+}
+
+func (f *fakeDeviceMapper) isActive(deviceName string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	_, ok := f.active[deviceName]
+	return ok
+}
+
+func (f *fakeDeviceMapper) isSuspended(deviceName string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	dev, ok := f.active[deviceName]
+	return ok && dev.suspended
+}
+
+// setLatency makes every next call take the given time
+func (f *fakeDeviceMapper) setLatency(latency time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.latency = latency
+}
+
+// call counts the call of the method and returns injected error, if any. Caller must hold the mutex,
+// which is released while latency elapses.
+func (f *fakeDeviceMapper) call(method string) error {
+	f.calls[method]++
+
+	if f.latency > 0 {
+		latency := f.latency
+		f.mu.Unlock()
+		time.Sleep(latency)
+		f.mu.Lock()
+	}
+
+	if errs := f.errs[method]; len(errs) > 0 {
+		f.errs[method] = errs[1:]
+		return errs[0]
+	}
+
+	return nil
+}
+
+// checkPool fails if the pool with the given name doesn't exist. Caller must hold the mutex.
+func (f *fakeDeviceMapper) checkPool(poolName string) error {
+	if !f.poolExists || poolName != f.poolName {
+		return unix.ENXIO
+	}
+
+	return nil
+}
+
+func (f *fakeDeviceMapper) CreatePool(poolName, dataFile, metaFile string, blockSizeSectors uint32, lowWaterMarkBlocks uint64, zeroNewBlocks bool, extraFeatures ...string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call("CreatePool"); err != nil {
+		return err
+	}
+
+	if f.poolExists {
+		return unix.EEXIST
+	}
+
+	f.poolName = poolName
+	f.poolExists = true
+	return nil
+}
+
+func (f *fakeDeviceMapper) ReloadPool(poolName, dataFile, metaFile string, blockSizeSectors uint32, lowWaterMarkBlocks uint64, zeroNewBlocks bool, extraFeatures ...string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call("ReloadPool"); err != nil {
+		return err
+	}
+
+	return f.checkPool(poolName)
+}
+
+func (f *fakeDeviceMapper) GetThinPoolTable(poolName string) (*dmsetup.ThinPoolTable, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call("GetThinPoolTable"); err != nil {
+		return nil, err
+	}
+
+	if err := f.checkPool(poolName); err != nil {
+		return nil, err
+	}
+
+	return &dmsetup.ThinPoolTable{BlockSizeSectors: 128}, nil
+}
+
+func (f *fakeDeviceMapper) GetPoolStatus(poolName string) (*dmsetup.PoolStatus, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call("GetPoolStatus"); err != nil {
+		return nil, err
+	}
+
+	if err := f.checkPool(poolName); err != nil {
+		return nil, err
+	}
+
+	return &dmsetup.PoolStatus{
+		Mode:                dmsetup.PoolModeReadWrite,
+		UsedDataBlocks:      f.usedDataBlocks,
+		TotalDataBlocks:     1024,
+		UsedMetadataBlocks:  f.usedMetadataBlocks,
+		TotalMetadataBlocks: 1024,
+	}, nil
+}
+
+func (f *fakeDeviceMapper) setPoolUsage(dataBlocks, metadataBlocks uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.usedDataBlocks = dataBlocks
+	f.usedMetadataBlocks = metadataBlocks
+}
+
+func (f *fakeDeviceMapper) WaitEvent(ctx context.Context, poolName string, eventNumber uint32) error {
+	f.mu.Lock()
+	err := f.call("WaitEvent")
+	f.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	// Pool state changes only with calls of the fake, nothing to wait for
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (f *fakeDeviceMapper) ReserveMetadataSnapshot(poolName string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call("ReserveMetadataSnapshot"); err != nil {
+		return err
+	}
+
+	if err := f.checkPool(poolName); err != nil {
+		return err
+	}
+
+	if f.metadataSnap {
+		return unix.EBUSY
+	}
+
+	f.metadataSnap = true
+	return nil
+}
+
+func (f *fakeDeviceMapper) ReleaseMetadataSnapshot(poolName string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call("ReleaseMetadataSnapshot"); err != nil {
+		return err
+	}
+
+	if err := f.checkPool(poolName); err != nil {
+		return err
+	}
+
+	if !f.metadataSnap {
+		return unix.EINVAL
+	}
+
+	f.metadataSnap = false
+	return nil
+}
+
+func (f *fakeDeviceMapper) CreateDevice(poolName string, deviceID uint32) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call("CreateDevice"); err != nil {
+		return err
+	}
+
+	if err := f.checkPool(poolName); err != nil {
+		return err
+	}
+
+	if f.thinIDs[deviceID] {
+		return unix.EEXIST
+	}
+
+	f.thinIDs[deviceID] = true
+	return nil
+}
+
+func (f *fakeDeviceMapper) CreateSnapshot(poolName string, deviceID uint32, baseDeviceID uint32) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call("CreateSnapshot"); err != nil {
+		return err
+	}
+
+	if err := f.checkPool(poolName); err != nil {
+		return err
+	}
+
+	if !f.thinIDs[baseDeviceID] {
+		return unix.ENODATA
+	}
+
+	if f.thinIDs[deviceID] {
+		return unix.EEXIST
+	}
+
+	f.thinIDs[deviceID] = true
+	return nil
+}
+
+func (f *fakeDeviceMapper) DeleteDevice(poolName string, deviceID uint32) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call("DeleteDevice"); err != nil {
+		return err
+	}
+
+	if err := f.checkPool(poolName); err != nil {
+		return err
+	}
+
+	if !f.thinIDs[deviceID] {
+		return unix.ENODATA
+	}
+
+	for _, dev := range f.active {
+		if dev.deviceID == deviceID {
+			return unix.EBUSY
+		}
+	}
+
+	delete(f.thinIDs, deviceID)
+	return nil
+}
+
+func (f *fakeDeviceMapper) ActivateDevice(poolName string, deviceName string, deviceID uint32, size uint64, external string, opts ...dmsetup.ActivateDeviceOpt) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call("ActivateDevice"); err != nil {
+		return err
+	}
+
+	if err := f.checkPool(poolName); err != nil {
+		return err
+	}
+
+	if _, ok := f.active[deviceName]; ok {
+		return unix.EEXIST
+	}
+
+	if !f.thinIDs[deviceID] {
+		return unix.ENODATA
+	}
+
+	dev := &fakeDevice{
+		deviceID: deviceID,
+		size:     size,
+		table:    dmsetup.ThinMapping(poolName, deviceID, size, external),
+	}
+
+	for _, opt := range opts {
+		if opt == dmsetup.ActivateReadOnly {
+			dev.readOnly = true
+		}
+	}
+
+	f.active[deviceName] = dev
+	return nil
+}
+
+func (f *fakeDeviceMapper) ReloadDevice(poolName string, deviceName string, deviceID uint32, size uint64, external string, opts ...dmsetup.ActivateDeviceOpt) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call("ReloadDevice"); err != nil {
+		return err
+	}
+
+	dev, ok := f.active[deviceName]
+	if !ok {
+		return unix.ENXIO
+	}
+
+	dev.size = size
+	dev.table = dmsetup.ThinMapping(poolName, deviceID, size, external)
+	return nil
+}
+
+func (f *fakeDeviceMapper) SuspendDevice(deviceName string, opts ...dmsetup.SuspendDeviceOpt) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call("SuspendDevice"); err != nil {
+		return err
+	}
+
+	if deviceName == f.poolName {
+		return f.checkPool(deviceName)
+	}
+
+	dev, ok := f.active[deviceName]
+	if !ok {
+		return unix.ENXIO
+	}
+
+	dev.suspended = true
+	return nil
+}
+
+func (f *fakeDeviceMapper) ResumeDevice(deviceName string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call("ResumeDevice"); err != nil {
+		return err
+	}
+
+	if deviceName == f.poolName {
+		return f.checkPool(deviceName)
+	}
+
+	dev, ok := f.active[deviceName]
+	if !ok {
+		return unix.ENXIO
+	}
+
+	dev.suspended = false
+	return nil
+}
+
+func (f *fakeDeviceMapper) RenameDevice(deviceName, newName string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call("RenameDevice"); err != nil {
+		return err
+	}
+
+	dev, ok := f.active[deviceName]
+	if !ok {
+		return unix.ENXIO
+	}
+
+	if _, ok := f.active[newName]; ok {
+		return unix.EEXIST
+	}
+
+	delete(f.active, deviceName)
+	f.active[newName] = dev
+	return nil
+}
+
+func (f *fakeDeviceMapper) ClearTable(deviceName string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.call("ClearTable")
+}
+
+func (f *fakeDeviceMapper) RemoveDevice(ctx context.Context, deviceName string, opts ...dmsetup.RemoveDeviceOpt) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call("RemoveDevice"); err != nil {
+		return err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if deviceName == f.poolName {
+		if err := f.checkPool(deviceName); err != nil {
+			return err
+		}
+
+		f.poolExists = false
+		return nil
+	}
+
+	dev, ok := f.active[deviceName]
+	if !ok {
+		return unix.ENXIO
+	}
+
+	if dev.busy > 0 {
+		dev.busy--
+		return errors.Wrapf(unix.EBUSY, "failed to remove %q", deviceName)
+	}
+
+	delete(f.active, deviceName)
+	return nil
+}
+
+func (f *fakeDeviceMapper) Info(deviceName string) ([]*dmsetup.DeviceInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call("Info"); err != nil {
+		return nil, err
+	}
+
+	var infos []*dmsetup.DeviceInfo
+	if f.poolExists && (deviceName == "" || deviceName == f.poolName) {
+		infos = append(infos, &dmsetup.DeviceInfo{Name: f.poolName, TableLive: true})
+	}
+
+	for name, dev := range f.active {
+		if deviceName == "" || deviceName == name {
+			infos = append(infos, &dmsetup.DeviceInfo{
+				Name:      name,
+				TableLive: true,
+				Suspended: dev.suspended,
+				ReadOnly:  dev.readOnly,
+				Major:     fakeDeviceMajor,
+				Minor:     dev.deviceID,
+			})
+		}
+	}
+
+	if deviceName != "" && len(infos) == 0 {
+		return nil, unix.ENXIO
+	}
+
+	return infos, nil
+}
+
+func (f *fakeDeviceMapper) ListThinDevices() (map[string]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call("ListThinDevices"); err != nil {
+		return nil, err
+	}
+
+	tables := make(map[string]string, len(f.active))
+	for name, dev := range f.active {
+		tables[name] = dev.table
+	}
+
+	return tables, nil
+}
+
+// newFakePool returns pool device backed by metadata store in a temp directory and the fake device-mapper
+func newFakePool(t testing.TB) (*PoolDevice, *fakeDeviceMapper, func()) {
+	tempDir, store := createStore(t)
+
+	dm := newFakeDeviceMapper("test-pool")
+	pool := &PoolDevice{
+		poolName:      dm.poolName,
+		metadata:      store,
+		reservedNames: make(map[string]struct{}),
+		dm:            dm,
+	}
+
+	return pool, dm, func() {
+		cleanupStore(t, tempDir, store)
+	}
+}
+
+func TestFakeCreateDeviceIDTaken(t *testing.T) {
+	pool, dm, cleanup := newFakePool(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	// Device ID the store allocates first is taken by a device created out of band
+	dm.failNext("CreateDevice", unix.EEXIST)
+
+	id, err := pool.CreateThinDevice(ctx, "thin-1", device1Size, WithDeviceNodeTimeout(0))
+	require.NoError(t, err)
+	assert.True(t, dm.hasThinID(id))
+	assert.True(t, dm.isActive("thin-1"))
+	assert.Equal(t, 2, dm.callCount("CreateDevice"))
+
+	info, err := pool.metadata.GetDevice(ctx, "thin-1")
+	require.NoError(t, err)
+	assert.Equal(t, id, info.DeviceID)
+	assert.True(t, info.IsActivated)
+}
+
+func TestFakeCreateRollback(t *testing.T) {
+	pool, dm, cleanup := newFakePool(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	dm.failNext("ActivateDevice", unix.ENOMEM)
+	_, err := pool.CreateThinDevice(ctx, "thin-1", device1Size, WithDeviceNodeTimeout(0))
+	require.Error(t, err)
+	assert.Equal(t, unix.ENOMEM, errors.Cause(err))
+
+	// Thin device is deleted from the pool and metadata, so its ID is reused by the next device
+	_, err = pool.metadata.GetDevice(ctx, "thin-1")
+	assert.Equal(t, ErrNotFound, errors.Cause(err))
+	assert.Empty(t, dm.thinIDs)
+	assert.Equal(t, 1, dm.callCount("DeleteDevice"))
+
+	id, err := pool.CreateThinDevice(ctx, "thin-1", device1Size, WithDeviceNodeTimeout(0))
+	require.NoError(t, err)
+	assert.True(t, dm.hasThinID(id))
+}
+
+func TestFakeSnapshotRollback(t *testing.T) {
+	pool, dm, cleanup := newFakePool(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	baseID, err := pool.CreateThinDevice(ctx, "thin-1", device1Size, WithDeviceNodeTimeout(0))
+	require.NoError(t, err)
+
+	dm.failNext("ActivateDevice", unix.ENOMEM)
+	_, err = pool.CreateSnapshotDevice(ctx, "thin-1", "snap-1", device1Size, WithDeviceNodeTimeout(0))
+	require.Error(t, err)
+
+	_, err = pool.metadata.GetDevice(ctx, "snap-1")
+	assert.Equal(t, ErrNotFound, errors.Cause(err))
+	assert.Equal(t, map[uint32]bool{baseID: true}, dm.thinIDs, "only base device should be left in the pool")
+
+	// Base device is resumed after snapshot
+	assert.Equal(t, 1, dm.callCount("SuspendDevice"))
+	assert.Equal(t, 1, dm.callCount("ResumeDevice"))
+	assert.False(t, dm.active["thin-1"].suspended)
+}
+
+func TestFakeCreateNodeTimeoutRollback(t *testing.T) {
+	pool, dm, cleanup := newFakePool(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	baseID, err := pool.CreateThinDevice(ctx, "thin-1", device1Size, WithDeviceNodeTimeout(0))
+	require.NoError(t, err)
+
+	// Fake doesn't create device nodes, so waiting for them times out
+	_, err = pool.CreateThinDevice(ctx, "thin-2", device1Size, WithDeviceNodeTimeout(10*time.Millisecond))
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, ErrDeviceNodeTimeout))
+
+	_, err = pool.CreateSnapshotDevice(ctx, "thin-1", "snap-1", device1Size, WithDeviceNodeTimeout(10*time.Millisecond))
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, ErrDeviceNodeTimeout))
+
+	for _, name := range []string{"thin-2", "snap-1"} {
+		_, err = pool.metadata.GetDevice(ctx, name)
+		assert.Equal(t, ErrNotFound, errors.Cause(err), "device %q should be rolled back", name)
+		assert.False(t, dm.isActive(name))
+	}
+
+	assert.Equal(t, map[uint32]bool{baseID: true}, dm.thinIDs, "only base device should be left in the pool")
+
+	// Timeout is still told apart if rollback fails too
+	dm.failNext("DeleteDevice", unix.EIO)
+	_, err = pool.CreateThinDevice(ctx, "thin-3", device1Size, WithDeviceNodeTimeout(10*time.Millisecond))
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, ErrDeviceNodeTimeout))
+	assert.Contains(t, err.Error(), "failed to rollback device")
+
+	info, err := pool.metadata.GetDevice(ctx, "thin-3")
+	require.NoError(t, err)
+	assert.Equal(t, Faulty, info.State)
+}
+
+func TestFakeDeleteReusesDeviceID(t *testing.T) {
+	pool, dm, cleanup := newFakePool(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	id1, err := pool.CreateThinDevice(ctx, "thin-1", device1Size, WithDeviceNodeTimeout(0))
+	require.NoError(t, err)
+
+	id2, err := pool.CreateThinDevice(ctx, "thin-2", device1Size, WithDeviceNodeTimeout(0))
+	require.NoError(t, err)
+
+	err = pool.DeleteDevice(ctx, "thin-1")
+	require.NoError(t, err)
+	assert.False(t, dm.hasThinID(id1))
+	assert.False(t, dm.isActive("thin-1"))
+
+	id3, err := pool.CreateThinDevice(ctx, "thin-3", device1Size, WithDeviceNodeTimeout(0))
+	require.NoError(t, err)
+	assert.Equal(t, id1, id3, "released device ID should be reused")
+	assert.NotEqual(t, id2, id3)
+}
+
+func TestFakeDeleteFailureKeepsDevice(t *testing.T) {
+	pool, dm, cleanup := newFakePool(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	id, err := pool.CreateThinDevice(ctx, "thin-1", device1Size, WithoutActivation())
+	require.NoError(t, err)
+
+	dm.failNext("DeleteDevice", unix.EIO)
+	err = pool.DeleteDevice(ctx, "thin-1")
+	require.Error(t, err)
+
+	// Metadata keeps the device thin-pool still has
+	info, err := pool.metadata.GetDevice(ctx, "thin-1")
+	require.NoError(t, err)
+	assert.Equal(t, id, info.DeviceID)
+	assert.True(t, dm.hasThinID(id))
+}
+
+func TestFakeRemoveBusyDevice(t *testing.T) {
+	pool, dm, cleanup := newFakePool(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	pool.removeRetry = removeRetry{retries: 2, delay: time.Millisecond}
+
+	_, err := pool.CreateThinDevice(ctx, "thin-1", device1Size, WithDeviceNodeTimeout(0))
+	require.NoError(t, err)
+
+	_, err = pool.CreateThinDevice(ctx, "thin-2", device1Size, WithDeviceNodeTimeout(0))
+	require.NoError(t, err)
+
+	// Device released before retries run out is removed
+	dm.setBusy("thin-1", 2)
+	err = pool.RemoveDevice(ctx, "thin-1", false)
+	require.NoError(t, err)
+	assert.False(t, dm.isActive("thin-1"))
+	assert.Equal(t, 3, dm.callCount("RemoveDevice"))
+
+	// Device still busy after retries stays activated
+	dm.setBusy("thin-2", 3)
+	err = pool.RemoveDevice(ctx, "thin-2", false)
+	require.Error(t, err)
+	assert.Equal(t, unix.EBUSY, errors.Cause(err))
+	assert.True(t, dm.isActive("thin-2"))
+
+	info, err := pool.metadata.GetDevice(ctx, "thin-2")
+	require.NoError(t, err)
+	assert.True(t, info.IsActivated)
+}
+
+func TestFakeConcurrentCreate(t *testing.T) {
+	pool, dm, cleanup := newFakePool(t)
+	defer cleanup()
+
+	const count = 32
+
+	// Every other device ID is taken out of band, creates have to retry concurrently
+	for id := uint32(0); id < count*2; id += 2 {
+		dm.thinIDs[id] = true
+	}
+
+	var (
+		wg  sync.WaitGroup
+		ids = make([]uint32, count)
+	)
+
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			id, err := pool.CreateThinDevice(context.Background(), fmt.Sprintf("thin-%d", i), device1Size, WithDeviceNodeTimeout(0))
+			assert.NoError(t, err)
+			ids[i] = id
+		}(i)
+	}
+
+	wg.Wait()
+
+	seen := make(map[uint32]bool, count)
+	for _, id := range ids {
+		assert.False(t, seen[id], "device ID %d is assigned twice", id)
+		seen[id] = true
+	}
+
+	assert.Len(t, dm.thinIDs, count*2)
+	assert.Len(t, dm.active, count)
+}
+
+func TestFakeActivateRetries(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		errs     []error
+		calls    int
+		expected error
+	}{
+		{name: "Busy", errs: []error{unix.EBUSY, unix.EBUSY}, calls: 3},
+		{name: "NoDevice", errs: []error{unix.ENXIO}, calls: 2},
+		{name: "BusyExhausted", errs: []error{unix.EBUSY, unix.EBUSY, unix.EBUSY}, calls: 3, expected: unix.EBUSY},
+		{name: "InvalidTable", errs: []error{unix.EINVAL}, calls: 1, expected: unix.EINVAL},
+		{name: "NameTaken", errs: []error{unix.EEXIST}, calls: 1, expected: unix.EEXIST},
+		{name: "TransientThenPermanent", errs: []error{unix.ENXIO, unix.EINVAL}, calls: 2, expected: unix.EINVAL},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			pool, dm, cleanup := newFakePool(t)
+			defer cleanup()
+
+			ctx := context.Background()
+			pool.removeRetry = removeRetry{retries: 2, delay: time.Millisecond}
+
+			dm.failNext("ActivateDevice", tc.errs...)
+			id, err := pool.CreateThinDevice(ctx, "thin-1", device1Size, WithDeviceNodeTimeout(0))
+			assert.Equal(t, tc.calls, dm.callCount("ActivateDevice"))
+
+			if tc.expected != nil {
+				require.Error(t, err)
+				assert.Equal(t, tc.expected, errors.Cause(err))
+				assert.Empty(t, dm.thinIDs, "device should be rolled back")
+				return
+			}
+
+			require.NoError(t, err)
+			assert.True(t, dm.isActive("thin-1"))
+			assert.True(t, dm.hasThinID(id))
+		})
+	}
+}
+
+// setExternalOrigin makes block device queries of external origin report the given size and read-only mode
+func setExternalOrigin(t *testing.T, path string, size uint64, readOnly bool) func() {
+	prevSize, prevReadOnly := blockDeviceSize, blockDeviceReadOnly
+
+	blockDeviceSize = func(devicePath string) (uint64, error) {
+		assert.Equal(t, path, devicePath)
+		return size, nil
+	}
+
+	blockDeviceReadOnly = func(devicePath string) (bool, error) {
+		assert.Equal(t, path, devicePath)
+		return readOnly, nil
+	}
+
+	return func() {
+		blockDeviceSize, blockDeviceReadOnly = prevSize, prevReadOnly
+	}
+}
+
+func TestFakeExternalOrigin(t *testing.T) {
+	pool, dm, cleanup := newFakePool(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	const origin = "/dev/golden"
+
+	restore := setExternalOrigin(t, origin, device1Size, true)
+	defer restore()
+
+	id, err := pool.CreateThinDeviceWithExternalOrigin(ctx, "thin-1", device1Size, origin, WithDeviceNodeTimeout(0))
+	require.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("0 %d thin /dev/mapper/test-pool %d /dev/golden", device1Size/dmsetup.SectorSize, id), dm.table("thin-1"))
+
+	info, err := pool.metadata.GetDevice(ctx, "thin-1")
+	require.NoError(t, err)
+	assert.Equal(t, origin, info.ExternalOrigin)
+
+	// External origin is kept in metadata, so reactivated device and its snapshots use it
+	err = pool.RemoveDevice(ctx, "thin-1", false)
+	require.NoError(t, err)
+
+	err = pool.ReactivateDevice(ctx, "thin-1")
+	require.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("0 %d thin /dev/mapper/test-pool %d /dev/golden", device1Size/dmsetup.SectorSize, id), dm.table("thin-1"))
+
+	snapID, err := pool.CreateSnapshotDevice(ctx, "thin-1", "snap-1", device1Size, WithDeviceNodeTimeout(0))
+	require.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("0 %d thin /dev/mapper/test-pool %d /dev/golden", device1Size/dmsetup.SectorSize, snapID), dm.table("snap-1"))
+
+	// Retried create has to ask for the same external origin
+	_, err = pool.CreateThinDeviceWithExternalOrigin(ctx, "thin-1", device1Size, origin, WithIdempotentCreate())
+	assert.NoError(t, err)
+
+	_, err = pool.CreateThinDevice(ctx, "thin-1", device1Size, WithIdempotentCreate())
+	assert.True(t, errors.Is(err, ErrDeviceConflict))
+}
+
+func TestFakeSnapshotSuspendedDevice(t *testing.T) {
+	pool, dm, cleanup := newFakePool(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	_, err := pool.CreateThinDevice(ctx, "thin-1", device1Size, WithDeviceNodeTimeout(0))
+	require.NoError(t, err)
+
+	// Device suspended by caller stays suspended until caller resumes it
+	err = pool.SuspendDevice(ctx, "thin-1")
+	require.NoError(t, err)
+
+	_, err = pool.CreateSnapshotDevice(ctx, "thin-1", "snap-1", device1Size, WithDeviceNodeTimeout(0))
+	require.NoError(t, err)
+	assert.True(t, dm.isSuspended("thin-1"))
+	assert.Equal(t, 1, dm.callCount("SuspendDevice"))
+	assert.Equal(t, 0, dm.callCount("ResumeDevice"))
+
+	err = pool.ResumeDevice(ctx, "thin-1")
+	require.NoError(t, err)
+
+	_, err = pool.CreateSnapshotDevice(ctx, "thin-1", "snap-2", device1Size, WithDeviceNodeTimeout(0))
+	require.NoError(t, err)
+	assert.False(t, dm.isSuspended("thin-1"), "device suspended for snapshot should be resumed")
+	assert.Equal(t, 2, dm.callCount("SuspendDevice"))
+}
+
+func TestFakeExternalOriginInvalid(t *testing.T) {
+	pool, dm, cleanup := newFakePool(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	const origin = "/dev/golden"
+
+	restore := setExternalOrigin(t, origin, device1Size, false)
+	_, err := pool.CreateThinDeviceWithExternalOrigin(ctx, "thin-1", device1Size, origin)
+	restore()
+	assert.EqualError(t, err, `external origin "/dev/golden" must be read-only`)
+
+	restore = setExternalOrigin(t, origin, device1Size-dmsetup.SectorSize, true)
+	_, err = pool.CreateThinDeviceWithExternalOrigin(ctx, "thin-1", device1Size, origin)
+	restore()
+	assert.Error(t, err, "external origin smaller than the device should be rejected")
+
+	_, err = pool.CreateThinDeviceWithExternalOrigin(ctx, "thin-1", device1Size, origin, WithFilesystem("ext4"))
+	assert.Error(t, err)
+
+	_, err = pool.CreateThinDeviceWithExternalOrigin(ctx, "thin-1", device1Size, "")
+	assert.Error(t, err)
+
+	// Nothing is created in the pool
+	assert.Zero(t, dm.callCount("CreateDevice"))
+	_, err = pool.metadata.GetDevice(ctx, "thin-1")
+	assert.True(t, errors.Is(err, ErrNotFound))
+}
+
+func TestFakeWithMetadataSnapshot(t *testing.T) {
+	pool, dm, cleanup := newFakePool(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	err := pool.WithMetadataSnapshot(ctx, func(ctx context.Context) error {
+		assert.True(t, dm.metadataSnap, "metadata snapshot should be reserved while callback runs")
+		return nil
+	})
+	require.NoError(t, err)
+	assert.False(t, dm.metadataSnap)
+
+	// Snapshot is released if callback fails or panics
+	callbackErr := errors.New("thin_dump failed")
+	err = pool.WithMetadataSnapshot(ctx, func(ctx context.Context) error {
+		return callbackErr
+	})
+	assert.Equal(t, callbackErr, err)
+	assert.False(t, dm.metadataSnap)
+
+	assert.Panics(t, func() {
+		pool.WithMetadataSnapshot(ctx, func(ctx context.Context) error {
+			panic("backup failed")
+		})
+	})
+	assert.False(t, dm.metadataSnap)
+	assert.Equal(t, 3, dm.callCount("ReleaseMetadataSnapshot"))
+
+	// Callback isn't called without the snapshot
+	dm.failNext("ReserveMetadataSnapshot", unix.EIO)
+	called := false
+	err = pool.WithMetadataSnapshot(ctx, func(ctx context.Context) error {
+		called = true
+		return nil
+	})
+	assert.Error(t, err)
+	assert.False(t, called)
+	assert.Equal(t, 3, dm.callCount("ReleaseMetadataSnapshot"))
+}
+
+func TestFakeWithMetadataSnapshotConcurrent(t *testing.T) {
+	pool, dm, cleanup := newFakePool(t)
+	defer cleanup()
+
+	const count = 8
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		running int
+		overlap bool
+	)
+
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			err := pool.WithMetadataSnapshot(context.Background(), func(ctx context.Context) error {
+				mu.Lock()
+				running++
+				overlap = overlap || running > 1
+				mu.Unlock()
+
+				time.Sleep(time.Millisecond)
+
+				mu.Lock()
+				running--
+				mu.Unlock()
+				return nil
+			})
+
+			assert.NoError(t, err, "a single metadata snapshot should be reserved at a time")
+		}()
+	}
+
+	wg.Wait()
+	assert.False(t, overlap, "callbacks shouldn't run concurrently")
+	assert.Equal(t, count, dm.callCount("ReserveMetadataSnapshot"))
+}
+
+func TestFakeDeviceSizeRounding(t *testing.T) {
+	pool, dm, cleanup := newFakePool(t)
+	defer cleanup()
+
+	pool.dataBlockSizeSectors = 128
+	ctx := context.Background()
+
+	id, err := pool.CreateThinDevice(ctx, "thin-1", 100000, WithDeviceNodeTimeout(0))
+	require.NoError(t, err)
+
+	info, err := pool.metadata.GetDevice(ctx, "thin-1")
+	require.NoError(t, err)
+	assert.EqualValues(t, 131072, info.Size, "size should be rounded up to whole data blocks")
+	assert.Equal(t, fmt.Sprintf("0 256 thin /dev/mapper/test-pool %d", id), dm.table("thin-1"))
+
+	// Same unaligned size is accepted by idempotent create and gives snapshot of the same size
+	_, err = pool.CreateThinDevice(ctx, "thin-1", 100000, WithIdempotentCreate())
+	require.NoError(t, err)
+
+	_, err = pool.CreateSnapshotDevice(ctx, "thin-1", "snap-1", 100000, WithDeviceNodeTimeout(0))
+	require.NoError(t, err)
+
+	snap, err := pool.metadata.GetDevice(ctx, "snap-1")
+	require.NoError(t, err)
+	assert.Equal(t, info.Size, snap.Size)
+
+	_, err = pool.CreateThinDevice(ctx, "thin-2", 0)
+	assert.EqualError(t, err, `size of device "thin-2" can't be zero`)
+}
+
+func TestFakeResizeDevice(t *testing.T) {
+	pool, dm, cleanup := newFakePool(t)
+	defer cleanup()
+
+	pool.dataBlockSizeSectors = 128
+	ctx := context.Background()
+
+	id, err := pool.CreateThinDevice(ctx, "thin-1", 65536, WithDeviceNodeTimeout(0))
+	require.NoError(t, err)
+
+	err = pool.ResizeDevice(ctx, "thin-1", 100000)
+	require.NoError(t, err)
+
+	info, err := pool.metadata.GetDevice(ctx, "thin-1")
+	require.NoError(t, err)
+	assert.EqualValues(t, 131072, info.Size, "size should be rounded up to whole data blocks")
+	assert.Equal(t, fmt.Sprintf("0 256 thin /dev/mapper/test-pool %d", id), dm.table("thin-1"))
+
+	// Failed resume gets the device back to the old table
+	dm.failNext("ResumeDevice", unix.EIO)
+
+	err = pool.ResizeDevice(ctx, "thin-1", 262144)
+	assert.Equal(t, unix.EIO, errors.Cause(err))
+	assert.False(t, dm.isSuspended("thin-1"), "device should be resumed")
+	assert.Equal(t, fmt.Sprintf("0 256 thin /dev/mapper/test-pool %d", id), dm.table("thin-1"))
+
+	info, err = pool.metadata.GetDevice(ctx, "thin-1")
+	require.NoError(t, err)
+	assert.EqualValues(t, 131072, info.Size)
+
+	// Failed suspend leaves the device running with the old table
+	dm.failNext("SuspendDevice", unix.EIO)
+
+	err = pool.ResizeDevice(ctx, "thin-1", 262144)
+	assert.Equal(t, unix.EIO, errors.Cause(err))
+	assert.False(t, dm.isSuspended("thin-1"))
+	assert.Equal(t, 1, dm.callCount("ClearTable"))
+}
+
+func TestFakeDeviceSizeCheck(t *testing.T) {
+	pool, dm, cleanup := newFakePool(t)
+	defer cleanup()
+
+	logger, hook := test.NewNullLogger()
+	ctx := log.WithLogger(context.Background(), logrus.NewEntry(logger))
+
+	// Fake pool has 1024 data blocks of 64KiB
+	pool.dataBlockSizeSectors = 128
+	capacity := uint64(1024 * 65536)
+
+	_, err := pool.CreateThinDevice(ctx, "thin-1", capacity*100, WithoutActivation())
+	require.NoError(t, err)
+	assert.Zero(t, dm.callCount("GetPoolStatus"), "pool shouldn't be queried if the check is disabled")
+
+	pool.maxDeviceSizeRatio = 4
+
+	warnings := func() []*logrus.Entry {
+		var entries []*logrus.Entry
+		for _, entry := range hook.AllEntries() {
+			if entry.Level == logrus.WarnLevel {
+				entries = append(entries, entry)
+			}
+		}
+
+		return entries
+	}
+
+	_, err = pool.CreateThinDevice(ctx, "thin-2", capacity*4, WithoutActivation())
+	require.NoError(t, err)
+	assert.Empty(t, warnings(), "device at the threshold shouldn't be reported")
+
+	_, err = pool.CreateThinDevice(ctx, "thin-3", capacity*4+1, WithoutActivation())
+	require.NoError(t, err, "large device should only be reported by default")
+
+	reported := warnings()
+	require.Len(t, reported, 1)
+	assert.Equal(t, "thin-3", reported[0].Data["device"])
+
+	pool.rejectLargeDevices = true
+
+	_, err = pool.CreateThinDevice(ctx, "thin-4", capacity*4+1, WithoutActivation())
+	assert.True(t, errors.Is(err, ErrDeviceTooLarge))
+
+	_, err = pool.CreateSnapshotDevice(ctx, "thin-2", "snap-1", capacity*5, WithoutActivation())
+	assert.True(t, errors.Is(err, ErrDeviceTooLarge))
+
+	_, err = pool.metadata.GetDevice(ctx, "thin-4")
+	assert.True(t, errors.Is(err, ErrDeviceNotFound), "device shouldn't be created")
+	assert.Zero(t, dm.callCount("CreateSnapshot"))
+}
+
+func TestFakeReconcileActivation(t *testing.T) {
+	pool, dm, cleanup := newFakePool(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	_, err := pool.CreateThinDevice(ctx, "thin-1", device1Size, WithDeviceNodeTimeout(0))
+	require.NoError(t, err)
+
+	id2, err := pool.CreateThinDevice(ctx, "thin-2", device1Size, WithoutActivation())
+	require.NoError(t, err)
+
+	_, err = pool.CreateThinDevice(ctx, "thin-3", device1Size, WithoutActivation())
+	require.NoError(t, err)
+
+	updated, err := pool.reconcileActivation(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, updated, "metadata should match device-mapper")
+
+	// While the snapshotter isn't running, thin-1 is deactivated (like on reboot), thin-2 is activated with dmsetup,
+	// and a foreign device is activated as thin-3
+	err = dm.RemoveDevice(ctx, "thin-1")
+	require.NoError(t, err)
+
+	err = dm.ActivateDevice(dm.poolName, "thin-2", id2, device1Size, "")
+	require.NoError(t, err)
+
+	err = dm.CreateDevice(dm.poolName, 1000)
+	require.NoError(t, err)
+
+	err = dm.ActivateDevice(dm.poolName, "thin-3", 1000, device1Size, "")
+	require.NoError(t, err)
+
+	updated, err = pool.reconcileActivation(ctx)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"thin-1", "thin-2"}, updated)
+
+	for name, activated := range map[string]bool{"thin-1": false, "thin-2": true, "thin-3": false} {
+		info, err := pool.metadata.GetDevice(ctx, name)
+		require.NoError(t, err)
+		assert.Equal(t, activated, info.IsActivated, "activation state of %q", name)
+	}
+
+	// Reconciled device is activated again
+	err = pool.ReactivateDevice(ctx, "thin-1")
+	require.NoError(t, err)
+	assert.True(t, dm.isActive("thin-1"))
+}
+
+func TestFakeDeviceStates(t *testing.T) {
+	pool, dm, cleanup := newFakePool(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	assertState := func(name string, expected DeviceState) {
+		info, err := pool.metadata.GetDevice(ctx, name)
+		require.NoError(t, err)
+		assert.Equal(t, expected, info.State, "state of %q", name)
+	}
+
+	_, err := pool.CreateThinDevice(ctx, "thin-1", device1Size, WithDeviceNodeTimeout(0))
+	require.NoError(t, err)
+	assertState("thin-1", Activated)
+
+	err = pool.RemoveDevice(ctx, "thin-1", false)
+	require.NoError(t, err)
+	assertState("thin-1", Created)
+
+	// Failed activation goes back to the previous state
+	dm.failNext("ActivateDevice", unix.EINVAL)
+	err = pool.ReactivateDevice(ctx, "thin-1")
+	require.Error(t, err)
+	assertState("thin-1", Created)
+
+	err = pool.ReactivateDevice(ctx, "thin-1")
+	require.NoError(t, err)
+
+	dm.setBusy("thin-1", 1)
+	pool.removeRetry = removeRetry{retries: -1}
+	err = pool.RemoveDevice(ctx, "thin-1", false)
+	require.Error(t, err)
+	assertState("thin-1", Activated)
+
+	// Device which can't be rolled back is faulty, it can't be activated, but can be deleted
+	dm.failNext("ActivateDevice", unix.EINVAL)
+	dm.failNext("DeleteDevice", unix.EIO)
+	_, err = pool.CreateThinDevice(ctx, "thin-2", device1Size)
+	require.Error(t, err)
+	assertState("thin-2", Faulty)
+
+	err = pool.ReactivateDevice(ctx, "thin-2")
+	assert.EqualError(t, err, `device "thin-2" is faulty, it can only be deleted`)
+
+	// Faulty device is deleted from the store even if the pool doesn't have it anymore
+	info, err := pool.metadata.GetDevice(ctx, "thin-2")
+	require.NoError(t, err)
+	require.NoError(t, dm.DeleteDevice(dm.poolName, info.DeviceID))
+
+	err = pool.DeleteDevice(ctx, "thin-2")
+	require.NoError(t, err)
+
+	// Device which isn't faulty must be in the pool
+	info, err = pool.metadata.GetDevice(ctx, "thin-1")
+	require.NoError(t, err)
+	require.NoError(t, dm.RemoveDevice(ctx, "thin-1"))
+	require.NoError(t, dm.DeleteDevice(dm.poolName, info.DeviceID))
+	require.NoError(t, pool.setDeviceState(ctx, "thin-1", Created))
+	require.NoError(t, pool.metadata.UpdateDevice(ctx, "thin-1", func(info *DeviceInfo) error {
+		info.IsActivated = false
+		return nil
+	}))
+
+	err = pool.DeleteDevice(ctx, "thin-1")
+	assert.Equal(t, unix.ENODATA, errors.Cause(err))
+
+	summaries, err := pool.ListDevices(ctx)
+	require.NoError(t, err)
+	require.Len(t, summaries, 1)
+	assert.Equal(t, Created, summaries[0].State)
+}
+
+func TestFakeRecoverJournal(t *testing.T) {
+	pool, dm, cleanup := newFakePool(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	for _, name := range []string{"thin-1", "thin-2", "thin-3"} {
+		_, err := pool.CreateThinDevice(ctx, name, device1Size, WithDeviceNodeTimeout(0))
+		require.NoError(t, err)
+	}
+
+	err := pool.RemoveDevice(ctx, "thin-1", false)
+	require.NoError(t, err)
+
+	err = pool.RemoveDevice(ctx, "thin-2", false)
+	require.NoError(t, err)
+
+	// Crash while creating: "new-1" after thin device was created, "new-2" before
+	new1, err := pool.metadata.reserveDeviceID(&DeviceInfo{Name: "new-1", Size: device1Size}, false)
+	require.NoError(t, err)
+	require.NoError(t, dm.CreateDevice(dm.poolName, new1))
+
+	new2, err := pool.metadata.reserveDeviceID(&DeviceInfo{Name: "new-2", Size: device1Size}, false)
+	require.NoError(t, err)
+
+	// Crash while deleting: "thin-1" after thin device was deleted, "thin-2" before,
+	// "thin-3" is still activated and can't be deleted
+	info1, _, err := pool.metadata.beginRemove("thin-1")
+	require.NoError(t, err)
+	require.NoError(t, dm.DeleteDevice(dm.poolName, info1.DeviceID))
+
+	info2, _, err := pool.metadata.beginRemove("thin-2")
+	require.NoError(t, err)
+
+	_, _, err = pool.metadata.beginRemove("thin-3")
+	require.NoError(t, err)
+
+	err = pool.recoverDevices(ctx)
+	require.NoError(t, err)
+
+	journal, err := pool.metadata.getJournal(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, journal)
+
+	// Interrupted creates are undone, interrupted deletes are finished
+	for _, name := range []string{"new-1", "new-2", "thin-1", "thin-2"} {
+		_, err := pool.metadata.GetDevice(ctx, name)
+		assert.True(t, errors.Is(err, ErrDeviceNotFound), "device %q shouldn't be in the store", name)
+	}
+
+	for _, id := range []uint32{new1, new2, info1.DeviceID, info2.DeviceID} {
+		assert.False(t, dm.hasThinID(id), "device id %d shouldn't be in the pool", id)
+	}
+
+	stats, err := pool.Stats(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, stats.Devices)
+	assert.Equal(t, maxDeviceID-2, stats.AvailableDeviceIDs, "device ids should be freed")
+
+	info3, err := pool.metadata.GetDevice(ctx, "thin-3")
+	require.NoError(t, err)
+	assert.Equal(t, Faulty, info3.State)
+	assert.True(t, info3.IsActivated)
+}
+
+func TestFakeReconcileStates(t *testing.T) {
+	pool, dm, cleanup := newFakePool(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	_, err := pool.CreateThinDevice(ctx, "thin-1", device1Size, WithDeviceNodeTimeout(0))
+	require.NoError(t, err)
+
+	_, err = pool.CreateThinDevice(ctx, "thin-2", device1Size, WithoutActivation())
+	require.NoError(t, err)
+
+	// Crash while thin-1 was being deactivated and thin-2 was being activated, neither call was done
+	require.NoError(t, pool.setDeviceState(ctx, "thin-1", Deactivating))
+	require.NoError(t, pool.setDeviceState(ctx, "thin-2", Activating))
+
+	updated, err := pool.reconcileActivation(ctx)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"thin-1", "thin-2"}, updated)
+
+	for name, state := range map[string]DeviceState{"thin-1": Activated, "thin-2": Created} {
+		info, err := pool.metadata.GetDevice(ctx, name)
+		require.NoError(t, err)
+		assert.Equal(t, state, info.State, "state of %q", name)
+		assert.Equal(t, dm.isActive(name), info.IsActivated)
+	}
+}
+
+func TestFakeRemoveRetryDoesntBlockCreate(t *testing.T) {
+	pool, dm, cleanup := newFakePool(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	pool.removeRetry = removeRetry{retries: 1, delay: 500 * time.Millisecond}
+
+	_, err := pool.CreateThinDevice(ctx, "thin-1", device1Size, WithDeviceNodeTimeout(0))
+	require.NoError(t, err)
+
+	dm.setBusy("thin-1", 1)
+
+	removed := make(chan error, 1)
+	go func() {
+		removed <- pool.RemoveDevice(ctx, "thin-1", false)
+	}()
+
+	for dm.callCount("RemoveDevice") == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Removal is waiting to retry while holding only the lock of its device
+	_, err = pool.CreateThinDevice(ctx, "thin-2", device1Size, WithDeviceNodeTimeout(0))
+	require.NoError(t, err)
+
+	select {
+	case <-removed:
+		t.Fatal("create should finish while removal of another device is retried")
+	default:
+	}
+
+	require.NoError(t, <-removed)
+}
+
+func TestFakeRemovePoolWaitsForOperations(t *testing.T) {
+	pool, dm, cleanup := newFakePool(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	_, err := pool.CreateThinDevice(ctx, "thin-1", device1Size, WithDeviceNodeTimeout(0))
+	require.NoError(t, err)
+
+	// Operation in progress, like snapshot of a device
+	pool.offlineMutex.RLock()
+
+	removed := make(chan error, 1)
+	go func() {
+		removed <- pool.RemovePool(ctx, false)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+
+	select {
+	case <-removed:
+		t.Fatal("pool should not be removed while an operation is running")
+	default:
+	}
+
+	assert.Zero(t, dm.callCount("RemoveDevice"))
+	assert.True(t, dm.isActive("thin-1"))
+
+	pool.offlineMutex.RUnlock()
+
+	require.NoError(t, <-removed)
+	assert.False(t, dm.isActive("thin-1"))
+}
+
+func TestFakeConcurrentCreatesLimit(t *testing.T) {
+	pool, dm, cleanup := newFakePool(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	pool.maxDevices = 4
+	dm.setLatency(10 * time.Millisecond)
+
+	// Creates in flight are counted against the limit
+	var (
+		wg      sync.WaitGroup
+		created int32
+		refused int32
+	)
+
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			_, err := pool.CreateThinDevice(ctx, fmt.Sprintf("thin-%d", i), device1Size, WithDeviceNodeTimeout(0))
+			if err == nil {
+				atomic.AddInt32(&created, 1)
+			} else if errors.Is(err, ErrPoolAtCapacity) {
+				atomic.AddInt32(&refused, 1)
+			}
+		}(i)
+	}
+
+	wg.Wait()
+	assert.EqualValues(t, 4, created)
+	assert.EqualValues(t, 4, refused)
+	assert.Zero(t, pool.provisioningDevices)
+	assert.Zero(t, pool.provisioningBytes)
+}
+
+// BenchmarkFakeCreateSnapshotDevices takes snapshots of committed base devices over device-mapper taking
+// a millisecond per call, the way Prepare of containers from several images does. Snapshots of different bases
+// run in parallel, even while removal of a busy device is retried. Snapshots of the same base only wait for each
+// other while the base is suspended.
+func BenchmarkFakeCreateSnapshotDevices(b *testing.B) {
+	const baseCount = 8
+
+	ctx := context.Background()
+
+	run := func(b *testing.B, parallel, removing bool) {
+		pool, dm, cleanup := newFakePool(b)
+		defer cleanup()
+
+		logrus.SetLevel(logrus.WarnLevel)
+		defer logrus.SetLevel(logrus.InfoLevel)
+
+		for i := 0; i < baseCount; i++ {
+			_, err := pool.CreateThinDevice(ctx, fmt.Sprintf("thin-base-%d", i), device1Size, WithDeviceNodeTimeout(0))
+			require.NoError(b, err)
+		}
+
+		dm.setLatency(time.Millisecond)
+
+		if removing {
+			_, err := pool.CreateThinDevice(ctx, "thin-busy", device1Size, WithDeviceNodeTimeout(0))
+			require.NoError(b, err)
+
+			pool.removeRetry = removeRetry{retries: 1 << 20, delay: time.Millisecond}
+			dm.setBusy("thin-busy", 1<<20)
+
+			stop, cancel := context.WithCancel(ctx)
+			defer cancel()
+
+			go pool.RemoveDevice(stop, "thin-busy", false)
+		}
+
+		var names int64
+		snapshot := func() {
+			n := atomic.AddInt64(&names, 1)
+			baseName := fmt.Sprintf("thin-base-%d", n%baseCount)
+			if _, err := pool.CreateSnapshotDevice(ctx, baseName, fmt.Sprintf("snap-%d", n), device1Size, WithDeviceNodeTimeout(0)); err != nil {
+				b.Error(err)
+			}
+		}
+
+		b.ResetTimer()
+		if !parallel {
+			for i := 0; i < b.N; i++ {
+				snapshot()
+			}
+
+			return
+		}
+
+		b.SetParallelism(baseCount)
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				snapshot()
+			}
+		})
+	}
+
+	b.Run("Serial", func(b *testing.B) {
+		run(b, false, false)
+	})
+
+	b.Run("Parallel", func(b *testing.B) {
+		run(b, true, false)
+	})
+
+	b.Run("ParallelWhileRemoving", func(b *testing.B) {
+		run(b, true, true)
+	})
+}
@@ -21,7 +21,10 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/events"
 	"github.com/containerd/containerd/log"
 	"github.com/containerd/containerd/mount"
 	"github.com/containerd/containerd/snapshots"
@@ -31,11 +34,11 @@ import (
 	"github.com/sirupsen/logrus"
 
 	"github.com/firecracker-microvm/firecracker-containerd/snapshotter/pkg/dmsetup"
+	"github.com/firecracker-microvm/firecracker-containerd/snapshotter/pkg/losetup"
 )
 
 const (
 	metadataFileName = "metadata.db"
-	fsTypeExt4       = "ext4"
 )
 
 type closeFunc func() error
@@ -43,16 +46,47 @@ type closeFunc func() error
 // devmapper implements containerd's snapshotter (https://godoc.org/github.com/containerd/containerd/snapshots#Snapshotter)
 // based on Linux device-mapper targets.
 type Snapshotter struct {
-	store     *storage.MetaStore
-	pool      *PoolDevice
-	config    *Config
-	cleanupFn []closeFunc
-	closeOnce sync.Once
+	store      *storage.MetaStore
+	pool       *PoolDevice
+	config     *Config
+	configPath string
+	configLock sync.RWMutex
+	cleanupFn  []closeFunc
+	closeOnce  sync.Once
+
+	// Samples pool usage in the background, nil unless pool_monitor_interval is set
+	monitor *poolMonitor
+
+	// Runs fstrim on mounted active snapshots, nil unless fstrim_interval is set
+	trimmer *trimJob
+
+	// Receives PoolSpace events, low space is only logged if nil
+	publisher events.Publisher
 }
 
-func NewSnapshotter(ctx context.Context, configPath string) (*Snapshotter, error) {
+// Opt represents optional settings for NewSnapshotter call
+type Opt func(opts *snapshotterOptions)
+
+type snapshotterOptions struct {
+	publisher events.Publisher
+}
+
+// WithEventPublisher makes the snapshotter publish PoolSpace event to containerd once pool usage reaches
+// low_space_threshold. Without it low space is only logged.
+func WithEventPublisher(publisher events.Publisher) Opt {
+	return func(opts *snapshotterOptions) {
+		opts.publisher = publisher
+	}
+}
+
+func NewSnapshotter(ctx context.Context, configPath string, opts ...Opt) (_ *Snapshotter, retErr error) {
 	log.G(ctx).WithField("config-path", configPath).Info("creating devmapper snapshotter")
 
+	options := &snapshotterOptions{}
+	for _, opt := range opts {
+		opt(options)
+	}
+
 	var cleanupFn []closeFunc
 
 	config, err := LoadConfig(configPath)
@@ -71,19 +105,138 @@ func NewSnapshotter(ctx context.Context, configPath string) (*Snapshotter, error
 
 	cleanupFn = append(cleanupFn, store.Close)
 
-	poolDevice, err := NewPoolDevice(ctx, config)
+	var loopDevices []string
+	if config.usesLoopback() {
+		dataDevice, metadataDevice, err := attachLoopbackDevices(ctx, config)
+		if err != nil {
+			return nil, err
+		}
+
+		config.DataDevice, config.MetadataDevice = dataDevice, metadataDevice
+		loopDevices = []string{dataDevice, metadataDevice}
+
+		defer func() {
+			if retErr == nil {
+				return
+			}
+
+			if err := losetup.DetachLoopDevice(loopDevices...); err != nil {
+				log.G(ctx).WithError(err).Warn("failed to detach loop devices")
+			}
+		}()
+	}
+
+	var poolOpts []PoolOpt
+	if config.LowSpaceThreshold > 0 {
+		callback := publishLowSpace(options.publisher, config.PoolName, config.LowSpaceThreshold)
+		poolOpts = append(poolOpts, WithLowSpaceWarning(config.LowSpaceThreshold, callback))
+	}
+
+	if config.AutoExtendThreshold > 0 {
+		if _, err := losetup.GetBackingFile(config.DataDevice); err != nil {
+			return nil, errors.Wrapf(err, "auto extend needs data device on a loop device, %q is not one", config.DataDevice)
+		}
+
+		extend := extendLoopDevice(config.DataDevice, config.AutoExtendSizeBytes)
+		poolOpts = append(poolOpts, WithAutoExtend(config.AutoExtendThreshold, extend))
+	}
+
+	poolDevice, err := NewPoolDevice(ctx, config, poolOpts...)
 	if err != nil {
 		return nil, err
 	}
 
 	cleanupFn = append(cleanupFn, poolDevice.Close)
 
-	return &Snapshotter{
-		store:     store,
-		config:    config,
-		pool:      poolDevice,
-		cleanupFn: cleanupFn,
-	}, nil
+	// Pool is torn down while its metadata store is still open
+	if len(loopDevices) > 0 {
+		cleanupFn = append([]closeFunc{teardownLoopbackPool(poolDevice, loopDevices...)}, cleanupFn...)
+	}
+
+	// Monitor is stopped first, so it doesn't query the pool being closed
+	var monitor *poolMonitor
+	if config.PoolMonitorIntervalDuration > 0 {
+		monitor = startPoolMonitor(ctx, poolDevice, config.PoolMonitorIntervalDuration)
+		cleanupFn = append([]closeFunc{monitor.Close}, cleanupFn...)
+	}
+
+	dm := &Snapshotter{
+		store:      store,
+		config:     config,
+		configPath: configPath,
+		pool:       poolDevice,
+		cleanupFn:  cleanupFn,
+		monitor:    monitor,
+		publisher:  options.publisher,
+	}
+
+	// Stopped before the store it walks is closed
+	if config.FstrimIntervalDuration > 0 {
+		dm.trimmer = startTrimJob(ctx, dm, config.FstrimIntervalDuration)
+		dm.cleanupFn = append([]closeFunc{dm.trimmer.Close}, dm.cleanupFn...)
+	}
+
+	return dm, nil
+}
+
+// Reload re-reads configuration file and applies the changes which don't require recreating the pool
+// (mkfs options, over-provisioning ratio, refuse Prepare threshold and discard mount option). Nothing is applied if any other field is changed.
+func (dm *Snapshotter) Reload(ctx context.Context) error {
+	log.G(ctx).WithField("config-path", dm.configPath).Info("reloading devmapper configuration")
+
+	next, err := LoadConfig(dm.configPath)
+	if err != nil {
+		return err
+	}
+
+	dm.configLock.Lock()
+	defer dm.configLock.Unlock()
+
+	// Loop devices attached at start aren't in the file
+	if next.usesLoopback() {
+		next.DataDevice, next.MetadataDevice = dm.config.DataDevice, dm.config.MetadataDevice
+	}
+
+	changes, err := dm.config.reloadDiff(next)
+	if err != nil {
+		return errors.Wrap(err, "configuration can't be reloaded")
+	}
+
+	if len(changes) == 0 {
+		log.G(ctx).Info("configuration is unchanged")
+		return nil
+	}
+
+	if next.OverProvisioningRatio != dm.config.OverProvisioningRatio {
+		if err := dm.pool.setOverProvisioningRatio(ctx, next.OverProvisioningRatio); err != nil {
+			return err
+		}
+	}
+
+	if next.LowSpaceThreshold != dm.config.LowSpaceThreshold {
+		callback := publishLowSpace(dm.publisher, next.PoolName, next.LowSpaceThreshold)
+		dm.pool.setLowSpaceWarning(ctx, next.LowSpaceThreshold, callback)
+	}
+
+	if retry := newRemoveRetry(next); retry != newRemoveRetry(dm.config) {
+		dm.pool.setRemoveRetry(ctx, retry)
+	}
+
+	dm.config = next
+
+	for _, change := range changes {
+		log.G(ctx).Infof("applied %s", change)
+	}
+
+	return nil
+}
+
+// currentConfig returns configuration in effect, it's replaced as a whole on reload
+func (dm *Snapshotter) currentConfig() *Config {
+	dm.configLock.RLock()
+	defer dm.configLock.RUnlock()
+
+	return dm.config
 }
 
 func (dm *Snapshotter) Stat(ctx context.Context, key string) (snapshots.Info, error) {
@@ -120,10 +273,49 @@ func (dm *Snapshotter) Update(ctx context.Context, info snapshots.Info, fieldpat
 	return info, complete(ctx, trans, nil)
 }
 
+// Usage returns space used by the snapshot. Empty key returns data space used by the whole pool.
 func (dm *Snapshotter) Usage(ctx context.Context, key string) (snapshots.Usage, error) {
 	log.G(ctx).WithField("key", key).Debug("usage")
 
-	return snapshots.Usage{}, errors.New("usage not implemented")
+	if key == "" {
+		status, err := dm.PoolUsage(ctx)
+		if err != nil {
+			return snapshots.Usage{}, err
+		}
+
+		return snapshots.Usage{Size: int64(status.UsedDataBytes())}, nil
+	}
+
+	ctx, trans, err := dm.store.TransactionContext(ctx, false)
+	if err != nil {
+		return snapshots.Usage{}, err
+	}
+
+	defer trans.Rollback()
+
+	snapID, _, _, err := storage.GetInfo(ctx, key)
+	if err != nil {
+		return snapshots.Usage{}, err
+	}
+
+	// Device space shared with the parent snapshot is accounted to the parent
+	size, err := dm.pool.GetUsage(ctx, dm.getDeviceName(snapID))
+	if err != nil {
+		return snapshots.Usage{}, toErrdefs(err)
+	}
+
+	return snapshots.Usage{Size: int64(size)}, nil
+}
+
+// PoolUsage returns the latest pool status sampled by the monitor, pool is queried if there is no sample
+func (dm *Snapshotter) PoolUsage(ctx context.Context) (*PoolStatus, error) {
+	if dm.monitor != nil {
+		if status := dm.monitor.latest(); status != nil {
+			return status, nil
+		}
+	}
+
+	return dm.pool.GetPoolStatus(ctx)
 }
 
 func (dm *Snapshotter) Mounts(ctx context.Context, key string) ([]mount.Mount, error) {
@@ -141,14 +333,45 @@ func (dm *Snapshotter) Mounts(ctx context.Context, key string) ([]mount.Mount, e
 		return nil, err
 	}
 
-	return dm.buildMounts(snap), nil
+	_, info, _, err := storage.GetInfo(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return dm.buildMounts(snap, info.Labels), nil
 }
 
 func (dm *Snapshotter) Prepare(ctx context.Context, key, parent string, opts ...snapshots.Opt) ([]mount.Mount, error) {
 	log.G(ctx).WithFields(logrus.Fields{"key": key, "parent": parent}).Debug("prepare")
+
+	if err := dm.checkPoolSpace(); err != nil {
+		return nil, toErrdefs(err)
+	}
+
 	return dm.createSnapshot(ctx, snapshots.KindActive, key, parent, opts...)
 }
 
+// checkPoolSpace refuses new active snapshots once the latest sample of pool usage reaches refuse_prepare_threshold
+func (dm *Snapshotter) checkPoolSpace() error {
+	threshold := dm.currentConfig().RefusePrepareThreshold
+	if dm.monitor == nil || threshold == 0 {
+		return nil
+	}
+
+	status := dm.monitor.latest()
+	if status == nil {
+		return nil
+	}
+
+	dataUsage, metadataUsage := status.DataUsage(), status.MetadataUsage()
+	if dataUsage < threshold && metadataUsage < threshold {
+		return nil
+	}
+
+	return errors.Wrapf(ErrPoolFull, "pool %q has %.1f%% of data and %.1f%% of metadata space used, new snapshots are refused at %g%%",
+		dm.pool.poolName, dataUsage, metadataUsage, threshold)
+}
+
 func (dm *Snapshotter) View(ctx context.Context, key, parent string, opts ...snapshots.Opt) ([]mount.Mount, error) {
 	log.G(ctx).WithFields(logrus.Fields{"key": key, "parent": parent}).Debug("prepare")
 	return dm.createSnapshot(ctx, snapshots.KindView, key, parent, opts...)
@@ -184,7 +407,8 @@ func (dm *Snapshotter) Remove(ctx context.Context, key string) error {
 	}
 
 	deviceName := dm.getDeviceName(snapID)
-	if err := dm.pool.RemoveDevice(ctx, deviceName, true); err != nil {
+	// Device is deleted in the background, so busy device doesn't block the snapshotter or get leaked
+	if err := dm.pool.DeleteDeviceDeferred(ctx, deviceName); err != nil {
 		log.G(ctx).WithError(err).Errorf("failed to remove device")
 		return complete(ctx, trans, err)
 	}
@@ -192,6 +416,170 @@ func (dm *Snapshotter) Remove(ctx context.Context, key string) error {
 	return complete(ctx, trans, nil)
 }
 
+// ExpandOpt represents optional settings for Expand call
+type ExpandOpt func(opts *expandOptions)
+
+type expandOptions struct {
+	deviceOnly bool
+}
+
+// WithoutFilesystemResize grows only the device, for instance when it's attached to a running VM
+// which grows the filesystem itself
+func WithoutFilesystemResize() ExpandOpt {
+	return func(opts *expandOptions) {
+		opts.deviceOnly = true
+	}
+}
+
+// Expand grows device of an active snapshot to newSizeBytes, which may go beyond base_image_size, and grows
+// its filesystem online. The device table is reloaded with the new size, then the filesystem is mounted on
+// the host for a while and grown with resize2fs or xfs_growfs. Don't let the host mount filesystem used by
+// a VM, expand such snapshot with WithoutFilesystemResize and grow the filesystem in the guest instead.
+func (dm *Snapshotter) Expand(ctx context.Context, key string, newSizeBytes uint64, opts ...ExpandOpt) error {
+	log.G(ctx).WithFields(logrus.Fields{"key": key, "size": newSizeBytes}).Debug("expand")
+
+	options := &expandOptions{}
+	for _, opt := range opts {
+		opt(options)
+	}
+
+	ctx, trans, err := dm.store.TransactionContext(ctx, false)
+	if err != nil {
+		return err
+	}
+
+	defer trans.Rollback()
+
+	snap, err := storage.GetSnapshot(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	if snap.Kind != snapshots.KindActive {
+		return errors.Wrapf(errdefs.ErrFailedPrecondition, "snapshot %q is not active, only active snapshots can be expanded", key)
+	}
+
+	deviceName := dm.getDeviceName(snap.ID)
+	if err := dm.pool.ResizeDevice(ctx, deviceName, newSizeBytes); err != nil {
+		return toErrdefs(errors.Wrapf(err, "failed to resize device of snapshot %q", key))
+	}
+
+	if options.deviceOnly {
+		return nil
+	}
+
+	fsType := dm.currentConfig().FilesystemType
+	return mount.WithTempMount(ctx, dm.buildMounts(snap, nil), func(root string) error {
+		return growFilesystem(ctx, fsType, dm.getDevicePath(snap), root)
+	})
+}
+
+// MountReadOnly takes a read-only snapshot of the live device of an active snapshot and mounts it on the host
+// for inspection or backup without disturbing the user of the device (like a running VM).
+// Returns the host path where the filesystem is mounted, use UnmountReadOnly to clean up.
+// The copy is only crash-consistent: writes cached in the guest are not included unless it synced first
+// or filesystem is frozen with WithFreeze option.
+func (dm *Snapshotter) MountReadOnly(ctx context.Context, key string, opts ...CreateOpt) (string, error) {
+	log.G(ctx).WithField("key", key).Debug("mount read-only")
+
+	ctx, trans, err := dm.store.TransactionContext(ctx, false)
+	if err != nil {
+		return "", err
+	}
+
+	defer trans.Rollback()
+
+	snap, err := storage.GetSnapshot(ctx, key)
+	if err != nil {
+		return "", err
+	}
+
+	if snap.Kind != snapshots.KindActive {
+		return "", errors.Errorf("snapshot %q is not active, mount it directly", key)
+	}
+
+	var (
+		deviceName  = dm.getDeviceName(snap.ID)
+		inspectName = dm.getInspectDeviceName(snap.ID)
+		mountPath   = dm.getInspectMountPath(snap.ID)
+	)
+
+	createOpts := append([]CreateOpt{WithReadOnly()}, opts...)
+	if makeCreateOptions(createOpts).freezer == nil {
+		log.G(ctx).Warnf("read-only copy of %q is crash-consistent only, sync filesystem in the guest to include cached writes", key)
+	}
+
+	info, err := dm.pool.metadata.GetDevice(ctx, deviceName)
+	if err != nil {
+		return "", toErrdefs(err)
+	}
+
+	if _, err := dm.pool.CreateSnapshotDevice(ctx, deviceName, inspectName, info.Size, createOpts...); err != nil {
+		return "", toErrdefs(errors.Wrapf(err, "failed to create read-only snapshot of %q", deviceName))
+	}
+
+	if err := os.MkdirAll(mountPath, 0700); err != nil {
+		dm.deleteInspectDevice(ctx, inspectName)
+		return "", errors.Wrapf(err, "failed to create mount point %q", mountPath)
+	}
+
+	// Journal of a live filesystem is not clean, "noload" ("norecovery" for xfs) skips replaying it as the device is read-only
+	fsType := dm.currentConfig().FilesystemType
+	options := []string{"ro", "noload"}
+	if fsType == "xfs" {
+		options = []string{"ro", "norecovery"}
+	}
+
+	mounts := []mount.Mount{
+		{
+			Source:  dmsetup.GetFullDevicePath(inspectName),
+			Type:    fsType,
+			Options: append(options, filesystemMountOptions(fsType)...),
+		},
+	}
+
+	if err := mount.All(mounts, mountPath); err != nil {
+		dm.deleteInspectDevice(ctx, inspectName)
+		return "", errors.Wrapf(err, "failed to mount read-only copy of %q", key)
+	}
+
+	return mountPath, nil
+}
+
+// UnmountReadOnly unmounts and deletes read-only copy created by MountReadOnly
+func (dm *Snapshotter) UnmountReadOnly(ctx context.Context, key string) error {
+	log.G(ctx).WithField("key", key).Debug("unmount read-only")
+
+	ctx, trans, err := dm.store.TransactionContext(ctx, false)
+	if err != nil {
+		return err
+	}
+
+	defer trans.Rollback()
+
+	snap, err := storage.GetSnapshot(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	mountPath := dm.getInspectMountPath(snap.ID)
+	if err := mount.UnmountAll(mountPath, 0); err != nil {
+		return errors.Wrapf(err, "failed to unmount %q", mountPath)
+	}
+
+	if err := os.Remove(mountPath); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "failed to remove mount point %q", mountPath)
+	}
+
+	return dm.pool.DeleteDevice(ctx, dm.getInspectDeviceName(snap.ID))
+}
+
+func (dm *Snapshotter) deleteInspectDevice(ctx context.Context, deviceName string) {
+	if err := dm.pool.DeleteDevice(ctx, deviceName); err != nil {
+		log.G(ctx).WithError(err).Errorf("failed to delete read-only device %q", deviceName)
+	}
+}
+
 func (dm *Snapshotter) Walk(ctx context.Context, fn func(context.Context, snapshots.Info) error) error {
 	log.G(ctx).Debug("walk")
 
@@ -225,6 +613,12 @@ func (dm *Snapshotter) createSnapshot(ctx context.Context, kind snapshots.Kind,
 		return nil, err
 	}
 
+	// Time spent here is a part of container cold start, log it next to VM boot timing
+	start := time.Now()
+	defer func() {
+		log.G(ctx).WithField("key", key).Infof("snapshot device created in %s", time.Since(start))
+	}()
+
 	snap, err := storage.CreateSnapshot(ctx, kind, key, parent, opts...)
 	if err != nil {
 		return nil, complete(ctx, trans, err)
@@ -234,13 +628,13 @@ func (dm *Snapshotter) createSnapshot(ctx context.Context, kind snapshots.Kind,
 		deviceName := dm.getDeviceName(snap.ID)
 		log.G(ctx).Debugf("creating new thin device '%s'", deviceName)
 
-		err := dm.pool.CreateThinDevice(ctx, deviceName, dm.config.BaseImageSizeBytes)
+		_, err := dm.pool.CreateThinDevice(ctx, deviceName, dm.currentConfig().BaseImageSizeBytes)
 		if err != nil {
 			log.G(ctx).WithError(err).Errorf("failed to create thin device for snapshot %s", snap.ID)
 			return nil, complete(ctx, trans, err)
 		}
 
-		if err := dm.mkfs(ctx, deviceName); err != nil {
+		if err := dm.mkfs(ctx, deviceName, dm.currentConfig().BaseImageSizeBytes); err != nil {
 			return nil, complete(ctx, trans, err)
 		}
 	} else {
@@ -248,14 +642,19 @@ func (dm *Snapshotter) createSnapshot(ctx context.Context, kind snapshots.Kind,
 		snapDeviceName := dm.getDeviceName(snap.ID)
 		log.G(ctx).Debugf("creating snapshot device '%s' from '%s'", snapDeviceName, parentDeviceName)
 
-		err := dm.pool.CreateSnapshotDevice(ctx, parentDeviceName, snapDeviceName, dm.config.BaseImageSizeBytes)
+		_, err := dm.pool.CreateSnapshotDevice(ctx, parentDeviceName, snapDeviceName, dm.currentConfig().BaseImageSizeBytes)
 		if err != nil {
 			log.G(ctx).WithError(err).Errorf("failed to create snapshot device from parent %s", parentDeviceName)
 			return nil, complete(ctx, trans, err)
 		}
 	}
 
-	mounts := dm.buildMounts(snap)
+	_, info, _, err := storage.GetInfo(ctx, key)
+	if err != nil {
+		return nil, complete(ctx, trans, err)
+	}
+
+	mounts := dm.buildMounts(snap, info.Labels)
 
 	// Remove default directories not expected by the container image
 	_ = mount.WithTempMount(ctx, mounts, func(root string) error {
@@ -265,16 +664,21 @@ func (dm *Snapshotter) createSnapshot(ctx context.Context, kind snapshots.Kind,
 	return mounts, complete(ctx, trans, nil)
 }
 
-func (dm *Snapshotter) mkfs(ctx context.Context, deviceName string) error {
-	args := []string{
-		"-E",
-		// We don't want any zeroing in advance when running mkfs on thin devices (see "man mkfs.ext4")
-		"nodiscard,lazy_itable_init=0,lazy_journal_init=0",
-		dmsetup.GetFullDevicePath(deviceName),
+func (dm *Snapshotter) mkfs(ctx context.Context, deviceName string, sizeBytes uint64) error {
+	config := dm.currentConfig()
+
+	args, err := config.mkfsArgs(dmsetup.GetFullDevicePath(deviceName), sizeBytes)
+	if err != nil {
+		return err
 	}
 
-	log.G(ctx).Debugf("mkfs.ext4 %s", strings.Join(args, " "))
-	output, err := exec.Command("mkfs.ext4", args...).CombinedOutput()
+	tool, err := mkfsTool(config.FilesystemType)
+	if err != nil {
+		return err
+	}
+
+	log.G(ctx).Debugf("%s %s", tool, strings.Join(args, " "))
+	output, err := exec.Command(tool, args...).CombinedOutput()
 	if err != nil {
 		log.G(ctx).WithError(err).Errorf("failed to write fs:\n%s", string(output))
 		return err
@@ -286,7 +690,15 @@ func (dm *Snapshotter) mkfs(ctx context.Context, deviceName string) error {
 
 func (dm *Snapshotter) getDeviceName(snapID string) string {
 	// Add pool name as prefix to avoid collisions with devices from other pools
-	return fmt.Sprintf("%s-snap-%s", dm.config.PoolName, snapID)
+	return fmt.Sprintf("%s-snap-%s", dm.currentConfig().PoolName, snapID)
+}
+
+func (dm *Snapshotter) getInspectDeviceName(snapID string) string {
+	return dm.getDeviceName(snapID) + "-ro"
+}
+
+func (dm *Snapshotter) getInspectMountPath(snapID string) string {
+	return filepath.Join(dm.currentConfig().RootPath, "inspect", snapID)
 }
 
 func (dm *Snapshotter) getDevicePath(snap storage.Snapshot) string {
@@ -294,17 +706,21 @@ func (dm *Snapshotter) getDevicePath(snap storage.Snapshot) string {
 	return dmsetup.GetFullDevicePath(name)
 }
 
-func (dm *Snapshotter) buildMounts(snap storage.Snapshot) []mount.Mount {
-	var options []string
+// buildMounts returns mounts of the snapshot, labels of active snapshot may opt it out of mount_discard
+func (dm *Snapshotter) buildMounts(snap storage.Snapshot, labels map[string]string) []mount.Mount {
+	config := dm.currentConfig()
+	options := filesystemMountOptions(config.FilesystemType)
 
 	if snap.Kind != snapshots.KindActive {
 		options = append(options, "ro")
+	} else if config.MountDiscard && discardEnabled(labels) {
+		options = append(options, "discard")
 	}
 
 	mounts := []mount.Mount{
 		{
 			Source:  dm.getDevicePath(snap),
-			Type:    fsTypeExt4,
+			Type:    config.FilesystemType,
 			Options: options,
 		},
 	}
@@ -325,5 +741,21 @@ func complete(ctx context.Context, trans storage.Transactor, err error) error {
 		}
 	}
 
-	return err
+	return toErrdefs(err)
+}
+
+// toErrdefs maps pool errors to containerd error classes, so clients get AlreadyExists, NotFound and Unavailable gRPC codes
+func toErrdefs(err error) error {
+	switch {
+	case errors.Is(err, ErrDeviceAlreadyExists), errors.Is(err, ErrSnapshotAlreadyExists), errors.Is(err, ErrDeviceConflict):
+		return errors.Wrap(errdefs.ErrAlreadyExists, err.Error())
+	case errors.Is(err, ErrDeviceNotFound):
+		return errors.Wrap(errdefs.ErrNotFound, err.Error())
+	case errors.Is(err, ErrPoolFull):
+		return errors.Wrap(errdefs.ErrUnavailable, err.Error())
+	case errors.Is(err, ErrShrinkNotSupported):
+		return errors.Wrap(errdefs.ErrInvalidArgument, err.Error())
+	default:
+		return err
+	}
 }
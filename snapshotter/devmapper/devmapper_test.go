@@ -22,12 +22,15 @@ import (
 	"testing"
 	"time"
 
+	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/snapshots"
 	"github.com/containerd/containerd/snapshots/testsuite"
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	"github.com/firecracker-microvm/firecracker-containerd/snapshotter/pkg/dmsetup"
 	"github.com/firecracker-microvm/firecracker-containerd/snapshotter/pkg/losetup"
 )
 
@@ -58,7 +61,7 @@ func TestSnapshotterSuite(t *testing.T) {
 
 		// Remove device mapper pool after test completes
 		removePool := func() error {
-			return snap.pool.RemovePool(ctx)
+			return snap.pool.RemovePool(ctx, false)
 		}
 
 		// Pool cleanup should be called before closing metadata store (as we need to retrieve device names)
@@ -83,3 +86,28 @@ func saveConfig(t *testing.T, path string, config *Config) {
 	err = ioutil.WriteFile(path, data, 0700)
 	require.NoError(t, err)
 }
+
+func TestToErrdefs(t *testing.T) {
+	err := toErrdefs(errors.Wrapf(ErrDeviceAlreadyExists, "device %q", "thin-1"))
+	assert.True(t, errdefs.IsAlreadyExists(err))
+	assert.Contains(t, err.Error(), "thin-1")
+
+	err = toErrdefs(errors.Wrapf(ErrSnapshotAlreadyExists, "snapshot %q", "snap-1"))
+	assert.True(t, errdefs.IsAlreadyExists(err))
+
+	err = toErrdefs(errors.Wrapf(ErrDeviceConflict, "device %q", "thin-1"))
+	assert.True(t, errdefs.IsAlreadyExists(err))
+
+	err = toErrdefs(errors.Wrapf(ErrDeviceNotFound, "device %q", "thin-2"))
+	assert.True(t, errdefs.IsNotFound(err))
+
+	err = toErrdefs(&PoolHealthError{PoolName: "test-pool", Condition: PoolOutOfDataSpace, Status: &dmsetup.PoolStatus{}})
+	assert.True(t, errdefs.IsUnavailable(err))
+
+	err = toErrdefs(errors.Wrapf(ErrShrinkNotSupported, "device %q", "thin-1"))
+	assert.True(t, errdefs.IsInvalidArgument(err))
+
+	expected := errors.New("pool error")
+	assert.Equal(t, expected, toErrdefs(expected))
+	assert.Nil(t, toErrdefs(nil))
+}
@@ -0,0 +1,110 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package devmapper
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/containerd/containerd/log"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// Filesystem freeze ioctls from linux/fs.h, _IOWR('X', 119, int) and _IOWR('X', 120, int)
+const (
+	ioctlFIFREEZE = 0xc0045877
+	ioctlFITHAW   = 0xc0045878
+)
+
+// mountFreezer freezes filesystem mounted at the given path with FIFREEZE, like "fsfreeze" does
+type mountFreezer struct {
+	mountPoint string
+}
+
+// NewMountFreezer returns FilesystemFreezer of the filesystem mounted at mountPoint, to be used with WithFreeze
+// when the filesystem on the base device is mounted on this host. Freezing requires CAP_SYS_ADMIN.
+func NewMountFreezer(mountPoint string) FilesystemFreezer {
+	return &mountFreezer{mountPoint: mountPoint}
+}
+
+// Replaced in tests, which can't freeze filesystems
+var newMountFreezer = NewMountFreezer
+
+func (f *mountFreezer) Freeze(ctx context.Context) error {
+	return f.ioctl(ioctlFIFREEZE, "freeze")
+}
+
+func (f *mountFreezer) Thaw(ctx context.Context) error {
+	return f.ioctl(ioctlFITHAW, "thaw")
+}
+
+func (f *mountFreezer) ioctl(request uintptr, what string) error {
+	dir, err := os.Open(f.mountPoint)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open mount point %q", f.mountPoint)
+	}
+
+	defer dir.Close()
+
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, dir.Fd(), request, 0); errno != 0 {
+		return errors.Wrapf(errno, "failed to %s filesystem at %q", what, f.mountPoint)
+	}
+
+	return nil
+}
+
+// WithMountFreeze freezes filesystem on the base device while snapshot is taken, like WithFreeze, with mount point
+// of the filesystem looked up in /proc/self/mountinfo. Base device must be activated and mounted on this host
+// (not only inside a VM), otherwise snapshot fails. Filesystem is thawed once snapshot is created, even if that fails.
+func WithMountFreeze() CreateOpt {
+	return func(opts *createOptions) {
+		opts.mountFreeze = true
+	}
+}
+
+// snapshotFreezer returns freezer of filesystem on the base device requested by options, nil if none
+func (p *PoolDevice) snapshotFreezer(ctx context.Context, info *DeviceInfo, options *createOptions) (FilesystemFreezer, error) {
+	if !options.mountFreeze {
+		return options.freezer, nil
+	}
+
+	if options.freezer != nil {
+		return nil, errors.New("WithFreeze and WithMountFreeze can't be used together")
+	}
+
+	if !info.IsActivated {
+		return nil, errors.Errorf("device %q is not activated, its filesystem can't be frozen", info.Name)
+	}
+
+	infos, err := p.dm.Info(info.Name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to query device %q", info.Name)
+	}
+
+	mounts, err := readMountPoints(mountInfoPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// Bind mounts share the filesystem, freezing any of them freezes it
+	points := mounts[fmt.Sprintf("%d:%d", infos[0].Major, infos[0].Minor)]
+	if len(points) == 0 {
+		return nil, errors.Errorf("device %q is not mounted, its filesystem can't be frozen", info.Name)
+	}
+
+	log.G(ctx).Debugf("freezing filesystem of device %q mounted at %q", info.Name, points[0])
+	return newMountFreezer(points[0]), nil
+}
@@ -0,0 +1,129 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package devmapper
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestMountFreezerMissingMountPoint(t *testing.T) {
+	freezer := NewMountFreezer("/non/existing/mount/point")
+
+	err := freezer.Freeze(context.Background())
+	assert.Error(t, err)
+
+	err = freezer.Thaw(context.Background())
+	assert.Error(t, err)
+}
+
+// setMountInfo points mountInfoPath to a file with the given contents and makes mount point freezers
+// record calls in the returned freezers by mount point
+func setMountInfo(t *testing.T, mountInfo string) (map[string]*testFreezer, func()) {
+	tempDir, err := ioutil.TempDir("", "mountinfo-")
+	require.NoError(t, err)
+
+	path := filepath.Join(tempDir, "mountinfo")
+	err = ioutil.WriteFile(path, []byte(mountInfo), 0600)
+	require.NoError(t, err)
+
+	freezers := make(map[string]*testFreezer)
+	prevPath, prevFreezer := mountInfoPath, newMountFreezer
+
+	mountInfoPath = path
+	newMountFreezer = func(mountPoint string) FilesystemFreezer {
+		if freezers[mountPoint] == nil {
+			freezers[mountPoint] = &testFreezer{}
+		}
+
+		return freezers[mountPoint]
+	}
+
+	return freezers, func() {
+		mountInfoPath, newMountFreezer = prevPath, prevFreezer
+		os.RemoveAll(tempDir)
+	}
+}
+
+func TestFakeMountFreeze(t *testing.T) {
+	pool, dm, cleanup := newFakePool(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	id, err := pool.CreateThinDevice(ctx, "thin-1", device1Size, WithDeviceNodeTimeout(0))
+	require.NoError(t, err)
+
+	freezers, restore := setMountInfo(t, fmt.Sprintf("22 1 %d:%d / /mnt/thin\\0401 rw,relatime shared:1 - ext4 /dev/mapper/thin-1 rw\n", fakeDeviceMajor, id))
+	defer restore()
+
+	_, err = pool.CreateSnapshotDevice(ctx, "thin-1", "snap-1", device1Size, WithMountFreeze(), WithDeviceNodeTimeout(0))
+	require.NoError(t, err)
+
+	freezer := freezers["/mnt/thin 1"]
+	require.NotNil(t, freezer, "filesystem should be frozen at its mount point")
+	assert.Equal(t, 1, freezer.frozen)
+	assert.Equal(t, 1, freezer.thawed)
+
+	// Filesystem is thawed and base device resumed if snapshot fails
+	dm.failNext("CreateSnapshot", unix.EIO)
+	_, err = pool.CreateSnapshotDevice(ctx, "thin-1", "snap-2", device1Size, WithMountFreeze())
+	require.Error(t, err)
+	assert.Equal(t, 2, freezer.frozen)
+	assert.Equal(t, 2, freezer.thawed)
+	assert.Equal(t, dm.callCount("SuspendDevice"), dm.callCount("ResumeDevice"))
+
+	_, err = pool.CreateSnapshots(ctx, "thin-1", []string{"snap-3", "snap-4"}, device1Size, WithMountFreeze(), WithDeviceNodeTimeout(0))
+	require.NoError(t, err)
+	assert.Equal(t, 3, freezer.frozen)
+	assert.Equal(t, 3, freezer.thawed)
+
+	_, err = pool.CreateSnapshotDevice(ctx, "thin-1", "snap-5", device1Size, WithMountFreeze(), WithFreeze(&testFreezer{}))
+	assert.Error(t, err, "only one way to freeze filesystem should be accepted")
+}
+
+func TestFakeMountFreezeNotMounted(t *testing.T) {
+	pool, dm, cleanup := newFakePool(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	_, err := pool.CreateThinDevice(ctx, "thin-1", device1Size, WithDeviceNodeTimeout(0))
+	require.NoError(t, err)
+
+	_, err = pool.CreateThinDevice(ctx, "thin-2", device1Size, WithoutActivation())
+	require.NoError(t, err)
+
+	freezers, restore := setMountInfo(t, "22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw\n")
+	defer restore()
+
+	_, err = pool.CreateSnapshotDevice(ctx, "thin-1", "snap-1", device1Size, WithMountFreeze())
+	assert.EqualError(t, err, `device "thin-1" is not mounted, its filesystem can't be frozen`)
+
+	_, err = pool.CreateSnapshotDevice(ctx, "thin-2", "snap-2", device1Size, WithMountFreeze())
+	assert.EqualError(t, err, `device "thin-2" is not activated, its filesystem can't be frozen`)
+
+	// Snapshot isn't taken without freeze it was asked for
+	assert.Empty(t, freezers)
+	assert.Zero(t, dm.callCount("SuspendDevice"))
+	assert.Zero(t, dm.callCount("CreateSnapshot"))
+}
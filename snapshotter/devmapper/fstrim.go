@@ -0,0 +1,183 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package devmapper
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/mount"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/containerd/containerd/snapshots/storage"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// DiscardLabel set to "false" on Prepare opts the snapshot out of mount_discard and fstrim_interval,
+// for instance when write latency matters more than returning free space to the pool
+const DiscardLabel = "containerd.io/snapshot/devmapper.discard"
+
+// discardEnabled tells whether snapshot labels allow discard, values other than booleans are ignored
+func discardEnabled(labels map[string]string) bool {
+	value, ok := labels[DiscardLabel]
+	if !ok {
+		return true
+	}
+
+	enabled, err := strconv.ParseBool(value)
+	return err != nil || enabled
+}
+
+// trimJob runs fstrim on filesystems of active snapshots in the background. Only filesystems mounted on the host
+// are trimmed, devices attached to VMs are left to the guest.
+type trimJob struct {
+	snapshotter *Snapshotter
+	interval    time.Duration
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func startTrimJob(ctx context.Context, snapshotter *Snapshotter, interval time.Duration) *trimJob {
+	ctx, cancel := context.WithCancel(ctx)
+
+	j := &trimJob{
+		snapshotter: snapshotter,
+		interval:    interval,
+		cancel:      cancel,
+		done:        make(chan struct{}),
+	}
+
+	go j.run(ctx)
+	return j
+}
+
+func (j *trimJob) run(ctx context.Context) {
+	defer close(j.done)
+
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := j.snapshotter.trimSnapshots(ctx); err != nil {
+				log.G(ctx).WithError(err).Warn("failed to trim snapshots")
+			}
+		}
+	}
+}
+
+// Close stops the job and waits for fstrim being run
+func (j *trimJob) Close() error {
+	j.cancel()
+	<-j.done
+	return nil
+}
+
+// trimSnapshots runs fstrim on mounted filesystems of active snapshots which aren't opted out with DiscardLabel.
+// Failure to trim one snapshot is logged, so it doesn't keep the others from being trimmed.
+func (dm *Snapshotter) trimSnapshots(ctx context.Context) error {
+	devicePaths, err := dm.trimCandidates(ctx)
+	if err != nil {
+		return err
+	}
+
+	mounts, err := mount.Self()
+	if err != nil {
+		return errors.Wrap(err, "failed to read mount table")
+	}
+
+	for _, devicePath := range devicePaths {
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		mountPoint, err := trimDevice(ctx, devicePath, mounts)
+		if err != nil {
+			log.G(ctx).WithError(err).Warnf("failed to trim %q", devicePath)
+		} else if mountPoint != "" {
+			log.G(ctx).Debugf("trimmed %q mounted at %q", devicePath, mountPoint)
+		}
+	}
+
+	return nil
+}
+
+// trimCandidates returns device paths of active snapshots which allow discard
+func (dm *Snapshotter) trimCandidates(ctx context.Context) ([]string, error) {
+	ctx, trans, err := dm.store.TransactionContext(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+
+	defer trans.Rollback()
+
+	var devicePaths []string
+	err = storage.WalkInfo(ctx, func(ctx context.Context, info snapshots.Info) error {
+		if info.Kind != snapshots.KindActive || !discardEnabled(info.Labels) {
+			return nil
+		}
+
+		snap, err := storage.GetSnapshot(ctx, info.Name)
+		if err != nil {
+			return err
+		}
+
+		devicePaths = append(devicePaths, dm.getDevicePath(snap))
+		return nil
+	})
+
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list active snapshots")
+	}
+
+	return devicePaths, nil
+}
+
+// trimDevice runs fstrim on a mount point of the device and returns it, empty if the device isn't activated or
+// mounted. Mounts are matched by device number, as the mount table may name the device differently.
+func trimDevice(ctx context.Context, devicePath string, mounts []mount.Info) (string, error) {
+	var stat unix.Stat_t
+	if err := unix.Stat(devicePath, &stat); err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+
+		return "", errors.Wrapf(err, "failed to stat %q", devicePath)
+	}
+
+	major, minor := unix.Major(uint64(stat.Rdev)), unix.Minor(uint64(stat.Rdev))
+	for _, info := range mounts {
+		if uint32(info.Major) != major || uint32(info.Minor) != minor {
+			continue
+		}
+
+		// Trimming any mount point of the filesystem trims all of it
+		output, err := exec.CommandContext(ctx, "fstrim", info.Mountpoint).CombinedOutput()
+		if err != nil {
+			return "", errors.Wrapf(err, "fstrim failed on %q: %s", info.Mountpoint, string(output))
+		}
+
+		return info.Mountpoint, nil
+	}
+
+	return "", nil
+}
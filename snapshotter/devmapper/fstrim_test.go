@@ -0,0 +1,131 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package devmapper
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/containerd/mount"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/containerd/containerd/snapshots/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/firecracker-microvm/firecracker-containerd/snapshotter/pkg/losetup"
+)
+
+func TestDiscardEnabled(t *testing.T) {
+	assert.True(t, discardEnabled(nil))
+	assert.True(t, discardEnabled(map[string]string{DiscardLabel: "true"}))
+	assert.True(t, discardEnabled(map[string]string{DiscardLabel: "invalid"}))
+	assert.False(t, discardEnabled(map[string]string{DiscardLabel: "false"}))
+	assert.False(t, discardEnabled(map[string]string{DiscardLabel: "0"}))
+}
+
+func TestBuildMountsDiscard(t *testing.T) {
+	dm := &Snapshotter{config: &Config{PoolName: "test", FilesystemType: "ext4", MountDiscard: true}}
+
+	active := storage.Snapshot{Kind: snapshots.KindActive, ID: "1"}
+	mounts := dm.buildMounts(active, nil)
+	require.Len(t, mounts, 1)
+	assert.Equal(t, []string{"discard"}, mounts[0].Options)
+
+	mounts = dm.buildMounts(active, map[string]string{DiscardLabel: "false"})
+	assert.Empty(t, mounts[0].Options, "label should opt snapshot out of discard")
+
+	mounts = dm.buildMounts(storage.Snapshot{Kind: snapshots.KindView, ID: "2"}, nil)
+	assert.Equal(t, []string{"ro"}, mounts[0].Options)
+
+	dm.config = &Config{PoolName: "test", FilesystemType: "xfs"}
+	mounts = dm.buildMounts(active, nil)
+	assert.Equal(t, "xfs", mounts[0].Type)
+	assert.Equal(t, []string{"nouuid"}, mounts[0].Options)
+}
+
+func TestTrimCandidates(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "trim-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	store, err := storage.NewMetaStore(filepath.Join(tempDir, metadataFileName))
+	require.NoError(t, err)
+	defer store.Close()
+
+	dm := &Snapshotter{store: store, config: &Config{PoolName: "test"}}
+
+	ctx, trans, err := store.TransactionContext(context.Background(), true)
+	require.NoError(t, err)
+
+	active, err := storage.CreateSnapshot(ctx, snapshots.KindActive, "active-1", "")
+	require.NoError(t, err)
+
+	_, err = storage.CreateSnapshot(ctx, snapshots.KindActive, "active-2", "",
+		snapshots.WithLabels(map[string]string{DiscardLabel: "false"}))
+	require.NoError(t, err)
+
+	_, err = storage.CreateSnapshot(ctx, snapshots.KindView, "view-1", "")
+	require.NoError(t, err)
+
+	err = trans.Commit()
+	require.NoError(t, err)
+
+	devicePaths, err := dm.trimCandidates(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []string{dm.getDevicePath(active)}, devicePaths, "only active snapshots allowing discard are trimmed")
+}
+
+func TestTrimDevice(t *testing.T) {
+	ctx := context.Background()
+
+	tempDir, err := ioutil.TempDir("", "trim-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	_, loopDevice := createLoopbackDevice(t, tempDir)
+	defer losetup.DetachLoopDevice(loopDevice)
+
+	mountPoint, err := trimDevice(ctx, filepath.Join(tempDir, "missing"), nil)
+	require.NoError(t, err)
+	assert.Empty(t, mountPoint, "device which isn't activated is skipped")
+
+	output, err := exec.Command("mkfs.ext4", "-q", loopDevice).CombinedOutput()
+	require.NoErrorf(t, err, "mkfs failed: %s", string(output))
+
+	mounts, err := mount.Self()
+	require.NoError(t, err)
+
+	mountPoint, err = trimDevice(ctx, loopDevice, mounts)
+	require.NoError(t, err)
+	assert.Empty(t, mountPoint, "device which isn't mounted is skipped")
+
+	target := filepath.Join(tempDir, "mnt")
+	err = os.Mkdir(target, 0700)
+	require.NoError(t, err)
+
+	err = mount.All([]mount.Mount{{Source: loopDevice, Type: "ext4"}}, target)
+	require.NoError(t, err)
+	defer mount.UnmountAll(target, 0)
+
+	mounts, err = mount.Self()
+	require.NoError(t, err)
+
+	mountPoint, err = trimDevice(ctx, loopDevice, mounts)
+	require.NoError(t, err)
+	assert.Equal(t, target, mountPoint)
+}
@@ -0,0 +1,73 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package devmapper
+
+import (
+	"context"
+
+	"github.com/containerd/containerd/log"
+)
+
+// DeviceEvent describes a device which was created or deleted
+type DeviceEvent struct {
+	// Name is the device name under /dev/mapper
+	Name string
+	// DeviceID is the ID of the device within thin-pool
+	DeviceID uint32
+	// SizeBytes is the virtual size of the device
+	SizeBytes uint64
+	// ParentName is the name of the device snapshot was taken of, empty for thin devices
+	ParentName string
+}
+
+// DeviceHook is called after a device operation succeeded.
+// Returned error is only logged, the operation is not rolled back.
+type DeviceHook func(ctx context.Context, event DeviceEvent) error
+
+// DeviceHooks are optional callbacks for external bookkeeping of pool devices, nil hooks are skipped.
+// Hooks are called once the pool releases its locks, so they can call back into the pool.
+type DeviceHooks struct {
+	// OnDeviceCreated is called after CreateThinDevice or ImportDevice
+	OnDeviceCreated DeviceHook
+	// OnSnapshotCreated is called after CreateSnapshotDevice
+	OnSnapshotCreated DeviceHook
+	// OnDeviceRemoved is called after the device is deleted from the pool by DeleteDevice or CleanupOrphans.
+	// Deactivation with RemoveDevice keeps the device, so it doesn't call the hook.
+	OnDeviceRemoved DeviceHook
+}
+
+// WithDeviceHooks sets callbacks the pool calls when devices are created and removed
+func WithDeviceHooks(hooks DeviceHooks) PoolOpt {
+	return func(opts *poolOptions) {
+		opts.hooks = hooks
+	}
+}
+
+// call invokes the hook (if not nil) with the device info and logs its error
+func (hook DeviceHook) call(ctx context.Context, info *DeviceInfo) {
+	if hook == nil {
+		return
+	}
+
+	event := DeviceEvent{
+		Name:       info.Name,
+		DeviceID:   info.DeviceID,
+		SizeBytes:  info.Size,
+		ParentName: info.ParentName,
+	}
+
+	if err := hook(ctx, event); err != nil {
+		log.G(ctx).WithError(err).Errorf("device hook failed for %q", info.Name)
+	}
+}
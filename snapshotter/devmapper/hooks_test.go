@@ -0,0 +1,43 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package devmapper
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeviceHookCall(t *testing.T) {
+	info := &DeviceInfo{Name: "snap-1", DeviceID: 2, Size: 1024, ParentName: "thin-1", IsActivated: true}
+
+	var events []DeviceEvent
+	hook := DeviceHook(func(ctx context.Context, event DeviceEvent) error {
+		events = append(events, event)
+		return errors.New("bookkeeping failed")
+	})
+
+	assert.NotPanics(t, func() {
+		hook.call(context.Background(), info)
+	}, "hook error must only be logged")
+
+	assert.Equal(t, []DeviceEvent{{Name: "snap-1", DeviceID: 2, SizeBytes: 1024, ParentName: "thin-1"}}, events)
+
+	var hooks DeviceHooks
+	assert.NotPanics(t, func() {
+		hooks.OnDeviceCreated.call(context.Background(), info)
+	}, "nil hook must be skipped")
+}
@@ -0,0 +1,253 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package devmapper
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+
+	"github.com/containerd/containerd/log"
+	"github.com/pkg/errors"
+
+	"github.com/firecracker-microvm/firecracker-containerd/snapshotter/pkg/dmsetup"
+)
+
+// sparseChunkSize is the granularity of hole detection, matches default thin-pool block size
+const sparseChunkSize = 64 * 1024
+
+// ExportDevice copies contents of the device to a sparse image file at outPath.
+// Device is activated read-only for the duration of export if it's not activated.
+// Unallocated regions of thin device read as zeros, so zero chunks are left as holes in the image.
+// Activated device must not be written to while exported.
+func (p *PoolDevice) ExportDevice(ctx context.Context, deviceName, outPath string) (retErr error) {
+	ctx, finish := p.startOperation(ctx, operationExport, deviceName)
+	defer func() {
+		finish(ctx, retErr)
+	}()
+
+	p.offlineMutex.RLock()
+	defer p.offlineMutex.RUnlock()
+
+	unlock := p.deviceLocks.lock(deviceName)
+	defer unlock()
+
+	info, err := p.metadata.GetDevice(ctx, deviceName)
+	if err != nil {
+		return errors.Wrapf(err, "failed to query device %q", deviceName)
+	}
+
+	ctx = withDeviceID(ctx, info.DeviceID)
+
+	if !info.IsActivated {
+		// Temporary activation isn't recorded in metadata store, device is back to its prior state once exported
+		err := p.activateWithRetries(ctx, info, dmsetup.ActivateReadOnly)
+		if err != nil {
+			return errors.Wrapf(err, "failed to activate device %q for export", deviceName)
+		}
+
+		defer func() {
+			if err := p.dm.RemoveDevice(ctx, deviceName, dmsetup.RemoveWithForce, dmsetup.RemoveWithRetries); err != nil {
+				log.G(ctx).WithError(err).Errorf("failed to deactivate device %q after export", deviceName)
+			}
+		}()
+
+		if err := waitForDeviceNode(ctx, dmsetup.GetFullDevicePath(deviceName), deviceNodeTimeout); err != nil {
+			return err
+		}
+	}
+
+	src, err := os.Open(dmsetup.GetFullDevicePath(deviceName))
+	if err != nil {
+		return errors.Wrapf(err, "failed to open device %q", deviceName)
+	}
+
+	defer src.Close()
+
+	dst, err := os.OpenFile(outPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create image %q", outPath)
+	}
+
+	defer func() {
+		if err := dst.Close(); err != nil && retErr == nil {
+			retErr = errors.Wrapf(err, "failed to close image %q", outPath)
+		}
+
+		if retErr != nil {
+			if err := os.Remove(outPath); err != nil {
+				log.G(ctx).WithError(err).Warnf("failed to remove incomplete image %q", outPath)
+			}
+		}
+	}()
+
+	if err := copySparse(ctx, dst, src, info.Size); err != nil {
+		return errors.Wrapf(err, "failed to export device %q", deviceName)
+	}
+
+	// Trailing holes aren't written, extend the image to the device size
+	if err := dst.Truncate(int64(info.Size)); err != nil {
+		return errors.Wrapf(err, "failed to resize image %q", outPath)
+	}
+
+	return nil
+}
+
+// ImportDevice creates new thin device and writes contents of the image file at srcPath to it.
+// Device size is virtualSizeBytes or image size if zero, zero chunks of the image are skipped,
+// so their blocks stay unallocated. Device is left activated. If import fails, the device is deleted.
+func (p *PoolDevice) ImportDevice(ctx context.Context, deviceName, srcPath string, virtualSizeBytes uint64) (retErr error) {
+	ctx, finish := p.startOperation(ctx, operationImport, deviceName)
+	defer func() {
+		finish(ctx, retErr)
+	}()
+
+	// Deferred first, so the hook runs after locks are released
+	var created *DeviceInfo
+	defer func() {
+		if created != nil {
+			p.hooks.OnDeviceCreated.call(ctx, created)
+		}
+	}()
+
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open image %q", srcPath)
+	}
+
+	defer src.Close()
+
+	stat, err := src.Stat()
+	if err != nil {
+		return errors.Wrapf(err, "failed to stat image %q", srcPath)
+	}
+
+	if !stat.Mode().IsRegular() {
+		return errors.Errorf("image %q is not a regular file", srcPath)
+	}
+
+	imageSize := uint64(stat.Size())
+	if virtualSizeBytes == 0 {
+		virtualSizeBytes = imageSize
+	}
+
+	if virtualSizeBytes < imageSize {
+		return errors.Errorf("image %q of %d bytes doesn't fit device of %d bytes", srcPath, imageSize, virtualSizeBytes)
+	}
+
+	p.offlineMutex.RLock()
+	defer p.offlineMutex.RUnlock()
+
+	defer func() {
+		p.metrics.observeOperation(operationImport, retErr)
+	}()
+
+	virtualSizeBytes, err = p.newDeviceSize(ctx, deviceName, virtualSizeBytes)
+	if err != nil {
+		return err
+	}
+
+	release, err := p.reserveName(ctx, deviceName)
+	if err != nil {
+		return err
+	}
+
+	defer release()
+
+	unlock := p.deviceLocks.lock(deviceName)
+	defer unlock()
+
+	info := &DeviceInfo{
+		Name: deviceName,
+		Size: virtualSizeBytes,
+	}
+
+	err = p.addDevice(ctx, info, func(devID uint32) error {
+		return deviceIDError(ctx, devID, p.dm.CreateDevice(p.poolName, devID))
+	})
+
+	if err != nil {
+		return err
+	}
+
+	ctx = withDeviceID(ctx, info.DeviceID)
+
+	if err := p.writeImage(ctx, deviceName, src, imageSize); err != nil {
+		return p.rollbackDevice(ctx, deviceName, errors.Wrapf(err, "failed to import %q to device %q", srcPath, deviceName))
+	}
+
+	created = info
+	return nil
+}
+
+// writeImage activates just created device and writes size bytes of the image to it
+func (p *PoolDevice) writeImage(ctx context.Context, deviceName string, src io.Reader, size uint64) error {
+	if err := p.activateDevice(ctx, deviceName); err != nil {
+		return err
+	}
+
+	if err := waitForDeviceNode(ctx, dmsetup.GetFullDevicePath(deviceName), deviceNodeTimeout); err != nil {
+		return err
+	}
+
+	dst, err := os.OpenFile(dmsetup.GetFullDevicePath(deviceName), os.O_WRONLY, 0)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open device %q", deviceName)
+	}
+
+	defer dst.Close()
+
+	if err := copySparse(ctx, dst, src, size); err != nil {
+		return err
+	}
+
+	return dst.Sync()
+}
+
+// copySparse copies size bytes from src to dst, seeking over zero chunks instead of writing them.
+// Holes are left in dst if it's a file, while blocks of thin device stay unallocated.
+func copySparse(ctx context.Context, dst io.WriteSeeker, src io.Reader, size uint64) error {
+	var (
+		buf  = make([]byte, sparseChunkSize)
+		zero = make([]byte, sparseChunkSize)
+	)
+
+	for remaining := size; remaining > 0; {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		chunk := buf
+		if remaining < uint64(len(chunk)) {
+			chunk = chunk[:remaining]
+		}
+
+		if _, err := io.ReadFull(src, chunk); err != nil {
+			return errors.Wrapf(err, "failed to read at offset %d", size-remaining)
+		}
+
+		if bytes.Equal(chunk, zero[:len(chunk)]) {
+			if _, err := dst.Seek(int64(len(chunk)), io.SeekCurrent); err != nil {
+				return errors.Wrapf(err, "failed to skip hole at offset %d", size-remaining)
+			}
+		} else if _, err := dst.Write(chunk); err != nil {
+			return errors.Wrapf(err, "failed to write at offset %d", size-remaining)
+		}
+
+		remaining -= uint64(len(chunk))
+	}
+
+	return nil
+}
@@ -0,0 +1,63 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package devmapper
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCopySparse(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "copy-sparse-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	// Data chunk, 8 zero chunks, partial data chunk
+	data := make([]byte, 10*sparseChunkSize+100)
+	copy(data, bytes.Repeat([]byte{1}, sparseChunkSize))
+	copy(data[9*sparseChunkSize:], bytes.Repeat([]byte{2}, sparseChunkSize+100))
+
+	dst, err := os.Create(filepath.Join(tempDir, "image"))
+	require.NoError(t, err)
+	defer dst.Close()
+
+	err = copySparse(context.Background(), dst, bytes.NewReader(data), uint64(len(data)))
+	require.NoError(t, err)
+
+	result, err := ioutil.ReadFile(dst.Name())
+	require.NoError(t, err)
+	assert.Equal(t, data, result)
+
+	stat, err := dst.Stat()
+	require.NoError(t, err)
+	allocated := stat.Sys().(*syscall.Stat_t).Blocks * 512
+	assert.Truef(t, allocated < int64(len(data)), "%d bytes allocated, zero chunks must be holes", allocated)
+
+	// Source shorter than size
+	err = copySparse(context.Background(), dst, bytes.NewReader(data[:10]), sparseChunkSize)
+	assert.Error(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = copySparse(ctx, dst, bytes.NewReader(data), uint64(len(data)))
+	assert.Equal(t, context.Canceled, err)
+}
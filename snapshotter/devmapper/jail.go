@@ -0,0 +1,113 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package devmapper
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+
+	"github.com/containerd/containerd/log"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+
+	"github.com/firecracker-microvm/firecracker-containerd/snapshotter/pkg/dmsetup"
+)
+
+// jailNodes describes where device nodes of activated devices are created for a jailed VMM
+type jailNodes struct {
+	dir string
+	uid int
+	gid int
+}
+
+// Replaced in tests, which can't create device nodes
+var mknod = unix.Mknod
+
+// WithJailDeviceNodes makes the pool create a block device node in dir for every device it activates, so a VMM
+// in a chroot (like the one set up by jailer) which can't see /dev/mapper can open the device. Nodes are named
+// after devices and owned by uid and gid (-1 keeps root). DevicePath returns the node path. The node is removed
+// once the device is deactivated and renamed with the device.
+func WithJailDeviceNodes(dir string, uid, gid int) PoolOpt {
+	return func(opts *poolOptions) {
+		opts.jailNodes = &jailNodes{dir: dir, uid: uid, gid: gid}
+	}
+}
+
+// DevicePath returns path of the device node to open the device with, the node in jail directory
+// if WithJailDeviceNodes option specified, device-mapper node otherwise
+func (p *PoolDevice) DevicePath(deviceName string) string {
+	if p.jailNodes == nil {
+		return dmsetup.GetFullDevicePath(deviceName)
+	}
+
+	return filepath.Join(p.jailNodes.dir, deviceName)
+}
+
+// createJailNode creates jail node of just activated device with its major:minor, replacing a stale node
+// left by an earlier activation
+func (p *PoolDevice) createJailNode(ctx context.Context, deviceName string) error {
+	if p.jailNodes == nil {
+		return nil
+	}
+
+	infos, err := p.dm.Info(deviceName)
+	if err != nil {
+		return errors.Wrapf(err, "failed to query device %q", deviceName)
+	}
+
+	path := p.DevicePath(deviceName)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "failed to remove stale node %q", path)
+	}
+
+	dev := unix.Mkdev(infos[0].Major, infos[0].Minor)
+	if err := mknod(path, unix.S_IFBLK|0600, int(dev)); err != nil {
+		return errors.Wrapf(err, "failed to create node %q of device %q", path, deviceName)
+	}
+
+	if err := os.Chown(path, p.jailNodes.uid, p.jailNodes.gid); err != nil {
+		p.removeJailNode(ctx, deviceName)
+		return errors.Wrapf(err, "failed to change owner of node %q", path)
+	}
+
+	log.G(ctx).Debugf("created node %q of device %q (%d:%d)", path, deviceName, infos[0].Major, infos[0].Minor)
+	return nil
+}
+
+// removeJailNode removes jail node of deactivated device. Failure is only logged, as the device is gone
+// and the node can't be used anymore.
+func (p *PoolDevice) removeJailNode(ctx context.Context, deviceName string) {
+	if p.jailNodes == nil {
+		return
+	}
+
+	path := p.DevicePath(deviceName)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		log.G(ctx).WithError(err).Warnf("failed to remove node %q of device %q", path, deviceName)
+	}
+}
+
+// renameJailNode renames jail node of activated device after the device itself was renamed
+func (p *PoolDevice) renameJailNode(oldName, newName string) error {
+	if p.jailNodes == nil {
+		return nil
+	}
+
+	if err := os.Rename(p.DevicePath(oldName), p.DevicePath(newName)); err != nil {
+		return errors.Wrapf(err, "failed to rename node of device %q", oldName)
+	}
+
+	return nil
+}
@@ -0,0 +1,122 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package devmapper
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+
+	"github.com/firecracker-microvm/firecracker-containerd/snapshotter/pkg/dmsetup"
+)
+
+// setJailNodes makes the pool create jail nodes in a temp directory, nodes are regular files
+// recording device numbers, as tests can't create device nodes
+func setJailNodes(t *testing.T, pool *PoolDevice) (map[string]uint64, func()) {
+	tempDir, err := ioutil.TempDir("", "jail-")
+	require.NoError(t, err)
+
+	nodes := make(map[string]uint64)
+	prevMknod := mknod
+
+	mknod = func(path string, mode uint32, dev int) error {
+		assert.Equal(t, uint32(unix.S_IFBLK|0600), mode)
+		nodes[path] = uint64(dev)
+		return ioutil.WriteFile(path, nil, 0600)
+	}
+
+	pool.jailNodes = &jailNodes{dir: tempDir, uid: -1, gid: -1}
+
+	return nodes, func() {
+		mknod = prevMknod
+		os.RemoveAll(tempDir)
+	}
+}
+
+func TestDevicePath(t *testing.T) {
+	pool := &PoolDevice{}
+	assert.Equal(t, dmsetup.GetFullDevicePath("thin-1"), pool.DevicePath("thin-1"))
+
+	pool.jailNodes = &jailNodes{dir: "/srv/jailer/firecracker/vm-1/root/dev", uid: -1, gid: -1}
+	assert.Equal(t, "/srv/jailer/firecracker/vm-1/root/dev/thin-1", pool.DevicePath("thin-1"))
+}
+
+func TestFakeJailNodes(t *testing.T) {
+	pool, dm, cleanup := newFakePool(t)
+	defer cleanup()
+
+	nodes, restore := setJailNodes(t, pool)
+	defer restore()
+
+	ctx := context.Background()
+
+	id, err := pool.CreateThinDevice(ctx, "thin-1", device1Size, WithDeviceNodeTimeout(0))
+	require.NoError(t, err)
+
+	path := pool.DevicePath("thin-1")
+	assert.Equal(t, filepath.Join(pool.jailNodes.dir, "thin-1"), path)
+	assert.Equal(t, unix.Mkdev(fakeDeviceMajor, id), nodes[path], "node should have major:minor of the device")
+	assert.FileExists(t, path)
+
+	// Node follows the device when it's renamed
+	err = pool.RenameDevice(ctx, "thin-1", "thin-2")
+	require.NoError(t, err)
+	assert.FileExists(t, pool.DevicePath("thin-2"))
+	assert.False(t, fileExists(path))
+
+	// Deactivated device has no node, reactivated device gets it back
+	err = pool.RemoveDevice(ctx, "thin-2", false)
+	require.NoError(t, err)
+	assert.False(t, fileExists(pool.DevicePath("thin-2")))
+
+	err = pool.ReactivateDevice(ctx, "thin-2")
+	require.NoError(t, err)
+	assert.FileExists(t, pool.DevicePath("thin-2"))
+
+	err = pool.DeleteDevice(ctx, "thin-2")
+	require.NoError(t, err)
+	assert.False(t, fileExists(pool.DevicePath("thin-2")))
+	assert.Empty(t, dm.active)
+}
+
+func TestFakeJailNodeFailure(t *testing.T) {
+	pool, dm, cleanup := newFakePool(t)
+	defer cleanup()
+
+	_, restore := setJailNodes(t, pool)
+	defer restore()
+
+	mknod = func(path string, mode uint32, dev int) error {
+		return unix.EPERM
+	}
+
+	// Device which can't be opened by the VMM isn't left activated
+	_, err := pool.CreateThinDevice(context.Background(), "thin-1", device1Size, WithDeviceNodeTimeout(0))
+	require.Error(t, err)
+	assert.Equal(t, unix.EPERM, errors.Cause(err))
+	assert.False(t, dm.isActive("thin-1"))
+	assert.Empty(t, dm.thinIDs)
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,141 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package devmapper
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+
+	"github.com/containerd/containerd/log"
+	"github.com/hashicorp/go-multierror"
+	"github.com/pkg/errors"
+
+	"github.com/firecracker-microvm/firecracker-containerd/snapshotter/pkg/losetup"
+)
+
+const (
+	// Directory under root path with sparse files backing the pool in loopback mode
+	loopbackDirName = "loopback"
+
+	loopbackDataFileName     = "data.img"
+	loopbackMetadataFileName = "metadata.img"
+)
+
+// attachLoopbackDevices allocates sparse data and metadata files under root directory and attaches them as loop
+// devices. Files left by the previous run are reused, so the pool comes back with its devices.
+func attachLoopbackDevices(ctx context.Context, config *Config) (dataDevice, metadataDevice string, retErr error) {
+	dir := filepath.Join(config.RootPath, loopbackDirName)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", "", errors.Wrapf(err, "failed to create loopback directory %q", dir)
+	}
+
+	dataDevice, err := attachLoopbackFile(ctx, filepath.Join(dir, loopbackDataFileName), config.LoopbackDataSizeBytes)
+	if err != nil {
+		return "", "", err
+	}
+
+	defer func() {
+		if retErr != nil {
+			if err := losetup.DetachLoopDevice(dataDevice); err != nil {
+				log.G(ctx).WithError(err).Warnf("failed to detach loop device %q", dataDevice)
+			}
+		}
+	}()
+
+	metadataDevice, err = attachLoopbackFile(ctx, filepath.Join(dir, loopbackMetadataFileName), config.LoopbackMetadataSizeBytes)
+	if err != nil {
+		return "", "", err
+	}
+
+	return dataDevice, metadataDevice, nil
+}
+
+// attachLoopbackFile makes sure the file is at least sizeBytes long and returns loop device it's attached to.
+// Loop device left attached by unclean shutdown is reused.
+func attachLoopbackFile(ctx context.Context, path string, sizeBytes uint64) (string, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to open loopback file %q", path)
+	}
+
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to stat loopback file %q", path)
+	}
+
+	currentSize := uint64(info.Size())
+	switch {
+	case currentSize == 0:
+		log.G(ctx).Infof("allocating loopback file %q of %d bytes", path, sizeBytes)
+	case currentSize < sizeBytes:
+		log.G(ctx).Infof("growing loopback file %q from %d to %d bytes", path, currentSize, sizeBytes)
+	case currentSize > sizeBytes:
+		log.G(ctx).Warnf("loopback file %q is %d bytes, larger than configured %d bytes, files are never shrunk",
+			path, currentSize, sizeBytes)
+	}
+
+	if currentSize < sizeBytes {
+		if err := file.Truncate(int64(sizeBytes)); err != nil {
+			return "", errors.Wrapf(err, "failed to allocate loopback file %q", path)
+		}
+	}
+
+	attached, err := losetup.FindAssociatedLoopDevices(path)
+	if err != nil {
+		return "", err
+	}
+
+	if len(attached) > 0 {
+		log.G(ctx).Infof("reusing loop device %q of %q", attached[0], path)
+
+		// File might have been grown above while attached
+		if err := losetup.RefreshCapacity(attached[0]); err != nil {
+			return "", err
+		}
+
+		return attached[0], nil
+	}
+
+	loopDevice, err := losetup.AttachLoopDevice(path)
+	if err != nil {
+		return "", err
+	}
+
+	log.G(ctx).Infof("attached %q as loop device %q", path, loopDevice)
+	return loopDevice, nil
+}
+
+// teardownLoopbackPool returns cleanup function which deactivates devices of the pool, removes the pool and detaches
+// its loop devices. Loop devices are kept if the pool couldn't be removed, files are always kept for the next start.
+func teardownLoopbackPool(pool *PoolDevice, loopDevices ...string) closeFunc {
+	return func() error {
+		ctx := context.Background()
+
+		if err := pool.RemovePool(ctx, false); err != nil {
+			return errors.Wrapf(err, "failed to tear down loopback pool %q, loop devices are kept", pool.poolName)
+		}
+
+		var result *multierror.Error
+		for _, loopDevice := range loopDevices {
+			if err := losetup.DetachLoopDevice(loopDevice); err != nil {
+				result = multierror.Append(result, errors.Wrapf(err, "failed to detach loop device %q", loopDevice))
+			}
+		}
+
+		return result.ErrorOrNil()
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package devmapper
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/firecracker-microvm/firecracker-containerd/snapshotter/pkg/losetup"
+)
+
+func TestAttachLoopbackDevices(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "loopback-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	ctx := context.Background()
+	config := &Config{
+		RootPath:                  tempDir,
+		LoopbackDataSizeBytes:     32 * 1024 * 1024,
+		LoopbackMetadataSizeBytes: 4 * 1024 * 1024,
+	}
+
+	dataDevice, metadataDevice, err := attachLoopbackDevices(ctx, config)
+	require.NoError(t, err)
+	defer losetup.DetachLoopDevice(dataDevice, metadataDevice)
+
+	dataFile := filepath.Join(tempDir, loopbackDirName, loopbackDataFileName)
+	metadataFile := filepath.Join(tempDir, loopbackDirName, loopbackMetadataFileName)
+
+	for device, file := range map[string]string{dataDevice: dataFile, metadataDevice: metadataFile} {
+		backingFile, err := losetup.GetBackingFile(device)
+		require.NoError(t, err)
+		assert.Equal(t, file, backingFile)
+	}
+
+	assertFileSize(t, dataFile, 32*1024*1024)
+	assertFileSize(t, metadataFile, 4*1024*1024)
+
+	// Next start reuses attached devices, files are grown but never shrunk
+	config.LoopbackDataSizeBytes = 64 * 1024 * 1024
+	config.LoopbackMetadataSizeBytes = 1024 * 1024
+
+	nextData, nextMetadata, err := attachLoopbackDevices(ctx, config)
+	require.NoError(t, err)
+	assert.Equal(t, dataDevice, nextData)
+	assert.Equal(t, metadataDevice, nextMetadata)
+
+	assertFileSize(t, dataFile, 64*1024*1024)
+	assertFileSize(t, metadataFile, 4*1024*1024)
+}
+
+func assertFileSize(t *testing.T, path string, size int64) {
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, size, info.Size(), "unexpected size of %q", path)
+}
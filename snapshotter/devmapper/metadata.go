@@ -15,10 +15,14 @@ package devmapper
 
 import (
 	"context"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"math/rand"
 	"strconv"
+	"time"
 
+	"github.com/hashicorp/go-multierror"
 	"github.com/pkg/errors"
 	"go.etcd.io/bbolt"
 )
@@ -35,6 +39,52 @@ type DeviceInfo struct {
 	ParentName string `json:"parent_name"`
 	// IsActivated indicates whether thin device was actived
 	IsActivated bool `json:"is_active"`
+	// IsReadOnly indicates whether thin device is activated in read-only mode
+	IsReadOnly bool `json:"is_read_only"`
+	// ExternalOrigin is a read-only block device outside the pool unprovisioned blocks of the device are read from,
+	// empty if there is none. Snapshots of the device share it.
+	ExternalOrigin string `json:"external_origin"`
+	// CreatedAt is the time in UTC device was saved to metadata store, zero for devices saved by older versions
+	CreatedAt time.Time `json:"created_at"`
+	// ActivatedAt is the time in UTC device was last activated, zero if it never was
+	ActivatedAt time.Time `json:"activated_at"`
+	// State is the state of the device in its lifecycle, empty for devices saved by older versions
+	// until the pool is reopened
+	State DeviceState `json:"state"`
+	// DeletePending is set once deletion was requested with DeleteDeviceDeferred, the device is deleted
+	// in the background and can't be activated or snapshotted anymore
+	DeletePending bool `json:"delete_pending"`
+}
+
+// DeviceState represents state of a device in its lifecycle. Transitional states are saved before
+// device-mapper is called, so an operation interrupted by a crash is known after restart.
+type DeviceState string
+
+const (
+	// Creating device has its device ID reserved, thin device may not exist in thin-pool yet.
+	// It's only kept in the journal, the device isn't visible in the store until it's created.
+	Creating DeviceState = "creating"
+	// Created device exists in thin-pool and is not activated
+	Created DeviceState = "created"
+	// Activating device is being activated
+	Activating DeviceState = "activating"
+	// Activated device has device-mapper node
+	Activated DeviceState = "activated"
+	// Deactivating device is being deactivated
+	Deactivating DeviceState = "deactivating"
+	// Removing device is being deleted from thin-pool
+	Removing DeviceState = "removing"
+	// Faulty device couldn't be deleted after a failed or interrupted operation, it should be deleted
+	Faulty DeviceState = "faulty"
+)
+
+// journalEntry records a device-mapper operation in progress. It's saved before device-mapper is called
+// and deleted in the same transaction the outcome is saved in, so entries left by a crash are replayed
+// once the pool is reopened.
+type journalEntry struct {
+	// State is Creating or Removing
+	State DeviceState `json:"state"`
+	Info  DeviceInfo  `json:"info"`
 }
 
 type (
@@ -44,12 +94,18 @@ type (
 
 const (
 	maxDeviceID = 0xffffff // Device IDs are 24-bit numbers
+
+	// How many device IDs found to be used by devices unknown to metadata AddDevice skips before giving up
+	maxTakenDeviceIDRetries = 16
+
+	// Pool is almost full if this many random device IDs are all taken
+	maxRandomDeviceIDAttempts = 1024
 )
 
-type deviceState byte
+type deviceIDState byte
 
 const (
-	deviceFree deviceState = iota
+	deviceFree deviceIDState = iota
 	deviceTaken
 )
 
@@ -57,11 +113,40 @@ const (
 var (
 	devicesBucketName  = []byte("devices")    // Contains thin devices metadata <device_name>=<DeviceInfo>
 	deviceIDBucketName = []byte("device_ids") // Tracks used device ids <device_id_[0..maxDeviceID)>=<byte_[0/1]>
+
+	// Contains released device ids to be reused <big_endian_device_id>=<empty>.
+	// Keys are sorted numerically, so the lowest released id is reused first.
+	freeDeviceIDBucketName = []byte("free_device_ids")
+
+	// Contains the number of taken device ids <takenDeviceIDsKey>=<big_endian_count>,
+	// so exhausted id space is detected without scanning device_ids bucket
+	deviceIDCountBucketName = []byte("device_id_count")
+	takenDeviceIDsKey       = []byte("taken")
+
+	// Contains device-mapper operations in progress <device_name>=<journalEntry>
+	journalBucketName = []byte("journal")
 )
 
 var (
-	ErrNotFound      = errors.New("not found")
-	ErrAlreadyExists = errors.New("object already exists")
+	// ErrDeviceNotFound is returned when the pool has no device with the given name
+	ErrDeviceNotFound = errors.New("device not found")
+
+	// ErrDeviceAlreadyExists is returned when device name is taken
+	ErrDeviceAlreadyExists = errors.New("device already exists")
+
+	// ErrSnapshotAlreadyExists is returned by CreateSnapshotDevice when snapshot name is taken
+	ErrSnapshotAlreadyExists = errors.New("snapshot already exists")
+
+	// ErrNoDeviceIDsAvailable is returned when all 24-bit device IDs of the pool are taken
+	ErrNoDeviceIDsAvailable = errors.New("no device IDs available")
+
+	// ErrNotFound and ErrAlreadyExists are the same as ErrDeviceNotFound and ErrDeviceAlreadyExists
+	ErrNotFound      = ErrDeviceNotFound
+	ErrAlreadyExists = ErrDeviceAlreadyExists
+
+	// ErrDeviceIDTaken should be returned from DeviceIDCallback if thin-pool already has a device with the ID,
+	// which metadata doesn't know about. AddDevice keeps the ID marked as taken and retries with another one.
+	ErrDeviceIDTaken = errors.New("device id is taken in thin-pool")
 )
 
 // PoolMetadata keeps device info for the given thin-pool device, it also responsible for
@@ -94,100 +179,423 @@ func (m *PoolMetadata) ensureDatabaseInitialized() error {
 			return err
 		}
 
+		if _, err := tx.CreateBucketIfNotExists(journalBucketName); err != nil {
+			return err
+		}
+
+		if err := ensureFreeDeviceIDs(tx); err != nil {
+			return err
+		}
+
+		return ensureDeviceIDCount(tx)
+	})
+}
+
+// ensureFreeDeviceIDs creates free list of device ids, databases created before it was introduced
+// only have free ids marked in device_ids bucket
+func ensureFreeDeviceIDs(tx *bolt.Tx) error {
+	if tx.Bucket(freeDeviceIDBucketName) != nil {
+		return nil
+	}
+
+	free, err := tx.CreateBucket(freeDeviceIDBucketName)
+	if err != nil {
+		return err
+	}
+
+	return tx.Bucket(deviceIDBucketName).ForEach(func(key, state []byte) error {
+		if state[0] != byte(deviceFree) {
+			return nil
+		}
+
+		id, err := strconv.ParseUint(string(key), 10, 32)
+		if err != nil {
+			return err
+		}
+
+		return free.Put(freeDeviceIDKey(uint32(id)), nil)
+	})
+}
+
+// ensureDeviceIDCount creates counter of taken device ids, databases created before it was introduced
+// have taken ids counted once
+func ensureDeviceIDCount(tx *bolt.Tx) error {
+	if tx.Bucket(deviceIDCountBucketName) != nil {
+		return nil
+	}
+
+	if _, err := tx.CreateBucket(deviceIDCountBucketName); err != nil {
+		return err
+	}
+
+	var count uint32
+	err := tx.Bucket(deviceIDBucketName).ForEach(func(key, state []byte) error {
+		if len(state) > 0 && state[0] == byte(deviceTaken) && string(key) != "0" {
+			count++
+		}
+
 		return nil
 	})
+
+	if err != nil {
+		return err
+	}
+
+	return setTakenDeviceIDs(tx, count)
+}
+
+// takenDeviceIDs returns the number of taken device ids in [1, maxDeviceID) range, which ids are allocated from
+func takenDeviceIDs(tx *bolt.Tx) uint32 {
+	value := tx.Bucket(deviceIDCountBucketName).Get(takenDeviceIDsKey)
+	if len(value) != 4 {
+		return 0
+	}
+
+	return binary.BigEndian.Uint32(value)
+}
+
+func setTakenDeviceIDs(tx *bolt.Tx, count uint32) error {
+	value := make([]byte, 4)
+	binary.BigEndian.PutUint32(value, count)
+	return tx.Bucket(deviceIDCountBucketName).Put(takenDeviceIDsKey, value)
+}
+
+// checkDeviceIDsAvailable returns ErrNoDeviceIDsAvailable if every device id is taken, so allocation fails
+// right away instead of probing ids which are all taken
+func checkDeviceIDsAvailable(tx *bolt.Tx) error {
+	if taken := takenDeviceIDs(tx); taken >= maxDeviceID-1 {
+		return errors.Wrapf(ErrNoDeviceIDsAvailable, "all %d device IDs are taken", taken)
+	}
+
+	return nil
 }
 
 // AddDevice saves device info to database.
 // The callback should be used to indicate whether device allocation was successful or not.
-// An error returned from the callback will rollback the ID assignment transaction in the database and
-// free it for future use.
+// An error returned from the callback will rollback the ID assignment and free it for future use.
+// The device ID is reserved and journaled before the callback is called, and the callback runs outside
+// of transaction, so a crash in the callback leaves a journal entry to undo the allocation on restart.
 func (m *PoolMetadata) AddDevice(ctx context.Context, info *DeviceInfo, fn DeviceIDCallback) error {
-	return m.db.Update(func(tx *bolt.Tx) error {
-		devicesBucket := tx.Bucket(devicesBucketName)
-
-		// Make sure device name is unique
-		if err := getObject(devicesBucket, info.Name, nil); err == nil {
-			return ErrAlreadyExists
+	for attempt := 0; ; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return err
 		}
 
-		// Find next available device ID
-		deviceID, err := getNextDeviceID(tx)
+		// Find next available device ID. IDs next to the one taken out of band are likely taken too,
+		// as tools allocate them sequentially, so retries jump to a random ID.
+		deviceID, err := m.reserveDeviceID(info, attempt > 0)
 		if err != nil {
 			return err
 		}
 
-		if err := fn(deviceID); err != nil {
+		// ID stays marked as taken, as it's used by a device created out of band
+		err = fn(deviceID)
+		if errors.Is(err, ErrDeviceIDTaken) && attempt < maxTakenDeviceIDRetries {
+			if err := m.deleteJournalEntry(info.Name); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if err != nil {
+			if abortErr := m.abortAdd(info.Name, deviceID, !errors.Is(err, ErrDeviceIDTaken)); abortErr != nil {
+				return multierror.Append(err, abortErr)
+			}
+
 			return err
 		}
 
 		info.DeviceID = deviceID
+		return m.commitAdd(info)
+	}
+}
 
-		return putObject(devicesBucket, info.Name, info, false)
+// reserveDeviceID marks the next (or a random) free device ID as taken and journals the device as Creating
+func (m *PoolMetadata) reserveDeviceID(info *DeviceInfo, random bool) (uint32, error) {
+	var deviceID uint32
+
+	err := m.db.Update(func(tx *bolt.Tx) error {
+		// Make sure device name is unique, including devices being created
+		if err := getObject(tx.Bucket(devicesBucketName), info.Name, nil); err == nil {
+			return errors.Wrapf(ErrAlreadyExists, "device %q", info.Name)
+		}
+
+		if tx.Bucket(journalBucketName).Get([]byte(info.Name)) != nil {
+			return errors.Wrapf(ErrAlreadyExists, "device %q is being created or removed", info.Name)
+		}
+
+		next := getNextDeviceID
+		if random {
+			next = getRandomDeviceID
+		}
+
+		id, err := next(tx)
+		if err != nil {
+			return err
+		}
+
+		entry := &journalEntry{State: Creating, Info: *info}
+		entry.Info.DeviceID = id
+
+		deviceID = id
+		return putObject(tx.Bucket(journalBucketName), info.Name, entry, false)
 	})
+
+	return deviceID, err
 }
 
-// getNextDeviceID finds the next free device ID by taking a cursor
-// through the deviceIDBucketName bucket and finding the next sequentially
-// unassigned ID.  Device ID state is marked by a byte deviceFree or
-// deviceTaken.  Low device IDs will be reused sooner.
+// commitAdd saves just created device and deletes its journal entry
+func (m *PoolMetadata) commitAdd(info *DeviceInfo) error {
+	return m.db.Update(func(tx *bolt.Tx) error {
+		stampCreated(info)
+
+		if err := putObject(tx.Bucket(devicesBucketName), info.Name, info, false); err != nil {
+			return err
+		}
+
+		return tx.Bucket(journalBucketName).Delete([]byte(info.Name))
+	})
+}
+
+// abortAdd deletes journal entry of device which wasn't created, freeing its device ID unless it's taken
+// by a device unknown to the store
+func (m *PoolMetadata) abortAdd(name string, deviceID uint32, free bool) error {
+	return m.db.Update(func(tx *bolt.Tx) error {
+		if free {
+			if err := markDeviceID(tx, deviceID, deviceFree); err != nil {
+				return err
+			}
+		}
+
+		return tx.Bucket(journalBucketName).Delete([]byte(name))
+	})
+}
+
+func (m *PoolMetadata) deleteJournalEntry(name string) error {
+	return m.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(journalBucketName).Delete([]byte(name))
+	})
+}
+
+// getJournal returns operations left in the journal, sorted by device name
+func (m *PoolMetadata) getJournal(ctx context.Context) ([]*journalEntry, error) {
+	var entries []*journalEntry
+
+	err := m.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(journalBucketName).ForEach(func(k, v []byte) error {
+			entry := &journalEntry{}
+			if err := json.Unmarshal(v, entry); err != nil {
+				return errors.Wrapf(err, "failed to unmarshal journal entry %q", string(k))
+			}
+
+			entries = append(entries, entry)
+			return nil
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// getNextDeviceID takes the lowest released device ID from freeDeviceIDBucketName bucket,
+// or allocates a new one from the sequence of deviceIDBucketName bucket if none were released.
+// Device ID state is marked by a byte deviceFree or deviceTaken.
 func getNextDeviceID(tx *bolt.Tx) (uint32, error) {
 	bucket := tx.Bucket(deviceIDBucketName)
-	cursor := bucket.Cursor()
-
-	// Check if any device id can be reused.
-	// Bolt stores its keys in byte-sorted order within a bucket.
-	// This makes sequential iteration extremely fast.
-	for key, taken := cursor.First(); key != nil; key, taken = cursor.Next() {
-		isFree := taken[0] == byte(deviceFree)
-		if !isFree {
-			continue
+
+	// Bolt stores its keys in byte-sorted order within a bucket, so the first key is the lowest ID
+	if key, _ := tx.Bucket(freeDeviceIDBucketName).Cursor().First(); key != nil {
+		id := binary.BigEndian.Uint32(key)
+		if err := markDeviceID(tx, id, deviceTaken); err != nil {
+			return 0, err
 		}
 
-		parsedID, err := strconv.ParseUint(string(key), 10, 32)
+		return id, nil
+	}
+
+	// Free list is empty, so if there is a free ID it's ahead of the sequence
+	if err := checkDeviceIDsAvailable(tx); err != nil {
+		return 0, err
+	}
+
+	// Try allocate new device ID, skipping the ones taken by imported devices
+	for {
+		seq, err := bucket.NextSequence()
 		if err != nil {
 			return 0, err
 		}
 
-		id := uint32(parsedID)
+		if seq >= maxDeviceID {
+			return 0, errors.Wrapf(ErrNoDeviceIDsAvailable, "all %d device IDs are taken", maxDeviceID)
+		}
+
+		if isDeviceIDTaken(tx, uint32(seq)) {
+			continue
+		}
+
+		id := uint32(seq)
 		if err := markDeviceID(tx, id, deviceTaken); err != nil {
 			return 0, err
 		}
 
 		return id, nil
 	}
+}
 
-	// Try allocate new device ID
-	seq, err := bucket.NextSequence()
-	if err != nil {
+// getRandomDeviceID takes a random device ID which is not marked as deviceTaken
+func getRandomDeviceID(tx *bolt.Tx) (uint32, error) {
+	if err := checkDeviceIDsAvailable(tx); err != nil {
 		return 0, err
 	}
 
-	if seq >= maxDeviceID {
-		return 0, errors.Errorf("dm-meta: couldn't find free device key")
+	for attempt := 0; attempt < maxRandomDeviceIDAttempts; attempt++ {
+		// Sequence starts from 1, so does the range of random IDs
+		id := uint32(rand.Int63n(maxDeviceID-1)) + 1
+		if isDeviceIDTaken(tx, id) {
+			continue
+		}
+
+		if err := markDeviceID(tx, id, deviceTaken); err != nil {
+			return 0, err
+		}
+
+		return id, nil
 	}
 
-	id := uint32(seq)
-	if err := markDeviceID(tx, id, deviceTaken); err != nil {
+	return 0, errors.Wrapf(ErrNoDeviceIDsAvailable, "no free device ID in %d random attempts", maxRandomDeviceIDAttempts)
+}
+
+// isDeviceIDTaken checks whether device ID is marked as deviceTaken
+func isDeviceIDTaken(tx *bolt.Tx, deviceID uint32) bool {
+	key := strconv.FormatUint(uint64(deviceID), 10)
+	value := tx.Bucket(deviceIDBucketName).Get([]byte(key))
+	return len(value) > 0 && value[0] == byte(deviceTaken)
+}
+
+// MarkDeviceIDsTaken marks device IDs used in thin-pool as deviceTaken, so they are never allocated while their
+// devices exist (for instance devices left by a lost metadata store or created out of band). Returns the number
+// of IDs which weren't marked before.
+func (m *PoolMetadata) MarkDeviceIDsTaken(ctx context.Context, ids []uint32) (int, error) {
+	marked := 0
+	err := m.db.Update(func(tx *bolt.Tx) error {
+		for _, id := range ids {
+			// Device ID 0 isn't allocated from
+			if id == 0 || isDeviceIDTaken(tx, id) {
+				continue
+			}
+
+			if id >= maxDeviceID {
+				return errors.Errorf("invalid device id %d", id)
+			}
+
+			if err := markDeviceID(tx, id, deviceTaken); err != nil {
+				return err
+			}
+
+			marked++
+		}
+
+		return nil
+	})
+
+	if err != nil {
 		return 0, err
 	}
 
-	return id, nil
+	return marked, nil
+}
+
+// ImportDevice saves info of a device which already exists in thin-pool with the given device ID
+// (like a device created out of band). Returns ErrAlreadyExists if the name or device ID is taken.
+func (m *PoolMetadata) ImportDevice(ctx context.Context, info *DeviceInfo) error {
+	if info.DeviceID >= maxDeviceID {
+		return errors.Errorf("invalid device id %d", info.DeviceID)
+	}
+
+	return m.db.Update(func(tx *bolt.Tx) error {
+		devicesBucket := tx.Bucket(devicesBucketName)
+
+		if err := getObject(devicesBucket, info.Name, nil); err == nil {
+			return errors.Wrapf(ErrAlreadyExists, "device %q", info.Name)
+		}
+
+		if isDeviceIDTaken(tx, info.DeviceID) {
+			return errors.Wrapf(ErrAlreadyExists, "device id %d", info.DeviceID)
+		}
+
+		if err := markDeviceID(tx, info.DeviceID, deviceTaken); err != nil {
+			return err
+		}
+
+		stampCreated(info)
+		return putObject(devicesBucket, info.Name, info, false)
+	})
+}
+
+// stampCreated sets creation time and state of a new device unless they're set already,
+// device saved as activated gets the same activation time
+func stampCreated(info *DeviceInfo) {
+	now := time.Now().UTC()
+
+	if info.State == "" {
+		info.State = Created
+		if info.IsActivated {
+			info.State = Activated
+		}
+	}
+
+	if info.CreatedAt.IsZero() {
+		info.CreatedAt = now
+	}
+
+	if info.IsActivated && info.ActivatedAt.IsZero() {
+		info.ActivatedAt = now
+	}
 }
 
 // markDeviceID marks a device as deviceFree or deviceTaken
-func markDeviceID(tx *bolt.Tx, deviceID uint32, state deviceState) error {
+func markDeviceID(tx *bolt.Tx, deviceID uint32, state deviceIDState) error {
 	var (
 		bucket = tx.Bucket(deviceIDBucketName)
 		key    = strconv.FormatUint(uint64(deviceID), 10)
 		value  = []byte{byte(state)}
 	)
 
+	// ID 0 is never allocated, so it isn't counted
+	if wasTaken := isDeviceIDTaken(tx, deviceID); deviceID != 0 && wasTaken != (state == deviceTaken) {
+		count := takenDeviceIDs(tx)
+		if wasTaken {
+			count--
+		} else {
+			count++
+		}
+
+		if err := setTakenDeviceIDs(tx, count); err != nil {
+			return errors.Wrap(err, "failed to update number of taken device ids")
+		}
+	}
+
 	if err := bucket.Put([]byte(key), value); err != nil {
 		return errors.Wrapf(err, "failed to free device id %q", key)
 	}
 
-	return nil
+	free := tx.Bucket(freeDeviceIDBucketName)
+	if state == deviceFree {
+		return free.Put(freeDeviceIDKey(deviceID), nil)
+	}
+
+	return free.Delete(freeDeviceIDKey(deviceID))
+}
+
+// freeDeviceIDKey makes a key of freeDeviceIDBucketName bucket
+func freeDeviceIDKey(deviceID uint32) []byte {
+	key := make([]byte, 4)
+	binary.BigEndian.PutUint32(key, deviceID)
+	return key
 }
 
 // UpdateDevice updates device info in metadata store.
@@ -225,6 +633,50 @@ func (m *PoolMetadata) UpdateDevice(ctx context.Context, name string, fn DeviceI
 	})
 }
 
+// RenameDevice changes device name in metadata store and updates parent references of its snapshots.
+// The callback should be used to indicate whether device rename was successful or not.
+// An error returned from the callback will rollback the rename transaction in the database.
+func (m *PoolMetadata) RenameDevice(ctx context.Context, oldName, newName string, fn DeviceInfoCallback) error {
+	return m.db.Update(func(tx *bolt.Tx) error {
+		var (
+			device = &DeviceInfo{}
+			bucket = tx.Bucket(devicesBucketName)
+		)
+
+		if err := getObject(bucket, oldName, device); err != nil {
+			return err
+		}
+
+		if err := getObject(bucket, newName, nil); err == nil {
+			return errors.Wrapf(ErrAlreadyExists, "device %q", newName)
+		}
+
+		if err := bucket.Delete([]byte(oldName)); err != nil {
+			return errors.Wrapf(err, "failed to delete device info for %q", oldName)
+		}
+
+		device.Name = newName
+		if err := putObject(bucket, newName, device, false); err != nil {
+			return err
+		}
+
+		// Update snapshots referring to the old name
+		children, err := getChildren(bucket, oldName)
+		if err != nil {
+			return err
+		}
+
+		for _, child := range children {
+			child.ParentName = newName
+			if err := putObject(bucket, child.Name, child, true); err != nil {
+				return err
+			}
+		}
+
+		return fn(device)
+	})
+}
+
 // GetDevice retrieves device info by name from database
 func (m *PoolMetadata) GetDevice(ctx context.Context, name string) (*DeviceInfo, error) {
 	var (
@@ -240,10 +692,106 @@ func (m *PoolMetadata) GetDevice(ctx context.Context, name string) (*DeviceInfo,
 	return &dev, err
 }
 
+// GetChildren retrieves infos of devices which are snapshots of the given device
+func (m *PoolMetadata) GetChildren(ctx context.Context, name string) ([]*DeviceInfo, error) {
+	var (
+		children []*DeviceInfo
+		err      error
+	)
+
+	err = m.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(devicesBucketName)
+		if err := getObject(bucket, name, nil); err != nil {
+			return err
+		}
+
+		children, err = getChildren(bucket, name)
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return children, nil
+}
+
 // RemoveDevice removes device info from store.
+// Snapshots of the removed device become snapshots of its parent, so their lineage stays complete.
 // The callback should be used to indicate whether device removal was successful or not.
-// An error returned from the callback will rollback the remove transaction in the database.
+// An error returned from the callback will rollback the removal and restore the device state.
+// The device is marked Removing and journaled before the callback is called and the callback runs outside
+// of transaction, so removal interrupted by a crash is finished on restart.
 func (m *PoolMetadata) RemoveDevice(ctx context.Context, name string, fn DeviceInfoCallback) error {
+	device, prevState, err := m.beginRemove(name)
+	if err != nil {
+		return err
+	}
+
+	if err := fn(device); err != nil {
+		if abortErr := m.abortRemove(name, prevState); abortErr != nil {
+			return multierror.Append(err, abortErr)
+		}
+
+		return err
+	}
+
+	return m.commitRemove(name)
+}
+
+// beginRemove marks device as Removing and journals it, returns device info and its state before removal
+func (m *PoolMetadata) beginRemove(name string) (*DeviceInfo, DeviceState, error) {
+	var (
+		device    = &DeviceInfo{}
+		prevState DeviceState
+	)
+
+	err := m.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(devicesBucketName)
+		if err := getObject(bucket, name, device); err != nil {
+			return err
+		}
+
+		prevState = device.State
+		device.State = Removing
+
+		if err := putObject(bucket, name, device, true); err != nil {
+			return err
+		}
+
+		return putObject(tx.Bucket(journalBucketName), name, &journalEntry{State: Removing, Info: *device}, true)
+	})
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	return device, prevState, nil
+}
+
+// abortRemove restores state of device which wasn't removed and deletes its journal entry
+func (m *PoolMetadata) abortRemove(name string, state DeviceState) error {
+	return m.db.Update(func(tx *bolt.Tx) error {
+		var (
+			device = &DeviceInfo{}
+			bucket = tx.Bucket(devicesBucketName)
+		)
+
+		if err := getObject(bucket, name, device); err != nil {
+			return err
+		}
+
+		device.State = state
+		if err := putObject(bucket, name, device, true); err != nil {
+			return err
+		}
+
+		return tx.Bucket(journalBucketName).Delete([]byte(name))
+	})
+}
+
+// commitRemove deletes removed device from the store along with its journal entry and frees its device ID
+func (m *PoolMetadata) commitRemove(name string) error {
 	return m.db.Update(func(tx *bolt.Tx) error {
 		var (
 			device = &DeviceInfo{}
@@ -258,12 +806,171 @@ func (m *PoolMetadata) RemoveDevice(ctx context.Context, name string, fn DeviceI
 			return errors.Wrapf(err, "failed to delete device info for %q", name)
 		}
 
+		children, err := getChildren(bucket, name)
+		if err != nil {
+			return err
+		}
+
+		for _, child := range children {
+			child.ParentName = device.ParentName
+			if err := putObject(bucket, child.Name, child, true); err != nil {
+				return err
+			}
+		}
+
 		if err := markDeviceID(tx, device.DeviceID, deviceFree); err != nil {
 			return err
 		}
 
-		return fn(device)
+		return tx.Bucket(journalBucketName).Delete([]byte(name))
+	})
+}
+
+// GetTotalVirtualSize returns the sum of virtual sizes of all devices in the store
+func (m *PoolMetadata) GetTotalVirtualSize(ctx context.Context) (uint64, error) {
+	var total uint64
+
+	err := m.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(devicesBucketName)
+		return bucket.ForEach(func(_, data []byte) error {
+			var device DeviceInfo
+			if err := json.Unmarshal(data, &device); err != nil {
+				return err
+			}
+
+			total += device.Size
+			return nil
+		})
 	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return total, nil
+}
+
+// DeviceStats represents counts of devices and device IDs in metadata store
+type DeviceStats struct {
+	// Devices is the number of thin devices and snapshots
+	Devices int
+	// ActivatedDevices is the number of devices which are activated
+	ActivatedDevices int
+	// HighestDeviceID is the highest device ID in use
+	HighestDeviceID uint32
+	// TakenDeviceIDs is the number of device IDs in use, including IDs of devices created out of band
+	TakenDeviceIDs int
+}
+
+// GetDeviceStats returns counts of devices and device IDs in use
+func (m *PoolMetadata) GetDeviceStats(ctx context.Context) (*DeviceStats, error) {
+	stats := &DeviceStats{}
+
+	err := m.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(devicesBucketName)
+		err := bucket.ForEach(func(_, data []byte) error {
+			var device DeviceInfo
+			if err := json.Unmarshal(data, &device); err != nil {
+				return err
+			}
+
+			stats.Devices++
+
+			if device.IsActivated {
+				stats.ActivatedDevices++
+			}
+
+			if device.DeviceID > stats.HighestDeviceID {
+				stats.HighestDeviceID = device.DeviceID
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			return err
+		}
+
+		return tx.Bucket(deviceIDBucketName).ForEach(func(_, state []byte) error {
+			if len(state) > 0 && state[0] == byte(deviceTaken) {
+				stats.TakenDeviceIDs++
+			}
+
+			return nil
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
+
+// CountDevices returns the number of devices in the store
+func (m *PoolMetadata) CountDevices(ctx context.Context) (int, error) {
+	var count int
+
+	err := m.db.View(func(tx *bolt.Tx) error {
+		count = tx.Bucket(devicesBucketName).Stats().KeyN
+		return nil
+	})
+
+	return count, err
+}
+
+// GetDeviceByID retrieves device info by device ID, ErrNotFound if no device in the store has the ID
+func (m *PoolMetadata) GetDeviceByID(ctx context.Context, deviceID uint32) (*DeviceInfo, error) {
+	var result *DeviceInfo
+
+	err := m.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(devicesBucketName).ForEach(func(_, data []byte) error {
+			var device DeviceInfo
+			if err := json.Unmarshal(data, &device); err != nil {
+				return err
+			}
+
+			if device.DeviceID == deviceID {
+				result = &device
+			}
+
+			return nil
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if result == nil {
+		return nil, errors.Wrapf(ErrNotFound, "device id %d", deviceID)
+	}
+
+	return result, nil
+}
+
+// GetDevices retrieves info of all devices currently stored in database, sorted by name
+func (m *PoolMetadata) GetDevices(ctx context.Context) ([]*DeviceInfo, error) {
+	var devices []*DeviceInfo
+
+	err := m.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(devicesBucketName)
+		return bucket.ForEach(func(_, data []byte) error {
+			device := &DeviceInfo{}
+			if err := json.Unmarshal(data, device); err != nil {
+				return err
+			}
+
+			devices = append(devices, device)
+			return nil
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return devices, nil
 }
 
 // GetDeviceNames retrieves the list of device names currently stored in database
@@ -319,7 +1026,7 @@ func putObject(bucket *bolt.Bucket, key string, obj interface{}, overwrite bool)
 func getObject(bucket *bolt.Bucket, key string, obj interface{}) error {
 	data := bucket.Get([]byte(key))
 	if data == nil {
-		return ErrNotFound
+		return errors.Wrapf(ErrNotFound, "device %q", key)
 	}
 
 	if obj != nil {
@@ -330,3 +1037,25 @@ func getObject(bucket *bolt.Bucket, key string, obj interface{}) error {
 
 	return nil
 }
+
+// getChildren returns infos of devices which parent is the given device
+func getChildren(bucket *bolt.Bucket, name string) ([]*DeviceInfo, error) {
+	var children []*DeviceInfo
+
+	if err := bucket.ForEach(func(k, v []byte) error {
+		child := &DeviceInfo{}
+		if err := json.Unmarshal(v, child); err != nil {
+			return errors.Wrapf(err, "failed to unmarshal object with key %q", string(k))
+		}
+
+		if child.ParentName == name {
+			children = append(children, child)
+		}
+
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return children, nil
+}
@@ -15,14 +15,18 @@ package devmapper
 
 import (
 	"context"
-	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.etcd.io/bbolt"
 )
 
 var (
@@ -65,7 +69,7 @@ func TestPoolMetadata_AddDeviceRollback(t *testing.T) {
 	assert.Equal(t, expectedErr, err)
 
 	_, err = store.GetDevice(testCtx, "test2")
-	assert.Equal(t, ErrNotFound, err)
+	assert.Equal(t, ErrNotFound, errors.Cause(err))
 }
 
 func TestPoolMetadata_AddDeviceDuplicate(t *testing.T) {
@@ -76,7 +80,61 @@ func TestPoolMetadata_AddDeviceDuplicate(t *testing.T) {
 	assert.NoError(t, err)
 
 	err = store.AddDevice(testCtx, &DeviceInfo{Name: "test"}, testDevIDCallback)
-	assert.Equal(t, ErrAlreadyExists, err)
+	assert.Equal(t, ErrAlreadyExists, errors.Cause(err))
+}
+
+func TestPoolMetadata_GetDeviceByID(t *testing.T) {
+	tempDir, store := createStore(t)
+	defer cleanupStore(t, tempDir, store)
+
+	info := &DeviceInfo{Name: "test"}
+	err := store.AddDevice(testCtx, info, testDevIDCallback)
+	require.NoError(t, err)
+
+	result, err := store.GetDeviceByID(testCtx, info.DeviceID)
+	require.NoError(t, err)
+	assert.Equal(t, "test", result.Name)
+
+	_, err = store.GetDeviceByID(testCtx, info.DeviceID+1)
+	assert.True(t, errors.Is(err, ErrDeviceNotFound))
+}
+
+func TestPoolMetadata_Timestamps(t *testing.T) {
+	tempDir, store := createStore(t)
+	defer func() {
+		assert.NoError(t, os.RemoveAll(tempDir))
+	}()
+
+	before := time.Now().UTC()
+
+	info := &DeviceInfo{Name: "thin-1"}
+	err := store.AddDevice(testCtx, info, testDevIDCallback)
+	require.NoError(t, err)
+
+	assert.Equal(t, time.UTC, info.CreatedAt.Location())
+	assert.False(t, info.CreatedAt.Before(before))
+	assert.True(t, info.ActivatedAt.IsZero(), "device saved inactive wasn't activated")
+
+	imported := &DeviceInfo{Name: "thin-2", DeviceID: 100, IsActivated: true}
+	err = store.ImportDevice(testCtx, imported)
+	require.NoError(t, err)
+	assert.Equal(t, imported.CreatedAt, imported.ActivatedAt)
+
+	// Timestamps are kept in the store across restarts
+	require.NoError(t, store.Close())
+
+	store, err = NewPoolMetadata(filepath.Join(tempDir, "test.db"))
+	require.NoError(t, err)
+	defer store.Close()
+
+	devices, err := store.GetDevices(testCtx)
+	require.NoError(t, err)
+	require.Len(t, devices, 2)
+
+	assert.Equal(t, "thin-1", devices[0].Name)
+	assert.True(t, info.CreatedAt.Equal(devices[0].CreatedAt))
+	assert.Equal(t, "thin-2", devices[1].Name)
+	assert.True(t, imported.ActivatedAt.Equal(devices[1].ActivatedAt))
 }
 
 func TestPoolMetadata_ReuseDeviceID(t *testing.T) {
@@ -104,6 +162,283 @@ func TestPoolMetadata_ReuseDeviceID(t *testing.T) {
 	assert.Equal(t, info2.DeviceID, info3.DeviceID)
 }
 
+func TestPoolMetadata_ImportDevice(t *testing.T) {
+	tempDir, store := createStore(t)
+	defer cleanupStore(t, tempDir, store)
+
+	err := store.ImportDevice(testCtx, &DeviceInfo{Name: "imported", DeviceID: 2, Size: 1024, IsActivated: true})
+	require.NoError(t, err)
+
+	result, err := store.GetDevice(testCtx, "imported")
+	require.NoError(t, err)
+	assert.EqualValues(t, 2, result.DeviceID)
+	assert.True(t, result.IsActivated)
+
+	err = store.ImportDevice(testCtx, &DeviceInfo{Name: "imported", DeviceID: 3})
+	assert.Equal(t, ErrAlreadyExists, errors.Cause(err), "name is taken")
+
+	err = store.ImportDevice(testCtx, &DeviceInfo{Name: "other", DeviceID: 2})
+	assert.Equal(t, ErrAlreadyExists, errors.Cause(err), "device id is taken")
+
+	// New devices get IDs around the imported one
+	info1 := &DeviceInfo{Name: "test1"}
+	err = store.AddDevice(testCtx, info1, testDevIDCallback)
+	require.NoError(t, err)
+
+	info2 := &DeviceInfo{Name: "test2"}
+	err = store.AddDevice(testCtx, info2, testDevIDCallback)
+	require.NoError(t, err)
+
+	assert.EqualValues(t, 1, info1.DeviceID)
+	assert.EqualValues(t, 3, info2.DeviceID)
+}
+
+func TestPoolMetadata_MarkDeviceIDsTaken(t *testing.T) {
+	tempDir, store := createStore(t)
+	defer cleanupStore(t, tempDir, store)
+
+	info := &DeviceInfo{Name: "test1"}
+	err := store.AddDevice(testCtx, info, testDevIDCallback)
+	require.NoError(t, err)
+	assert.EqualValues(t, 1, info.DeviceID)
+
+	// IDs of devices found in the pool, ID of the known device and 0 aren't counted
+	marked, err := store.MarkDeviceIDsTaken(testCtx, []uint32{0, 1, 2, 3, 3})
+	require.NoError(t, err)
+	assert.Equal(t, 2, marked)
+
+	marked, err = store.MarkDeviceIDsTaken(testCtx, []uint32{2, 3})
+	require.NoError(t, err)
+	assert.Equal(t, 0, marked, "IDs are already taken")
+
+	_, err = store.MarkDeviceIDsTaken(testCtx, []uint32{maxDeviceID})
+	assert.Error(t, err)
+
+	info = &DeviceInfo{Name: "test2"}
+	err = store.AddDevice(testCtx, info, testDevIDCallback)
+	require.NoError(t, err)
+	assert.EqualValues(t, 4, info.DeviceID, "IDs used in the pool shouldn't be allocated")
+}
+
+func TestPoolMetadata_ReuseLowestDeviceID(t *testing.T) {
+	tempDir, store := createStore(t)
+	defer cleanupStore(t, tempDir, store)
+
+	ids := make(map[string]uint32)
+	for _, name := range []string{"test1", "test2", "test3", "test4"} {
+		info := &DeviceInfo{Name: name}
+		err := store.AddDevice(testCtx, info, testDevIDCallback)
+		require.NoError(t, err)
+		ids[name] = info.DeviceID
+	}
+
+	for _, name := range []string{"test3", "test2"} {
+		err := store.RemoveDevice(testCtx, name, testDevInfoCallback)
+		require.NoError(t, err)
+	}
+
+	info := &DeviceInfo{Name: "test5"}
+	err := store.AddDevice(testCtx, info, testDevIDCallback)
+	require.NoError(t, err)
+	assert.Equal(t, ids["test2"], info.DeviceID)
+
+	info = &DeviceInfo{Name: "test6"}
+	err = store.AddDevice(testCtx, info, testDevIDCallback)
+	require.NoError(t, err)
+	assert.Equal(t, ids["test3"], info.DeviceID)
+
+	info = &DeviceInfo{Name: "test7"}
+	err = store.AddDevice(testCtx, info, testDevIDCallback)
+	require.NoError(t, err)
+	assert.Equal(t, ids["test4"]+1, info.DeviceID, "no released ids left, new one should be allocated")
+}
+
+func TestPoolMetadata_AddDeviceIDTaken(t *testing.T) {
+	tempDir, store := createStore(t)
+	defer cleanupStore(t, tempDir, store)
+
+	// First two IDs are used in thin-pool by devices unknown to metadata
+	var tried []uint32
+	info := &DeviceInfo{Name: "test1"}
+	err := store.AddDevice(testCtx, info, func(id uint32) error {
+		tried = append(tried, id)
+		if len(tried) <= 2 {
+			return ErrDeviceIDTaken
+		}
+
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Len(t, tried, 3)
+	assert.Equal(t, tried[2], info.DeviceID)
+
+	// Out of band IDs stay taken
+	info2 := &DeviceInfo{Name: "test2"}
+	err = store.AddDevice(testCtx, info2, testDevIDCallback)
+	require.NoError(t, err)
+	assert.NotContains(t, tried, info2.DeviceID)
+
+	// Retries are limited
+	err = store.AddDevice(testCtx, &DeviceInfo{Name: "test3"}, func(uint32) error { return ErrDeviceIDTaken })
+	assert.Equal(t, ErrDeviceIDTaken, err)
+}
+
+func TestPoolMetadata_OutOfBandIDRange(t *testing.T) {
+	tempDir, store := createStore(t)
+	defer cleanupStore(t, tempDir, store)
+
+	// More adjacent IDs are used out of band than AddDevice retries
+	err := store.AddDevice(testCtx, &DeviceInfo{Name: "test"}, func(id uint32) error {
+		if id <= 10*maxTakenDeviceIDRetries {
+			return ErrDeviceIDTaken
+		}
+
+		return nil
+	})
+	assert.NoError(t, err)
+}
+
+func TestPoolMetadata_AddDeviceCancelled(t *testing.T) {
+	tempDir, store := createStore(t)
+	defer cleanupStore(t, tempDir, store)
+
+	ctx, cancel := context.WithCancel(testCtx)
+	err := store.AddDevice(ctx, &DeviceInfo{Name: "test"}, func(uint32) error {
+		// Caller gives up while ID is being retried
+		cancel()
+		return ErrDeviceIDTaken
+	})
+	assert.Equal(t, context.Canceled, err)
+
+	_, err = store.GetDevice(testCtx, "test")
+	assert.Equal(t, ErrNotFound, errors.Cause(err))
+}
+
+func TestPoolMetadata_FreeListMigration(t *testing.T) {
+	tempDir, store := createStore(t)
+	defer os.RemoveAll(tempDir)
+
+	info1 := &DeviceInfo{Name: "test1"}
+	err := store.AddDevice(testCtx, info1, testDevIDCallback)
+	require.NoError(t, err)
+
+	err = store.AddDevice(testCtx, &DeviceInfo{Name: "test2"}, testDevIDCallback)
+	require.NoError(t, err)
+
+	err = store.RemoveDevice(testCtx, "test1", testDevInfoCallback)
+	require.NoError(t, err)
+
+	// Simulate database created before free list was introduced
+	err = store.db.Update(func(tx *bolt.Tx) error {
+		return tx.DeleteBucket(freeDeviceIDBucketName)
+	})
+	require.NoError(t, err)
+
+	err = store.Close()
+	require.NoError(t, err)
+
+	store, err = NewPoolMetadata(filepath.Join(tempDir, "test.db"))
+	require.NoError(t, err)
+	defer store.Close()
+
+	info3 := &DeviceInfo{Name: "test3"}
+	err = store.AddDevice(testCtx, info3, testDevIDCallback)
+	require.NoError(t, err)
+	assert.Equal(t, info1.DeviceID, info3.DeviceID, "released id should be picked from migrated free list")
+}
+
+func TestPoolMetadata_DeviceIDsExhausted(t *testing.T) {
+	tempDir, store := createStore(t)
+	defer cleanupStore(t, tempDir, store)
+
+	info1 := &DeviceInfo{Name: "test1"}
+	err := store.AddDevice(testCtx, info1, testDevIDCallback)
+	require.NoError(t, err)
+
+	// Simulate the pool with all device IDs taken, without allocating 16M of them
+	err = store.db.Update(func(tx *bolt.Tx) error {
+		return setTakenDeviceIDs(tx, maxDeviceID-1)
+	})
+	require.NoError(t, err)
+
+	calls := 0
+	start := time.Now()
+	err = store.AddDevice(testCtx, &DeviceInfo{Name: "test2"}, func(uint32) error {
+		calls++
+		return nil
+	})
+
+	assert.True(t, errors.Is(err, ErrNoDeviceIDsAvailable), "unexpected error: %v", err)
+	assert.Zero(t, calls, "no device ID should be tried")
+	assert.True(t, time.Since(start) < time.Second, "exhaustion should be detected right away")
+
+	err = store.db.View(func(tx *bolt.Tx) error {
+		_, err := getRandomDeviceID(tx)
+		return err
+	})
+	assert.True(t, errors.Is(err, ErrNoDeviceIDsAvailable))
+
+	// Released ID is reused even if the sequence is exhausted
+	err = store.RemoveDevice(testCtx, "test1", testDevInfoCallback)
+	require.NoError(t, err)
+
+	info3 := &DeviceInfo{Name: "test3"}
+	err = store.AddDevice(testCtx, info3, testDevIDCallback)
+	require.NoError(t, err)
+	assert.Equal(t, info1.DeviceID, info3.DeviceID)
+}
+
+func TestPoolMetadata_TakenDeviceIDCount(t *testing.T) {
+	tempDir, store := createStore(t)
+	defer os.RemoveAll(tempDir)
+
+	count := func() uint32 {
+		var taken uint32
+		err := store.db.View(func(tx *bolt.Tx) error {
+			taken = takenDeviceIDs(tx)
+			return nil
+		})
+
+		require.NoError(t, err)
+		return taken
+	}
+
+	for _, name := range []string{"test1", "test2", "test3"} {
+		err := store.AddDevice(testCtx, &DeviceInfo{Name: name}, testDevIDCallback)
+		require.NoError(t, err)
+	}
+
+	err := store.ImportDevice(testCtx, &DeviceInfo{Name: "imported", DeviceID: 100})
+	require.NoError(t, err)
+	assert.EqualValues(t, 4, count())
+
+	err = store.RemoveDevice(testCtx, "test2", testDevInfoCallback)
+	require.NoError(t, err)
+	assert.EqualValues(t, 3, count())
+
+	// Failed allocation doesn't change the count
+	err = store.AddDevice(testCtx, &DeviceInfo{Name: "failed"}, func(uint32) error {
+		return errors.New("failed to create device")
+	})
+	require.Error(t, err)
+	assert.EqualValues(t, 3, count())
+
+	// Simulate database created before the counter was introduced
+	err = store.db.Update(func(tx *bolt.Tx) error {
+		return tx.DeleteBucket(deviceIDCountBucketName)
+	})
+	require.NoError(t, err)
+
+	err = store.Close()
+	require.NoError(t, err)
+
+	store, err = NewPoolMetadata(filepath.Join(tempDir, "test.db"))
+	require.NoError(t, err)
+	defer store.Close()
+
+	assert.EqualValues(t, 3, count(), "taken IDs should be counted on migration")
+}
+
 func TestPoolMetadata_RemoveDevice(t *testing.T) {
 	tempDir, store := createStore(t)
 	defer cleanupStore(t, tempDir, store)
@@ -115,7 +450,92 @@ func TestPoolMetadata_RemoveDevice(t *testing.T) {
 	assert.NoError(t, err)
 
 	_, err = store.GetDevice(testCtx, "test")
-	assert.Equal(t, ErrNotFound, err)
+	assert.Equal(t, ErrNotFound, errors.Cause(err))
+}
+
+func TestPoolMetadata_AddDeviceJournal(t *testing.T) {
+	tempDir, store := createStore(t)
+	defer cleanupStore(t, tempDir, store)
+
+	info := &DeviceInfo{Name: "test", Size: 10}
+	err := store.AddDevice(testCtx, info, func(id uint32) error {
+		// Device ID is journaled before device-mapper is called, device isn't visible yet
+		journal, err := store.getJournal(testCtx)
+		require.NoError(t, err)
+		require.Len(t, journal, 1)
+		assert.Equal(t, Creating, journal[0].State)
+		assert.Equal(t, "test", journal[0].Info.Name)
+		assert.Equal(t, id, journal[0].Info.DeviceID)
+
+		_, err = store.GetDevice(testCtx, "test")
+		assert.Equal(t, ErrNotFound, errors.Cause(err))
+
+		// Name is taken until create is done
+		err = store.AddDevice(testCtx, &DeviceInfo{Name: "test"}, testDevIDCallback)
+		assert.Equal(t, ErrAlreadyExists, errors.Cause(err))
+		return nil
+	})
+	require.NoError(t, err)
+
+	journal, err := store.getJournal(testCtx)
+	require.NoError(t, err)
+	assert.Empty(t, journal)
+
+	result, err := store.GetDevice(testCtx, "test")
+	require.NoError(t, err)
+	assert.Equal(t, Created, result.State)
+
+	// Failed create leaves nothing behind and frees device ID
+	err = store.AddDevice(testCtx, &DeviceInfo{Name: "test2"}, func(uint32) error { return errors.New("create failed") })
+	assert.Error(t, err)
+
+	journal, err = store.getJournal(testCtx)
+	require.NoError(t, err)
+	assert.Empty(t, journal)
+
+	stats, err := store.GetDeviceStats(testCtx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, stats.TakenDeviceIDs)
+}
+
+func TestPoolMetadata_RemoveDeviceJournal(t *testing.T) {
+	tempDir, store := createStore(t)
+	defer cleanupStore(t, tempDir, store)
+
+	err := store.AddDevice(testCtx, &DeviceInfo{Name: "test", IsActivated: true}, testDevIDCallback)
+	require.NoError(t, err)
+
+	removeErr := errors.New("remove failed")
+	err = store.RemoveDevice(testCtx, "test", func(info *DeviceInfo) error {
+		assert.Equal(t, Removing, info.State)
+
+		journal, err := store.getJournal(testCtx)
+		require.NoError(t, err)
+		require.Len(t, journal, 1)
+		assert.Equal(t, Removing, journal[0].State)
+
+		stored, err := store.GetDevice(testCtx, "test")
+		require.NoError(t, err)
+		assert.Equal(t, Removing, stored.State)
+		return removeErr
+	})
+	assert.Equal(t, removeErr, err)
+
+	// Failed removal restores the state
+	info, err := store.GetDevice(testCtx, "test")
+	require.NoError(t, err)
+	assert.Equal(t, Activated, info.State)
+
+	journal, err := store.getJournal(testCtx)
+	require.NoError(t, err)
+	assert.Empty(t, journal)
+
+	err = store.RemoveDevice(testCtx, "test", testDevInfoCallback)
+	require.NoError(t, err)
+
+	journal, err = store.getJournal(testCtx)
+	require.NoError(t, err)
+	assert.Empty(t, journal)
 }
 
 func TestPoolMetadata_UpdateDevice(t *testing.T) {
@@ -150,6 +570,87 @@ func TestPoolMetadata_UpdateDevice(t *testing.T) {
 	assert.False(t, newInfo.IsActivated)
 }
 
+func TestPoolMetadata_RemoveDeviceKeepsLineage(t *testing.T) {
+	tempDir, store := createStore(t)
+	defer cleanupStore(t, tempDir, store)
+
+	err := store.AddDevice(testCtx, &DeviceInfo{Name: "base"}, testDevIDCallback)
+	require.NoError(t, err)
+
+	err = store.AddDevice(testCtx, &DeviceInfo{Name: "snap-1", ParentName: "base"}, testDevIDCallback)
+	require.NoError(t, err)
+
+	err = store.AddDevice(testCtx, &DeviceInfo{Name: "snap-2", ParentName: "snap-1"}, testDevIDCallback)
+	require.NoError(t, err)
+
+	children, err := store.GetChildren(testCtx, "snap-1")
+	require.NoError(t, err)
+	require.Len(t, children, 1)
+	assert.Equal(t, "snap-2", children[0].Name)
+
+	err = store.RemoveDevice(testCtx, "snap-1", testDevInfoCallback)
+	require.NoError(t, err)
+
+	child, err := store.GetDevice(testCtx, "snap-2")
+	require.NoError(t, err)
+	assert.Equal(t, "base", child.ParentName)
+
+	_, err = store.GetChildren(testCtx, "snap-1")
+	assert.Equal(t, ErrNotFound, errors.Cause(err))
+}
+
+func TestPoolMetadata_RenameDevice(t *testing.T) {
+	tempDir, store := createStore(t)
+	defer cleanupStore(t, tempDir, store)
+
+	parent := &DeviceInfo{Name: "parent", Size: 1}
+	err := store.AddDevice(testCtx, parent, testDevIDCallback)
+	require.NoError(t, err)
+
+	err = store.AddDevice(testCtx, &DeviceInfo{Name: "child", ParentName: "parent"}, testDevIDCallback)
+	require.NoError(t, err)
+
+	err = store.RenameDevice(testCtx, "parent", "renamed", testDevInfoCallback)
+	require.NoError(t, err)
+
+	_, err = store.GetDevice(testCtx, "parent")
+	assert.Equal(t, ErrNotFound, errors.Cause(err))
+
+	renamed, err := store.GetDevice(testCtx, "renamed")
+	require.NoError(t, err)
+	assert.Equal(t, "renamed", renamed.Name)
+	assert.Equal(t, parent.DeviceID, renamed.DeviceID)
+	assert.EqualValues(t, 1, renamed.Size)
+
+	child, err := store.GetDevice(testCtx, "child")
+	require.NoError(t, err)
+	assert.Equal(t, "renamed", child.ParentName)
+
+	err = store.RenameDevice(testCtx, "renamed", "child", testDevInfoCallback)
+	assert.Equal(t, ErrAlreadyExists, errors.Cause(err))
+
+	err = store.RenameDevice(testCtx, "not-existing", "test", testDevInfoCallback)
+	assert.Equal(t, ErrNotFound, errors.Cause(err))
+}
+
+func TestPoolMetadata_RenameDeviceRollback(t *testing.T) {
+	tempDir, store := createStore(t)
+	defer cleanupStore(t, tempDir, store)
+
+	err := store.AddDevice(testCtx, &DeviceInfo{Name: "test1"}, testDevIDCallback)
+	require.NoError(t, err)
+
+	expectedErr := errors.New("rename failed")
+	err = store.RenameDevice(testCtx, "test1", "test2", func(*DeviceInfo) error { return expectedErr })
+	assert.Equal(t, expectedErr, err)
+
+	_, err = store.GetDevice(testCtx, "test1")
+	assert.NoError(t, err)
+
+	_, err = store.GetDevice(testCtx, "test2")
+	assert.Equal(t, ErrNotFound, errors.Cause(err))
+}
+
 func TestPoolMetadata_GetDeviceNames(t *testing.T) {
 	tempDir, store := createStore(t)
 	defer cleanupStore(t, tempDir, store)
@@ -168,7 +669,62 @@ func TestPoolMetadata_GetDeviceNames(t *testing.T) {
 	assert.Equal(t, "test2", names[1])
 }
 
-func createStore(t *testing.T) (tempDir string, store *PoolMetadata) {
+func TestPoolMetadata_GetTotalVirtualSize(t *testing.T) {
+	tempDir, store := createStore(t)
+	defer cleanupStore(t, tempDir, store)
+
+	total, err := store.GetTotalVirtualSize(testCtx)
+	assert.NoError(t, err)
+	assert.Zero(t, total)
+
+	err = store.AddDevice(testCtx, &DeviceInfo{Name: "test1", Size: 1024}, testDevIDCallback)
+	assert.NoError(t, err)
+
+	err = store.AddDevice(testCtx, &DeviceInfo{Name: "test2", Size: 2048}, testDevIDCallback)
+	assert.NoError(t, err)
+
+	total, err = store.GetTotalVirtualSize(testCtx)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 3072, total)
+}
+
+func TestPoolMetadata_Reopen(t *testing.T) {
+	tempDir, store := createStore(t)
+	defer os.RemoveAll(tempDir)
+
+	info1 := &DeviceInfo{Name: "test1", Size: 1024}
+	err := store.AddDevice(testCtx, info1, testDevIDCallback)
+	require.NoError(t, err)
+
+	info2 := &DeviceInfo{Name: "test2", ParentName: "test1", Size: 1024}
+	err = store.AddDevice(testCtx, info2, testDevIDCallback)
+	require.NoError(t, err)
+
+	err = store.Close()
+	require.NoError(t, err)
+
+	// Restarted snapshotter opens the same file
+	store, err = NewPoolMetadata(filepath.Join(tempDir, "test.db"))
+	require.NoError(t, err)
+	defer store.Close()
+
+	result, err := store.GetDevice(testCtx, "test2")
+	require.NoError(t, err)
+	assert.Equal(t, info2.DeviceID, result.DeviceID)
+	assert.Equal(t, "test1", result.ParentName)
+
+	// IDs taken before restart aren't handed out again
+	info3 := &DeviceInfo{Name: "test3"}
+	err = store.AddDevice(testCtx, info3, testDevIDCallback)
+	require.NoError(t, err)
+	assert.NotEqual(t, info1.DeviceID, info3.DeviceID)
+	assert.NotEqual(t, info2.DeviceID, info3.DeviceID)
+
+	err = store.RemoveDevice(testCtx, "test1", testDevInfoCallback)
+	assert.NoError(t, err)
+}
+
+func createStore(t testing.TB) (tempDir string, store *PoolMetadata) {
 	tempDir, err := ioutil.TempDir("", "pool-metadata-")
 	require.NoErrorf(t, err, "couldn't create temp directory for metadata tests")
 
@@ -179,10 +735,47 @@ func createStore(t *testing.T) (tempDir string, store *PoolMetadata) {
 	return tempDir, metadata
 }
 
-func cleanupStore(t *testing.T, tempDir string, store *PoolMetadata) {
+func cleanupStore(t testing.TB, tempDir string, store *PoolMetadata) {
 	err := store.Close()
 	assert.NoErrorf(t, err, "failed to close metadata store")
 
 	err = os.RemoveAll(tempDir)
 	assert.NoErrorf(t, err, "failed to cleanup temp directory")
 }
+
+// BenchmarkAddDeviceCollisions creates devices concurrently in a pool, where a range of device IDs
+// is used by devices unknown to metadata store, and reports how many IDs were found to be taken
+func BenchmarkAddDeviceCollisions(b *testing.B) {
+	const outOfBandIDs = 256
+
+	tempDir, store := createStore(b)
+	defer cleanupStore(b, tempDir, store)
+
+	var (
+		names      int64
+		collisions int64
+		failures   int64
+	)
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			name := fmt.Sprintf("thin-%d", atomic.AddInt64(&names, 1))
+			err := store.AddDevice(testCtx, &DeviceInfo{Name: name}, func(id uint32) error {
+				if id <= outOfBandIDs {
+					atomic.AddInt64(&collisions, 1)
+					return ErrDeviceIDTaken
+				}
+
+				return nil
+			})
+
+			if err != nil {
+				atomic.AddInt64(&failures, 1)
+			}
+		}
+	})
+
+	b.ReportMetric(float64(collisions)/float64(b.N), "collisions/op")
+	b.ReportMetric(float64(failures)/float64(b.N), "failures/op")
+}
@@ -0,0 +1,145 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package devmapper
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	metricsNamespace = "devmapper"
+
+	// Values of "operation" label
+	operationCreate   = "create"
+	operationSnapshot = "snapshot"
+	operationRemove   = "remove"
+	operationDelete   = "delete"
+	operationImport   = "import"
+)
+
+// poolMetrics holds Prometheus collectors of pool device, nil if metrics aren't enabled
+type poolMetrics struct {
+	operations      *prometheus.CounterVec
+	deviceIDRetries prometheus.Histogram
+	busyRemovals    prometheus.Counter
+	discardedBytes  prometheus.Counter
+
+	activeDevices   *prometheus.Desc
+	highestDeviceID *prometheus.Desc
+
+	metadata *PoolMetadata
+}
+
+func newPoolMetrics(poolName string, metadata *PoolMetadata) *poolMetrics {
+	labels := prometheus.Labels{"pool": poolName}
+
+	return &poolMetrics{
+		operations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   metricsNamespace,
+			Name:        "device_operations_total",
+			Help:        "Number of device creates, snapshots, removals and deletions by result.",
+			ConstLabels: labels,
+		}, []string{"operation", "result"}),
+		deviceIDRetries: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace:   metricsNamespace,
+			Name:        "device_id_collisions",
+			Help:        "Number of device IDs found taken in thin-pool while allocating device ID for new device.",
+			ConstLabels: labels,
+			Buckets:     []float64{0, 1, 2, 4, 8, 16},
+		}),
+		busyRemovals: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   metricsNamespace,
+			Name:        "device_remove_busy_total",
+			Help:        "Number of device removals failed because device was still in use after retries.",
+			ConstLabels: labels,
+		}),
+		discardedBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   metricsNamespace,
+			Name:        "discarded_bytes_total",
+			Help:        "Number of bytes discarded on devices before deletion.",
+			ConstLabels: labels,
+		}),
+		activeDevices: prometheus.NewDesc(metricsNamespace+"_active_devices",
+			"Number of activated devices.", nil, labels),
+		highestDeviceID: prometheus.NewDesc(metricsNamespace+"_highest_device_id",
+			"Highest device ID in use.", nil, labels),
+		metadata: metadata,
+	}
+}
+
+// Describe implements prometheus.Collector
+func (m *poolMetrics) Describe(ch chan<- *prometheus.Desc) {
+	m.operations.Describe(ch)
+	m.deviceIDRetries.Describe(ch)
+	m.busyRemovals.Describe(ch)
+	m.discardedBytes.Describe(ch)
+	ch <- m.activeDevices
+	ch <- m.highestDeviceID
+}
+
+// Collect implements prometheus.Collector, device gauges are read from metadata store on each scrape
+func (m *poolMetrics) Collect(ch chan<- prometheus.Metric) {
+	m.operations.Collect(ch)
+	m.deviceIDRetries.Collect(ch)
+	m.busyRemovals.Collect(ch)
+	m.discardedBytes.Collect(ch)
+
+	stats, err := m.metadata.GetDeviceStats(context.Background())
+	if err != nil {
+		err = errors.Wrap(err, "failed to query device stats")
+		ch <- prometheus.NewInvalidMetric(m.activeDevices, err)
+		ch <- prometheus.NewInvalidMetric(m.highestDeviceID, err)
+		return
+	}
+
+	ch <- prometheus.MustNewConstMetric(m.activeDevices, prometheus.GaugeValue, float64(stats.ActivatedDevices))
+	ch <- prometheus.MustNewConstMetric(m.highestDeviceID, prometheus.GaugeValue, float64(stats.HighestDeviceID))
+}
+
+func (m *poolMetrics) observeOperation(operation string, err error) {
+	if m == nil {
+		return
+	}
+
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+
+	m.operations.WithLabelValues(operation, result).Inc()
+
+	if operation == operationRemove && errors.Cause(err) == unix.EBUSY {
+		m.busyRemovals.Inc()
+	}
+}
+
+func (m *poolMetrics) observeDeviceIDRetries(retries int) {
+	if m == nil {
+		return
+	}
+
+	m.deviceIDRetries.Observe(float64(retries))
+}
+
+func (m *poolMetrics) observeDiscard(bytes uint64) {
+	if m == nil {
+		return
+	}
+
+	m.discardedBytes.Add(float64(bytes))
+}
@@ -0,0 +1,102 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package devmapper
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestPoolMetrics(t *testing.T) {
+	tempDir, store := createStore(t)
+	defer cleanupStore(t, tempDir, store)
+
+	metrics := newPoolMetrics("test-pool", store)
+	registry := prometheus.NewRegistry()
+	require.NoError(t, registry.Register(metrics))
+
+	ctx := context.Background()
+	pool := &PoolDevice{poolName: "test-pool", metadata: store, metrics: metrics}
+
+	// Two device IDs are taken in thin-pool before allocation succeeds
+	collisions := 2
+	thin1 := &DeviceInfo{Name: "thin-1", IsActivated: true}
+	err := pool.addDevice(ctx, thin1, func(uint32) error {
+		if collisions > 0 {
+			collisions--
+			return ErrDeviceIDTaken
+		}
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	thin2 := &DeviceInfo{Name: "thin-2"}
+	err = pool.addDevice(ctx, thin2, func(uint32) error { return nil })
+	require.NoError(t, err)
+
+	metrics.observeOperation(operationCreate, nil)
+	metrics.observeOperation(operationCreate, errors.New("create failed"))
+	metrics.observeOperation(operationRemove, errors.Wrap(unix.EBUSY, "remove failed"))
+
+	assert.EqualValues(t, 1, testutil.ToFloat64(metrics.operations.WithLabelValues(operationCreate, "success")))
+	assert.EqualValues(t, 1, testutil.ToFloat64(metrics.operations.WithLabelValues(operationCreate, "failure")))
+	assert.EqualValues(t, 1, testutil.ToFloat64(metrics.operations.WithLabelValues(operationRemove, "failure")))
+	assert.EqualValues(t, 1, testutil.ToFloat64(metrics.busyRemovals))
+
+	metrics.observeDiscard(1024)
+	metrics.observeDiscard(2048)
+	assert.EqualValues(t, 3072, testutil.ToFloat64(metrics.discardedBytes))
+
+	families, err := registry.Gather()
+	require.NoError(t, err)
+
+	values := make(map[string]float64)
+	for _, family := range families {
+		metric := family.GetMetric()[0]
+		switch {
+		case metric.Gauge != nil:
+			values[family.GetName()] = metric.Gauge.GetValue()
+		case metric.Histogram != nil:
+			values[family.GetName()] = metric.Histogram.GetSampleSum()
+		}
+	}
+
+	assert.EqualValues(t, 1, values["devmapper_active_devices"])
+	// Retries after a collision take random IDs
+	highestID := thin1.DeviceID
+	if thin2.DeviceID > highestID {
+		highestID = thin2.DeviceID
+	}
+
+	assert.EqualValues(t, highestID, values["devmapper_highest_device_id"])
+	assert.EqualValues(t, 2, values["devmapper_device_id_collisions"], "collisions of both allocations should be summed up")
+}
+
+func TestPoolMetricsDisabled(t *testing.T) {
+	var metrics *poolMetrics
+
+	assert.NotPanics(t, func() {
+		metrics.observeOperation(operationCreate, nil)
+		metrics.observeDeviceIDRetries(1)
+		metrics.observeDiscard(1)
+	})
+}
@@ -0,0 +1,107 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package devmapper
+
+import (
+	"context"
+	"os/exec"
+	"strings"
+
+	"github.com/containerd/containerd/log"
+	"github.com/pkg/errors"
+
+	"github.com/firecracker-microvm/firecracker-containerd/snapshotter/pkg/dmsetup"
+)
+
+// mkfsTools maps filesystem types supported by WithFilesystem to their mkfs tools
+var mkfsTools = map[string]string{
+	"ext4": "mkfs.ext4",
+	"xfs":  "mkfs.xfs",
+}
+
+// growTools maps filesystem types to tools growing mounted filesystem to the size of its device
+var growTools = map[string]string{
+	"ext4": "resize2fs",
+	"xfs":  "xfs_growfs",
+}
+
+// mkfsTool returns path of mkfs tool for the filesystem type
+func mkfsTool(fsType string) (string, error) {
+	tool, ok := mkfsTools[fsType]
+	if !ok {
+		return "", errors.Errorf("unsupported filesystem type %q", fsType)
+	}
+
+	path, err := exec.LookPath(tool)
+	if err != nil {
+		return "", errors.Wrapf(err, "%s is needed to create %s filesystem", tool, fsType)
+	}
+
+	return path, nil
+}
+
+// makeFilesystem runs mkfs on activated device, args go before the device path
+func makeFilesystem(ctx context.Context, deviceName, fsType string, args []string) error {
+	tool, err := mkfsTool(fsType)
+	if err != nil {
+		return err
+	}
+
+	args = append(append([]string{}, args...), dmsetup.GetFullDevicePath(deviceName))
+
+	log.G(ctx).Debugf("%s %s", tool, strings.Join(args, " "))
+	output, err := exec.CommandContext(ctx, tool, args...).CombinedOutput()
+	if err != nil {
+		return errors.Wrapf(err, "failed to create %s filesystem on device %q: %s", fsType, deviceName, string(output))
+	}
+
+	return nil
+}
+
+// growFilesystem grows filesystem mounted at mountPoint to the size of its device.
+// resize2fs takes the device, while xfs_growfs takes the mount point.
+func growFilesystem(ctx context.Context, fsType, devicePath, mountPoint string) error {
+	tool, ok := growTools[fsType]
+	if !ok {
+		return errors.Errorf("unsupported filesystem type %q", fsType)
+	}
+
+	path, err := exec.LookPath(tool)
+	if err != nil {
+		return errors.Wrapf(err, "%s is needed to grow %s filesystem", tool, fsType)
+	}
+
+	target := devicePath
+	if fsType == "xfs" {
+		target = mountPoint
+	}
+
+	log.G(ctx).Debugf("%s %s", path, target)
+	output, err := exec.CommandContext(ctx, path, target).CombinedOutput()
+	if err != nil {
+		return errors.Wrapf(err, "failed to grow %s filesystem on %q: %s", fsType, devicePath, string(output))
+	}
+
+	return nil
+}
+
+// filesystemMountOptions returns options needed to mount filesystem of the type from a thin device.
+// Snapshots share UUID with their origin, which xfs refuses to mount twice unless UUID check is skipped.
+func filesystemMountOptions(fsType string) []string {
+	if fsType == "xfs" {
+		return []string{"nouuid"}
+	}
+
+	return nil
+}
@@ -0,0 +1,107 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package devmapper
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/containerd/containerd/mount"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+
+	"github.com/firecracker-microvm/firecracker-containerd/snapshotter/pkg/losetup"
+)
+
+func TestMkfsTool(t *testing.T) {
+	_, err := mkfsTool("btrfs")
+	assert.EqualError(t, err, `unsupported filesystem type "btrfs"`)
+
+	path := os.Getenv("PATH")
+	defer os.Setenv("PATH", path)
+
+	err = os.Setenv("PATH", "")
+	require.NoError(t, err)
+
+	_, err = mkfsTool("xfs")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "mkfs.xfs is needed to create xfs filesystem")
+}
+
+func TestCreateWithFilesystemInactive(t *testing.T) {
+	pool := &PoolDevice{poolName: "test-pool"}
+
+	_, err := pool.CreateThinDevice(context.Background(), "thin-1", device1Size, WithFilesystem("ext4"), WithoutActivation())
+	assert.Error(t, err)
+
+	_, err = pool.CreateThinDevice(context.Background(), "thin-1", device1Size, WithFilesystem("ext4"), WithReadOnly())
+	assert.Error(t, err)
+
+	_, err = pool.CreateThinDevice(context.Background(), "thin-1", device1Size, WithFilesystem("ntfs"))
+	assert.Error(t, err)
+}
+
+func TestGrowFilesystem(t *testing.T) {
+	ctx := context.Background()
+
+	err := growFilesystem(ctx, "btrfs", "/dev/loop0", "/mnt")
+	assert.EqualError(t, err, `unsupported filesystem type "btrfs"`)
+
+	tempDir, err := ioutil.TempDir("", "grow-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	imagePath, loopDevice := createLoopbackDevice(t, tempDir)
+	defer losetup.DetachLoopDevice(loopDevice)
+
+	output, err := exec.Command("mkfs.ext4", "-q", loopDevice).CombinedOutput()
+	require.NoErrorf(t, err, "mkfs failed: %s", string(output))
+
+	// Device is grown under mounted filesystem, the way ResizeDevice reloads the table
+	err = os.Truncate(imagePath, 256*1024*1024)
+	require.NoError(t, err)
+
+	err = losetup.RefreshCapacity(loopDevice)
+	require.NoError(t, err)
+
+	var growErr error
+	mounts := []mount.Mount{{Source: loopDevice, Type: "ext4"}}
+	err = mount.WithTempMount(ctx, mounts, func(root string) error {
+		if growErr = growFilesystem(ctx, "ext4", loopDevice, root); growErr != nil {
+			return nil
+		}
+
+		var stat unix.Statfs_t
+		if err := unix.Statfs(root, &stat); err != nil {
+			return err
+		}
+
+		assert.True(t, uint64(stat.Blocks)*uint64(stat.Bsize) > 200*1024*1024, "filesystem should be grown online")
+		return nil
+	})
+
+	require.NoError(t, err)
+
+	// Online resize needs CAP_SYS_RESOURCE, which containers running tests often lack
+	if growErr != nil && strings.Contains(growErr.Error(), "Permission denied to resize") {
+		t.Skip("online resize is not permitted")
+	}
+
+	require.NoError(t, growErr)
+}
@@ -0,0 +1,157 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package devmapper
+
+import (
+	"context"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/events"
+	"github.com/containerd/containerd/log"
+	"github.com/pkg/errors"
+
+	"github.com/firecracker-microvm/firecracker-containerd/proto"
+	"github.com/firecracker-microvm/firecracker-containerd/snapshotter/pkg/losetup"
+)
+
+// Topic of PoolSpace event published once pool usage reaches low_space_threshold
+const poolLowSpaceTopic = "/snapshot/devmapper/pool/low-space"
+
+// poolMonitor samples pool status in the background. Sampling goes through GetPoolStatus, so the pool is
+// extended and low space is reported as configured with WithAutoExtend and WithLowSpaceWarning.
+type poolMonitor struct {
+	pool     *PoolDevice
+	interval time.Duration
+
+	// Latest sample, nil if the last query failed
+	status     *PoolStatus
+	statusLock sync.RWMutex
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// startPoolMonitor takes the first sample before returning, so thresholds apply to the very first Prepare
+func startPoolMonitor(ctx context.Context, pool *PoolDevice, interval time.Duration) *poolMonitor {
+	ctx, cancel := context.WithCancel(ctx)
+
+	m := &poolMonitor{
+		pool:     pool,
+		interval: interval,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+
+	m.check(ctx)
+	go m.run(ctx)
+
+	return m
+}
+
+func (m *poolMonitor) run(ctx context.Context) {
+	defer close(m.done)
+
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.check(ctx)
+		}
+	}
+}
+
+// check replaces the latest sample. If the pool couldn't be extended, usage is still sampled, so Prepare is
+// refused when it has to be. Failed query drops the sample, so usage which might be stale doesn't refuse snapshots.
+func (m *poolMonitor) check(ctx context.Context) {
+	status, err := m.pool.GetPoolStatus(ctx)
+	if err != nil {
+		log.G(ctx).WithError(err).Warn("failed to sample pool usage")
+		status, _ = m.pool.queryPoolStatus()
+	}
+
+	m.statusLock.Lock()
+	defer m.statusLock.Unlock()
+
+	m.status = status
+}
+
+func (m *poolMonitor) latest() *PoolStatus {
+	m.statusLock.RLock()
+	defer m.statusLock.RUnlock()
+
+	return m.status
+}
+
+// Close stops sampling and waits for the sample being taken
+func (m *poolMonitor) Close() error {
+	m.cancel()
+	<-m.done
+	return nil
+}
+
+// publishLowSpace returns low space callback publishing PoolSpace event, nil if there is no publisher
+func publishLowSpace(publisher events.Publisher, poolName string, threshold float64) LowSpaceCallback {
+	if publisher == nil {
+		return nil
+	}
+
+	return func(ctx context.Context, status *PoolStatus) {
+		event := &proto.PoolSpace{
+			PoolName:            poolName,
+			UsedDataBlocks:      status.UsedDataBlocks,
+			TotalDataBlocks:     status.TotalDataBlocks,
+			UsedMetadataBlocks:  status.UsedMetadataBlocks,
+			TotalMetadataBlocks: status.TotalMetadataBlocks,
+			Threshold:           threshold,
+		}
+
+		if err := publisher.Publish(ctx, poolLowSpaceTopic, event); err != nil {
+			log.G(ctx).WithError(err).Warn("failed to publish pool low space event")
+		}
+	}
+}
+
+// extendLoopDevice returns ExtendFunc growing image file of the loop device by sizeBytes. The loop device
+// keeps its path, so the pool is reloaded with the same data device.
+func extendLoopDevice(loopDevice string, sizeBytes uint64) ExtendFunc {
+	return func(ctx context.Context, currentBlocks uint64) (string, error) {
+		imagePath, err := losetup.GetBackingFile(loopDevice)
+		if err != nil {
+			return "", errors.Wrapf(err, "only data devices on loop devices can be extended, %q is not one", loopDevice)
+		}
+
+		info, err := os.Stat(imagePath)
+		if err != nil {
+			return "", errors.Wrapf(err, "failed to stat image %q of loop device %q", imagePath, loopDevice)
+		}
+
+		newSize := info.Size() + int64(sizeBytes)
+		if err := os.Truncate(imagePath, newSize); err != nil {
+			return "", errors.Wrapf(err, "failed to grow image %q of loop device %q", imagePath, loopDevice)
+		}
+
+		if err := losetup.RefreshCapacity(loopDevice); err != nil {
+			return "", err
+		}
+
+		log.G(ctx).Infof("grown image %q of loop device %q to %d bytes", imagePath, loopDevice, newSize)
+		return loopDevice, nil
+	}
+}
@@ -0,0 +1,191 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package devmapper
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/events"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+
+	"github.com/firecracker-microvm/firecracker-containerd/proto"
+	"github.com/firecracker-microvm/firecracker-containerd/snapshotter/pkg/losetup"
+)
+
+type testPublisher struct {
+	topics []string
+	events []events.Event
+}
+
+func (p *testPublisher) Publish(ctx context.Context, topic string, event events.Event) error {
+	p.topics = append(p.topics, topic)
+	p.events = append(p.events, event)
+	return nil
+}
+
+func TestFakePoolMonitor(t *testing.T) {
+	pool, dm, cleanup := newFakePool(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	publisher := &testPublisher{}
+
+	pool.dataBlockSizeSectors = 128
+	pool.lowSpaceThreshold = 80
+	pool.lowSpaceCallback = publishLowSpace(publisher, pool.poolName, 80)
+
+	dm.setPoolUsage(512, 100)
+
+	// Interval is long enough for the test to drive sampling with check
+	monitor := startPoolMonitor(ctx, pool, time.Hour)
+	defer monitor.Close()
+
+	snap := &Snapshotter{
+		pool:    pool,
+		config:  &Config{RefusePrepareThreshold: 90},
+		monitor: monitor,
+	}
+
+	usage, err := snap.Usage(ctx, "")
+	require.NoError(t, err)
+	assert.EqualValues(t, 512*128*512, usage.Size, "pool usage should be reported for empty key")
+	assert.NoError(t, snap.checkPoolSpace())
+	assert.Empty(t, publisher.events)
+
+	// Low space is published once, Prepare is refused only at its own threshold
+	dm.setPoolUsage(850, 100)
+	monitor.check(ctx)
+	monitor.check(ctx)
+	assert.NoError(t, snap.checkPoolSpace())
+
+	require.Len(t, publisher.events, 1)
+	assert.Equal(t, poolLowSpaceTopic, publisher.topics[0])
+	assert.Equal(t, &proto.PoolSpace{
+		PoolName:            pool.poolName,
+		UsedDataBlocks:      850,
+		TotalDataBlocks:     1024,
+		UsedMetadataBlocks:  100,
+		TotalMetadataBlocks: 1024,
+		Threshold:           80,
+	}, publisher.events[0])
+
+	dm.setPoolUsage(100, 950)
+	monitor.check(ctx)
+
+	err = snap.checkPoolSpace()
+	assert.True(t, errors.Is(err, ErrPoolFull))
+
+	_, err = snap.Prepare(ctx, "snap-1", "")
+	assert.True(t, errdefs.IsUnavailable(err), "Prepare should be refused")
+
+	// Failed sample doesn't refuse snapshots, pool is queried for usage instead
+	dm.failNext("GetPoolStatus", unix.EIO, unix.EIO)
+	monitor.check(ctx)
+	assert.Nil(t, monitor.latest())
+	assert.NoError(t, snap.checkPoolSpace())
+
+	status, err := snap.PoolUsage(ctx)
+	require.NoError(t, err)
+	assert.EqualValues(t, 950, status.UsedMetadataBlocks)
+}
+
+func TestFakePoolMonitorSampling(t *testing.T) {
+	pool, dm, cleanup := newFakePool(t)
+	defer cleanup()
+
+	monitor := startPoolMonitor(context.Background(), pool, time.Millisecond)
+
+	dm.setPoolUsage(10, 10)
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if status := monitor.latest(); status != nil && status.UsedDataBlocks == 10 {
+			break
+		}
+	}
+
+	status := monitor.latest()
+	require.NotNil(t, status)
+	assert.EqualValues(t, 10, status.UsedDataBlocks, "usage should be sampled periodically")
+
+	err := monitor.Close()
+	require.NoError(t, err)
+
+	// No samples are taken once closed
+	calls := dm.callCount("GetPoolStatus")
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, calls, dm.callCount("GetPoolStatus"))
+}
+
+func TestFakeSetLowSpaceWarning(t *testing.T) {
+	pool, dm, cleanup := newFakePool(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	var reported []float64
+	callback := func(threshold float64) LowSpaceCallback {
+		return func(ctx context.Context, status *PoolStatus) {
+			reported = append(reported, threshold)
+		}
+	}
+
+	pool.dataBlockSizeSectors = 128
+	pool.lowSpaceThreshold = 80
+	pool.lowSpaceCallback = callback(80)
+
+	dm.setPoolUsage(512, 100)
+	_, err := pool.GetPoolStatus(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, reported)
+
+	// Reloaded threshold applies to the next query
+	pool.setLowSpaceWarning(ctx, 40, callback(40))
+	_, err = pool.GetPoolStatus(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []float64{40}, reported)
+
+	pool.setLowSpaceWarning(ctx, 0, nil)
+	_, err = pool.GetPoolStatus(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []float64{40}, reported, "zero threshold disables the warning")
+}
+
+func TestExtendLoopDevice(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "extend-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	imagePath, loopDevice := createLoopbackDevice(t, tempDir)
+	defer losetup.DetachLoopDevice(loopDevice)
+
+	extend := extendLoopDevice(loopDevice, 64*1024*1024)
+
+	dataDevice, err := extend(context.Background(), 0)
+	require.NoError(t, err)
+	assert.Equal(t, loopDevice, dataDevice)
+
+	info, err := os.Stat(imagePath)
+	require.NoError(t, err)
+	assert.EqualValues(t, 192*1024*1024, info.Size())
+
+	_, err = extendLoopDevice(imagePath, 1024)(context.Background(), 0)
+	assert.Error(t, err, "only loop devices can be extended")
+}
@@ -0,0 +1,95 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package devmapper
+
+import (
+	"context"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	"github.com/sirupsen/logrus"
+)
+
+// Log fields of pool operations, so logs of a device can be followed from create to removal
+const (
+	logFieldPool     = "pool"
+	logFieldDevice   = "device"
+	logFieldDeviceID = "device_id"
+	logFieldOp       = "op"
+	logFieldDuration = "duration"
+)
+
+// Values of "op" log field, besides ones shared with metrics
+const (
+	operationExport     = "export"
+	operationSnapshots  = "snapshots"
+	operationSuspend    = "suspend"
+	operationResume     = "resume"
+	operationReactivate = "reactivate"
+	operationRename     = "rename"
+	operationResize     = "resize"
+	operationCleanup    = "cleanup"
+	operationLoad       = "load"
+	operationReload     = "reload"
+	operationCompact    = "compact"
+	operationRepair     = "repair"
+	operationRemovePool = "remove_pool"
+)
+
+// finishOperation logs completion of the operation started by startOperation
+type finishOperation func(ctx context.Context, err error)
+
+// startOperation logs start of the operation on the device at debug level and returns ctx whose logger
+// carries pool, op and device fields, so every log line of the operation has them. deviceName is empty for
+// operations on the whole pool. Returned func logs completion with duration at info level, or at error level
+// if the operation failed. It takes ctx, so fields added during the operation, like device ID, are logged too.
+func (p *PoolDevice) startOperation(ctx context.Context, op, deviceName string) (context.Context, finishOperation) {
+	fields := logrus.Fields{
+		logFieldPool: p.poolName,
+		logFieldOp:   op,
+	}
+
+	if deviceName != "" {
+		fields[logFieldDevice] = deviceName
+	}
+
+	ctx = log.WithLogger(ctx, log.G(ctx).WithFields(fields))
+	log.G(ctx).Debug("operation started")
+
+	start := time.Now()
+	return ctx, func(ctx context.Context, err error) {
+		entry := log.G(ctx).WithField(logFieldDuration, time.Since(start))
+		if err != nil {
+			entry.WithError(err).Error("operation failed")
+			return
+		}
+
+		entry.Info("operation completed")
+	}
+}
+
+// withDeviceID adds device ID field to the logger of ctx once ID of the device is known
+func withDeviceID(ctx context.Context, deviceID uint32) context.Context {
+	return log.WithLogger(ctx, log.G(ctx).WithField(logFieldDeviceID, deviceID))
+}
+
+// withDeviceIDOf adds ID of the device to the logger of ctx, unknown device is left for the operation to report
+func (p *PoolDevice) withDeviceIDOf(ctx context.Context, deviceName string) context.Context {
+	info, err := p.metadata.GetDevice(ctx, deviceName)
+	if err != nil {
+		return ctx
+	}
+
+	return withDeviceID(ctx, info.DeviceID)
+}
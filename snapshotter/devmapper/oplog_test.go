@@ -0,0 +1,65 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package devmapper
+
+import (
+	"context"
+	"testing"
+
+	"github.com/containerd/containerd/log"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStartOperation(t *testing.T) {
+	logger, hook := test.NewNullLogger()
+	logger.SetLevel(logrus.DebugLevel)
+
+	ctx := log.WithLogger(context.Background(), logrus.NewEntry(logger))
+	pool := &PoolDevice{poolName: "test-pool"}
+
+	opCtx, finish := pool.startOperation(ctx, operationCreate, "thin-1")
+	opCtx = withDeviceID(opCtx, 3)
+	log.G(opCtx).Infof("created device %q", "thin-1")
+	finish(opCtx, nil)
+
+	entries := hook.AllEntries()
+	require.Len(t, entries, 3)
+
+	assert.Equal(t, logrus.DebugLevel, entries[0].Level)
+	assert.Equal(t, logrus.Fields{logFieldPool: "test-pool", logFieldOp: operationCreate, logFieldDevice: "thin-1"}, entries[0].Data)
+
+	assert.Equal(t, `created device "thin-1"`, entries[1].Message, "message text must not change")
+	assert.Equal(t, uint32(3), entries[1].Data[logFieldDeviceID])
+
+	assert.Equal(t, logrus.InfoLevel, entries[2].Level)
+	assert.Equal(t, uint32(3), entries[2].Data[logFieldDeviceID])
+	assert.Contains(t, entries[2].Data, logFieldDuration)
+
+	hook.Reset()
+
+	opCtx, finish = pool.startOperation(ctx, operationCompact, "")
+	finish(opCtx, errors.New("pool is in use"))
+
+	entries = hook.AllEntries()
+	require.Len(t, entries, 2)
+
+	assert.NotContains(t, entries[0].Data, logFieldDevice, "pool operation has no device field")
+	assert.Equal(t, logrus.ErrorLevel, entries[1].Level)
+	assert.Equal(t, operationCompact, entries[1].Data[logFieldOp])
+	assert.Contains(t, entries[1].Data, logrus.ErrorKey)
+}
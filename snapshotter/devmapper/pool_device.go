@@ -14,150 +14,3831 @@
 package devmapper
 
 import (
+	"bytes"
 	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/containerd/containerd/log"
 	"github.com/hashicorp/go-multierror"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sys/unix"
 
 	"github.com/firecracker-microvm/firecracker-containerd/snapshotter/pkg/dmsetup"
 )
 
+const (
+	// maxRemoveConcurrency limits the number of parallel dmsetup calls when removing many devices at once
+	maxRemoveConcurrency = 8
+
+	// maxActivateConcurrency limits the number of parallel activations when creating many snapshots at once
+	maxActivateConcurrency = 8
+
+	// How long to wait for device node after activation by default, and how often to check for it.
+	// Poll interval doubles after each check up to the max.
+	deviceNodeTimeout         = 10 * time.Second
+	deviceNodePollInterval    = 10 * time.Millisecond
+	deviceNodeMaxPollInterval = 200 * time.Millisecond
+)
+
 // PoolDevice ties together data and metadata volumes, represents thin-pool and manages volumes, snapshots and device ids.
 type PoolDevice struct {
-	poolName string
-	metadata *PoolMetadata
+	poolName       string
+	dataDevice     string
+	metadataDevice string
+	metadata       *PoolMetadata
+
+	// Thin-pool allows only one metadata snapshot at a time
+	metadataSnapMutex sync.Mutex
+
+	// Held for writing by offline operations (repair and compaction), which remove the pool for a while,
+	// and for reading by operations which need the pool, so they don't run concurrently
+	offlineMutex sync.RWMutex
+
+	// Set if device-mapper is too old for deferred removal, devices are removed synchronously then
+	noDeferredRemoval bool
+
+	// Limit of total virtual size of devices in the pool, zero if unlimited.
+	// Creates check limits and count the new device as provisioning under write lock of the mutex, then hold
+	// it for reading while the device is created, so they run in parallel but don't race with pool extension.
+	maxVirtualSizeBytes   uint64
+	overProvisioningRatio float64
+	provisionMutex        sync.RWMutex
+
+	// Virtual size and number of devices being created, counted against limits until they're saved.
+	// Released without provisionMutex, as concurrent creates hold it for reading.
+	provisioningBytes   uint64
+	provisioningDevices int
+	provisioningMutex   sync.Mutex
+
+	// Limit of the number of devices in the pool, zero if unlimited
+	maxDevices int
+
+	// Virtual size of a single device as a multiple of pool data capacity, above which creating it logs
+	// a warning (or fails if rejectLargeDevices is set), zero if not checked
+	maxDeviceSizeRatio float64
+	rejectLargeDevices bool
+
+	// Names of devices being created, claimed before any device-mapper work is done
+	// so concurrent creates of the same name fail early
+	reservedNames map[string]struct{}
+	reservedMutex sync.Mutex
+
+	// Slow device-mapper calls (activation, suspend, snapshot, removal) run under lock of the device they touch,
+	// so operations on different devices run in parallel
+	deviceLocks deviceLocks
+
+	// Prometheus collectors, nil unless WithMetrics option specified
+	metrics *poolMetrics
+
+	dataBlockSizeSectors uint32
+
+	// Usage percentage of data or metadata space reported as low space by GetPoolStatus, zero if disabled.
+	// lowSpace is set once usage crosses the threshold, so warning isn't repeated until usage drops below.
+	// Threshold and callback are replaced on config reload, all four are guarded by lowSpaceMutex.
+	lowSpaceThreshold float64
+	lowSpaceCallback  LowSpaceCallback
+	lowSpace          bool
+	lowSpaceMutex     sync.Mutex
+
+	// Data usage percentage at which GetPoolStatus extends the pool with extendFunc, nil if disabled
+	extendThreshold float64
+	extendFunc      ExtendFunc
+
+	// Discard blocks of activated devices before they're deleted
+	discardOnDelete bool
+
+	// Retries of busy device removal, replaced on config reload
+	removeRetry      removeRetry
+	removeRetryMutex sync.RWMutex
+
+	// Callbacks of device lifecycle events
+	hooks DeviceHooks
+
+	// Device-mapper calls, runs dmsetup unless WithDeviceMapper option specified
+	dm DeviceMapper
+
+	// Nodes of activated devices for jailed VMM, nil unless WithJailDeviceNodes option specified
+	jailNodes *jailNodes
+
+	// Background deletion of devices marked with DeleteDeviceDeferred
+	deletes *deleteQueue
+
+	// Releases process-wide dmsetup settings on close, nil if pool wasn't created with NewPoolDevice
+	releaseDmsetup func()
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+var (
+	// ErrOverProvisioned is returned when a new device would exceed configured over-provisioning ratio
+	ErrOverProvisioned = errors.New("thin-pool over-provisioning limit exceeded")
+
+	// ErrShrinkNotSupported is returned when thin device is resized to smaller size, filesystem on it would be corrupted
+	ErrShrinkNotSupported = errors.New("thin device can't be shrunk")
+
+	// ErrInvalidDeviceName is returned when device name can't be used as device-mapper name under /dev/mapper
+	ErrInvalidDeviceName = errors.New("invalid device name")
+
+	// ErrDeviceTooLarge is returned when virtual size of a new device exceeds data capacity of the pool
+	// more than max_device_size_ratio allows and device_size_check is "error"
+	ErrDeviceTooLarge = errors.New("device is too large for thin-pool")
+
+	// ErrPoolAtCapacity is returned when a new device would exceed the configured maximum number of devices
+	ErrPoolAtCapacity = errors.New("thin-pool device limit reached")
+
+	// ErrDeviceNodeTimeout is returned when device was activated, but its device node didn't appear in time
+	ErrDeviceNodeTimeout = errors.New("device node didn't appear")
+
+	// ErrPoolMissing is returned by Healthy when the thin-pool device doesn't exist
+	ErrPoolMissing = errors.New("thin-pool device doesn't exist")
+
+	// ErrPoolFull matches PoolHealthError of the pool which is out of data space or above space usage threshold.
+	// Snapshotter wraps it when Prepare is refused above refuse_prepare_threshold.
+	ErrPoolFull = errors.New("thin-pool is out of space")
+
+	// ErrPoolInError matches PoolHealthError of the pool which is failed, needs check or is read-only
+	ErrPoolInError = errors.New("thin-pool is in error state")
+
+	// ErrDeviceConflict is returned by idempotent create when device with the same name exists with different parameters
+	ErrDeviceConflict = errors.New("device exists with different parameters")
+
+	// ErrDeletePending is returned when device marked with DeleteDeviceDeferred is activated or snapshotted
+	ErrDeletePending = errors.New("device is pending deletion")
+
+	// ErrDmsetupConflict is returned when a pool needs udev sync mode or device directory different from the one
+	// used by pools already open in the process, dmsetup applies them process-wide
+	ErrDmsetupConflict = errors.New("dmsetup settings conflict with open pools")
+)
+
+// dmsetupSettings are udev sync mode and device directory set in dmsetup package by open pools
+var dmsetupSettings struct {
+	sync.Mutex
+	udevSync  bool
+	deviceDir string
+	pools     int
+}
+
+// dmsetupSettingsOf returns udev sync mode and device directory the pool needs, empty config values are defaults
+func dmsetupSettingsOf(config *Config) (udevSync bool, deviceDir string) {
+	deviceDir = defaultDeviceDir
+	if config.DeviceDir != "" {
+		deviceDir = filepath.Clean(config.DeviceDir)
+	}
+
+	return config.UdevSyncMode != UdevSyncDisabled, deviceDir
+}
+
+// applyDmsetupSettings sets udev sync mode and device directory of config in dmsetup package. Fails with
+// ErrDmsetupConflict if other open pools use different ones. Returned function releases the settings.
+func applyDmsetupSettings(ctx context.Context, config *Config) (func(), error) {
+	udevSync, deviceDir := dmsetupSettingsOf(config)
+
+	dmsetupSettings.Lock()
+	defer dmsetupSettings.Unlock()
+
+	if dmsetupSettings.pools > 0 {
+		if udevSync != dmsetupSettings.udevSync || deviceDir != dmsetupSettings.deviceDir {
+			return nil, errors.Wrapf(ErrDmsetupConflict, "pool %q uses udev sync %t and device directory %q, open pools use %t and %q",
+				config.PoolName, udevSync, deviceDir, dmsetupSettings.udevSync, dmsetupSettings.deviceDir)
+		}
+	} else {
+		dmsetup.SetUdevSync(udevSync)
+		dmsetup.SetDeviceDir(deviceDir)
+
+		dmsetupSettings.udevSync = udevSync
+		dmsetupSettings.deviceDir = deviceDir
+	}
+
+	dmsetupSettings.pools++
+
+	log.G(ctx).Infof("using udev sync mode: %s", config.UdevSyncMode)
+	log.G(ctx).Infof("using device directory: %s", deviceDir)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			dmsetupSettings.Lock()
+			defer dmsetupSettings.Unlock()
+
+			dmsetupSettings.pools--
+		})
+	}, nil
+}
+
+// maxDeviceNameLength is the longest device-mapper name, DM_NAME_LEN includes terminating zero
+const maxDeviceNameLength = 127
+
+// validateDeviceName makes sure device node of the name stays in /dev/mapper and device-mapper accepts the name
+func validateDeviceName(name string) error {
+	switch {
+	case name == "":
+		return errors.Wrap(ErrInvalidDeviceName, "name is empty")
+	case name == "." || name == "..":
+		return errors.Wrapf(ErrInvalidDeviceName, "%q is reserved", name)
+	case strings.ContainsRune(name, '/'):
+		return errors.Wrapf(ErrInvalidDeviceName, "%q contains path separator", name)
+	case len(name) > maxDeviceNameLength:
+		return errors.Wrapf(ErrInvalidDeviceName, "%q is longer than %d characters", name, maxDeviceNameLength)
+	}
+
+	return nil
+}
+
+// PoolOpt represents optional settings for NewPoolDevice call
+type PoolOpt func(opts *poolOptions)
+
+type poolOptions struct {
+	registerer        prometheus.Registerer
+	lowSpaceThreshold float64
+	lowSpaceCallback  LowSpaceCallback
+	extendThreshold   float64
+	extendFunc        ExtendFunc
+	discardOnDelete   bool
+	zeroNewBlocks     bool
+	hooks             DeviceHooks
+	checkMetadata     bool
+	repairMetadata    bool
+	dm                DeviceMapper
+	jailNodes         *jailNodes
+}
+
+// ExtendFunc grows data volume of the pool which currently has currentBlocks data blocks and returns path of
+// the data device to reload the pool with. It can be the current path if the device was resized in place.
+// Data already stored on the volume must be kept.
+type ExtendFunc func(ctx context.Context, currentBlocks uint64) (newDataFile string, err error)
+
+// LowSpaceCallback is called by GetPoolStatus once pool usage crosses low space threshold
+type LowSpaceCallback func(ctx context.Context, status *PoolStatus)
+
+// WithMetrics registers Prometheus collectors of the pool (device operations by result, device ID collisions,
+// busy removals, number of active devices and the highest device ID) with the given registerer
+func WithMetrics(registerer prometheus.Registerer) PoolOpt {
+	return func(opts *poolOptions) {
+		opts.registerer = registerer
+	}
+}
+
+// WithLowSpaceWarning makes GetPoolStatus log a warning and call the callback (if not nil) once used data
+// or metadata space of the pool crosses the given threshold, percentage in (0, 100] range
+func WithLowSpaceWarning(thresholdPercent float64, callback LowSpaceCallback) PoolOpt {
+	return func(opts *poolOptions) {
+		opts.lowSpaceThreshold = thresholdPercent
+		opts.lowSpaceCallback = callback
+	}
+}
+
+// WithAutoExtend makes GetPoolStatus extend data volume of the pool with the given function once used data space
+// reaches the threshold (percentage in (0, 100] range) or the pool runs out of data space
+func WithAutoExtend(thresholdPercent float64, extend ExtendFunc) PoolOpt {
+	return func(opts *poolOptions) {
+		opts.extendThreshold = thresholdPercent
+		opts.extendFunc = extend
+	}
+}
+
+// WithDiscardOnDelete makes DeleteDevice discard all blocks of activated device before deleting it, so storage
+// backing the pool (like SSD or sparse file) reclaims the space promptly even if the pool doesn't pass discards
+// down on its own. Discard can be expensive on some storage, it's best-effort and failures are only logged.
+func WithDiscardOnDelete() PoolOpt {
+	return func(opts *poolOptions) {
+		opts.discardOnDelete = true
+	}
+}
+
+// WithZeroNewBlocks creates the pool without "skip_block_zeroing" feature, so newly provisioned blocks are zeroed
+// and new devices can't read data left by deleted ones. This costs extra writes on first write to each block.
+// NewPoolDevice fails if the pool already exists and doesn't zero new blocks.
+func WithZeroNewBlocks() PoolOpt {
+	return func(opts *poolOptions) {
+		opts.zeroNewBlocks = true
+	}
+}
+
+// WithMetadataCheck runs "thin_check" on metadata volume before the pool is created on it, so metadata left
+// inconsistent by unclean shutdown fails startup with the tool output instead of being used. Zeroed metadata
+// volume is formatted by the pool and isn't checked. If repair is set, inconsistent metadata is rewritten with
+// "thin_repair" and checked again. Existing pool is live and isn't checked, use CheckPoolHealth for it.
+func WithMetadataCheck(repair bool) PoolOpt {
+	return func(opts *poolOptions) {
+		opts.checkMetadata = true
+		opts.repairMetadata = repair
+	}
+}
+
+// WithDeviceMapper makes the pool use the given device-mapper implementation instead of running dmsetup,
+// like a fake in tests. Version checks, udev sync and thin provisioning tools still use dmsetup package.
+func WithDeviceMapper(dm DeviceMapper) PoolOpt {
+	return func(opts *poolOptions) {
+		opts.dm = dm
+	}
+}
+
+// NewPoolDevice creates new thin-pool from existing data and metadata volumes.
+// If pool 'poolName' already exists, it'll be reloaded with new parameters.
+// Zero data block size is taken from the existing pool, new pool can't be created without it.
+func NewPoolDevice(ctx context.Context, config *Config, opts ...PoolOpt) (*PoolDevice, error) {
+	options := &poolOptions{dm: dmsetupMapper{}}
+	for _, opt := range opts {
+		opt(options)
+	}
+
+	if options.lowSpaceThreshold < 0 || options.lowSpaceThreshold > 100 {
+		return nil, errors.Errorf("invalid low space threshold %g%%, must be in (0, 100] range", options.lowSpaceThreshold)
+	}
+
+	if options.extendFunc != nil && (options.extendThreshold <= 0 || options.extendThreshold > 100) {
+		return nil, errors.Errorf("invalid auto extend threshold %g%%, must be in (0, 100] range", options.extendThreshold)
+	}
+
+	if config.DataBlockSizeSectors != 0 {
+		if err := validateDataBlockSize(config.DataBlockSizeSectors); err != nil {
+			return nil, errors.Wrapf(err, "invalid data block size of %d sectors", config.DataBlockSizeSectors)
+		}
+	}
+
+	if options.zeroNewBlocks {
+		for _, feature := range config.ExtraFeatures {
+			if feature == dmsetup.FeatureSkipBlockZeroing {
+				return nil, errors.Errorf("%s feature contradicts zeroing of new blocks", feature)
+			}
+		}
+	}
+
+	log.G(ctx).Infof("initializing pool device %q", config.PoolName)
+
+	versions, err := dmsetup.GetVersions()
+	if err != nil {
+		log.G(ctx).Errorf("dmsetup not available")
+		return nil, err
+	}
+
+	log.G(ctx).Infof("using dmsetup: library %s, driver %s, thin-pool target %s",
+		versions.Library, versions.Driver, versions.ThinPool)
+
+	deferredRemoval, err := checkVersions(ctx, versions, config)
+	if err != nil {
+		return nil, err
+	}
+
+	releaseDmsetup, err := applyDmsetupSettings(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+
+	// Settings are released on failure, the pool owns them once created
+	created := false
+	defer func() {
+		if !created {
+			releaseDmsetup()
+		}
+	}()
+
+	// Existing pool is checked before opening metadata store, so a mismatch doesn't wait for the store lock
+	// held by another instance of the same pool
+	poolPath := dmsetup.GetFullDevicePath(config.PoolName)
+	existingTable, err := existingPoolTable(options.dm, config, poolPath, options.zeroNewBlocks)
+	if err != nil {
+		return nil, err
+	}
+
+	blockSizeSectors := config.DataBlockSizeSectors
+	if blockSizeSectors == 0 {
+		if existingTable == nil {
+			return nil, errors.Errorf("data block size is required to create pool %q", config.PoolName)
+		}
+
+		blockSizeSectors = existingTable.BlockSizeSectors
+		log.G(ctx).Infof("using data block size of existing pool %q: %d sectors", config.PoolName, blockSizeSectors)
+	}
+
+	if existingTable == nil && options.checkMetadata {
+		if err := checkMetadataVolume(ctx, config.MetadataDevice, options.repairMetadata); err != nil {
+			return nil, err
+		}
+	}
+
+	// Limit is computed before the store is opened, so failure doesn't leave the store locked
+	maxVirtualSizeBytes, err := maxVirtualSize(config.DataDevice, config.OverProvisioningRatio)
+	if err != nil {
+		return nil, err
+	}
+
+	if maxVirtualSizeBytes > 0 {
+		log.G(ctx).Infof("limiting total virtual size of devices to %d bytes", maxVirtualSizeBytes)
+	}
+
+	dbpath := filepath.Join(config.RootPath, config.PoolName+".db")
+	poolMetaStore, err := NewPoolMetadata(dbpath)
+	if err != nil {
+		return nil, err
+	}
+
+	var metrics *poolMetrics
+	if options.registerer != nil {
+		metrics = newPoolMetrics(config.PoolName, poolMetaStore)
+		if err := options.registerer.Register(metrics); err != nil {
+			poolMetaStore.Close()
+			return nil, errors.Wrap(err, "failed to register metrics")
+		}
+	}
+
+	// Store lock and metrics are released on failure, so the pool can be opened again by the same process
+	abort := func() {
+		if metrics != nil {
+			options.registerer.Unregister(metrics)
+		}
+
+		poolMetaStore.Close()
+	}
+
+	if existingTable != nil {
+		log.G(ctx).Debugf("reloading existing pool %q", poolPath)
+
+		// Pool created with zeroing keeps it, dropping it would expose data of deleted devices
+		zeroNewBlocks := existingTable.ZeroesNewBlocks()
+
+		log.G(ctx).Infof("using thin-pool features: %s", strings.Join(dmsetup.ThinPoolFeatures(zeroNewBlocks, config.ExtraFeatures), " "))
+		if err := options.dm.ReloadPool(config.PoolName, config.DataDevice, config.MetadataDevice, blockSizeSectors,
+			config.LowWaterMarkBlocks, zeroNewBlocks, config.ExtraFeatures...); err != nil {
+			abort()
+			return nil, errors.Wrapf(err, "failed to reload pool %q", config.PoolName)
+		}
+	} else {
+		log.G(ctx).Debug("creating new pool device")
+		log.G(ctx).Infof("using thin-pool features: %s", strings.Join(dmsetup.ThinPoolFeatures(options.zeroNewBlocks, config.ExtraFeatures), " "))
+		if err := options.dm.CreatePool(config.PoolName, config.DataDevice, config.MetadataDevice, blockSizeSectors,
+			config.LowWaterMarkBlocks, options.zeroNewBlocks, config.ExtraFeatures...); err != nil {
+			abort()
+			return nil, errors.Wrapf(err, "failed to create thin-pool with name %q", config.PoolName)
+		}
+	}
+
+	pool := &PoolDevice{
+		poolName:              config.PoolName,
+		dataDevice:            config.DataDevice,
+		metadataDevice:        config.MetadataDevice,
+		metadata:              poolMetaStore,
+		noDeferredRemoval:     !deferredRemoval,
+		maxVirtualSizeBytes:   maxVirtualSizeBytes,
+		overProvisioningRatio: config.OverProvisioningRatio,
+		maxDevices:            config.MaxDevices,
+		maxDeviceSizeRatio:    config.MaxDeviceSizeRatio,
+		rejectLargeDevices:    config.DeviceSizeCheck == DeviceSizeCheckError,
+		reservedNames:         make(map[string]struct{}),
+		metrics:               metrics,
+
+		dataBlockSizeSectors: blockSizeSectors,
+		lowSpaceThreshold:    options.lowSpaceThreshold,
+		lowSpaceCallback:     options.lowSpaceCallback,
+		extendThreshold:      options.extendThreshold,
+		extendFunc:           options.extendFunc,
+		discardOnDelete:      options.discardOnDelete,
+		removeRetry:          newRemoveRetry(config),
+		hooks:                options.hooks,
+		dm:                   options.dm,
+		jailNodes:            options.jailNodes,
+		releaseDmsetup:       releaseDmsetup,
+	}
+
+	// Operations interrupted by a crash are recovered before activation state is checked, as interrupted
+	// deletes can remove devices. Operations trust activation state in metadata, which is stale after host reboot.
+	if err := pool.recoverDevices(ctx); err != nil {
+		if metrics != nil {
+			options.registerer.Unregister(metrics)
+		}
+
+		pool.Close()
+		return nil, errors.Wrapf(err, "failed to reconcile devices of pool %q", config.PoolName)
+	}
+
+	if existingTable != nil {
+		pool.syncDeviceIDs(ctx)
+	}
+
+	// Devices marked for deletion before restart are picked up right away
+	pool.deletes = startDeleteQueue(context.Background(), pool)
+
+	created = true
+	return pool, nil
+}
+
+// existingPoolTable returns table of existing pool, nil if pool doesn't exist yet. Fails if the pool doesn't match config
+// (block size can't be changed after pool is created, zero block size matches any) or doesn't zero new blocks
+// while zeroing is required.
+func existingPoolTable(dm DeviceMapper, config *Config, poolPath string, zeroNewBlocks bool) (*dmsetup.ThinPoolTable, error) {
+	if _, err := os.Stat(poolPath); err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		return nil, errors.Wrapf(err, "failed to stat for %q", poolPath)
+	}
+
+	table, err := dm.GetThinPoolTable(config.PoolName)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to query table of existing pool %q", config.PoolName)
+	}
+
+	if config.DataBlockSizeSectors != 0 && table.BlockSizeSectors != config.DataBlockSizeSectors {
+		return nil, errors.Errorf("data block size mismatch for existing pool %q: pool has %d sectors, config has %d sectors",
+			config.PoolName, table.BlockSizeSectors, config.DataBlockSizeSectors)
+	}
+
+	if zeroNewBlocks && !table.ZeroesNewBlocks() {
+		return nil, errors.Errorf("existing pool %q doesn't zero new blocks (features: %s), it must be recreated to enable zeroing",
+			config.PoolName, strings.Join(table.Features, " "))
+	}
+
+	return table, nil
+}
+
+// maxVirtualSize returns limit of total virtual size of devices for the given over-provisioning ratio,
+// zero if it's unlimited
+func maxVirtualSize(dataDevice string, ratio float64) (uint64, error) {
+	if ratio <= 0 {
+		return 0, nil
+	}
+
+	dataSizeBytes, err := dmsetup.BlockDeviceSize(dataDevice)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to get size of data device %q", dataDevice)
+	}
+
+	return uint64(float64(dataSizeBytes) * ratio), nil
+}
+
+// roundUpToBlocks rounds size up to whole data blocks
+func roundUpToBlocks(sizeBytes uint64, blockSizeSectors uint32) uint64 {
+	blockSizeBytes := uint64(blockSizeSectors) * dmsetup.SectorSize
+	if blockSizeBytes == 0 {
+		return sizeBytes
+	}
+
+	return (sizeBytes + blockSizeBytes - 1) / blockSizeBytes * blockSizeBytes
+}
+
+// newDeviceSize returns virtual size of new device rounded up to whole data blocks, the pool provisions whole blocks
+// anyway and table length has to be a whole number of sectors. Logs a warning, or fails with ErrDeviceTooLarge,
+// if the size exceeds pool data capacity more than max_device_size_ratio allows.
+func (p *PoolDevice) newDeviceSize(ctx context.Context, deviceName string, virtualSizeBytes uint64) (uint64, error) {
+	if virtualSizeBytes == 0 {
+		return 0, errors.Errorf("size of device %q can't be zero", deviceName)
+	}
+
+	sizeBytes := roundUpToBlocks(virtualSizeBytes, p.dataBlockSizeSectors)
+	if sizeBytes != virtualSizeBytes {
+		log.G(ctx).WithField("device", deviceName).Debugf("rounded device size of %d bytes up to %d bytes", virtualSizeBytes, sizeBytes)
+	}
+
+	if p.maxDeviceSizeRatio <= 0 {
+		return sizeBytes, nil
+	}
+
+	// Capacity is queried every time, as the pool can be extended
+	status, err := p.dm.GetPoolStatus(p.poolName)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to query status of pool %q", p.poolName)
+	}
+
+	capacityBytes := status.TotalDataBlocks * uint64(p.dataBlockSizeSectors) * dmsetup.SectorSize
+	if float64(sizeBytes) <= float64(capacityBytes)*p.maxDeviceSizeRatio {
+		return sizeBytes, nil
+	}
+
+	if p.rejectLargeDevices {
+		return 0, errors.Wrapf(ErrDeviceTooLarge, "device %q of %d bytes exceeds %g times pool data capacity of %d bytes",
+			deviceName, sizeBytes, p.maxDeviceSizeRatio, capacityBytes)
+	}
+
+	log.G(ctx).WithField("device", deviceName).Warnf("device of %d bytes exceeds %g times pool data capacity of %d bytes",
+		sizeBytes, p.maxDeviceSizeRatio, capacityBytes)
+	return sizeBytes, nil
+}
+
+// setOverProvisioningRatio changes limit of total virtual size of devices, devices already created are kept
+// even if they exceed the new limit
+func (p *PoolDevice) setOverProvisioningRatio(ctx context.Context, ratio float64) error {
+	p.provisionMutex.Lock()
+	defer p.provisionMutex.Unlock()
+
+	maxVirtualSizeBytes, err := maxVirtualSize(p.dataDevice, ratio)
+	if err != nil {
+		return err
+	}
+
+	p.maxVirtualSizeBytes = maxVirtualSizeBytes
+	p.overProvisioningRatio = ratio
+	log.G(ctx).Infof("limiting total virtual size of devices to %d bytes (zero is unlimited)", maxVirtualSizeBytes)
+	return nil
+}
+
+// setRemoveRetry replaces retry settings, retries already in progress keep the settings they started with
+func (p *PoolDevice) setRemoveRetry(ctx context.Context, r removeRetry) {
+	p.removeRetryMutex.Lock()
+	defer p.removeRetryMutex.Unlock()
+
+	p.removeRetry = r
+	log.G(ctx).Infof("retrying busy devices %d times with delay of %s (timeout %s)", r.retries, r.delay, r.timeout)
+}
+
+func (p *PoolDevice) currentRemoveRetry() removeRetry {
+	p.removeRetryMutex.RLock()
+	defer p.removeRetryMutex.RUnlock()
+
+	return p.removeRetry
+}
+
+// versionRequirement represents minimum version of device-mapper component needed for a feature
+type versionRequirement struct {
+	component string
+	version   dmsetup.VersionNumber
+}
+
+var (
+	// Deferred removal needs both library and driver support (DM_DEFERRED_REMOVE)
+	deferredRemovalRequirements = []versionRequirement{
+		{"library", dmsetup.VersionNumber{Major: 1, Minor: 2, Patch: 89}},
+		{"driver", dmsetup.VersionNumber{Major: 4, Minor: 27, Patch: 0}},
+	}
+
+	// Thin-pool target versions which introduced optional features
+	thinPoolFeatureRequirements = map[string]dmsetup.VersionNumber{
+		dmsetup.FeatureIgnoreDiscard:     {Major: 1, Minor: 1, Patch: 0},
+		dmsetup.FeatureNoDiscardPassdown: {Major: 1, Minor: 1, Patch: 0},
+		dmsetup.FeatureErrorIfNoSpace:    {Major: 1, Minor: 10, Patch: 0},
+	}
+)
+
+// checkVersions makes sure device-mapper is recent enough for the features requested in config.
+// Returns an error naming the feature if it can't be supported, deferred removal is disabled
+// (reported by returned flag) instead of failing as remove falls back to synchronous mode.
+func checkVersions(ctx context.Context, versions *dmsetup.Versions, config *Config) (bool, error) {
+	components := map[string]dmsetup.VersionNumber{
+		"library": versions.Library,
+		"driver":  versions.Driver,
+	}
+
+	deferredRemoval := true
+	for _, req := range deferredRemovalRequirements {
+		if found := components[req.component]; found.Less(req.version) {
+			log.G(ctx).Warnf("deferred removal requires device-mapper %s version %s or newer, found %s, disabling it",
+				req.component, req.version, found)
+			deferredRemoval = false
+		}
+	}
+
+	// Thin-pool target is loaded on demand, so the version may not be known before pool is created
+	if versions.ThinPool.IsZero() {
+		log.G(ctx).Warn("thin-pool target version is unknown, skipping feature checks")
+		return deferredRemoval, nil
+	}
+
+	var result *multierror.Error
+	for _, feature := range config.ExtraFeatures {
+		required, ok := thinPoolFeatureRequirements[feature]
+		if ok && versions.ThinPool.Less(required) {
+			result = multierror.Append(result, errors.Errorf("thin-pool feature %q requires thin-pool target version %s or newer, found %s",
+				feature, required, versions.ThinPool))
+		}
+	}
+
+	return deferredRemoval, result.ErrorOrNil()
+}
+
+// CreateOpt represents optional settings for CreateThinDevice and CreateSnapshotDevice calls
+type CreateOpt func(opts *createOptions)
+
+type createOptions struct {
+	skipActivation bool
+	readOnly       bool
+	freezer        FilesystemFreezer
+	fsType         string
+	mkfsArgs       []string
+	nodeTimeout    time.Duration
+	idempotent     bool
+	externalOrigin string
+	mountFreeze    bool
+}
+
+// FilesystemFreezer quiesces filesystem on a device while it's being snapshotted,
+// for instance by asking the agent in the VM using the device to freeze it
+type FilesystemFreezer interface {
+	Freeze(ctx context.Context) error
+	Thaw(ctx context.Context) error
+}
+
+// WithoutActivation creates new device in the thin-pool, but doesn't activate it.
+// Use ReactivateDevice to bring the device online later.
+func WithoutActivation() CreateOpt {
+	return func(opts *createOptions) {
+		opts.skipActivation = true
+	}
+}
+
+// WithReadOnly activates new device in read-only mode.
+// The mode is remembered in metadata and kept by ReactivateDevice.
+func WithReadOnly() CreateOpt {
+	return func(opts *createOptions) {
+		opts.readOnly = true
+	}
+}
+
+// WithFreeze freezes filesystem on the base device while snapshot is taken, so the snapshot is consistent
+// rather than crash-consistent. Filesystem is thawed once snapshot is created, even if that fails.
+func WithFreeze(freezer FilesystemFreezer) CreateOpt {
+	return func(opts *createOptions) {
+		opts.freezer = freezer
+	}
+}
+
+// WithFilesystem creates filesystem of the given type ("ext4" or "xfs") on new thin device once it's activated.
+// Args are passed to mkfs before the device path. Device is deleted if mkfs fails.
+func WithFilesystem(fsType string, args ...string) CreateOpt {
+	return func(opts *createOptions) {
+		opts.fsType = fsType
+		opts.mkfsArgs = args
+	}
+}
+
+// WithDeviceNodeTimeout sets how long to wait for openable device node of activated device
+// before CreateThinDevice or CreateSnapshotDevice return, 10 seconds by default.
+// Zero returns right after activation, so the caller has to wait for the node itself.
+func WithDeviceNodeTimeout(timeout time.Duration) CreateOpt {
+	return func(opts *createOptions) {
+		opts.nodeTimeout = timeout
+	}
+}
+
+// WithIdempotentCreate makes CreateThinDevice return ID of the existing thin device with the same name
+// instead of ErrAlreadyExists, so a retried create is safe. Existing device must have the same size,
+// activation and read-only mode, otherwise ErrDeviceConflict is returned.
+func WithIdempotentCreate() CreateOpt {
+	return func(opts *createOptions) {
+		opts.idempotent = true
+	}
+}
+
+// withExternalOrigin sets external origin of the new thin device, see CreateThinDeviceWithExternalOrigin
+func withExternalOrigin(path string) CreateOpt {
+	return func(opts *createOptions) {
+		opts.externalOrigin = path
+	}
+}
+
+func makeCreateOptions(opts []CreateOpt) *createOptions {
+	options := &createOptions{nodeTimeout: deviceNodeTimeout}
+	for _, opt := range opts {
+		opt(options)
+	}
+
+	return options
+}
+
+// CreateThinDevice creates new thin device with the given name and virtual size and returns its device ID.
+// Device will be activated unless WithoutActivation option specified.
+// Existing device is an error, unless WithIdempotentCreate option specified.
+func (p *PoolDevice) CreateThinDevice(ctx context.Context, deviceName string, virtualSizeBytes uint64, opts ...CreateOpt) (_ uint32, retErr error) {
+	ctx, finish := p.startOperation(ctx, operationCreate, deviceName)
+	defer func() {
+		finish(ctx, retErr)
+	}()
+
+	// Deferred first, so the hook runs after locks are released
+	var created *DeviceInfo
+	defer func() {
+		if created != nil {
+			p.hooks.OnDeviceCreated.call(ctx, created)
+		}
+	}()
+
+	p.offlineMutex.RLock()
+	defer p.offlineMutex.RUnlock()
+
+	defer func() {
+		p.metrics.observeOperation(operationCreate, retErr)
+	}()
+
+	options := makeCreateOptions(opts)
+
+	virtualSizeBytes, err := p.newDeviceSize(ctx, deviceName, virtualSizeBytes)
+	if err != nil {
+		return 0, err
+	}
+
+	if options.fsType != "" {
+		if options.skipActivation || options.readOnly {
+			return 0, errors.New("filesystem can only be created on device activated read-write")
+		}
+
+		if options.nodeTimeout <= 0 {
+			return 0, errors.New("filesystem can't be created without waiting for device node")
+		}
+
+		if options.externalOrigin != "" {
+			return 0, errors.New("filesystem can't be created on device with external origin")
+		}
+
+		// Fail before creating the device if mkfs isn't available
+		if _, err := mkfsTool(options.fsType); err != nil {
+			return 0, err
+		}
+	}
+
+	if options.externalOrigin != "" {
+		if err := checkExternalOrigin(options.externalOrigin, virtualSizeBytes); err != nil {
+			return 0, err
+		}
+	}
+
+	release, err := p.reserveName(ctx, deviceName)
+	if errors.Is(err, ErrAlreadyExists) && options.idempotent {
+		return p.existingThinDevice(ctx, deviceName, virtualSizeBytes, options, err)
+	} else if err != nil {
+		return 0, err
+	}
+
+	defer release()
+
+	unlock := p.deviceLocks.lock(deviceName)
+	defer unlock()
+
+	deviceInfo := &DeviceInfo{
+		Name:           deviceName,
+		Size:           virtualSizeBytes,
+		IsReadOnly:     options.readOnly,
+		ExternalOrigin: options.externalOrigin,
+	}
+
+	// Create thin device and save metadata
+	err = p.addDevice(ctx, deviceInfo, func(devID uint32) error {
+		return deviceIDError(ctx, devID, p.dm.CreateDevice(p.poolName, devID))
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	ctx = withDeviceID(ctx, deviceInfo.DeviceID)
+
+	if options.skipActivation {
+		created = deviceInfo
+		return deviceInfo.DeviceID, nil
+	}
+
+	if err := p.activateDevice(ctx, deviceName); err != nil {
+		return 0, p.rollbackDevice(ctx, deviceName, err)
+	}
+
+	if err := p.waitForNode(ctx, deviceName, options); err != nil {
+		return 0, p.rollbackNodeWait(ctx, deviceName, err)
+	}
+
+	if options.fsType != "" {
+		if err := makeFilesystem(ctx, deviceName, options.fsType, options.mkfsArgs); err != nil {
+			return 0, p.rollbackDevice(ctx, deviceName, err)
+		}
+	}
+
+	created = deviceInfo
+	return deviceInfo.DeviceID, nil
+}
+
+// CreateThinDeviceWithExternalOrigin creates new thin device, which reads unprovisioned blocks from the block device
+// at externalOriginPath instead of zeros, and returns its device ID. Writes go to the thin device, so many devices can
+// share an immutable base image (like a golden rootfs) without copying it. External origin must be read-only and
+// at least as large as the device. Snapshots of the device share its external origin. Options are the same as
+// for CreateThinDevice, except WithFilesystem, which would hide the base image.
+func (p *PoolDevice) CreateThinDeviceWithExternalOrigin(ctx context.Context, deviceName string, virtualSizeBytes uint64, externalOriginPath string, opts ...CreateOpt) (uint32, error) {
+	if externalOriginPath == "" {
+		return 0, errors.New("external origin path is required")
+	}
+
+	opts = append(opts[:len(opts):len(opts)], withExternalOrigin(externalOriginPath))
+	return p.CreateThinDevice(ctx, deviceName, virtualSizeBytes, opts...)
+}
+
+// Block device queries of external origin, replaced in tests which have no block devices
+var (
+	blockDeviceSize     = dmsetup.BlockDeviceSize
+	blockDeviceReadOnly = dmsetup.BlockDeviceReadOnly
+)
+
+// checkExternalOrigin makes sure thin device of the given size can use the block device as external origin.
+// Thin-pool doesn't protect external origin from writes, so it must be read-only to be shared.
+func checkExternalOrigin(path string, virtualSizeBytes uint64) error {
+	readOnly, err := blockDeviceReadOnly(path)
+	if err != nil {
+		return errors.Wrapf(err, "failed to query external origin %q", path)
+	}
+
+	if !readOnly {
+		return errors.Errorf("external origin %q must be read-only", path)
+	}
+
+	size, err := blockDeviceSize(path)
+	if err != nil {
+		return errors.Wrapf(err, "failed to query size of external origin %q", path)
+	}
+
+	if size < virtualSizeBytes {
+		return errors.Errorf("external origin %q of %d bytes is smaller than device of %d bytes", path, size, virtualSizeBytes)
+	}
+
+	return nil
+}
+
+// existingThinDevice returns ID of the thin device created earlier with the same parameters.
+// Concurrent create of the device is waited for, if it failed, existsErr is returned.
+func (p *PoolDevice) existingThinDevice(ctx context.Context, deviceName string, virtualSizeBytes uint64, options *createOptions, existsErr error) (uint32, error) {
+	unlock := p.deviceLocks.lock(deviceName)
+	defer unlock()
+
+	info, err := p.metadata.GetDevice(ctx, deviceName)
+	if errors.Is(err, ErrNotFound) {
+		return 0, existsErr
+	} else if err != nil {
+		return 0, errors.Wrapf(err, "failed to query device %q", deviceName)
+	}
+
+	ctx = withDeviceID(ctx, info.DeviceID)
+
+	switch {
+	case info.ParentName != "":
+		return 0, errors.Wrapf(ErrDeviceConflict, "device %q is a snapshot of %q", deviceName, info.ParentName)
+	case info.Size != virtualSizeBytes:
+		return 0, errors.Wrapf(ErrDeviceConflict, "device %q has size %d, requested %d", deviceName, info.Size, virtualSizeBytes)
+	case info.IsActivated == options.skipActivation:
+		return 0, errors.Wrapf(ErrDeviceConflict, "device %q activated: %t, requested %t", deviceName, info.IsActivated, !options.skipActivation)
+	case info.IsReadOnly != options.readOnly:
+		return 0, errors.Wrapf(ErrDeviceConflict, "device %q read-only: %t, requested %t", deviceName, info.IsReadOnly, options.readOnly)
+	case info.ExternalOrigin != options.externalOrigin:
+		return 0, errors.Wrapf(ErrDeviceConflict, "device %q external origin: %q, requested %q", deviceName, info.ExternalOrigin, options.externalOrigin)
+	}
+
+	log.G(ctx).Debugf("device %q already exists with id %d", deviceName, info.DeviceID)
+	return info.DeviceID, nil
+}
+
+// CreateSnapshotDevice creates snapshot of the given device and returns device ID of the snapshot.
+// Snapshot will be activated unless WithoutActivation option specified.
+func (p *PoolDevice) CreateSnapshotDevice(ctx context.Context, deviceName string, snapshotName string, virtualSizeBytes uint64, opts ...CreateOpt) (_ uint32, retErr error) {
+	ctx, finish := p.startOperation(ctx, operationSnapshot, snapshotName)
+	defer func() {
+		finish(ctx, retErr)
+	}()
+
+	// Deferred first, so the hook runs after locks are released and base device is resumed
+	var created *DeviceInfo
+	defer func() {
+		if created != nil {
+			p.hooks.OnSnapshotCreated.call(ctx, created)
+		}
+	}()
+
+	p.offlineMutex.RLock()
+	defer p.offlineMutex.RUnlock()
+
+	defer func() {
+		p.metrics.observeOperation(operationSnapshot, retErr)
+	}()
+
+	options := makeCreateOptions(opts)
+
+	virtualSizeBytes, err := p.newDeviceSize(ctx, snapshotName, virtualSizeBytes)
+	if err != nil {
+		return 0, err
+	}
+
+	// Claim the name before suspending base device, so a duplicate doesn't stall it
+	release, err := p.reserveName(ctx, snapshotName)
+	if errors.Is(err, ErrAlreadyExists) {
+		return 0, errors.Wrapf(ErrSnapshotAlreadyExists, "snapshot %q", snapshotName)
+	} else if err != nil {
+		return 0, err
+	}
+
+	defer release()
+
+	// Base device is suspended while snapshot is taken, concurrent snapshots of it have to wait for that,
+	// but not for activation of the snapshot
+	unlocks := p.deviceLocks.lockEach(deviceName, snapshotName)
+	unlockBase := unlocks[0]
+	defer unlocks[1]()
+	defer unlockBase()
+
+	baseDeviceInfo, err := p.metadata.GetDevice(ctx, deviceName)
+	if err != nil {
+		return 0, err
+	}
+
+	if baseDeviceInfo.DeletePending {
+		return 0, errors.Wrapf(ErrDeletePending, "device %q can't be snapshotted", deviceName)
+	}
+
+	resume, thaw, err := p.quiesceDevice(ctx, baseDeviceInfo, options)
+	if err != nil {
+		return 0, err
+	}
+
+	defer thaw()
+
+	// Base device must not be left suspended if snapshot fails, I/O of its user would hang
+	defer func() {
+		if err := resume(); err != nil {
+			log.G(ctx).WithError(err).Errorf("failed to resume device %q", deviceName)
+		}
+	}()
+
+	snapshotDeviceInfo := &DeviceInfo{
+		Name:           snapshotName,
+		Size:           virtualSizeBytes,
+		ParentName:     deviceName,
+		IsReadOnly:     options.readOnly,
+		ExternalOrigin: baseDeviceInfo.ExternalOrigin,
+	}
+
+	err = p.addDevice(ctx, snapshotDeviceInfo, func(devID uint32) error {
+		return deviceIDError(ctx, devID, p.dm.CreateSnapshot(p.poolName, devID, baseDeviceInfo.DeviceID))
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	ctx = withDeviceID(ctx, snapshotDeviceInfo.DeviceID)
+
+	if err := resume(); err != nil {
+		return 0, errors.Wrapf(err, "failed to resume device %q", deviceName)
+	}
+
+	// Snapshot is taken, no need to keep the filesystem frozen or base device locked while it's being activated
+	thaw()
+	unlockBase()
+
+	if options.skipActivation {
+		created = snapshotDeviceInfo
+		return snapshotDeviceInfo.DeviceID, nil
+	}
+
+	if err := p.activateDevice(ctx, snapshotName); err != nil {
+		return 0, p.rollbackDevice(ctx, snapshotName, err)
+	}
+
+	if err := p.waitForNode(ctx, snapshotName, options); err != nil {
+		return 0, p.rollbackNodeWait(ctx, snapshotName, err)
+	}
+
+	created = snapshotDeviceInfo
+	return snapshotDeviceInfo.DeviceID, nil
+}
+
+// quiesceDevice freezes filesystem on the device if options ask for it and suspends the device if it's activated,
+// so in-flight writes are flushed before snapshot. Returned resume and thaw undo that and do nothing once called.
+// Device already suspended with SuspendDevice is neither frozen nor suspended and is left suspended.
+func (p *PoolDevice) quiesceDevice(ctx context.Context, info *DeviceInfo, options *createOptions) (func() error, func(), error) {
+	if info.IsActivated {
+		suspended, err := p.isSuspended(info.Name)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// Freezing would block on suspended device, its writes are flushed already
+		if suspended {
+			log.G(ctx).Debugf("device %q is suspended by caller, keeping it suspended", info.Name)
+			return func() error { return nil }, func() {}, nil
+		}
+	}
+
+	freezer, err := p.snapshotFreezer(ctx, info, options)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	thaw := func() {}
+	if freezer != nil {
+		if err := freezer.Freeze(ctx); err != nil {
+			return nil, nil, errors.Wrapf(err, "failed to freeze filesystem on device %q", info.Name)
+		}
+
+		var once sync.Once
+		thaw = func() {
+			once.Do(func() {
+				if err := freezer.Thaw(ctx); err != nil {
+					log.G(ctx).WithError(err).Errorf("failed to thaw filesystem on device %q", info.Name)
+				}
+			})
+		}
+	}
+
+	suspended := false
+	if info.IsActivated {
+		if err := p.dm.SuspendDevice(info.Name); err != nil {
+			thaw()
+			return nil, nil, errors.Wrapf(err, "failed to suspend device %q", info.Name)
+		}
+
+		suspended = true
+	}
+
+	resume := func() error {
+		if !suspended {
+			return nil
+		}
+
+		suspended = false
+		return p.dm.ResumeDevice(info.Name)
+	}
+
+	return resume, thaw, nil
+}
+
+// isSuspended tells whether the activated device is suspended
+func (p *PoolDevice) isSuspended(deviceName string) (bool, error) {
+	infos, err := p.dm.Info(deviceName)
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to query device %q", deviceName)
+	}
+
+	return len(infos) > 0 && infos[0].Suspended, nil
+}
+
+// CreateSnapshots creates snapshots of the given device with the given names and returns their device IDs in
+// the same order. Base device is suspended once while all snapshots are taken, then snapshots are activated in
+// parallel (up to maxActivateConcurrency at a time) unless WithoutActivation option specified.
+// If any snapshot fails, snapshots already created are deleted and errors are returned as multierror.
+func (p *PoolDevice) CreateSnapshots(ctx context.Context, deviceName string, snapshotNames []string, virtualSizeBytes uint64, opts ...CreateOpt) (_ []uint32, retErr error) {
+	ctx, finish := p.startOperation(ctx, operationSnapshots, deviceName)
+	defer func() {
+		finish(ctx, retErr)
+	}()
+
+	// Deferred first, so hooks run after locks are released and base device is resumed
+	var created []*DeviceInfo
+	defer func() {
+		for _, info := range created {
+			p.hooks.OnSnapshotCreated.call(ctx, info)
+		}
+	}()
+
+	if len(snapshotNames) == 0 {
+		return nil, nil
+	}
+
+	p.offlineMutex.RLock()
+	defer p.offlineMutex.RUnlock()
+
+	defer func() {
+		for range snapshotNames {
+			p.metrics.observeOperation(operationSnapshot, retErr)
+		}
+	}()
+
+	options := makeCreateOptions(opts)
+
+	virtualSizeBytes, err := p.newDeviceSize(ctx, snapshotNames[0], virtualSizeBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	// Claim the names before suspending base device, so a duplicate doesn't stall it
+	seen := make(map[string]bool, len(snapshotNames))
+	for _, name := range snapshotNames {
+		if seen[name] {
+			return nil, errors.Errorf("snapshot %q is listed more than once", name)
+		}
+
+		seen[name] = true
+
+		release, err := p.reserveName(ctx, name)
+		if errors.Is(err, ErrAlreadyExists) {
+			return nil, errors.Wrapf(ErrSnapshotAlreadyExists, "snapshot %q", name)
+		} else if err != nil {
+			return nil, err
+		}
+
+		defer release()
+	}
+
+	unlock := p.deviceLocks.lock(append([]string{deviceName}, snapshotNames...)...)
+	defer unlock()
+
+	baseDeviceInfo, err := p.metadata.GetDevice(ctx, deviceName)
+	if err != nil {
+		return nil, err
+	}
+
+	if baseDeviceInfo.DeletePending {
+		return nil, errors.Wrapf(ErrDeletePending, "device %q can't be snapshotted", deviceName)
+	}
+
+	infos, err := p.takeSnapshots(ctx, baseDeviceInfo, snapshotNames, virtualSizeBytes, options)
+	if err != nil {
+		return nil, p.rollbackDevices(ctx, infos, err)
+	}
+
+	if !options.skipActivation {
+		if err := p.activateSnapshots(ctx, infos, options); err != nil {
+			return nil, p.rollbackDevices(ctx, infos, err)
+		}
+	}
+
+	ids := make([]uint32, len(infos))
+	for i, info := range infos {
+		ids[i] = info.DeviceID
+	}
+
+	created = infos
+	return ids, nil
+}
+
+// takeSnapshots creates snapshots of the base device while it's suspended once for all of them,
+// and returns infos of snapshots created, even if some failed. Caller must hold locks of all the devices.
+func (p *PoolDevice) takeSnapshots(ctx context.Context, base *DeviceInfo, names []string, virtualSizeBytes uint64, options *createOptions) ([]*DeviceInfo, error) {
+	resume, thaw, err := p.quiesceDevice(ctx, base, options)
+	if err != nil {
+		return nil, err
+	}
+
+	defer thaw()
+
+	defer func() {
+		if err := resume(); err != nil {
+			log.G(ctx).WithError(err).Errorf("failed to resume device %q", base.Name)
+		}
+	}()
+
+	infos := make([]*DeviceInfo, 0, len(names))
+	for _, name := range names {
+		info := &DeviceInfo{
+			Name:           name,
+			Size:           virtualSizeBytes,
+			ParentName:     base.Name,
+			IsReadOnly:     options.readOnly,
+			ExternalOrigin: base.ExternalOrigin,
+		}
+
+		err := p.addDevice(ctx, info, func(devID uint32) error {
+			return deviceIDError(ctx, devID, p.dm.CreateSnapshot(p.poolName, devID, base.DeviceID))
+		})
+
+		if err != nil {
+			return infos, errors.Wrapf(err, "failed to create snapshot %q", name)
+		}
+
+		infos = append(infos, info)
+	}
+
+	if err := resume(); err != nil {
+		return infos, errors.Wrapf(err, "failed to resume device %q", base.Name)
+	}
+
+	return infos, nil
+}
+
+// activateSnapshots activates devices in parallel and waits for their device nodes, errors are returned as multierror
+func (p *PoolDevice) activateSnapshots(ctx context.Context, infos []*DeviceInfo, options *createOptions) error {
+	var (
+		result *multierror.Error
+		mutex  sync.Mutex
+		wg     sync.WaitGroup
+		sem    = make(chan struct{}, maxActivateConcurrency)
+	)
+
+	for _, info := range infos {
+		wg.Add(1)
+		sem <- struct{}{}
+
+		go func(name string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			err := p.activateDevice(ctx, name)
+			if err == nil {
+				err = p.waitForNode(ctx, name, options)
+			}
+
+			if err != nil {
+				mutex.Lock()
+				result = multierror.Append(result, errors.Wrapf(err, "failed to activate snapshot %q", name))
+				mutex.Unlock()
+			}
+		}(info.Name)
+	}
+
+	wg.Wait()
+	return result.ErrorOrNil()
+}
+
+// rollbackDevices deletes devices created by failed batch operation, newest first.
+// Returns createErr with rollback errors appended as multierror.
+func (p *PoolDevice) rollbackDevices(ctx context.Context, infos []*DeviceInfo, createErr error) error {
+	result := multierror.Append(nil, createErr)
+	for i := len(infos) - 1; i >= 0; i-- {
+		if err := p.rollbackDevice(ctx, infos[i].Name, nil); err != nil {
+			result = multierror.Append(result, err)
+		}
+	}
+
+	return result
+}
+
+// CreateSnapshotDeviceFromID creates snapshot of the thin device with the given ID and returns device ID of the snapshot.
+// The origin must exist in the pool, but doesn't have to be tracked in metadata store, like a device restored into
+// pool metadata during migration. It must not be activated, as the origin has to be suspended while snapshot is taken,
+// so activated origins are snapshotted by name with CreateSnapshotDevice (after LoadExisting if they're untracked).
+// Origin tracked in metadata store is snapshotted with CreateSnapshotDevice. Untracked origin isn't recorded as
+// snapshot's parent. Snapshot will be activated unless WithoutActivation option specified.
+func (p *PoolDevice) CreateSnapshotDeviceFromID(ctx context.Context, originID uint32, snapshotName string, virtualSizeBytes uint64, opts ...CreateOpt) (_ uint32, retErr error) {
+	if originID == 0 || originID >= maxDeviceID {
+		return 0, errors.Errorf("device id %d is out of range [1, %d)", originID, maxDeviceID)
+	}
+
+	if origin, err := p.metadata.GetDeviceByID(ctx, originID); err == nil {
+		return p.CreateSnapshotDevice(ctx, origin.Name, snapshotName, virtualSizeBytes, opts...)
+	} else if !errors.Is(err, ErrDeviceNotFound) {
+		return 0, errors.Wrapf(err, "failed to query device id %d", originID)
+	}
+
+	ctx, finish := p.startOperation(ctx, operationSnapshot, snapshotName)
+	defer func() {
+		finish(ctx, retErr)
+	}()
+
+	// Deferred first, so the hook runs after locks are released
+	var created *DeviceInfo
+	defer func() {
+		if created != nil {
+			p.hooks.OnSnapshotCreated.call(ctx, created)
+		}
+	}()
+
+	p.offlineMutex.RLock()
+	defer p.offlineMutex.RUnlock()
+
+	defer func() {
+		p.metrics.observeOperation(operationSnapshot, retErr)
+	}()
+
+	options := makeCreateOptions(opts)
+	if options.freezer != nil || options.mountFreeze {
+		return 0, errors.New("origin isn't activated, its filesystem can't be frozen")
+	}
+
+	virtualSizeBytes, err := p.newDeviceSize(ctx, snapshotName, virtualSizeBytes)
+	if err != nil {
+		return 0, err
+	}
+
+	release, err := p.reserveName(ctx, snapshotName)
+	if errors.Is(err, ErrAlreadyExists) {
+		return 0, errors.Wrapf(ErrSnapshotAlreadyExists, "snapshot %q", snapshotName)
+	} else if err != nil {
+		return 0, err
+	}
+
+	defer release()
+
+	unlock := p.deviceLocks.lock(snapshotName)
+	defer unlock()
+
+	thinDevices, err := p.activeThinDevices(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	for name, thin := range thinDevices {
+		if thin.DeviceID == originID {
+			return 0, errors.Errorf("device id %d is activated as %q, snapshot it with CreateSnapshotDevice", originID, name)
+		}
+	}
+
+	// create_snap of a missing origin fails with a vague error, check the pool has it beforehand
+	err = p.withMetadataSnapshot(ctx, func() error {
+		_, err := dmsetup.ThinDump(p.metadataDevice, originID)
+		return err
+	})
+
+	if errors.Is(err, dmsetup.ErrThinDeviceNotFound) {
+		return 0, errors.Wrapf(ErrDeviceNotFound, "device id %d in pool %q", originID, p.poolName)
+	} else if err != nil {
+		return 0, errors.Wrapf(err, "failed to look up device id %d", originID)
+	}
+
+	snapshotDeviceInfo := &DeviceInfo{
+		Name:       snapshotName,
+		Size:       virtualSizeBytes,
+		IsReadOnly: options.readOnly,
+	}
+
+	err = p.addDevice(ctx, snapshotDeviceInfo, func(devID uint32) error {
+		return deviceIDError(ctx, devID, p.dm.CreateSnapshot(p.poolName, devID, originID))
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	ctx = withDeviceID(ctx, snapshotDeviceInfo.DeviceID)
+
+	if options.skipActivation {
+		created = snapshotDeviceInfo
+		return snapshotDeviceInfo.DeviceID, nil
+	}
+
+	if err := p.activateDevice(ctx, snapshotName); err != nil {
+		return 0, p.rollbackDevice(ctx, snapshotName, err)
+	}
+
+	if err := p.waitForNode(ctx, snapshotName, options); err != nil {
+		return 0, p.rollbackNodeWait(ctx, snapshotName, err)
+	}
+
+	created = snapshotDeviceInfo
+	return snapshotDeviceInfo.DeviceID, nil
+}
+
+// rollbackDevice deactivates (if activated) and deletes just created device from thin-pool and metadata store
+// after create failed, so its device ID goes back to the free list. Returns createErr joined with rollback error, if any.
+func (p *PoolDevice) rollbackDevice(ctx context.Context, deviceName string, createErr error) error {
+	if err := p.undoDevice(ctx, deviceName); err != nil {
+		return multierror.Append(createErr, err)
+	}
+
+	return createErr
+}
+
+// rollbackNodeWait rolls back the device whose node didn't appear after activation. Failed rollback is added
+// to the message only, so the wait error stays the cause and ErrDeviceNodeTimeout can still be told apart.
+func (p *PoolDevice) rollbackNodeWait(ctx context.Context, deviceName string, waitErr error) error {
+	if err := p.undoDevice(ctx, deviceName); err != nil {
+		return errors.Wrapf(waitErr, "%v", err)
+	}
+
+	return waitErr
+}
+
+// undoDevice deactivates and deletes just created device. If it can't be deleted, it's marked as Faulty.
+func (p *PoolDevice) undoDevice(ctx context.Context, deviceName string) error {
+	if err := p.removeDevice(ctx, deviceName, false); err != nil {
+		return errors.Wrapf(err, "failed to deactivate device %q on rollback", deviceName)
+	}
+
+	err := p.metadata.RemoveDevice(ctx, deviceName, func(info *DeviceInfo) error {
+		return p.dm.DeleteDevice(p.poolName, info.DeviceID)
+	})
+
+	if err != nil {
+		// Device is kept, so its device ID isn't handed out again, but it's of no use to anyone
+		if stateErr := p.setDeviceState(ctx, deviceName, Faulty); stateErr != nil {
+			log.G(ctx).WithError(stateErr).Errorf("failed to mark device %q as faulty", deviceName)
+		}
+
+		return errors.Wrapf(err, "failed to rollback device %q", deviceName)
+	}
+
+	return nil
+}
+
+// reserveName claims device name for the duration of create, returns ErrInvalidDeviceName if the name
+// can't be used and ErrAlreadyExists if it's taken by an existing device or by another create in progress.
+// Once release is called either the device is saved to metadata store (which keeps the name taken)
+// or create failed and the name is free again.
+func (p *PoolDevice) reserveName(ctx context.Context, name string) (func(), error) {
+	if err := validateDeviceName(name); err != nil {
+		return nil, err
+	}
+
+	p.reservedMutex.Lock()
+	defer p.reservedMutex.Unlock()
+
+	if _, ok := p.reservedNames[name]; ok {
+		return nil, errors.Wrapf(ErrAlreadyExists, "device %q is being created", name)
+	}
+
+	if _, err := p.metadata.GetDevice(ctx, name); err == nil {
+		return nil, errors.Wrapf(ErrAlreadyExists, "device %q", name)
+	} else if !errors.Is(err, ErrNotFound) {
+		return nil, errors.Wrapf(err, "failed to query device %q", name)
+	}
+
+	if p.reservedNames == nil {
+		p.reservedNames = make(map[string]struct{})
+	}
+
+	p.reservedNames[name] = struct{}{}
+
+	release := func() {
+		p.reservedMutex.Lock()
+		defer p.reservedMutex.Unlock()
+
+		delete(p.reservedNames, name)
+	}
+
+	return release, nil
+}
+
+// addDevice saves new device to metadata store unless it would exceed over-provisioning limit
+func (p *PoolDevice) addDevice(ctx context.Context, info *DeviceInfo, fn DeviceIDCallback) error {
+	release, err := p.reserveProvisioning(ctx, info)
+	if err != nil {
+		return err
+	}
+
+	defer release()
+
+	p.provisionMutex.RLock()
+	defer p.provisionMutex.RUnlock()
+
+	retries := 0
+	defer func() {
+		p.metrics.observeDeviceIDRetries(retries)
+	}()
+
+	next := fn
+	fn = func(deviceID uint32) error {
+		err := next(deviceID)
+		if errors.Is(err, ErrDeviceIDTaken) {
+			retries++
+		}
+
+		return err
+	}
+
+	return p.metadata.AddDevice(ctx, info, fn)
+}
+
+// reserveProvisioning checks limits of the pool for the new device and counts it as provisioning until release
+// is called. Only the check runs under write lock, so concurrent creates don't wait for each other's device-mapper
+// calls.
+func (p *PoolDevice) reserveProvisioning(ctx context.Context, info *DeviceInfo) (func(), error) {
+	p.provisionMutex.Lock()
+	defer p.provisionMutex.Unlock()
+
+	// Read before saved devices, so device saved meanwhile is counted twice (rejecting rather than exceeding
+	// the limit) instead of being missed
+	provisioningDevices, provisioningBytes := p.provisioning()
+
+	if p.maxDevices > 0 {
+		count, err := p.metadata.CountDevices(ctx)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to count devices")
+		}
+
+		count += provisioningDevices
+		if count >= p.maxDevices {
+			return nil, errors.Wrapf(ErrPoolAtCapacity, "can't create device %q: pool has %d of %d devices", info.Name, count, p.maxDevices)
+		}
+	}
+
+	if p.maxVirtualSizeBytes > 0 {
+		total, err := p.metadata.GetTotalVirtualSize(ctx)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to query provisioned size")
+		}
+
+		total += provisioningBytes
+		if total+info.Size > p.maxVirtualSizeBytes {
+			log.G(ctx).WithField("device", info.Name).Errorf("can't provision %d bytes: %d of %d bytes already provisioned",
+				info.Size, total, p.maxVirtualSizeBytes)
+			return nil, ErrOverProvisioned
+		}
+	}
+
+	p.provisioningMutex.Lock()
+	defer p.provisioningMutex.Unlock()
+
+	p.provisioningDevices++
+	p.provisioningBytes += info.Size
+
+	return func() {
+		p.provisioningMutex.Lock()
+		defer p.provisioningMutex.Unlock()
+
+		p.provisioningDevices--
+		p.provisioningBytes -= info.Size
+	}, nil
+}
+
+// provisioning returns the number and virtual size of devices being created
+func (p *PoolDevice) provisioning() (int, uint64) {
+	p.provisioningMutex.Lock()
+	defer p.provisioningMutex.Unlock()
+
+	return p.provisioningDevices, p.provisioningBytes
+}
+
+// deviceIDError translates "File exists" from thin-pool into ErrDeviceIDTaken, so another device ID is tried
+func deviceIDError(ctx context.Context, deviceID uint32, err error) error {
+	if err == unix.EEXIST {
+		log.G(ctx).Warnf("device id %d is taken by a device unknown to metadata, trying another one", deviceID)
+		return ErrDeviceIDTaken
+	}
+
+	return err
+}
+
+// waitForNode waits for device node of just activated device, unless waiting is disabled with WithDeviceNodeTimeout
+func (p *PoolDevice) waitForNode(ctx context.Context, deviceName string, options *createOptions) error {
+	if options.nodeTimeout <= 0 {
+		return nil
+	}
+
+	return waitForDeviceNode(ctx, dmsetup.GetFullDevicePath(deviceName), options.nodeTimeout)
+}
+
+// waitForDeviceNode waits for block device node to appear and become openable after activation,
+// udev may create it with a delay. Returns ErrDeviceNodeTimeout if it doesn't within the timeout.
+func waitForDeviceNode(ctx context.Context, path string, timeout time.Duration) error {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	var (
+		start    = time.Now()
+		deadline = start.Add(timeout)
+		interval = deviceNodePollInterval
+	)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return errors.Wrapf(ctx.Err(), "stopped waiting for device node %q", path)
+		case <-timer.C:
+		}
+
+		err := checkDeviceNode(path)
+		if err == nil {
+			return nil
+		}
+
+		if !time.Now().Before(deadline) {
+			return errors.Wrapf(ErrDeviceNodeTimeout, "%q in %s (udev sync disabled or udevd not running?): %v",
+				path, time.Since(start).Round(time.Millisecond), err)
+		}
+
+		timer.Reset(interval)
+		if interval *= 2; interval > deviceNodeMaxPollInterval {
+			interval = deviceNodeMaxPollInterval
+		}
+	}
+}
+
+// checkDeviceNode makes sure the path is a device node which can be opened
+func checkDeviceNode(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	if info.Mode()&os.ModeDevice == 0 {
+		return errors.Errorf("unexpected file mode %s", info.Mode())
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	return file.Close()
+}
+
+// LoadExisting adds active thin devices of the pool missing from metadata (like devices created out of band
+// with dmsetup), so their device IDs aren't handed out again and they're removed together with the pool.
+// Devices which table can't be parsed or which ID is already taken are logged and skipped.
+// Inactive devices aren't visible to dmsetup and can't be found this way. Returns names of devices added.
+func (p *PoolDevice) LoadExisting(ctx context.Context) (_ []string, retErr error) {
+	ctx, finish := p.startOperation(ctx, operationLoad, "")
+	defer func() {
+		finish(ctx, retErr)
+	}()
+
+	p.offlineMutex.RLock()
+	defer p.offlineMutex.RUnlock()
+
+	return p.loadExisting(ctx)
+}
+
+func (p *PoolDevice) loadExisting(ctx context.Context) ([]string, error) {
+	thinDevices, err := p.activeThinDevices(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var loaded []string
+	for name, thin := range thinDevices {
+		existing, err := p.metadata.GetDevice(ctx, name)
+		if err == nil {
+			if existing.DeviceID != thin.DeviceID {
+				log.G(ctx).Warnf("device %q has id %d, but metadata has %d", name, thin.DeviceID, existing.DeviceID)
+			}
+
+			continue
+		}
+
+		if !errors.Is(err, ErrNotFound) {
+			return loaded, errors.Wrapf(err, "failed to query device %q", name)
+		}
+
+		info := &DeviceInfo{
+			Name:           name,
+			DeviceID:       thin.DeviceID,
+			Size:           thin.LengthSectors * dmsetup.SectorSize,
+			IsActivated:    true,
+			ExternalOrigin: thin.ExternalOrigin,
+		}
+
+		if err := p.metadata.ImportDevice(ctx, info); err != nil {
+			if errors.Is(err, ErrAlreadyExists) {
+				log.G(ctx).Warnf("skipping device %q, its id %d is taken by another device", name, thin.DeviceID)
+				continue
+			}
+
+			return loaded, errors.Wrapf(err, "failed to save device %q", name)
+		}
+
+		log.G(ctx).Infof("loaded existing device %q with id %d", name, thin.DeviceID)
+		loaded = append(loaded, name)
+	}
+
+	return loaded, nil
+}
+
+// recoverDevices replays the journal and reconciles activation state of devices with device-mapper
+func (p *PoolDevice) recoverDevices(ctx context.Context) error {
+	if _, err := p.recoverJournal(ctx); err != nil {
+		return err
+	}
+
+	_, err := p.reconcileActivation(ctx)
+	return err
+}
+
+// recoverJournal finishes or undoes device-mapper operations interrupted by a crash, which are left in the journal.
+// Interrupted create is undone: thin device is deleted from the pool if it was created and device ID is freed.
+// Interrupted delete is finished, as thin device may be gone from the pool already. Device which can't be deleted
+// is saved as Faulty, so its device ID isn't handed out again and it can be deleted later with DeleteDevice.
+// Returns names of devices recovered.
+func (p *PoolDevice) recoverJournal(ctx context.Context) ([]string, error) {
+	entries, err := p.metadata.getJournal(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read journal")
+	}
+
+	var recovered []string
+	for _, entry := range entries {
+		info := &entry.Info
+
+		switch entry.State {
+		case Creating:
+			if err := p.deleteThinDevice(ctx, info, true); err != nil {
+				log.G(ctx).WithError(err).Warnf("failed to undo interrupted create of device %q, marking it as faulty", info.Name)
+
+				info.State = Faulty
+				err = p.metadata.commitAdd(info)
+			} else {
+				log.G(ctx).Infof("undone interrupted create of device %q with id %d", info.Name, info.DeviceID)
+				err = p.metadata.abortAdd(info.Name, info.DeviceID, true)
+			}
+
+			if err != nil {
+				return recovered, errors.Wrapf(err, "failed to recover device %q", info.Name)
+			}
+		case Removing:
+			if err := p.deleteThinDevice(ctx, info, true); err != nil {
+				log.G(ctx).WithError(err).Warnf("failed to finish interrupted delete of device %q, marking it as faulty", info.Name)
+				err = p.metadata.abortRemove(info.Name, Faulty)
+			} else {
+				log.G(ctx).Infof("finished interrupted delete of device %q with id %d", info.Name, info.DeviceID)
+				err = p.metadata.commitRemove(info.Name)
+			}
+
+			if err != nil {
+				return recovered, errors.Wrapf(err, "failed to recover device %q", info.Name)
+			}
+		default:
+			return recovered, errors.Errorf("unexpected state %q of device %q in journal", entry.State, info.Name)
+		}
+
+		recovered = append(recovered, info.Name)
+	}
+
+	return recovered, nil
+}
+
+// reconcileActivation makes activation state of devices in metadata store match device-mapper. Devices are
+// deactivated by host reboot, and can be activated or removed with dmsetup while the snapshotter isn't running.
+// A device activated under the same name with different device ID isn't the one in metadata, so it's counted
+// as inactive. State left by interrupted activation or deactivation (or missing in devices saved by older
+// versions) is replaced with Activated or Created, Faulty devices stay faulty. Devices missing from metadata
+// aren't added, see LoadExisting. Returns names of devices updated.
+func (p *PoolDevice) reconcileActivation(ctx context.Context) ([]string, error) {
+	thinDevices, err := p.activeThinDevices(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	infos, err := p.metadata.GetDevices(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list devices")
+	}
+
+	var updated []string
+	for _, info := range infos {
+		thin, ok := thinDevices[info.Name]
+		if ok && thin.DeviceID != info.DeviceID {
+			log.G(ctx).Warnf("device %q has id %d, but metadata has %d", info.Name, thin.DeviceID, info.DeviceID)
+			ok = false
+		}
+
+		state := Created
+		if info.State == Faulty {
+			state = Faulty
+		} else if ok {
+			state = Activated
+		}
+
+		if info.IsActivated == ok && info.State == state {
+			continue
+		}
+
+		err := p.metadata.UpdateDevice(ctx, info.Name, func(info *DeviceInfo) error {
+			info.IsActivated = ok
+			info.State = state
+			return nil
+		})
+
+		if err != nil {
+			return updated, errors.Wrapf(err, "failed to save activation state of device %q", info.Name)
+		}
+
+		switch {
+		case info.IsActivated == ok:
+			log.G(ctx).Debugf("device %q was %q, marked as %s in metadata", info.Name, info.State, state)
+		case ok:
+			log.G(ctx).Infof("device %q is activated, marked as activated in metadata", info.Name)
+		default:
+			// Node left by the previous activation points to a device which is gone
+			p.removeJailNode(ctx, info.Name)
+			log.G(ctx).Infof("device %q is not activated, marked as deactivated in metadata", info.Name)
+		}
+
+		updated = append(updated, info.Name)
+	}
+
+	return updated, nil
+}
+
+// activeThinDevices returns tables of activated thin devices of the pool by device name,
+// whether they're tracked in metadata store or not. Devices which table can't be parsed are logged and skipped.
+func (p *PoolDevice) activeThinDevices(ctx context.Context) (map[string]*dmsetup.ThinTable, error) {
+	poolInfos, err := p.dm.Info(p.poolName)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to query pool %q", p.poolName)
+	}
+
+	if len(poolInfos) != 1 {
+		return nil, errors.Errorf("unexpected number of pool infos %d", len(poolInfos))
+	}
+
+	// Kernel reports the pool of thin devices as major:minor
+	poolDevice := fmt.Sprintf("%d:%d", poolInfos[0].Major, poolInfos[0].Minor)
+
+	tables, err := p.dm.ListThinDevices()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list thin devices")
+	}
+
+	result := make(map[string]*dmsetup.ThinTable)
+	for name, table := range tables {
+		thin, err := dmsetup.ParseThinTable(table)
+		if err != nil {
+			log.G(ctx).WithError(err).Warnf("skipping thin device %q", name)
+			continue
+		}
+
+		if thin.PoolDevice != poolDevice && thin.PoolDevice != dmsetup.GetFullDevicePath(p.poolName) {
+			continue
+		}
+
+		result[name] = thin
+	}
+
+	return result, nil
+}
+
+// DeviceStatus describes a thin device as stored in metadata along with its device-mapper state
+type DeviceStatus struct {
+	DeviceInfo
+	// Path of the device node
+	Path string
+	// Active is set if device-mapper has live table for the device. It differs from IsActivated if the
+	// device was activated or removed bypassing the pool device.
+	Active    bool
+	ReadOnly  bool
+	Suspended bool
+	OpenCount uint32
+}
+
+// GetDeviceStatus returns metadata and device-mapper state of the device.
+// Returns ErrNotFound if the device is unknown to metadata.
+func (p *PoolDevice) GetDeviceStatus(ctx context.Context, deviceName string) (*DeviceStatus, error) {
+	info, err := p.metadata.GetDevice(ctx, deviceName)
+	if err != nil {
+		return nil, err
+	}
+
+	status := &DeviceStatus{
+		DeviceInfo: *info,
+		Path:       dmsetup.GetFullDevicePath(deviceName),
+	}
+
+	// Query all devices, as dmsetup doesn't report a missing device with an error code
+	infos, err := p.dm.Info("")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to query device-mapper devices")
+	}
+
+	for _, dmInfo := range infos {
+		if dmInfo.Name == deviceName {
+			status.Active = dmInfo.TableLive
+			status.ReadOnly = dmInfo.ReadOnly
+			status.Suspended = dmInfo.Suspended
+			status.OpenCount = dmInfo.OpenCount
+			break
+		}
+	}
+
+	return status, nil
+}
+
+// SuspendDevice suspends I/O of the activated device (see "dmsetup suspend"), outstanding writes are flushed first.
+// I/O is blocked until ResumeDevice is called. CreateSnapshotDevice suspends the base device by itself.
+func (p *PoolDevice) SuspendDevice(ctx context.Context, deviceName string) (retErr error) {
+	ctx, finish := p.startOperation(ctx, operationSuspend, deviceName)
+	defer func() {
+		finish(ctx, retErr)
+	}()
+
+	p.offlineMutex.RLock()
+	defer p.offlineMutex.RUnlock()
+
+	unlock := p.deviceLocks.lock(deviceName)
+	defer unlock()
+
+	ctx = p.withDeviceIDOf(ctx, deviceName)
+
+	if err := p.checkActivated(ctx, deviceName); err != nil {
+		return err
+	}
+
+	if err := p.dm.SuspendDevice(deviceName); err != nil {
+		return errors.Wrapf(err, "failed to suspend device %q", deviceName)
+	}
+
+	return nil
+}
+
+// ResumeDevice resumes I/O of the device suspended with SuspendDevice (see "dmsetup resume")
+func (p *PoolDevice) ResumeDevice(ctx context.Context, deviceName string) (retErr error) {
+	ctx, finish := p.startOperation(ctx, operationResume, deviceName)
+	defer func() {
+		finish(ctx, retErr)
+	}()
+
+	p.offlineMutex.RLock()
+	defer p.offlineMutex.RUnlock()
+
+	unlock := p.deviceLocks.lock(deviceName)
+	defer unlock()
+
+	ctx = p.withDeviceIDOf(ctx, deviceName)
+
+	if err := p.checkActivated(ctx, deviceName); err != nil {
+		return err
+	}
+
+	if err := p.dm.ResumeDevice(deviceName); err != nil {
+		return errors.Wrapf(err, "failed to resume device %q", deviceName)
+	}
+
+	return nil
+}
+
+func (p *PoolDevice) checkActivated(ctx context.Context, deviceName string) error {
+	info, err := p.metadata.GetDevice(ctx, deviceName)
+	if err != nil {
+		return err
+	}
+
+	if !info.IsActivated {
+		return errors.Errorf("device %q is not activated", deviceName)
+	}
+
+	return nil
+}
+
+// ReactivateDevice activates previously created device using the device ID and size stored in metadata.
+// It's a no-op if device is already activated.
+func (p *PoolDevice) ReactivateDevice(ctx context.Context, deviceName string) (retErr error) {
+	ctx, finish := p.startOperation(ctx, operationReactivate, deviceName)
+	defer func() {
+		finish(ctx, retErr)
+	}()
+
+	p.offlineMutex.RLock()
+	defer p.offlineMutex.RUnlock()
+
+	unlock := p.deviceLocks.lock(deviceName)
+	defer unlock()
+
+	info, err := p.metadata.GetDevice(ctx, deviceName)
+	if err != nil {
+		return err
+	}
+
+	ctx = withDeviceID(ctx, info.DeviceID)
+
+	if info.IsActivated {
+		log.G(ctx).Debugf("device %q is already activated", deviceName)
+		return nil
+	}
+
+	return p.activateDevice(ctx, deviceName)
+}
+
+// activateDevice activates thin device and marks it as activated in metadata store.
+// Caller must hold the device lock.
+func (p *PoolDevice) activateDevice(ctx context.Context, deviceName string) error {
+	info, err := p.metadata.GetDevice(ctx, deviceName)
+	if err != nil {
+		return err
+	}
+
+	if info.State == Faulty {
+		return errors.Errorf("device %q is faulty, it can only be deleted", deviceName)
+	}
+
+	if info.DeletePending {
+		return errors.Wrapf(ErrDeletePending, "device %q can't be activated", deviceName)
+	}
+
+	var opts []dmsetup.ActivateDeviceOpt
+	if info.IsReadOnly {
+		opts = append(opts, dmsetup.ActivateReadOnly)
+	}
+
+	if err := p.setDeviceState(ctx, deviceName, Activating); err != nil {
+		return err
+	}
+
+	// Run dmsetup outside of metadata transaction, so activations of independent devices can run in parallel
+	if err := p.activateWithRetries(ctx, info, opts...); err != nil {
+		if stateErr := p.setDeviceState(ctx, deviceName, Created); stateErr != nil {
+			return multierror.Append(err, stateErr)
+		}
+
+		return err
+	}
+
+	// Device is deactivated if it can't be opened through jail node or recorded as activated
+	err = p.createJailNode(ctx, deviceName)
+	if err == nil {
+		err = p.metadata.UpdateDevice(ctx, deviceName, func(info *DeviceInfo) error {
+			info.IsActivated = true
+			info.ActivatedAt = time.Now().UTC()
+			info.State = Activated
+			return nil
+		})
+
+		if err != nil {
+			p.removeJailNode(ctx, deviceName)
+		}
+	}
+
+	if err != nil {
+		if removeErr := p.dm.RemoveDevice(ctx, deviceName, dmsetup.RemoveWithForce); removeErr != nil {
+			return multierror.Append(err, errors.Wrapf(removeErr, "failed to deactivate device %q", deviceName))
+		}
+
+		if stateErr := p.setDeviceState(ctx, deviceName, Created); stateErr != nil {
+			return multierror.Append(err, stateErr)
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// setDeviceState saves state of the device, transitional state is saved before device-mapper call,
+// so the call interrupted by a crash is reconciled on restart
+func (p *PoolDevice) setDeviceState(ctx context.Context, deviceName string, state DeviceState) error {
+	err := p.metadata.UpdateDevice(ctx, deviceName, func(info *DeviceInfo) error {
+		info.State = state
+		return nil
+	})
+
+	if err != nil {
+		return errors.Wrapf(err, "failed to mark device %q as %s", deviceName, state)
+	}
+
+	return nil
+}
+
+// RemoveDevice deactivates the device (removes its device-mapper node), the device and its data are kept in
+// thin-pool, so it can be activated again with ReactivateDevice or deleted with DeleteDevice.
+// It's a no-op if device is not activated.
+func (p *PoolDevice) RemoveDevice(ctx context.Context, deviceName string, deferred bool) error {
+	p.offlineMutex.RLock()
+	defer p.offlineMutex.RUnlock()
+
+	return p.lockAndRemoveDevice(ctx, deviceName, deferred)
+}
+
+// lockAndRemoveDevice is RemoveDevice for callers already holding offlineMutex
+func (p *PoolDevice) lockAndRemoveDevice(ctx context.Context, deviceName string, deferred bool) (retErr error) {
+	ctx, finish := p.startOperation(ctx, operationRemove, deviceName)
+	defer func() {
+		finish(ctx, retErr)
+	}()
+
+	defer func() {
+		p.metrics.observeOperation(operationRemove, retErr)
+	}()
+
+	unlock := p.deviceLocks.lock(deviceName)
+	defer unlock()
+
+	ctx = p.withDeviceIDOf(ctx, deviceName)
+
+	return p.removeDevice(ctx, deviceName, deferred)
+}
+
+// removeDevice deactivates the device, caller must hold the device lock
+func (p *PoolDevice) removeDevice(ctx context.Context, deviceName string, deferred bool) error {
+	opts := []dmsetup.RemoveDeviceOpt{dmsetup.RemoveWithForce}
+	if deferred && !p.noDeferredRemoval {
+		opts = append(opts, dmsetup.RemoveDeferred)
+	}
+
+	// Make sure device is known before calling dmsetup
+	info, err := p.metadata.GetDevice(ctx, deviceName)
+	if err != nil {
+		return err
+	}
+
+	if !info.IsActivated {
+		log.G(ctx).Debugf("device %q is not activated", deviceName)
+		return nil
+	}
+
+	if err := p.setDeviceState(ctx, deviceName, Deactivating); err != nil {
+		return err
+	}
+
+	// Run dmsetup outside of metadata transaction, so removals of independent devices can run in parallel
+	if err := p.removeWithRetries(ctx, deviceName, opts...); err != nil {
+		if stateErr := p.setDeviceState(ctx, deviceName, info.State); stateErr != nil {
+			return multierror.Append(err, stateErr)
+		}
+
+		return err
+	}
+
+	p.removeJailNode(ctx, deviceName)
+
+	return p.metadata.UpdateDevice(ctx, deviceName, func(info *DeviceInfo) error {
+		info.IsActivated = false
+		if info.State != Faulty {
+			info.State = Created
+		}
+
+		return nil
+	})
+}
+
+// DeleteDevice deactivates the device (if activated) and deletes it from the thin-pool, releasing its device ID
+func (p *PoolDevice) DeleteDevice(ctx context.Context, deviceName string) (retErr error) {
+	ctx, finish := p.startOperation(ctx, operationDelete, deviceName)
+	defer func() {
+		finish(ctx, retErr)
+	}()
+
+	// Deferred first, so the hook runs after locks are released
+	var deleted *DeviceInfo
+	defer func() {
+		if deleted != nil {
+			p.hooks.OnDeviceRemoved.call(ctx, deleted)
+		}
+	}()
+
+	defer func() {
+		p.metrics.observeOperation(operationDelete, retErr)
+	}()
+
+	p.offlineMutex.RLock()
+	defer p.offlineMutex.RUnlock()
+
+	unlock := p.deviceLocks.lock(deviceName)
+	defer unlock()
+
+	info, err := p.deleteDevice(ctx, deviceName)
+	if err != nil {
+		return err
+	}
+
+	ctx = withDeviceID(ctx, info.DeviceID)
+	deleted = info
+	return nil
+}
+
+// deleteDevice deactivates and deletes the device and returns its info,
+// caller must hold the device lock or exclusive offline lock
+func (p *PoolDevice) deleteDevice(ctx context.Context, deviceName string) (*DeviceInfo, error) {
+	info, err := p.metadata.GetDevice(ctx, deviceName)
+	if err != nil {
+		return nil, err
+	}
+
+	children, err := p.metadata.GetChildren(ctx, deviceName)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to query snapshots of device %q", deviceName)
+	}
+
+	for _, child := range children {
+		// Thin-pool keeps blocks shared with snapshots, so this is safe for their data,
+		// but callers tracking lineage may not expect the parent to go first
+		log.G(ctx).Warnf("deleting device %q which has snapshot %q, it will become a snapshot of %q",
+			deviceName, child.Name, info.ParentName)
+	}
+
+	if info.IsActivated {
+		if p.discardOnDelete {
+			p.discardDevice(ctx, info)
+		}
+
+		if err := p.removeDevice(ctx, deviceName, false); err != nil {
+			return nil, errors.Wrapf(err, "failed to deactivate device %q", deviceName)
+		}
+	}
+
+	// Faulty device may not have been created in the pool, background deletion may have been interrupted by a crash
+	mayBeMissing := info.State == Faulty || info.DeletePending
+	err = p.metadata.RemoveDevice(ctx, deviceName, func(info *DeviceInfo) error {
+		return p.deleteThinDevice(ctx, info, mayBeMissing)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return info, nil
+}
+
+// deleteThinDevice deletes thin device from the pool. Device which may not have been created or may be deleted
+// already (like faulty one or one which deletion was interrupted) is considered deleted if the pool doesn't have it.
+func (p *PoolDevice) deleteThinDevice(ctx context.Context, info *DeviceInfo, mayBeMissing bool) error {
+	err := p.dm.DeleteDevice(p.poolName, info.DeviceID)
+	if mayBeMissing && errors.Cause(err) == unix.ENODATA {
+		log.G(ctx).Debugf("device %q with id %d is not in the pool", info.Name, info.DeviceID)
+		return nil
+	}
+
+	return err
+}
+
+// discardDevice discards all blocks of activated device, failure is logged as discard is best-effort
+func (p *PoolDevice) discardDevice(ctx context.Context, info *DeviceInfo) {
+	if info.IsReadOnly {
+		return
+	}
+
+	start := time.Now()
+	if err := dmsetup.DiscardBlocks(dmsetup.GetFullDevicePath(info.Name)); err != nil {
+		log.G(ctx).WithError(err).Warnf("failed to discard blocks of device %q", info.Name)
+		return
+	}
+
+	log.G(ctx).Debugf("discarded %d bytes of device %q in %s", info.Size, info.Name, time.Since(start))
+	p.metrics.observeDiscard(info.Size)
+}
+
+// RemoveDevices removes a list of devices.
+// Snapshots are removed before their parents, independent devices are removed concurrently
+// (up to maxRemoveConcurrency at a time). Errors are aggregated and returned as multierror.
+// Once ctx is done, devices not removed yet are listed in the error with ctx error.
+func (p *PoolDevice) RemoveDevices(ctx context.Context, deviceNames []string, deferred bool) error {
+	return p.removeDevices(ctx, deviceNames, deferred, p.RemoveDevice)
+}
+
+// removeDevices removes devices in removal order, calling remove for each of them
+func (p *PoolDevice) removeDevices(
+	ctx context.Context,
+	deviceNames []string,
+	deferred bool,
+	remove func(ctx context.Context, deviceName string, deferred bool) error,
+) error {
+	var (
+		result *multierror.Error
+		infos  []*DeviceInfo
+	)
+
+	for _, name := range deviceNames {
+		info, err := p.metadata.GetDevice(ctx, name)
+		if err != nil {
+			result = multierror.Append(result, errors.Wrapf(err, "failed to get device info %q", name))
+			continue
+		}
+
+		infos = append(infos, info)
+	}
+
+	var (
+		mutex sync.Mutex
+		sem   = make(chan struct{}, maxRemoveConcurrency)
+	)
+
+	batches := removalOrder(infos)
+	for i, batch := range batches {
+		if err := ctx.Err(); err != nil {
+			for _, remaining := range batches[i:] {
+				for _, name := range remaining {
+					result = multierror.Append(result, errors.Wrapf(err, "failed to remove %q", name))
+				}
+			}
+
+			break
+		}
+
+		var wg sync.WaitGroup
+
+		for _, name := range batch {
+			wg.Add(1)
+			sem <- struct{}{}
+
+			go func(name string) {
+				defer func() {
+					<-sem
+					wg.Done()
+				}()
+
+				if err := remove(ctx, name, deferred); err != nil {
+					mutex.Lock()
+					result = multierror.Append(result, errors.Wrapf(err, "failed to remove %q", name))
+					mutex.Unlock()
+				}
+			}(name)
+		}
+
+		// Wait for all children to be removed before proceeding to their parents
+		wg.Wait()
+	}
+
+	return result.ErrorOrNil()
+}
+
+// removalOrder splits devices into batches, so each device goes after all of its snapshots.
+// Devices within one batch don't depend on each other and can be removed in parallel.
+func removalOrder(infos []*DeviceInfo) [][]string {
+	parents := make(map[string]string, len(infos))
+	children := make(map[string]int, len(infos))
+
+	for _, info := range infos {
+		parents[info.Name] = info.ParentName
+	}
+
+	for _, info := range infos {
+		if _, ok := parents[info.ParentName]; ok {
+			children[info.ParentName]++
+		}
+	}
+
+	var (
+		batches [][]string
+		pending = infos
+	)
+
+	for len(pending) > 0 {
+		var (
+			batch []string
+			next  []*DeviceInfo
+		)
+
+		for _, info := range pending {
+			if children[info.Name] == 0 {
+				batch = append(batch, info.Name)
+			} else {
+				next = append(next, info)
+			}
+		}
+
+		// Might happen only if there is a loop in parent names, so just remove the rest in one batch
+		if len(batch) == 0 {
+			for _, info := range next {
+				batch = append(batch, info.Name)
+			}
+
+			next = nil
+		}
+
+		for _, name := range batch {
+			children[parents[name]]--
+		}
+
+		batches = append(batches, batch)
+		pending = next
+	}
+
+	return batches
+}
+
+// CleanupOrphans deletes devices of the pool which names aren't in knownNames, like devices left behind
+// by a crash. Active thin devices of the pool missing from metadata are loaded first (see LoadExisting),
+// so they're deleted as well. Every other pool operation waits while cleanup runs.
+// All devices not listed are deleted, so knownNames must be complete. Returns names of deleted devices.
+func (p *PoolDevice) CleanupOrphans(ctx context.Context, knownNames []string) (_ []string, retErr error) {
+	ctx, finish := p.startOperation(ctx, operationCleanup, "")
+	defer func() {
+		finish(ctx, retErr)
+	}()
+
+	// Deferred first, so hooks run after the pool is unlocked
+	var deleted []*DeviceInfo
+	defer func() {
+		for _, info := range deleted {
+			p.hooks.OnDeviceRemoved.call(ctx, info)
+		}
+	}()
+
+	p.offlineMutex.Lock()
+	defer p.offlineMutex.Unlock()
+
+	if _, err := p.loadExisting(ctx); err != nil {
+		return nil, errors.Wrap(err, "failed to load devices missing from metadata")
+	}
+
+	known := make(map[string]struct{}, len(knownNames))
+	for _, name := range knownNames {
+		known[name] = struct{}{}
+	}
+
+	names, err := p.metadata.GetDeviceNames(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list devices")
+	}
+
+	var orphans []*DeviceInfo
+	for _, name := range names {
+		if _, ok := known[name]; ok {
+			continue
+		}
+
+		info, err := p.metadata.GetDevice(ctx, name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to query device %q", name)
+		}
+
+		orphans = append(orphans, info)
+	}
+
+	var (
+		result  *multierror.Error
+		removed []string
+	)
+
+	// Like in RemoveDevices, snapshots go before their parents
+	for _, batch := range removalOrder(orphans) {
+		for _, name := range batch {
+			if err := ctx.Err(); err != nil {
+				return removed, multierror.Append(result, err).ErrorOrNil()
+			}
+
+			deleteCtx, finishDelete := p.startOperation(ctx, operationDelete, name)
+			info, err := p.deleteDevice(deleteCtx, name)
+			p.metrics.observeOperation(operationDelete, err)
+
+			if err != nil {
+				finishDelete(deleteCtx, err)
+				result = multierror.Append(result, errors.Wrapf(err, "failed to delete orphan device %q", name))
+				continue
+			}
+
+			deleteCtx = withDeviceID(deleteCtx, info.DeviceID)
+			finishDelete(deleteCtx, nil)
+
+			log.G(deleteCtx).Infof("deleted orphan device %q", name)
+			removed = append(removed, name)
+			deleted = append(deleted, info)
+		}
+	}
+
+	return removed, result.ErrorOrNil()
+}
+
+// RenameDevice changes the name of the given device, if device is activated, its /dev/mapper node will be renamed as well.
+// Snapshots of this device will refer to the new name as parent. Node is renamed within metadata transaction
+// while both names are locked, so the rename is never seen half done. Returns ErrAlreadyExists if the new name
+// is taken by an existing device or by a device being created.
+func (p *PoolDevice) RenameDevice(ctx context.Context, oldName, newName string) (retErr error) {
+	ctx, finish := p.startOperation(ctx, operationRename, oldName)
+	defer func() {
+		finish(ctx, retErr)
+	}()
+
+	p.offlineMutex.RLock()
+	defer p.offlineMutex.RUnlock()
+
+	// Claim the new name, so it can't be taken by a device being created
+	release, err := p.reserveName(ctx, newName)
+	if err != nil {
+		return err
+	}
+
+	defer release()
+
+	unlock := p.deviceLocks.lock(oldName, newName)
+	defer unlock()
+
+	ctx = p.withDeviceIDOf(ctx, oldName)
+
+	return p.metadata.RenameDevice(ctx, oldName, newName, func(info *DeviceInfo) error {
+		if !info.IsActivated {
+			return nil
+		}
+
+		if err := p.dm.RenameDevice(oldName, newName); err != nil {
+			return errors.Wrapf(err, "failed to rename device %q to %q", oldName, newName)
+		}
+
+		if err := p.renameJailNode(oldName, newName); err != nil {
+			if rollbackErr := p.dm.RenameDevice(newName, oldName); rollbackErr != nil {
+				return multierror.Append(err, errors.Wrapf(rollbackErr, "failed to rename device %q back", newName))
+			}
+
+			return err
+		}
+
+		return nil
+	})
+}
+
+// ResizeDevice grows virtual size of the given device, new size is rounded up to whole data blocks. If device is
+// activated, its table is reloaded with the new size (suspend, load new table, resume), filesystem on it needs to be
+// grown separately.
+func (p *PoolDevice) ResizeDevice(ctx context.Context, deviceName string, newSizeBytes uint64) (retErr error) {
+	ctx, finish := p.startOperation(ctx, operationResize, deviceName)
+	defer func() {
+		finish(ctx, retErr)
+	}()
+
+	p.offlineMutex.RLock()
+	defer p.offlineMutex.RUnlock()
+
+	unlock := p.deviceLocks.lock(deviceName)
+	defer unlock()
+
+	p.provisionMutex.Lock()
+	defer p.provisionMutex.Unlock()
+
+	info, err := p.metadata.GetDevice(ctx, deviceName)
+	if err != nil {
+		return err
+	}
+
+	ctx = withDeviceID(ctx, info.DeviceID)
+
+	sizeBytes := roundUpToBlocks(newSizeBytes, p.dataBlockSizeSectors)
+	if sizeBytes != newSizeBytes {
+		log.G(ctx).WithField("device", deviceName).Debugf("rounded device size of %d bytes up to %d bytes", newSizeBytes, sizeBytes)
+		newSizeBytes = sizeBytes
+	}
+
+	if newSizeBytes < info.Size {
+		return errors.Wrapf(ErrShrinkNotSupported, "can't resize device %q from %d to %d bytes", deviceName, info.Size, newSizeBytes)
+	}
+
+	if newSizeBytes == info.Size {
+		return nil
+	}
+
+	if p.maxVirtualSizeBytes > 0 {
+		_, provisioningBytes := p.provisioning()
+
+		total, err := p.metadata.GetTotalVirtualSize(ctx)
+		if err != nil {
+			return errors.Wrap(err, "failed to query provisioned size")
+		}
+
+		total += provisioningBytes
+		if total-info.Size+newSizeBytes > p.maxVirtualSizeBytes {
+			log.G(ctx).WithField("device", deviceName).Errorf("can't grow to %d bytes: %d of %d bytes already provisioned",
+				newSizeBytes, total, p.maxVirtualSizeBytes)
+			return ErrOverProvisioned
+		}
+	}
+
+	// Table is reloaded in metadata transaction, so failed reload leaves the old size in metadata
+	reloaded := false
+	err = p.metadata.UpdateDevice(ctx, deviceName, func(info *DeviceInfo) error {
+		oldSizeBytes := info.Size
+		info.Size = newSizeBytes
+		if !info.IsActivated {
+			return nil
+		}
+
+		if err := p.reloadDeviceSize(ctx, info, oldSizeBytes, newSizeBytes); err != nil {
+			return err
+		}
+
+		reloaded = true
+		return nil
+	})
+
+	if err != nil && reloaded {
+		// Metadata wasn't saved, get device-mapper back to the old size, filesystem isn't grown yet
+		if rollbackErr := p.reloadDeviceSize(ctx, info, newSizeBytes, info.Size); rollbackErr != nil {
+			return multierror.Append(err, errors.Wrapf(rollbackErr, "failed to restore size of device %q", deviceName))
+		}
+	}
+
+	return err
+}
+
+// reloadDeviceSize reloads table of activated device with the new size (load, suspend, resume). If any step fails,
+// the device is resumed with table of the old size, so it's never left suspended or with half-loaded table.
+func (p *PoolDevice) reloadDeviceSize(ctx context.Context, info *DeviceInfo, oldSizeBytes, newSizeBytes uint64) error {
+	var opts []dmsetup.ActivateDeviceOpt
+	if info.IsReadOnly {
+		opts = append(opts, dmsetup.ActivateReadOnly)
+	}
+
+	if err := p.dm.ReloadDevice(p.poolName, info.Name, info.DeviceID, newSizeBytes, info.ExternalOrigin, opts...); err != nil {
+		return errors.Wrapf(err, "failed to load new table for device %q", info.Name)
+	}
+
+	if err := p.dm.SuspendDevice(info.Name); err != nil {
+		if clearErr := p.dm.ClearTable(info.Name); clearErr != nil {
+			log.G(ctx).WithError(clearErr).Errorf("failed to clear inactive table of device %q", info.Name)
+		}
+
+		return errors.Wrapf(err, "failed to suspend device %q", info.Name)
+	}
+
+	if err := p.dm.ResumeDevice(info.Name); err != nil {
+		err = errors.Wrapf(err, "failed to resume device %q", info.Name)
+
+		// Whether or not the new table went live, load the old one again and retry resume
+		if reloadErr := p.dm.ReloadDevice(p.poolName, info.Name, info.DeviceID, oldSizeBytes, info.ExternalOrigin, opts...); reloadErr != nil {
+			log.G(ctx).WithError(reloadErr).Errorf("failed to load old table for device %q", info.Name)
+		}
+
+		if resumeErr := p.dm.ResumeDevice(info.Name); resumeErr != nil {
+			return multierror.Append(err, errors.Wrapf(resumeErr, "device %q is left suspended", info.Name))
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// WaitPoolEvent blocks until device-mapper raises an event for the thin-pool (for instance when
+// free space drops below low water mark or pool changes its mode) and returns updated pool status.
+func (p *PoolDevice) WaitPoolEvent(ctx context.Context) (*dmsetup.PoolStatus, error) {
+	eventNumber, err := p.poolEventNumber()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		if err := p.dm.WaitEvent(ctx, p.poolName, eventNumber); err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+
+			return nil, errors.Wrapf(err, "failed to wait for events on pool %q", p.poolName)
+		}
+
+		// Re-read event number to filter out spurious wakeups
+		current, err := p.poolEventNumber()
+		if err != nil {
+			return nil, err
+		}
+
+		if current == eventNumber {
+			continue
+		}
+
+		return p.dm.GetPoolStatus(p.poolName)
+	}
+}
+
+// PoolStatus represents thin-pool status along with its data block size
+type PoolStatus struct {
+	dmsetup.PoolStatus
+	DataBlockSizeSectors uint32
+}
+
+// PoolDeviceStats represents device counts and remaining capacity of the pool
+type PoolDeviceStats struct {
+	// Devices is the number of thin devices and snapshots in the pool
+	Devices int
+	// ActiveDevices and InactiveDevices split Devices by activation state
+	ActiveDevices   int
+	InactiveDevices int
+	// MaxDevices is the configured device limit, zero if unlimited
+	MaxDevices int
+	// AvailableDeviceIDs is the number of device IDs left to allocate, including IDs released by deleted devices
+	AvailableDeviceIDs int
+	// RemainingDevices is how many more devices can be created before hitting MaxDevices or running out of IDs
+	RemainingDevices int
+}
+
+// DeviceSummary describes a device of the pool, for instance to find snapshots which outlived their TTL
+type DeviceSummary struct {
+	Name        string
+	DeviceID    uint32
+	ParentName  string
+	Size        uint64
+	IsActivated bool
+	// State is the state of device in its lifecycle, Faulty devices should be deleted
+	State DeviceState
+	// DeletePending is set for devices waiting for background deletion
+	DeletePending bool
+	// CreatedAt and ActivatedAt are in UTC, zero if not known (see DeviceInfo)
+	CreatedAt   time.Time
+	ActivatedAt time.Time
+	// Age is the time since device was created, zero if creation time is not known
+	Age time.Duration
+}
+
+// ListDevices returns summaries of all devices in metadata store sorted by name.
+// Devices are read from metadata store without device-mapper calls.
+func (p *PoolDevice) ListDevices(ctx context.Context) ([]DeviceSummary, error) {
+	infos, err := p.metadata.GetDevices(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list devices")
+	}
+
+	now := time.Now()
+
+	summaries := make([]DeviceSummary, len(infos))
+	for i, info := range infos {
+		summaries[i] = DeviceSummary{
+			Name:          info.Name,
+			DeviceID:      info.DeviceID,
+			ParentName:    info.ParentName,
+			Size:          info.Size,
+			IsActivated:   info.IsActivated,
+			State:         info.State,
+			DeletePending: info.DeletePending,
+			CreatedAt:     info.CreatedAt,
+			ActivatedAt:   info.ActivatedAt,
+		}
+
+		if !info.CreatedAt.IsZero() {
+			summaries[i].Age = now.Sub(info.CreatedAt)
+		}
+	}
+
+	return summaries, nil
+}
+
+// Stats returns device counts and remaining capacity of the pool, so schedulers can apply backpressure
+// before creates start failing. Counts are read from metadata store without device-mapper calls.
+func (p *PoolDevice) Stats(ctx context.Context) (*PoolDeviceStats, error) {
+	stats, err := p.metadata.GetDeviceStats(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to query device stats")
+	}
+
+	// Device IDs start from 1
+	available := maxDeviceID - 1 - stats.TakenDeviceIDs
+	if available < 0 {
+		available = 0
+	}
+
+	remaining := available
+	if p.maxDevices > 0 && p.maxDevices-stats.Devices < remaining {
+		remaining = p.maxDevices - stats.Devices
+		if remaining < 0 {
+			remaining = 0
+		}
+	}
+
+	return &PoolDeviceStats{
+		Devices:            stats.Devices,
+		ActiveDevices:      stats.ActivatedDevices,
+		InactiveDevices:    stats.Devices - stats.ActivatedDevices,
+		MaxDevices:         p.maxDevices,
+		AvailableDeviceIDs: available,
+		RemainingDevices:   remaining,
+	}, nil
+}
+
+// DataUsage returns used data space in percents
+func (s *PoolStatus) DataUsage() float64 {
+	return usagePercent(s.UsedDataBlocks, s.TotalDataBlocks)
+}
+
+// MetadataUsage returns used metadata space in percents
+func (s *PoolStatus) MetadataUsage() float64 {
+	return usagePercent(s.UsedMetadataBlocks, s.TotalMetadataBlocks)
+}
+
+// UsedDataBytes returns data space allocated to thin devices in bytes
+func (s *PoolStatus) UsedDataBytes() uint64 {
+	return s.UsedDataBlocks * uint64(s.DataBlockSizeSectors) * dmsetup.SectorSize
+}
+
+func usagePercent(used, total uint64) float64 {
+	if total == 0 {
+		return 0
+	}
+
+	return float64(used) * 100 / float64(total)
+}
+
+// GetPoolStatus returns used and total data and metadata blocks of the pool (see "dmsetup status").
+// Logs a warning and calls low space callback once usage crosses threshold set with WithLowSpaceWarning.
+// If auto extension is enabled with WithAutoExtend and the pool needs more data space, it's extended first.
+func (p *PoolDevice) GetPoolStatus(ctx context.Context) (*PoolStatus, error) {
+	status, err := p.queryPoolStatus()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.needsExtend(status) {
+		if err := p.extendPool(ctx); err != nil {
+			return nil, err
+		}
+
+		status, err = p.queryPoolStatus()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	p.checkLowSpace(ctx, status)
+	return status, nil
+}
+
+func (p *PoolDevice) queryPoolStatus() (*PoolStatus, error) {
+	status, err := p.dm.GetPoolStatus(p.poolName)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to query status of pool %q", p.poolName)
+	}
+
+	return &PoolStatus{
+		PoolStatus:           *status,
+		DataBlockSizeSectors: p.dataBlockSizeSectors,
+	}, nil
+}
+
+// needsExtend tells whether the pool should be extended, which is the case when data usage reached
+// extension threshold or the pool is out of data space already
+func (p *PoolDevice) needsExtend(status *PoolStatus) bool {
+	if p.extendFunc == nil || status.Fail {
+		return false
+	}
+
+	return status.Mode == dmsetup.PoolModeOutOfDataSpace || status.DataUsage() >= p.extendThreshold
+}
+
+// extendPool grows data volume with extendFunc and reloads the pool to pick up the new size.
+// No devices are created while pool is extended.
+func (p *PoolDevice) extendPool(ctx context.Context) error {
+	p.offlineMutex.RLock()
+	defer p.offlineMutex.RUnlock()
+
+	p.provisionMutex.Lock()
+	defer p.provisionMutex.Unlock()
+
+	p.metadataSnapMutex.Lock()
+	defer p.metadataSnapMutex.Unlock()
+
+	// Pool might have been extended by concurrent call while waiting for the locks
+	status, err := p.queryPoolStatus()
+	if err != nil {
+		return err
+	}
+
+	if !p.needsExtend(status) {
+		return nil
+	}
+
+	log.G(ctx).Infof("extending pool %q: %d of %d data blocks used, mode %s",
+		p.poolName, status.UsedDataBlocks, status.TotalDataBlocks, status.Mode)
+
+	dataDevice, err := p.extendFunc(ctx, status.TotalDataBlocks)
+	if err != nil {
+		return errors.Wrapf(err, "failed to extend data device of pool %q", p.poolName)
+	}
+
+	if err := p.reloadPoolTable(ctx, dataDevice, p.metadataDevice, true); err != nil {
+		return err
+	}
+
+	maxVirtualSizeBytes, err := maxVirtualSize(dataDevice, p.overProvisioningRatio)
+	if err != nil {
+		return err
+	}
+
+	p.maxVirtualSizeBytes = maxVirtualSizeBytes
+	return nil
+}
+
+func (p *PoolDevice) checkLowSpace(ctx context.Context, status *PoolStatus) {
+	threshold, callback := p.lowSpaceWarning()
+
+	// Usage isn't reported for failed pool
+	if threshold == 0 || status.Fail {
+		return
+	}
+
+	dataUsage, metadataUsage := status.DataUsage(), status.MetadataUsage()
+	isLow := dataUsage >= threshold || metadataUsage >= threshold
+
+	if !p.setLowSpace(isLow) {
+		return
+	}
+
+	logger := log.G(ctx).WithField("pool", p.poolName)
+	if !isLow {
+		logger.Infof("pool space usage dropped below %g%%: data %.1f%%, metadata %.1f%%",
+			threshold, dataUsage, metadataUsage)
+		return
+	}
+
+	logger.Warnf("pool is running out of space: data %.1f%% (%d of %d blocks), metadata %.1f%% (%d of %d blocks) used",
+		dataUsage, status.UsedDataBlocks, status.TotalDataBlocks,
+		metadataUsage, status.UsedMetadataBlocks, status.TotalMetadataBlocks)
+
+	if callback != nil {
+		callback(ctx, status)
+	}
+}
+
+func (p *PoolDevice) lowSpaceWarning() (float64, LowSpaceCallback) {
+	p.lowSpaceMutex.Lock()
+	defer p.lowSpaceMutex.Unlock()
+
+	return p.lowSpaceThreshold, p.lowSpaceCallback
+}
+
+// setLowSpaceWarning replaces low space threshold and callback, zero threshold disables the warning.
+// Usage is compared with the new threshold on the next status query, so low space is reported again if reached.
+func (p *PoolDevice) setLowSpaceWarning(ctx context.Context, threshold float64, callback LowSpaceCallback) {
+	p.lowSpaceMutex.Lock()
+	defer p.lowSpaceMutex.Unlock()
+
+	p.lowSpaceThreshold = threshold
+	p.lowSpaceCallback = callback
+	p.lowSpace = false
+	log.G(ctx).Infof("warning about low space of pool %q at %g%% usage (zero is disabled)", p.poolName, threshold)
+}
+
+// setLowSpace tells whether low space state changed, callback is run without the lock held,
+// so it may query pool status again
+func (p *PoolDevice) setLowSpace(isLow bool) bool {
+	p.lowSpaceMutex.Lock()
+	defer p.lowSpaceMutex.Unlock()
+
+	if isLow == p.lowSpace {
+		return false
+	}
+
+	p.lowSpace = isLow
+	return true
+}
+
+func (p *PoolDevice) poolEventNumber() (uint32, error) {
+	infos, err := p.dm.Info(p.poolName)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to query pool info %q", p.poolName)
+	}
+
+	if len(infos) != 1 {
+		return 0, errors.Errorf("unexpected number of pool infos %d", len(infos))
+	}
+
+	return infos[0].EventNumber, nil
+}
+
+// DeviceDiff describes blocks which differ between two thin devices
+type DeviceDiff struct {
+	// BlockSizeBytes is the size of a single block in ranges
+	BlockSizeBytes uint64
+	// Ranges are sorted, non-overlapping block ranges with different contents
+	Ranges []dmsetup.BlockRange
+}
+
+// DiffDevices finds data blocks which differ between two snapshots.
+// Both devices must descend from the same origin device, otherwise comparison makes no sense.
+func (p *PoolDevice) DiffDevices(ctx context.Context, baseName, targetName string) (*DeviceDiff, error) {
+	p.offlineMutex.RLock()
+	defer p.offlineMutex.RUnlock()
+
+	baseInfo, err := p.metadata.GetDevice(ctx, baseName)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to query device metadata for %q", baseName)
+	}
+
+	targetInfo, err := p.metadata.GetDevice(ctx, targetName)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to query device metadata for %q", targetName)
+	}
+
+	baseOrigin, err := p.originName(ctx, baseInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	targetOrigin, err := p.originName(ctx, targetInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	if baseOrigin != targetOrigin {
+		return nil, errors.Errorf("devices %q and %q have different origins (%q and %q)", baseName, targetName, baseOrigin, targetOrigin)
+	}
+
+	var delta *dmsetup.ThinDeltaResult
+	err = p.withMetadataSnapshot(ctx, func() error {
+		delta, err = dmsetup.ThinDelta(p.metadataDevice, baseInfo.DeviceID, targetInfo.DeviceID)
+		return err
+	})
+
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to diff devices %q and %q", baseName, targetName)
+	}
+
+	return &DeviceDiff{
+		BlockSizeBytes: uint64(delta.DataBlockSizeSectors) * dmsetup.SectorSize,
+		Ranges:         delta.Ranges,
+	}, nil
+}
+
+// GetUsage returns the size of pool data space exclusively owned by the device: blocks
+// it mapped or overwrote since it was snapshotted from its parent, or all mapped blocks if it has no parent.
+// Blocks shared with the parent aren't counted, so usage of a fresh snapshot is zero.
+// This reserves a metadata snapshot of the pool and reads mappings of the device with thin_delta or thin_dump,
+// taking time proportional to the device size, so it shouldn't be called on a hot path.
+// Writes not yet committed to pool metadata (the kernel commits about every second) aren't counted.
+func (p *PoolDevice) GetUsage(ctx context.Context, deviceName string) (uint64, error) {
+	p.offlineMutex.RLock()
+	defer p.offlineMutex.RUnlock()
+
+	info, err := p.metadata.GetDevice(ctx, deviceName)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to query device %q", deviceName)
+	}
+
+	var parent *DeviceInfo
+	if info.ParentName != "" {
+		parent, err = p.metadata.GetDevice(ctx, info.ParentName)
+		if err != nil {
+			return 0, errors.Wrapf(err, "failed to query parent %q of device %q", info.ParentName, deviceName)
+		}
+	}
+
+	var (
+		blocks           uint64
+		blockSizeSectors uint32
+	)
+
+	err = p.withMetadataSnapshot(ctx, func() error {
+		if parent == nil {
+			mapping, err := dmsetup.ThinDump(p.metadataDevice, info.DeviceID)
+			if err != nil {
+				return err
+			}
+
+			blocks, blockSizeSectors = mapping.MappedBlocks, mapping.DataBlockSizeSectors
+			return nil
+		}
+
+		delta, err := dmsetup.ThinDelta(p.metadataDevice, parent.DeviceID, info.DeviceID)
+		if err != nil {
+			return err
+		}
+
+		// Blocks mapped by the parent only don't take space of the device
+		for _, r := range delta.Ranges {
+			blocks += r.Length
+		}
+
+		blocks -= delta.LeftOnlyBlocks
+		blockSizeSectors = delta.DataBlockSizeSectors
+		return nil
+	})
+
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to get usage of device %q", deviceName)
+	}
+
+	return blocks * uint64(blockSizeSectors) * dmsetup.SectorSize, nil
+}
+
+// WithMetadataSnapshot reserves metadata snapshot of the pool ("reserve_metadata_snap"), calls fn and releases
+// the snapshot once fn returns, fails or panics. While fn runs, metadata can be read consistently from the metadata
+// device with the snapshot, like "thin_dump --metadata-snap", for backups. Thin-pool has a single metadata snapshot,
+// so calls are serialized with each other, GetUsage, DiffDevices and pool reloads, and fn must not call them.
+// Repair and compaction, which take the pool offline, wait for fn to return.
+func (p *PoolDevice) WithMetadataSnapshot(ctx context.Context, fn func(ctx context.Context) error) error {
+	p.offlineMutex.RLock()
+	defer p.offlineMutex.RUnlock()
+
+	return p.withMetadataSnapshot(ctx, func() error {
+		return fn(ctx)
+	})
+}
+
+// withMetadataSnapshot reserves metadata snapshot of the pool for userspace thin tools run by fn.
+// The pool has a single metadata snapshot, so callers are serialized.
+func (p *PoolDevice) withMetadataSnapshot(ctx context.Context, fn func() error) error {
+	p.metadataSnapMutex.Lock()
+	defer p.metadataSnapMutex.Unlock()
+
+	if err := p.dm.ReserveMetadataSnapshot(p.poolName); err != nil {
+		return errors.Wrapf(err, "failed to reserve metadata snapshot of pool %q", p.poolName)
+	}
+
+	defer func() {
+		if err := p.dm.ReleaseMetadataSnapshot(p.poolName); err != nil {
+			log.G(ctx).WithError(err).Errorf("failed to release metadata snapshot of pool %q", p.poolName)
+		}
+	}()
+
+	return fn()
+}
+
+// syncDeviceIDs marks IDs of thin devices found in pool metadata as taken, so IDs of devices unknown to metadata
+// store aren't allocated again. Requires thin_ls, the pool is used as is if it's missing or fails.
+func (p *PoolDevice) syncDeviceIDs(ctx context.Context) {
+	if _, err := exec.LookPath("thin_ls"); err != nil {
+		log.G(ctx).Debugf("thin_ls not found, device IDs of pool %q are not checked", p.poolName)
+		return
+	}
+
+	var ids []uint32
+	err := p.withMetadataSnapshot(ctx, func() error {
+		var err error
+		ids, err = dmsetup.ThinDeviceIDs(p.metadataDevice)
+		return err
+	})
+
+	if err != nil {
+		log.G(ctx).WithError(err).Warnf("failed to list device IDs of pool %q", p.poolName)
+		return
+	}
+
+	marked, err := p.metadata.MarkDeviceIDsTaken(ctx, ids)
+	if err != nil {
+		log.G(ctx).WithError(err).Warnf("failed to mark device IDs of pool %q as taken", p.poolName)
+		return
+	}
+
+	if marked > 0 {
+		log.G(ctx).Warnf("marked %d device IDs used in pool %q but unknown to metadata store as taken", marked, p.poolName)
+	}
+}
+
+// GetSnapshotChain returns names of the device and its snapshot parents, starting with the device itself
+// and ending with the thin device it originates from
+func (p *PoolDevice) GetSnapshotChain(ctx context.Context, deviceName string) ([]string, error) {
+	info, err := p.metadata.GetDevice(ctx, deviceName)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to query device %q", deviceName)
+	}
+
+	return p.snapshotChain(ctx, info)
 }
 
-// NewPoolDevice creates new thin-pool from existing data and metadata volumes.
-// If pool 'poolName' already exists, it'll be reloaded with new parameters.
-func NewPoolDevice(ctx context.Context, config *Config) (*PoolDevice, error) {
-	log.G(ctx).Infof("initializing pool device %q", config.PoolName)
+// snapshotChain walks up snapshot parents of the device and returns their names
+func (p *PoolDevice) snapshotChain(ctx context.Context, info *DeviceInfo) ([]string, error) {
+	chain := []string{info.Name}
+
+	for info.ParentName != "" {
+		parent, err := p.metadata.GetDevice(ctx, info.ParentName)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to query parent %q of device %q", info.ParentName, info.Name)
+		}
+
+		info = parent
+		chain = append(chain, info.Name)
+	}
+
+	return chain, nil
+}
 
-	version, err := dmsetup.Version()
+// originName walks up snapshot parents and returns the name of the very first device
+func (p *PoolDevice) originName(ctx context.Context, info *DeviceInfo) (string, error) {
+	chain, err := p.snapshotChain(ctx, info)
 	if err != nil {
-		log.G(ctx).Errorf("dmsetup not available")
-		return nil, err
+		return "", err
 	}
 
-	log.G(ctx).Infof("using dmsetup: %s", version)
+	return chain[len(chain)-1], nil
+}
+
+// ExportDiff writes blocks of target device which differ from base device to w.
+// Each changed range is written as big-endian uint64 offset and uint64 length in bytes followed by range data.
+// Target device must be activated.
+func (p *PoolDevice) ExportDiff(ctx context.Context, baseName, targetName string, w io.Writer) error {
+	diff, err := p.DiffDevices(ctx, baseName, targetName)
+	if err != nil {
+		return err
+	}
 
-	dbpath := filepath.Join(config.RootPath, config.PoolName+".db")
-	poolMetaStore, err := NewPoolMetadata(dbpath)
+	file, err := os.Open(dmsetup.GetFullDevicePath(targetName))
 	if err != nil {
-		return nil, err
+		return errors.Wrapf(err, "failed to open device %q", targetName)
 	}
 
-	poolPath := dmsetup.GetFullDevicePath(config.PoolName)
-	if _, err := os.Stat(poolPath); err == nil {
-		log.G(ctx).Debugf("reloading existing pool %q", poolPath)
-		if err := dmsetup.ReloadPool(config.PoolName, config.DataDevice, config.MetadataDevice, config.DataBlockSizeSectors); err != nil {
-			return nil, errors.Wrapf(err, "failed to reload pool %q", config.PoolName)
+	defer file.Close()
+
+	for _, r := range diff.Ranges {
+		if err := ctx.Err(); err != nil {
+			return err
 		}
-	} else {
-		if !os.IsNotExist(err) {
-			return nil, errors.Wrapf(err, "failed to stat for %q", poolPath)
+
+		header := [2]uint64{r.Begin * diff.BlockSizeBytes, r.Length * diff.BlockSizeBytes}
+		if err := binary.Write(w, binary.BigEndian, header); err != nil {
+			return errors.Wrap(err, "failed to write range header")
 		}
 
-		log.G(ctx).Debug("creating new pool device")
-		if err := dmsetup.CreatePool(config.PoolName, config.DataDevice, config.MetadataDevice, config.DataBlockSizeSectors); err != nil {
-			return nil, errors.Wrapf(err, "failed to create thin-pool with name %q", config.PoolName)
+		section := io.NewSectionReader(file, int64(header[0]), int64(header[1]))
+		if _, err := io.CopyN(w, section, int64(header[1])); err != nil {
+			return errors.Wrapf(err, "failed to export range at offset %d of device %q", header[0], targetName)
 		}
 	}
 
-	return &PoolDevice{
-		poolName: config.PoolName,
-		metadata: poolMetaStore,
-	}, nil
+	return nil
 }
 
-func (p *PoolDevice) CreateThinDevice(ctx context.Context, deviceName string, virtualSizeBytes uint64) error {
-	deviceInfo := &DeviceInfo{
-		Name: deviceName,
-		Size: virtualSizeBytes,
+// ReloadPoolTable points existing thin-pool to new paths of its data and metadata devices, for instance after
+// loop devices backing the pool were attached under different names. Thin devices and their mappings are kept,
+// as they're stored in pool metadata. To make sure the new devices are the ones the pool was created on,
+// metadata device must have thin-pool metadata and data device must not be smaller than the pool.
+func (p *PoolDevice) ReloadPoolTable(ctx context.Context, dataDevice, metadataDevice string) (retErr error) {
+	ctx, finish := p.startOperation(ctx, operationReload, "")
+	defer func() {
+		finish(ctx, retErr)
+	}()
+
+	// Pool may be down or have its devices swapped while repaired or compacted
+	p.offlineMutex.RLock()
+	defer p.offlineMutex.RUnlock()
+
+	p.provisionMutex.Lock()
+	defer p.provisionMutex.Unlock()
+
+	// Don't change metadata device under running thin_delta
+	p.metadataSnapMutex.Lock()
+	defer p.metadataSnapMutex.Unlock()
+
+	return p.reloadPoolTable(ctx, dataDevice, metadataDevice, false)
+}
+
+// reloadPoolTable reloads the pool with the given devices, if grow is set data device must be larger than the pool.
+// Caller must hold offlineMutex (at least for reading), provisionMutex and metadataSnapMutex.
+func (p *PoolDevice) reloadPoolTable(ctx context.Context, dataDevice, metadataDevice string, grow bool) error {
+	table, err := p.dm.GetThinPoolTable(p.poolName)
+	if err != nil {
+		return errors.Wrapf(err, "failed to query table of pool %q", p.poolName)
 	}
 
-	// Create thin device and save metadata
-	err := p.metadata.AddDevice(ctx, deviceInfo, func(devID uint32) error {
-		return dmsetup.CreateDevice(p.poolName, devID)
-	})
+	status, err := p.dm.GetPoolStatus(p.poolName)
+	if err != nil {
+		return errors.Wrapf(err, "failed to query status of pool %q", p.poolName)
+	}
+
+	if status.Fail || status.NeedsCheck {
+		return errors.Errorf("pool %q needs repair, refusing to reload it", p.poolName)
+	}
+
+	if status.HeldMetadataRoot != "-" {
+		return errors.Errorf("pool %q has metadata snapshot reserved, refusing to reload it", p.poolName)
+	}
+
+	if err := checkThinPoolMetadata(metadataDevice); err != nil {
+		return err
+	}
+
+	dataSize, err := dmsetup.BlockDeviceSize(dataDevice)
+	if err != nil {
+		return errors.Wrapf(err, "failed to get size of data device %q", dataDevice)
+	}
+
+	if dataSize/dmsetup.SectorSize < table.LengthSectors {
+		return errors.Errorf("data device %q (%d bytes) is smaller than pool %q (%d sectors)",
+			dataDevice, dataSize, p.poolName, table.LengthSectors)
+	}
+
+	if grow && dataSize/dmsetup.SectorSize == table.LengthSectors {
+		return errors.Errorf("data device %q (%d bytes) isn't larger than pool %q", dataDevice, dataSize, p.poolName)
+	}
+
+	log.G(ctx).Infof("reloading pool %q with data device %q and metadata device %q", p.poolName, dataDevice, metadataDevice)
+
+	if err := p.dm.ReloadPool(p.poolName, dataDevice, metadataDevice, table.BlockSizeSectors, table.LowWaterMark, table.ZeroesNewBlocks(), table.Features...); err != nil {
+		return errors.Wrapf(err, "failed to reload pool %q", p.poolName)
+	}
+
+	// Writes queued by pool which is out of data space can't be flushed before it's resumed with more space
+	var suspendOpts []dmsetup.SuspendDeviceOpt
+	if status.Mode == dmsetup.PoolModeOutOfDataSpace {
+		suspendOpts = append(suspendOpts, dmsetup.SuspendNoFlush)
+	}
+
+	// New table is loaded as inactive one, it becomes live on resume
+	if err := p.dm.SuspendDevice(p.poolName, suspendOpts...); err != nil {
+		if clearErr := p.dm.ClearTable(p.poolName); clearErr != nil {
+			log.G(ctx).WithError(clearErr).Errorf("failed to clear inactive table of pool %q", p.poolName)
+		}
+
+		return errors.Wrapf(err, "failed to suspend pool %q", p.poolName)
+	}
+
+	if err := p.dm.ResumeDevice(p.poolName); err != nil {
+		return errors.Wrapf(err, "failed to resume pool %q", p.poolName)
+	}
+
+	p.dataDevice = dataDevice
+	p.metadataDevice = metadataDevice
+	return nil
+}
+
+// thinPoolMetadataMagic is the magic number at thinPoolMetadataMagicOffset of thin-pool metadata superblock.
+// Kernel formats metadata device if its superblock of thinPoolSuperblockSize bytes is all zeros.
+const (
+	thinPoolMetadataMagic       = 27022010
+	thinPoolMetadataMagicOffset = 32
+	thinPoolSuperblockSize      = 4096
+)
 
+// checkMetadataVolume runs thin_check on metadata volume of the pool which is not created yet,
+// unless it's zeroed and will be formatted. Inconsistent metadata is repaired if repair is set.
+func checkMetadataVolume(ctx context.Context, metadataDevice string, repair bool) error {
+	zeroed, err := isZeroedMetadata(metadataDevice)
 	if err != nil {
 		return err
 	}
 
-	// Activate thin device
-	err = p.metadata.UpdateDevice(ctx, deviceName, func(info *DeviceInfo) error {
-		info.IsActivated = true
-		return dmsetup.ActivateDevice(p.poolName, info.Name, info.DeviceID, info.Size, "")
-	})
+	if zeroed {
+		log.G(ctx).Debugf("metadata device %q is zeroed, skipping thin_check", metadataDevice)
+		return nil
+	}
 
-	return err
+	checkErr := dmsetup.ThinCheck(metadataDevice)
+	if checkErr == nil {
+		log.G(ctx).Infof("metadata on %q is consistent", metadataDevice)
+		return nil
+	}
+
+	if !repair {
+		return errors.Wrapf(checkErr, "metadata on %q is inconsistent, repair it with thin_repair or enable repair", metadataDevice)
+	}
+
+	log.G(ctx).WithError(checkErr).Warnf("metadata on %q is inconsistent, repairing it", metadataDevice)
+
+	if err := repairMetadataVolume(metadataDevice); err != nil {
+		return errors.Wrapf(err, "failed to repair metadata on %q", metadataDevice)
+	}
+
+	if err := dmsetup.ThinCheck(metadataDevice); err != nil {
+		return errors.Wrapf(err, "metadata on %q is inconsistent after repair", metadataDevice)
+	}
+
+	log.G(ctx).Infof("repaired metadata on %q", metadataDevice)
+	return nil
 }
 
-func (p *PoolDevice) CreateSnapshotDevice(ctx context.Context, deviceName string, snapshotName string, virtualSizeBytes uint64) error {
-	baseDeviceInfo, err := p.metadata.GetDevice(ctx, deviceName)
+// isZeroedMetadata reports whether superblock of the metadata device is all zeros
+func isZeroedMetadata(path string) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to open metadata device %q", path)
+	}
+
+	defer file.Close()
+
+	superblock := make([]byte, thinPoolSuperblockSize)
+	if _, err := io.ReadFull(file, superblock); err != nil {
+		return false, errors.Wrapf(err, "failed to read metadata superblock of %q", path)
+	}
+
+	return bytes.Equal(superblock, make([]byte, thinPoolSuperblockSize)), nil
+}
+
+// checkThinPoolMetadata makes sure the device has thin-pool metadata on it
+func checkThinPoolMetadata(path string) error {
+	file, err := os.Open(path)
 	if err != nil {
+		return errors.Wrapf(err, "failed to open metadata device %q", path)
+	}
+
+	defer file.Close()
+
+	var magic uint64
+	section := io.NewSectionReader(file, thinPoolMetadataMagicOffset, 8)
+	if err := binary.Read(section, binary.LittleEndian, &magic); err != nil {
+		return errors.Wrapf(err, "failed to read metadata superblock of %q", path)
+	}
+
+	if magic != thinPoolMetadataMagic {
+		return errors.Errorf("%q has no thin-pool metadata", path)
+	}
+
+	return nil
+}
+
+// CompactMetadata reclaims fragmented thin-pool metadata space by rewriting metadata with "thin_repair",
+// which packs the btrees left sparse by device creations and deletions. This is an offline operation:
+// the pool must be idle (no active thin devices), it's removed for the duration of compaction and then
+// created again on top of the compacted metadata. Data blocks are not touched.
+// If writing compacted metadata back fails, the pool is left down and compacted copy is kept for recovery.
+// Other pool operations wait until compaction is done.
+func (p *PoolDevice) CompactMetadata(ctx context.Context) (retErr error) {
+	ctx, finish := p.startOperation(ctx, operationCompact, "")
+	defer func() {
+		finish(ctx, retErr)
+	}()
+
+	p.offlineMutex.Lock()
+	defer p.offlineMutex.Unlock()
+
+	if err := p.checkIdle("compaction"); err != nil {
 		return err
 	}
 
-	// Suspend thin device if it was activated previously
-	isActivated := baseDeviceInfo.IsActivated
-	if isActivated {
-		if err := dmsetup.SuspendDevice(deviceName); err != nil {
-			return errors.Wrapf(err, "failed to suspend device %q", deviceName)
-		}
+	table, err := p.dm.GetThinPoolTable(p.poolName)
+	if err != nil {
+		return errors.Wrapf(err, "failed to query table of pool %q", p.poolName)
 	}
 
-	snapshotDeviceInfo := &DeviceInfo{
-		Name:       snapshotName,
-		Size:       virtualSizeBytes,
-		ParentName: deviceName,
+	before, err := p.dm.GetPoolStatus(p.poolName)
+	if err != nil {
+		return errors.Wrapf(err, "failed to query status of pool %q", p.poolName)
 	}
 
-	err = p.metadata.AddDevice(ctx, snapshotDeviceInfo, func(devID uint32) error {
-		return dmsetup.CreateSnapshot(p.poolName, devID, baseDeviceInfo.DeviceID)
-	})
+	log.G(ctx).Infof("compacting metadata of pool %q, used metadata blocks before: %d/%d",
+		p.poolName, before.UsedMetadataBlocks, before.TotalMetadataBlocks)
+
+	if err := p.rewriteMetadata(ctx, table, false); err != nil {
+		return err
+	}
+
+	after, err := p.dm.GetPoolStatus(p.poolName)
+	if err != nil {
+		return errors.Wrapf(err, "failed to query status of pool %q", p.poolName)
+	}
+
+	log.G(ctx).Infof("compacted metadata of pool %q, used metadata blocks after: %d/%d",
+		p.poolName, after.UsedMetadataBlocks, after.TotalMetadataBlocks)
+
+	return nil
+}
+
+// PoolCondition is a thin-pool state which prevents it from serving devices normally
+type PoolCondition string
+
+// Pool conditions reported by CheckPoolHealth
+const (
+	// PoolFailed means pool hit an internal error and can't report its status, it needs repair
+	PoolFailed PoolCondition = "failed"
+	// PoolNeedsCheck means kernel found metadata inconsistency and switched the pool to read-only, it needs repair
+	PoolNeedsCheck PoolCondition = "needs_check"
+	// PoolOutOfDataSpace means writes to unprovisioned blocks are queued or failed until the pool is extended
+	PoolOutOfDataSpace PoolCondition = "out_of_data_space"
+	// PoolReadOnly means no devices can be created or written to, for instance after metadata space ran out
+	PoolReadOnly PoolCondition = "read_only"
+	// PoolLowSpace means data or metadata usage reached the threshold of WithLowSpaceWarning, reported by Healthy only
+	PoolLowSpace PoolCondition = "low_space"
+)
+
+// PoolHealthError is returned by CheckPoolHealth when the pool is in a condition which needs attention
+type PoolHealthError struct {
+	PoolName  string
+	Condition PoolCondition
+	Status    *dmsetup.PoolStatus
+	// Threshold is the usage percentage PoolLowSpace condition was reported for
+	Threshold float64
+}
+
+// Is matches ErrPoolFull or ErrPoolInError depending on the condition, so callers can tell them apart with errors.Is
+func (e *PoolHealthError) Is(target error) bool {
+	switch e.Condition {
+	case PoolOutOfDataSpace, PoolLowSpace:
+		return target == ErrPoolFull
+	default:
+		return target == ErrPoolInError
+	}
+}
+
+func (e *PoolHealthError) Error() string {
+	switch e.Condition {
+	case PoolFailed:
+		return fmt.Sprintf("pool %q has failed and needs repair", e.PoolName)
+	case PoolNeedsCheck:
+		return fmt.Sprintf("pool %q has inconsistent metadata and needs repair", e.PoolName)
+	case PoolOutOfDataSpace:
+		return fmt.Sprintf("pool %q is out of data space (%d of %d data blocks used)",
+			e.PoolName, e.Status.UsedDataBlocks, e.Status.TotalDataBlocks)
+	case PoolLowSpace:
+		usage := &PoolStatus{PoolStatus: *e.Status}
+		return fmt.Sprintf("pool %q is running out of space (data %.1f%%, metadata %.1f%% used, threshold %g%%)",
+			e.PoolName, usage.DataUsage(), usage.MetadataUsage(), e.Threshold)
+	default:
+		return fmt.Sprintf("pool %q is %s (%d of %d metadata blocks used)",
+			e.PoolName, e.Condition, e.Status.UsedMetadataBlocks, e.Status.TotalMetadataBlocks)
+	}
+}
+
+// PoolZeroesNewBlocks reports whether the pool zeroes newly provisioned blocks according to its live table,
+// so operators can assert deleted devices' data isn't exposed to new devices (see WithZeroNewBlocks)
+func (p *PoolDevice) PoolZeroesNewBlocks(ctx context.Context) (bool, error) {
+	table, err := p.dm.GetThinPoolTable(p.poolName)
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to query table of pool %q", p.poolName)
+	}
+
+	log.G(ctx).Debugf("pool %q features: %s", p.poolName, strings.Join(table.Features, " "))
+	return table.ZeroesNewBlocks(), nil
+}
+
+// CheckPoolHealth returns *PoolHealthError if the pool is failed, needs metadata check, is out of data space
+// or is read-only. Failed and needs check pools can be repaired with RepairPool.
+func (p *PoolDevice) CheckPoolHealth(ctx context.Context) error {
+	status, err := p.dm.GetPoolStatus(p.poolName)
+	if err != nil {
+		return errors.Wrapf(err, "failed to query status of pool %q", p.poolName)
+	}
+
+	return poolHealth(p.poolName, status)
+}
+
+// Healthy returns nil if the pool exists, is active, isn't in any of the CheckPoolHealth conditions and its
+// data and metadata usage is below the threshold of WithLowSpaceWarning. It's meant for readiness probes,
+// so it only makes a single dmsetup call. Returns ErrPoolMissing if the pool doesn't exist, otherwise
+// *PoolHealthError, which matches ErrPoolFull or ErrPoolInError with errors.Is.
+func (p *PoolDevice) Healthy(ctx context.Context) error {
+	if _, err := os.Stat(dmsetup.GetFullDevicePath(p.poolName)); os.IsNotExist(err) {
+		return errors.Wrapf(ErrPoolMissing, "pool %q", p.poolName)
+	} else if err != nil {
+		return errors.Wrapf(err, "failed to stat pool %q", p.poolName)
+	}
+
+	status, err := p.dm.GetPoolStatus(p.poolName)
+	if err != nil {
+		return errors.Wrapf(ErrPoolInError, "failed to query status of pool %q: %v", p.poolName, err)
+	}
+
+	if err := poolHealth(p.poolName, status); err != nil {
+		return err
+	}
+
+	threshold, _ := p.lowSpaceWarning()
+	return poolSpaceHealth(p.poolName, status, threshold)
+}
+
+// poolSpaceHealth returns *PoolHealthError if data or metadata usage reached the threshold, zero threshold disables it
+func poolSpaceHealth(poolName string, status *dmsetup.PoolStatus, threshold float64) error {
+	usage := &PoolStatus{PoolStatus: *status}
+	if threshold == 0 || (usage.DataUsage() < threshold && usage.MetadataUsage() < threshold) {
+		return nil
+	}
+
+	return &PoolHealthError{PoolName: poolName, Condition: PoolLowSpace, Status: status, Threshold: threshold}
+}
+
+func poolHealth(poolName string, status *dmsetup.PoolStatus) error {
+	var condition PoolCondition
+
+	switch {
+	case status.Fail:
+		condition = PoolFailed
+	case status.NeedsCheck:
+		condition = PoolNeedsCheck
+	case status.Mode == dmsetup.PoolModeOutOfDataSpace:
+		condition = PoolOutOfDataSpace
+	case status.Mode == dmsetup.PoolModeReadOnly:
+		condition = PoolReadOnly
+	default:
+		return nil
+	}
 
+	return &PoolHealthError{PoolName: poolName, Condition: condition, Status: status}
+}
+
+// RepairPool brings back the pool which failed or needs metadata check. This is an offline operation:
+// the pool must be idle (no active thin devices) and it's removed while metadata is checked with "thin_check".
+// If metadata is consistent, "needs_check" flag is cleared, otherwise metadata is rewritten with "thin_repair".
+// The pool is created again afterwards and its health is returned. Other pool operations wait until repair is done.
+func (p *PoolDevice) RepairPool(ctx context.Context) (retErr error) {
+	ctx, finish := p.startOperation(ctx, operationRepair, "")
+	defer func() {
+		finish(ctx, retErr)
+	}()
+
+	p.offlineMutex.Lock()
+	defer p.offlineMutex.Unlock()
+
+	if err := p.checkIdle("repair"); err != nil {
+		return err
+	}
+
+	table, err := p.dm.GetThinPoolTable(p.poolName)
 	if err != nil {
+		return errors.Wrapf(err, "failed to query table of pool %q", p.poolName)
+	}
+
+	log.G(ctx).Warnf("repairing pool %q", p.poolName)
+
+	if err := p.rewriteMetadata(ctx, table, true); err != nil {
 		return err
 	}
 
-	if isActivated {
-		if err := dmsetup.ResumeDevice(deviceName); err != nil {
-			return errors.Wrapf(err, "failed to resume device %q", deviceName)
+	return p.CheckPoolHealth(ctx)
+}
+
+// checkIdle makes sure there are no active thin devices on the pool, so it can be taken offline
+func (p *PoolDevice) checkIdle(operation string) error {
+	infos, err := p.dm.Info(p.poolName)
+	if err != nil {
+		return errors.Wrapf(err, "failed to query pool info %q", p.poolName)
+	}
+
+	if len(infos) != 1 {
+		return errors.Errorf("unexpected number of pool infos %d", len(infos))
+	}
+
+	if infos[0].OpenCount > 0 {
+		return errors.Errorf("pool %q is in use (open count %d), deactivate all devices before %s",
+			p.poolName, infos[0].OpenCount, operation)
+	}
+
+	return nil
+}
+
+// rewriteMetadata removes the pool, rewrites its metadata with "thin_repair" and creates the pool again.
+// If check is set, metadata is verified with "thin_check" first and rewritten only if it's inconsistent.
+// If thin_repair fails, the pool is brought back with the original metadata. If writing rewritten metadata
+// back fails, the pool is left down and rewritten copy is kept for recovery. Caller must hold offlineMutex.
+func (p *PoolDevice) rewriteMetadata(ctx context.Context, table *dmsetup.ThinPoolTable, check bool) error {
+	metaSize, err := dmsetup.BlockDeviceSize(p.metadataDevice)
+	if err != nil {
+		return errors.Wrapf(err, "failed to get size of metadata device %q", p.metadataDevice)
+	}
+
+	rewritten, err := ioutil.TempFile("", p.poolName+"-metadata-")
+	if err != nil {
+		return errors.Wrap(err, "failed to create temp file for rewritten metadata")
+	}
+
+	rewrittenPath := rewritten.Name()
+	defer rewritten.Close()
+
+	if err := rewritten.Truncate(int64(metaSize)); err != nil {
+		os.Remove(rewrittenPath)
+		return errors.Wrapf(err, "failed to resize %q", rewrittenPath)
+	}
+
+	if err := p.dm.RemoveDevice(ctx, p.poolName); err != nil {
+		os.Remove(rewrittenPath)
+		return errors.Wrapf(err, "failed to remove pool %q", p.poolName)
+	}
+
+	createPool := func() error {
+		if err := p.dm.CreatePool(p.poolName, table.DataDevice, table.MetadataDevice, table.BlockSizeSectors,
+			table.LowWaterMark, table.ZeroesNewBlocks(), table.Features...); err != nil {
+			return errors.Wrapf(err, "failed to recreate pool %q", p.poolName)
 		}
+
+		return nil
 	}
 
-	err = p.metadata.UpdateDevice(ctx, snapshotName, func(info *DeviceInfo) error {
-		info.IsActivated = true
-		return dmsetup.ActivateDevice(p.poolName, info.Name, info.DeviceID, info.Size, "")
-	})
+	if check {
+		err := dmsetup.ThinCheck(p.metadataDevice)
+		if err == nil {
+			os.Remove(rewrittenPath)
+			log.G(ctx).Infof("metadata of pool %q is consistent", p.poolName)
+			return createPool()
+		}
 
-	return err
+		log.G(ctx).WithError(err).Warnf("metadata of pool %q is inconsistent, rewriting it", p.poolName)
+	}
+
+	if err := dmsetup.ThinRepair(p.metadataDevice, rewrittenPath); err != nil {
+		os.Remove(rewrittenPath)
+
+		// Original metadata is intact, bring the pool back as it was
+		if createErr := createPool(); createErr != nil {
+			return multierror.Append(err, createErr)
+		}
+
+		return err
+	}
+
+	if err := copyMetadata(rewritten, p.metadataDevice); err != nil {
+		return errors.Wrapf(err, "failed to write rewritten metadata to %q, pool %q is down, rewritten copy kept at %q",
+			p.metadataDevice, p.poolName, rewrittenPath)
+	}
+
+	os.Remove(rewrittenPath)
+	return createPool()
 }
 
-func (p *PoolDevice) RemoveDevice(ctx context.Context, deviceName string, deferred bool) error {
-	opts := []dmsetup.RemoveDeviceOpt{dmsetup.RemoveWithForce, dmsetup.RemoveWithRetries}
-	if deferred {
-		opts = append(opts, dmsetup.RemoveDeferred)
+// repairMetadataVolume rewrites metadata of a pool which is not created yet with "thin_repair".
+// If writing repaired metadata back fails, repaired copy is kept for recovery.
+func repairMetadataVolume(metadataDevice string) error {
+	metaSize, err := dmsetup.BlockDeviceSize(metadataDevice)
+	if err != nil {
+		return errors.Wrapf(err, "failed to get size of metadata device %q", metadataDevice)
 	}
 
-	return p.metadata.UpdateDevice(ctx, deviceName, func(info *DeviceInfo) error {
-		info.IsActivated = false
-		return dmsetup.RemoveDevice(deviceName, opts...)
-	})
+	repaired, err := ioutil.TempFile("", "repaired-metadata-")
+	if err != nil {
+		return errors.Wrap(err, "failed to create temp file for repaired metadata")
+	}
+
+	repairedPath := repaired.Name()
+	defer repaired.Close()
+
+	if err := repaired.Truncate(int64(metaSize)); err != nil {
+		os.Remove(repairedPath)
+		return errors.Wrapf(err, "failed to resize %q", repairedPath)
+	}
+
+	if err := dmsetup.ThinRepair(metadataDevice, repairedPath); err != nil {
+		os.Remove(repairedPath)
+		return err
+	}
+
+	if err := copyMetadata(repaired, metadataDevice); err != nil {
+		return errors.Wrapf(err, "failed to write repaired metadata to %q, repaired copy kept at %q", metadataDevice, repairedPath)
+	}
+
+	os.Remove(repairedPath)
+	return nil
 }
 
-func (p *PoolDevice) RemovePool(ctx context.Context) error {
+// copyMetadata writes contents of src to the beginning of the metadata device and flushes it
+func copyMetadata(src *os.File, metadataDevice string) error {
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	dst, err := os.OpenFile(metadataDevice, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+
+	defer dst.Close()
+
+	if _, err := io.Copy(dst, src); err != nil {
+		return err
+	}
+
+	return dst.Sync()
+}
+
+// RemovePool deactivates all devices of the pool and removes the pool. Devices are removed concurrently
+// and the whole removal stops once ctx is done. Devices which couldn't be removed are listed in the returned
+// multierror and stay activated in metadata, so RemovePool can be called again to retry them.
+// The pool is kept if any device couldn't be removed, unless force is set.
+func (p *PoolDevice) RemovePool(ctx context.Context, force bool) (retErr error) {
+	ctx, finish := p.startOperation(ctx, operationRemovePool, "")
+	defer func() {
+		finish(ctx, retErr)
+	}()
+
+	// Pool is destroyed, so no other operation may run on it meanwhile
+	p.offlineMutex.Lock()
+	defer p.offlineMutex.Unlock()
+
 	deviceNames, err := p.metadata.GetDeviceNames(ctx)
 	if err != nil {
 		return errors.Wrap(err, "can't query device names")
 	}
 
-	var result *multierror.Error
+	var (
+		result      *multierror.Error
+		activeNames []string
+	)
 
 	for _, name := range deviceNames {
 		info, err := p.metadata.GetDevice(ctx, name)
@@ -167,19 +3848,47 @@ func (p *PoolDevice) RemovePool(ctx context.Context) error {
 		}
 
 		if info.IsActivated {
-			if err := p.RemoveDevice(ctx, name, true); err != nil {
-				result = multierror.Append(result, errors.Wrapf(err, "failed to remove %q", name))
-			}
+			activeNames = append(activeNames, name)
 		}
 	}
 
-	if err := dmsetup.RemoveDevice(p.poolName, dmsetup.RemoveWithForce, dmsetup.RemoveWithRetries, dmsetup.RemoveDeferred); err != nil {
+	p.warnBusyDevices(ctx)
+
+	if err := p.removeDevices(ctx, activeNames, true, p.lockAndRemoveDevice); err != nil {
+		result = multierror.Append(result, err)
+	}
+
+	if result.ErrorOrNil() != nil && !force {
+		log.G(ctx).Warnf("not all devices were removed, keeping pool %q", p.poolName)
+		return result
+	}
+
+	opts := []dmsetup.RemoveDeviceOpt{dmsetup.RemoveWithForce, dmsetup.RemoveWithRetries}
+	if !p.noDeferredRemoval {
+		opts = append(opts, dmsetup.RemoveDeferred)
+	}
+
+	if err := p.dm.RemoveDevice(ctx, p.poolName, opts...); err != nil {
 		result = multierror.Append(result, errors.Wrapf(err, "failed to remove pool %q", p.poolName))
 	}
 
 	return result.ErrorOrNil()
 }
 
+// Close closes pool device metadata store. It's safe to call Close multiple times,
+// subsequent calls return the result of the first one.
 func (p *PoolDevice) Close() error {
-	return p.metadata.Close()
+	p.closeOnce.Do(func() {
+		if p.deletes != nil {
+			p.deletes.Close()
+		}
+
+		p.closeErr = p.metadata.Close()
+
+		if p.releaseDmsetup != nil {
+			p.releaseDmsetup()
+		}
+	})
+
+	return p.closeErr
 }
@@ -14,14 +14,23 @@
 package devmapper
 
 import (
+	"bytes"
 	"context"
+	"encoding/binary"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/docker/go-units"
+	"github.com/hashicorp/go-multierror"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -34,8 +43,9 @@ const (
 	thinDevice1 = "thin-1"
 	thinDevice2 = "thin-2"
 	snapDevice1 = "snap-1"
-	device1Size = 100000
-	device2Size = 200000
+	// Whole data blocks of test pools, as sizes of new devices are rounded up to data blocks
+	device1Size = 131072
+	device2Size = 262144
 	testsPrefix = "devmapper-snapshotter-tests-"
 )
 
@@ -56,12 +66,15 @@ func TestPoolDevice(t *testing.T) {
 	tempDir, err := ioutil.TempDir("", "pool-device-test-")
 	require.NoErrorf(t, err, "couldn't get temp directory for testing")
 
-	_, loopDataDevice := createLoopbackDevice(t, tempDir)
+	dataImage, loopDataDevice := createLoopbackDevice(t, tempDir)
 	_, loopMetaDevice := createLoopbackDevice(t, tempDir)
 
+	// Loop devices attached to grown data image by ExtendPool
+	var extendedDataDevices []string
+
 	defer func() {
 		// Detach loop devices and remove images
-		err := losetup.DetachLoopDevice(loopDataDevice, loopMetaDevice)
+		err := losetup.DetachLoopDevice(append(extendedDataDevices, loopDataDevice, loopMetaDevice)...)
 		assert.NoError(t, err)
 
 		err = os.RemoveAll(tempDir)
@@ -81,7 +94,7 @@ func TestPoolDevice(t *testing.T) {
 	require.NotNil(t, pool)
 
 	defer func() {
-		err := pool.RemovePool(ctx)
+		err := pool.RemovePool(ctx, false)
 		require.NoError(t, err, "can't close device pool")
 	}()
 
@@ -128,30 +141,153 @@ func TestPoolDevice(t *testing.T) {
 	output, err = exec.Command("umount", thin1MountPath, snap1MountPath).CombinedOutput()
 	assert.NoErrorf(t, err, "failed to unmount devices: %s", string(output))
 
+	t.Run("SuspendResumeDevice", func(t *testing.T) {
+		testSuspendResumeDevice(t, pool)
+	})
+
+	t.Run("ReadOnlySnapshot", func(t *testing.T) {
+		testReadOnlySnapshot(t, pool)
+	})
+
+	t.Run("RenameDevice", func(t *testing.T) {
+		testRenameDevice(t, pool)
+	})
+
+	t.Run("GetDeviceStatus", func(t *testing.T) {
+		testGetDeviceStatus(t, pool)
+	})
+
+	t.Run("DeactivateDevice", func(t *testing.T) {
+		testDeactivateDevice(t, pool)
+	})
+
+	t.Run("GetPoolStatus", func(t *testing.T) {
+		testGetPoolStatus(t, pool)
+	})
+
+	t.Run("ZeroNewBlocks", func(t *testing.T) {
+		testZeroNewBlocks(t, pool, config)
+	})
+
+	t.Run("ExtendPool", func(t *testing.T) {
+		extendedDataDevices = testExtendPool(t, pool, dataImage)
+	})
+
+	t.Run("ResizeDevice", func(t *testing.T) {
+		testResizeDevice(t, pool)
+	})
+
+	t.Run("ActivationRollback", func(t *testing.T) {
+		testActivationRollback(t, pool)
+	})
+
+	t.Run("SnapshotChain", func(t *testing.T) {
+		testSnapshotChain(t, pool)
+	})
+
+	t.Run("ExportImportDevice", func(t *testing.T) {
+		testExportDevice(t, pool)
+	})
+
+	t.Run("CreateWithFilesystem", func(t *testing.T) {
+		testCreateWithFilesystem(t, pool)
+	})
+
+	t.Run("CleanupOrphans", func(t *testing.T) {
+		testCleanupOrphans(t, pool)
+	})
+
+	t.Run("SnapshotFromID", func(t *testing.T) {
+		testSnapshotFromID(t, pool)
+	})
+
+	t.Run("CreateSnapshots", func(t *testing.T) {
+		testCreateSnapshots(t, pool)
+	})
+
+	t.Run("PlanRemovePool", func(t *testing.T) {
+		testPlanRemovePool(t, pool)
+	})
+
+	t.Run("Healthy", func(t *testing.T) {
+		assert.NoError(t, pool.Healthy(ctx))
+	})
+
+	t.Run("BlockSizeMismatch", func(t *testing.T) {
+		mismatched := *config
+		mismatched.DataBlockSizeSectors = 256
+
+		_, err := NewPoolDevice(ctx, &mismatched)
+		assert.Error(t, err, "block size of existing pool can't be changed")
+	})
+
+	t.Run("IdempotentCreate", func(t *testing.T) {
+		testIdempotentCreate(t, pool)
+	})
+
+	t.Run("DeviceHooks", func(t *testing.T) {
+		testDeviceHooks(t, pool)
+	})
+
+	t.Run("GetUsage", func(t *testing.T) {
+		testGetUsage(t, pool)
+	})
+
+	t.Run("DiscardOnDelete", func(t *testing.T) {
+		testDiscardOnDelete(t, pool)
+	})
+
+	t.Run("ConcurrentOperations", func(t *testing.T) {
+		testConcurrentOperations(t, pool)
+	})
+
+	t.Run("LoadExisting", func(t *testing.T) {
+		testLoadExisting(t, pool)
+	})
+
 	t.Run("RemoveDevice", func(t *testing.T) {
 		testRemoveThinDevice(t, pool)
 	})
+
+	t.Run("CompactMetadata", func(t *testing.T) {
+		testCompactMetadata(t, pool)
+	})
+
+	t.Run("RepairPool", func(t *testing.T) {
+		testRepairPool(t, pool)
+	})
 }
 
 func testCreateThinDevice(t *testing.T, pool *PoolDevice) {
 	ctx := context.Background()
 
-	err := pool.CreateThinDevice(ctx, thinDevice1, device1Size)
+	deviceID1, err := pool.CreateThinDevice(ctx, thinDevice1, device1Size)
 	require.NoError(t, err, "can't create first thin device")
 
-	err = pool.CreateThinDevice(ctx, thinDevice1, device1Size)
+	_, err = pool.CreateThinDevice(ctx, thinDevice1, device1Size)
 	require.Error(t, err, "device pool allows duplicated device names")
 
-	err = pool.CreateThinDevice(ctx, thinDevice2, device2Size)
+	deviceID2, err := pool.CreateThinDevice(ctx, thinDevice2, device2Size, WithoutActivation())
 	require.NoError(t, err, "can't create second thin device")
 
 	deviceInfo1, err := pool.metadata.GetDevice(ctx, thinDevice1)
 	assert.NoError(t, err)
+	assert.Equal(t, deviceID1, deviceInfo1.DeviceID)
+	assert.True(t, deviceInfo1.IsActivated)
 
 	deviceInfo2, err := pool.metadata.GetDevice(ctx, thinDevice2)
 	assert.NoError(t, err)
+	assert.Equal(t, deviceID2, deviceInfo2.DeviceID)
+	assert.False(t, deviceInfo2.IsActivated)
 
 	assert.NotEqual(t, deviceInfo1.DeviceID, deviceInfo2.DeviceID, "assigned device ids should be different")
+
+	err = pool.ReactivateDevice(ctx, thinDevice2)
+	require.NoError(t, err, "can't activate second thin device")
+
+	deviceInfo2, err = pool.metadata.GetDevice(ctx, thinDevice2)
+	assert.NoError(t, err)
+	assert.True(t, deviceInfo2.IsActivated)
 }
 
 func testMakeFileSystem(t *testing.T, pool *PoolDevice) {
@@ -167,50 +303,1845 @@ func testMakeFileSystem(t *testing.T, pool *PoolDevice) {
 }
 
 func testCreateSnapshot(t *testing.T, pool *PoolDevice) {
-	err := pool.CreateSnapshotDevice(context.Background(), thinDevice1, snapDevice1, device1Size)
+	_, err := pool.CreateSnapshotDevice(context.Background(), thinDevice1, snapDevice1, device1Size)
 	assert.NoErrorf(t, err, "failed to create snapshot from '%s' volume", thinDevice1)
+
+	_, err = pool.CreateSnapshotDevice(context.Background(), thinDevice1, snapDevice1, device1Size)
+	assert.True(t, errors.Is(err, ErrSnapshotAlreadyExists), "snapshot name is taken")
 }
 
-func testRemoveThinDevice(t *testing.T, pool *PoolDevice) {
-	deviceList := []string{
-		thinDevice1,
-		thinDevice2,
-		snapDevice1,
+func testSuspendResumeDevice(t *testing.T, pool *PoolDevice) {
+	ctx := context.Background()
+
+	err := pool.SuspendDevice(ctx, thinDevice1)
+	require.NoError(t, err)
+
+	status, err := pool.GetDeviceStatus(ctx, thinDevice1)
+	require.NoError(t, err)
+	assert.True(t, status.Suspended)
+
+	err = pool.ResumeDevice(ctx, thinDevice1)
+	require.NoError(t, err)
+
+	status, err = pool.GetDeviceStatus(ctx, thinDevice1)
+	require.NoError(t, err)
+	assert.False(t, status.Suspended)
+
+	// Snapshot fails once base device is suspended, base device must be resumed anyway
+	limit := pool.maxVirtualSizeBytes
+	pool.maxVirtualSizeBytes = 1
+	defer func() {
+		pool.maxVirtualSizeBytes = limit
+	}()
+
+	_, err = pool.CreateSnapshotDevice(ctx, thinDevice1, "snap-failed", device1Size)
+	assert.Equal(t, ErrOverProvisioned, err)
+
+	status, err = pool.GetDeviceStatus(ctx, thinDevice1)
+	require.NoError(t, err)
+	assert.False(t, status.Suspended, "base device should be resumed if snapshot fails")
+}
+
+func testReadOnlySnapshot(t *testing.T, pool *PoolDevice) {
+	const readOnlyDevice = "snap-ro"
+	ctx := context.Background()
+
+	_, err := pool.CreateSnapshotDevice(ctx, thinDevice1, readOnlyDevice, device1Size, WithReadOnly())
+	require.NoError(t, err)
+
+	infos, err := dmsetup.Info(readOnlyDevice)
+	require.NoError(t, err)
+	require.Len(t, infos, 1)
+	assert.True(t, infos[0].ReadOnly, "device should be activated read-only")
+
+	// Writes must be refused by kernel
+	file, err := os.OpenFile(dmsetup.GetFullDevicePath(readOnlyDevice), os.O_WRONLY, 0)
+	if err == nil {
+		_, err = file.Write([]byte("data"))
+		file.Close()
 	}
+	assert.Error(t, err, "writing to read-only device should fail")
 
-	for _, deviceName := range deviceList {
-		err := pool.RemoveDevice(context.Background(), deviceName, false)
-		assert.NoErrorf(t, err, "failed to remove '%s'", deviceName)
+	status, err := pool.GetDeviceStatus(ctx, readOnlyDevice)
+	require.NoError(t, err)
+	assert.True(t, status.IsReadOnly, "read-only mode should be saved in metadata")
+	assert.True(t, status.ReadOnly)
+
+	// Mode is kept when device is activated again
+	err = pool.RemoveDevice(ctx, readOnlyDevice, false)
+	require.NoError(t, err)
+
+	err = pool.ReactivateDevice(ctx, readOnlyDevice)
+	require.NoError(t, err)
+
+	status, err = pool.GetDeviceStatus(ctx, readOnlyDevice)
+	require.NoError(t, err)
+	assert.True(t, status.ReadOnly, "reactivated device should be read-only")
+
+	err = pool.DeleteDevice(ctx, readOnlyDevice)
+	require.NoError(t, err)
+
+	_, err = pool.metadata.GetDevice(ctx, readOnlyDevice)
+	assert.Equal(t, ErrNotFound, errors.Cause(err))
+}
+
+func testRenameDevice(t *testing.T, pool *PoolDevice) {
+	const renamed = "thin-2-renamed"
+	ctx := context.Background()
+
+	err := pool.RenameDevice(ctx, thinDevice2, renamed)
+	require.NoError(t, err)
+
+	_, err = os.Stat(dmsetup.GetFullDevicePath(renamed))
+	assert.NoError(t, err, "device node should be renamed")
+
+	err = pool.RenameDevice(ctx, renamed, thinDevice1)
+	assert.True(t, errors.Is(err, ErrAlreadyExists), "rename to existing device name shouldn't be allowed")
+
+	err = pool.RenameDevice(ctx, renamed, thinDevice2)
+	require.NoError(t, err)
+}
+
+func testGetDeviceStatus(t *testing.T, pool *PoolDevice) {
+	ctx := context.Background()
+
+	status, err := pool.GetDeviceStatus(ctx, snapDevice1)
+	require.NoError(t, err)
+	assert.Equal(t, thinDevice1, status.ParentName)
+	assert.Equal(t, dmsetup.GetFullDevicePath(snapDevice1), status.Path)
+	assert.EqualValues(t, device1Size, status.Size)
+	assert.True(t, status.Active)
+	assert.False(t, status.ReadOnly)
+
+	err = pool.RemoveDevice(ctx, snapDevice1, false)
+	require.NoError(t, err)
+
+	status, err = pool.GetDeviceStatus(ctx, snapDevice1)
+	require.NoError(t, err)
+	assert.False(t, status.Active)
+	assert.False(t, status.IsActivated)
+
+	err = pool.ReactivateDevice(ctx, snapDevice1)
+	require.NoError(t, err)
+
+	_, err = pool.GetDeviceStatus(ctx, "not-existing-device")
+	assert.Equal(t, ErrNotFound, errors.Cause(err))
+}
+
+func testDeactivateDevice(t *testing.T, pool *PoolDevice) {
+	const name = "thin-deactivate"
+	ctx := context.Background()
+
+	_, err := pool.CreateThinDevice(ctx, name, device1Size)
+	require.NoError(t, err)
+
+	err = pool.RemoveDevice(ctx, name, false)
+	require.NoError(t, err)
+
+	_, err = os.Stat(dmsetup.GetFullDevicePath(name))
+	assert.True(t, os.IsNotExist(err), "device node should be removed")
+
+	info, err := pool.metadata.GetDevice(ctx, name)
+	require.NoError(t, err, "deactivated device should be kept")
+	assert.False(t, info.IsActivated)
+
+	err = pool.RemoveDevice(ctx, name, false)
+	assert.NoError(t, err, "deactivating inactive device should be a no-op")
+
+	err = pool.ReactivateDevice(ctx, name)
+	require.NoError(t, err)
+
+	_, err = os.Stat(dmsetup.GetFullDevicePath(name))
+	assert.NoError(t, err, "device node should be back")
+
+	err = pool.RemoveDevice(ctx, name, false)
+	require.NoError(t, err)
+
+	// Inactive device is deleted from the pool without activating it
+	err = pool.DeleteDevice(ctx, name)
+	require.NoError(t, err)
+
+	_, err = pool.metadata.GetDevice(ctx, name)
+	assert.Equal(t, ErrNotFound, errors.Cause(err))
+}
+
+func testGetPoolStatus(t *testing.T, pool *PoolDevice) {
+	status, err := pool.GetPoolStatus(context.Background())
+	require.NoError(t, err)
+
+	assert.EqualValues(t, 128, status.DataBlockSizeSectors)
+	assert.NotZero(t, status.TotalDataBlocks)
+	assert.NotZero(t, status.TotalMetadataBlocks)
+	assert.True(t, status.UsedDataBlocks <= status.TotalDataBlocks)
+	assert.True(t, status.UsedMetadataBlocks <= status.TotalMetadataBlocks)
+}
+
+func testZeroNewBlocks(t *testing.T, pool *PoolDevice, config *Config) {
+	ctx := context.Background()
+
+	zeroes, err := pool.PoolZeroesNewBlocks(ctx)
+	require.NoError(t, err)
+	assert.False(t, zeroes, "pool is created with skip_block_zeroing by default")
+
+	// Existing pool skipping zeroing isn't silently used when zeroing is asked for
+	_, err = NewPoolDevice(ctx, config, WithZeroNewBlocks())
+	assert.Error(t, err)
+
+	zeroes, err = pool.PoolZeroesNewBlocks(ctx)
+	require.NoError(t, err)
+	assert.False(t, zeroes)
+}
+
+func TestZeroNewBlocksContradiction(t *testing.T) {
+	config := &Config{PoolName: "test-pool", ExtraFeatures: []string{dmsetup.FeatureSkipBlockZeroing}}
+
+	_, err := NewPoolDevice(context.Background(), config, WithZeroNewBlocks())
+	assert.Error(t, err)
+}
+
+func testExtendPool(t *testing.T, pool *PoolDevice, dataImage string) []string {
+	ctx := context.Background()
+
+	before, err := pool.GetPoolStatus(ctx)
+	require.NoError(t, err)
+	require.NotZero(t, before.UsedDataBlocks)
+
+	var attached []string
+	pool.extendThreshold = before.DataUsage()
+	pool.extendFunc = func(ctx context.Context, currentBlocks uint64) (string, error) {
+		assert.Equal(t, before.TotalDataBlocks, currentBlocks)
+
+		size, err := units.RAMInBytes("256Mb")
+		if err != nil {
+			return "", err
+		}
+
+		if err := os.Truncate(dataImage, size); err != nil {
+			return "", err
+		}
+
+		// Loop device keeps the old size, attach the grown image again to see the new one
+		loopDevice, err := losetup.AttachLoopDevice(dataImage)
+		if err != nil {
+			return "", err
+		}
+
+		attached = append(attached, loopDevice)
+		return loopDevice, nil
 	}
 
-	err := pool.RemoveDevice(context.Background(), "not-existing-device", false)
-	assert.Error(t, err, "should return an error if trying to remove not existing device")
+	defer func() {
+		pool.extendFunc = nil
+	}()
+
+	after, err := pool.GetPoolStatus(ctx)
+	require.NoError(t, err)
+	require.Len(t, attached, 1, "pool should be extended once")
+
+	assert.Equal(t, before.TotalDataBlocks*2, after.TotalDataBlocks)
+	assert.Equal(t, before.UsedDataBlocks, after.UsedDataBlocks, "data should be kept")
+	assert.Equal(t, attached[0], pool.dataDevice)
+
+	_, err = pool.GetPoolStatus(ctx)
+	require.NoError(t, err)
+	assert.Len(t, attached, 1, "pool should not be extended below threshold")
+
+	return attached
 }
 
-func tempMountPath(t *testing.T) string {
-	path, err := ioutil.TempDir("", "devmapper-snapshotter-mount-")
-	require.NoError(t, err, "failed to get temp directory for mount")
+func testResizeDevice(t *testing.T, pool *PoolDevice) {
+	const name = "thin-resize"
+	ctx := context.Background()
 
-	return path
+	_, err := pool.CreateThinDevice(ctx, name, device1Size)
+	require.NoError(t, err)
+
+	devicePath := dmsetup.GetFullDevicePath(name)
+	data := []byte("data written before resize")
+
+	file, err := os.OpenFile(devicePath, os.O_WRONLY, 0)
+	require.NoError(t, err)
+	_, err = file.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, file.Sync())
+	require.NoError(t, file.Close())
+
+	err = pool.ResizeDevice(ctx, name, device1Size*2)
+	require.NoError(t, err)
+
+	size, err := dmsetup.BlockDeviceSize(devicePath)
+	require.NoError(t, err)
+	assert.EqualValues(t, device1Size*2, size)
+
+	info, err := pool.metadata.GetDevice(ctx, name)
+	require.NoError(t, err)
+	assert.EqualValues(t, device1Size*2, info.Size)
+
+	file, err = os.Open(devicePath)
+	require.NoError(t, err)
+	read := make([]byte, len(data))
+	_, err = file.Read(read)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+	assert.Equal(t, data, read, "data should be kept after resize")
+
+	err = pool.ResizeDevice(ctx, name, device1Size)
+	assert.Equal(t, ErrShrinkNotSupported, errors.Cause(err))
+
+	err = pool.DeleteDevice(ctx, name)
+	require.NoError(t, err)
 }
 
-func createLoopbackDevice(t *testing.T, dir string) (string, string) {
-	file, err := ioutil.TempFile(dir, testsPrefix)
+func testActivationRollback(t *testing.T, pool *PoolDevice) {
+	ctx := context.Background()
+
+	// Name is free in metadata store, but taken by a device outside of the pool, so activation fails
+	const name = "thin-rollback-taken"
+
+	output, err := exec.Command("dmsetup", "create", name, "--table", "0 8 zero").CombinedOutput()
+	require.NoErrorf(t, err, "failed to create device outside of the pool: %s", string(output))
+
+	defer func() {
+		err := dmsetup.RemoveDevice(ctx, name)
+		assert.NoError(t, err)
+	}()
+
+	_, err = pool.CreateThinDevice(ctx, name, device1Size)
+	require.Error(t, err)
+
+	_, err = pool.metadata.GetDevice(ctx, name)
+	assert.Equal(t, ErrNotFound, errors.Cause(err), "failed device should be removed from metadata")
+
+	_, err = pool.CreateSnapshotDevice(ctx, thinDevice1, name, device1Size)
+	require.Error(t, err)
+
+	_, err = pool.metadata.GetDevice(ctx, name)
+	assert.Equal(t, ErrNotFound, errors.Cause(err), "failed snapshot should be removed from metadata")
+
+	// Device ID taken by the failed device goes back to the free list and is reused
+	id, err := pool.CreateThinDevice(ctx, "thin-rollback", device1Size, WithoutActivation())
 	require.NoError(t, err)
 
-	size, err := units.RAMInBytes("128Mb")
+	err = pool.DeleteDevice(ctx, "thin-rollback")
 	require.NoError(t, err)
 
-	err = file.Truncate(size)
+	_, err = pool.CreateThinDevice(ctx, name, device1Size)
+	require.Error(t, err)
+
+	next, err := pool.CreateThinDevice(ctx, "thin-rollback", device1Size, WithoutActivation())
 	require.NoError(t, err)
+	assert.Equal(t, id, next)
 
-	err = file.Close()
+	err = pool.DeleteDevice(ctx, "thin-rollback")
 	require.NoError(t, err)
+}
 
-	imagePath := file.Name()
+func testSnapshotChain(t *testing.T, pool *PoolDevice) {
+	ctx := context.Background()
 
-	loopDevice, err := losetup.AttachLoopDevice(imagePath)
+	_, err := pool.CreateThinDevice(ctx, "thin-chain", device1Size)
 	require.NoError(t, err)
 
-	return imagePath, loopDevice
+	_, err = pool.CreateSnapshotDevice(ctx, "thin-chain", "snap-chain-1", device1Size)
+	require.NoError(t, err)
+
+	// Snapshot of a snapshot
+	_, err = pool.CreateSnapshotDevice(ctx, "snap-chain-1", "snap-chain-2", device1Size)
+	require.NoError(t, err)
+
+	chain, err := pool.GetSnapshotChain(ctx, "snap-chain-2")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"snap-chain-2", "snap-chain-1", "thin-chain"}, chain)
+
+	chain, err = pool.GetSnapshotChain(ctx, "thin-chain")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"thin-chain"}, chain)
+
+	// Deleting the middle of the chain keeps the rest of it
+	err = pool.DeleteDevice(ctx, "snap-chain-1")
+	require.NoError(t, err)
+
+	chain, err = pool.GetSnapshotChain(ctx, "snap-chain-2")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"snap-chain-2", "thin-chain"}, chain)
+
+	_, err = pool.GetSnapshotChain(ctx, "snap-chain-1")
+	assert.Equal(t, ErrNotFound, errors.Cause(err))
+
+	for _, name := range []string{"snap-chain-2", "thin-chain"} {
+		err = pool.DeleteDevice(ctx, name)
+		assert.NoError(t, err)
+	}
+}
+
+func testExportDevice(t *testing.T, pool *PoolDevice) {
+	const name = "thin-export"
+	ctx := context.Background()
+
+	_, err := pool.CreateThinDevice(ctx, name, device1Size)
+	require.NoError(t, err)
+
+	defer func() {
+		err := pool.DeleteDevice(ctx, name)
+		assert.NoError(t, err)
+	}()
+
+	// Write data in the middle of the device, the rest is left unallocated
+	data := bytes.Repeat([]byte("export"), 1000)
+	offset := int64(device1Size / 2)
+
+	dev, err := os.OpenFile(dmsetup.GetFullDevicePath(name), os.O_WRONLY, 0)
+	require.NoError(t, err)
+	_, err = dev.WriteAt(data, offset)
+	require.NoError(t, err)
+	require.NoError(t, dev.Sync())
+	require.NoError(t, dev.Close())
+
+	// Export of inactive device keeps it inactive
+	err = pool.RemoveDevice(ctx, name, false)
+	require.NoError(t, err)
+
+	imageDir := tempMountPath(t)
+	defer os.RemoveAll(imageDir)
+
+	image := filepath.Join(imageDir, "image")
+
+	err = pool.ExportDevice(ctx, name, image)
+	require.NoError(t, err)
+
+	info, err := pool.metadata.GetDevice(ctx, name)
+	require.NoError(t, err)
+	assert.False(t, info.IsActivated)
+
+	_, err = os.Stat(dmsetup.GetFullDevicePath(name))
+	assert.True(t, os.IsNotExist(err), "device must be deactivated after export")
+
+	contents, err := ioutil.ReadFile(image)
+	require.NoError(t, err)
+	require.Len(t, contents, int(device1Size))
+	assert.Equal(t, data, contents[offset:offset+int64(len(data))])
+	assert.Equal(t, make([]byte, offset), contents[:offset])
+
+	err = pool.ExportDevice(ctx, "not-existing", image)
+	assert.Equal(t, ErrNotFound, errors.Cause(err))
+
+	testImportDevice(t, pool, image, data, offset)
+}
+
+// testImportDevice imports image exported by testExportDevice back to the pool
+func testImportDevice(t *testing.T, pool *PoolDevice, image string, data []byte, offset int64) {
+	const name = "thin-import"
+	ctx := context.Background()
+
+	err := pool.ImportDevice(ctx, name, image, device1Size/2)
+	assert.Error(t, err, "image must not fit smaller device")
+
+	err = pool.ImportDevice(ctx, name, image, 0)
+	require.NoError(t, err)
+
+	info, err := pool.metadata.GetDevice(ctx, name)
+	require.NoError(t, err)
+	assert.True(t, info.IsActivated)
+	assert.EqualValues(t, device1Size, info.Size)
+
+	contents, err := ioutil.ReadFile(dmsetup.GetFullDevicePath(name))
+	require.NoError(t, err)
+	require.Len(t, contents, int(device1Size))
+	assert.Equal(t, data, contents[offset:offset+int64(len(data))])
+	assert.Equal(t, make([]byte, offset), contents[:offset])
+
+	err = pool.DeleteDevice(ctx, name)
+	require.NoError(t, err)
+
+	// Name taken outside of the pool fails activation, imported device is rolled back
+	output, err := exec.Command("dmsetup", "create", name, "--table", "0 8 zero").CombinedOutput()
+	require.NoErrorf(t, err, "failed to create device outside of the pool: %s", string(output))
+
+	defer func() {
+		err := dmsetup.RemoveDevice(ctx, name)
+		assert.NoError(t, err)
+	}()
+
+	err = pool.ImportDevice(ctx, name, image, 0)
+	require.Error(t, err)
+
+	_, err = pool.metadata.GetDevice(ctx, name)
+	assert.Equal(t, ErrNotFound, errors.Cause(err), "failed import should be removed from metadata")
+}
+
+func testCreateWithFilesystem(t *testing.T, pool *PoolDevice) {
+	const (
+		name = "thin-mkfs"
+		size = 4 * 1024 * 1024
+	)
+
+	ctx := context.Background()
+
+	_, err := pool.CreateThinDevice(ctx, name, size, WithFilesystem("ext4", "-L", "rootfs"))
+	require.NoError(t, err)
+
+	defer func() {
+		err := pool.DeleteDevice(ctx, name)
+		assert.NoError(t, err)
+	}()
+
+	mountPath := tempMountPath(t)
+	defer os.RemoveAll(mountPath)
+
+	output, err := exec.Command("mount", dmsetup.GetFullDevicePath(name), mountPath).CombinedOutput()
+	require.NoErrorf(t, err, "failed to mount %q: %s", name, string(output))
+
+	files, err := ioutil.ReadDir(mountPath)
+	assert.NoError(t, err)
+
+	output, err = exec.Command("umount", mountPath).CombinedOutput()
+	assert.NoErrorf(t, err, "failed to unmount %q: %s", name, string(output))
+
+	// Fresh ext4 has nothing but lost+found
+	require.Len(t, files, 1)
+	assert.Equal(t, "lost+found", files[0].Name())
+
+	// Failed mkfs deletes the device
+	_, err = pool.CreateThinDevice(ctx, "thin-mkfs-failed", size, WithFilesystem("ext4", "-b", "invalid"))
+	require.Error(t, err)
+
+	_, err = pool.metadata.GetDevice(ctx, "thin-mkfs-failed")
+	assert.Equal(t, ErrNotFound, errors.Cause(err))
+}
+
+func testCleanupOrphans(t *testing.T, pool *PoolDevice) {
+	ctx := context.Background()
+
+	known, err := pool.metadata.GetDeviceNames(ctx)
+	require.NoError(t, err)
+
+	_, err = pool.CreateThinDevice(ctx, "thin-orphan", device1Size)
+	require.NoError(t, err)
+
+	_, err = pool.CreateSnapshotDevice(ctx, "thin-orphan", "snap-orphan", device1Size)
+	require.NoError(t, err)
+
+	removed, err := pool.CleanupOrphans(ctx, known)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"snap-orphan", "thin-orphan"}, removed)
+
+	names, err := pool.metadata.GetDeviceNames(ctx)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, known, names, "known devices must be kept")
+
+	for _, name := range removed {
+		_, err := os.Stat(dmsetup.GetFullDevicePath(name))
+		assert.True(t, os.IsNotExist(err), "orphan device %q must be deactivated", name)
+	}
+
+	// Nothing else to clean up
+	removed, err = pool.CleanupOrphans(ctx, known)
+	require.NoError(t, err)
+	assert.Empty(t, removed)
+}
+
+func testSnapshotFromID(t *testing.T, pool *PoolDevice) {
+	const (
+		originName = "thin-origin"
+		snapName   = "snap-from-id"
+	)
+
+	ctx := context.Background()
+
+	originID, err := pool.CreateThinDevice(ctx, originName, device1Size, WithoutActivation())
+	require.NoError(t, err)
+
+	// Tracked origin is snapshotted by name
+	_, err = pool.CreateSnapshotDeviceFromID(ctx, originID, snapName, device1Size)
+	require.NoError(t, err)
+
+	info, err := pool.metadata.GetDevice(ctx, snapName)
+	require.NoError(t, err)
+	assert.Equal(t, originName, info.ParentName)
+	require.NoError(t, pool.DeleteDevice(ctx, snapName))
+
+	// Forget the origin, it's still in the pool
+	err = pool.metadata.RemoveDevice(ctx, originName, func(*DeviceInfo) error { return nil })
+	require.NoError(t, err)
+
+	defer func() {
+		assert.NoError(t, dmsetup.DeleteDevice(pool.poolName, int(originID)))
+	}()
+
+	snapID, err := pool.CreateSnapshotDeviceFromID(ctx, originID, snapName, device1Size)
+	require.NoError(t, err)
+
+	info, err = pool.metadata.GetDevice(ctx, snapName)
+	require.NoError(t, err)
+	assert.Equal(t, snapID, info.DeviceID)
+	assert.Empty(t, info.ParentName, "untracked origin isn't a parent")
+	assert.True(t, info.IsActivated)
+	require.NoError(t, pool.DeleteDevice(ctx, snapName))
+
+	_, err = pool.CreateSnapshotDeviceFromID(ctx, 0, snapName, device1Size)
+	assert.Error(t, err, "device id is out of range")
+
+	_, err = pool.CreateSnapshotDeviceFromID(ctx, maxDeviceID-1, snapName, device1Size)
+	assert.True(t, errors.Is(err, ErrDeviceNotFound), "origin must exist in the pool")
+
+	_, err = pool.metadata.GetDevice(ctx, snapName)
+	assert.True(t, errors.Is(err, ErrDeviceNotFound), "failed snapshot must not be saved")
+
+	// Untracked origin which is activated has to be snapshotted by name
+	err = dmsetup.ActivateDevice(pool.poolName, originName, originID, device1Size, "")
+	require.NoError(t, err)
+
+	defer func() {
+		assert.NoError(t, dmsetup.RemoveDevice(ctx, originName))
+	}()
+
+	_, err = pool.CreateSnapshotDeviceFromID(ctx, originID, snapName, device1Size)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), originName)
+}
+
+func testCreateSnapshots(t *testing.T, pool *PoolDevice) {
+	const originName = "thin-batch-origin"
+
+	ctx := context.Background()
+	names := []string{"snap-batch-1", "snap-batch-2", "snap-batch-3"}
+
+	_, err := pool.CreateThinDevice(ctx, originName, device1Size)
+	require.NoError(t, err)
+
+	defer func() {
+		assert.NoError(t, pool.DeleteDevice(ctx, originName))
+	}()
+
+	ids, err := pool.CreateSnapshots(ctx, originName, names, device1Size)
+	require.NoError(t, err)
+	require.Len(t, ids, len(names))
+
+	for i, name := range names {
+		info, err := pool.metadata.GetDevice(ctx, name)
+		require.NoError(t, err)
+		assert.Equal(t, ids[i], info.DeviceID)
+		assert.Equal(t, originName, info.ParentName)
+		assert.True(t, info.IsActivated)
+		assert.FileExists(t, dmsetup.GetFullDevicePath(name))
+	}
+
+	origin, err := pool.metadata.GetDevice(ctx, originName)
+	require.NoError(t, err)
+	assert.True(t, origin.IsActivated, "origin must be resumed")
+
+	_, err = pool.CreateSnapshots(ctx, originName, []string{"snap-batch-4", names[0]}, device1Size)
+	assert.True(t, errors.Is(err, ErrSnapshotAlreadyExists))
+
+	_, err = pool.CreateSnapshots(ctx, originName, []string{"snap-batch-4", "snap-batch-4"}, device1Size)
+	assert.Error(t, err, "duplicate names must be rejected")
+
+	for _, name := range names {
+		require.NoError(t, pool.DeleteDevice(ctx, name))
+	}
+
+	// Second snapshot exceeds provisioning limit, so the first one is rolled back
+	total, err := pool.metadata.GetTotalVirtualSize(ctx)
+	require.NoError(t, err)
+
+	pool.maxVirtualSizeBytes = total + device1Size
+	defer func() {
+		pool.maxVirtualSizeBytes = 0
+	}()
+
+	_, err = pool.CreateSnapshots(ctx, originName, names[:2], device1Size)
+	assert.True(t, errors.Is(err, ErrOverProvisioned))
+
+	_, err = pool.metadata.GetDevice(ctx, names[0])
+	assert.True(t, errors.Is(err, ErrNotFound), "created snapshot must be rolled back")
+}
+
+func BenchmarkCreateSnapshots(b *testing.B) {
+	const (
+		originName    = "thin-bench-origin"
+		snapshotCount = 16
+	)
+
+	ctx := context.Background()
+
+	tempDir, err := ioutil.TempDir("", "pool-device-bench-")
+	require.NoError(b, err)
+	defer os.RemoveAll(tempDir)
+
+	_, loopDataDevice := createLoopbackDevice(b, tempDir)
+	_, loopMetaDevice := createLoopbackDevice(b, tempDir)
+
+	defer func() {
+		assert.NoError(b, losetup.DetachLoopDevice(loopDataDevice, loopMetaDevice))
+	}()
+
+	pool, err := NewPoolDevice(ctx, &Config{
+		PoolName:             "bench-pool-device",
+		RootPath:             tempDir,
+		DataDevice:           loopDataDevice,
+		MetadataDevice:       loopMetaDevice,
+		DataBlockSizeSectors: 128,
+	})
+	require.NoError(b, err)
+
+	defer func() {
+		assert.NoError(b, pool.RemovePool(ctx, false))
+	}()
+
+	_, err = pool.CreateThinDevice(ctx, originName, device1Size)
+	require.NoError(b, err)
+
+	names := make([]string, snapshotCount)
+	for i := range names {
+		names[i] = fmt.Sprintf("snap-bench-%d", i)
+	}
+
+	deleteSnapshots := func(b *testing.B) {
+		b.StopTimer()
+		for _, name := range names {
+			require.NoError(b, pool.DeleteDevice(ctx, name))
+		}
+		b.StartTimer()
+	}
+
+	b.Run("Loop", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, name := range names {
+				_, err := pool.CreateSnapshotDevice(ctx, originName, name, device1Size)
+				require.NoError(b, err)
+			}
+
+			deleteSnapshots(b)
+		}
+	})
+
+	b.Run("Batch", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_, err := pool.CreateSnapshots(ctx, originName, names, device1Size)
+			require.NoError(b, err)
+
+			deleteSnapshots(b)
+		}
+	})
+}
+
+func testPlanRemovePool(t *testing.T, pool *PoolDevice) {
+	const name = "thin-plan"
+
+	ctx := context.Background()
+
+	deviceID, err := pool.CreateThinDevice(ctx, name, device1Size)
+	require.NoError(t, err)
+
+	defer func() {
+		assert.NoError(t, pool.DeleteDevice(ctx, name))
+	}()
+
+	findDevice := func() DeviceRemovalInfo {
+		plan, err := pool.PlanRemovePool(ctx)
+		require.NoError(t, err)
+
+		for _, removal := range plan {
+			if removal.Name == name {
+				return removal
+			}
+		}
+
+		require.FailNow(t, "device is missing from the plan")
+		return DeviceRemovalInfo{}
+	}
+
+	removal := findDevice()
+	assert.Equal(t, deviceID, removal.DeviceID)
+	assert.True(t, removal.Active)
+	assert.False(t, removal.Busy())
+
+	file, err := os.Open(dmsetup.GetFullDevicePath(name))
+	require.NoError(t, err)
+
+	removal = findDevice()
+	assert.True(t, removal.Busy(), "open device is busy")
+	assert.Equal(t, uint32(1), removal.OpenCount)
+
+	require.NoError(t, file.Close())
+	require.NoError(t, pool.RemoveDevice(ctx, name, false))
+
+	removal = findDevice()
+	assert.False(t, removal.Active)
+	assert.False(t, removal.Busy())
+}
+
+func testIdempotentCreate(t *testing.T, pool *PoolDevice) {
+	const name = "thin-idempotent"
+
+	ctx := context.Background()
+
+	deviceID, err := pool.CreateThinDevice(ctx, name, device1Size, WithIdempotentCreate())
+	require.NoError(t, err)
+
+	defer func() {
+		assert.NoError(t, pool.DeleteDevice(ctx, name))
+	}()
+
+	retriedID, err := pool.CreateThinDevice(ctx, name, device1Size, WithIdempotentCreate())
+	require.NoError(t, err, "retried create must return existing device")
+	assert.Equal(t, deviceID, retriedID)
+
+	_, err = pool.CreateThinDevice(ctx, name, device1Size)
+	assert.True(t, errors.Is(err, ErrAlreadyExists), "strict create must fail")
+
+	_, err = pool.CreateThinDevice(ctx, name, device2Size, WithIdempotentCreate())
+	assert.True(t, errors.Is(err, ErrDeviceConflict), "size differs")
+
+	_, err = pool.CreateThinDevice(ctx, name, device1Size, WithIdempotentCreate(), WithoutActivation())
+	assert.True(t, errors.Is(err, ErrDeviceConflict), "activation differs")
+
+	_, err = pool.CreateThinDevice(ctx, name, device1Size, WithIdempotentCreate(), WithReadOnly())
+	assert.True(t, errors.Is(err, ErrDeviceConflict), "read-only mode differs")
+}
+
+func testDeviceHooks(t *testing.T, pool *PoolDevice) {
+	const (
+		thinName = "thin-hooks"
+		snapName = "snap-hooks"
+	)
+
+	ctx := context.Background()
+
+	var events []string
+	record := func(kind string) DeviceHook {
+		return func(ctx context.Context, event DeviceEvent) error {
+			events = append(events, fmt.Sprintf("%s %s %d %d %s", kind, event.Name, event.DeviceID, event.SizeBytes, event.ParentName))
+
+			// Device lock is released before hooks run, this would deadlock otherwise
+			unlock := pool.deviceLocks.lock(event.Name)
+			unlock()
+
+			_, err := pool.metadata.GetDevice(ctx, event.Name)
+			if kind == "removed" {
+				assert.True(t, errors.Is(err, ErrDeviceNotFound))
+			} else {
+				assert.NoError(t, err)
+			}
+
+			return errors.New("bookkeeping failed")
+		}
+	}
+
+	pool.hooks = DeviceHooks{
+		OnDeviceCreated:   record("created"),
+		OnSnapshotCreated: record("snapshot"),
+		OnDeviceRemoved:   record("removed"),
+	}
+
+	defer func() {
+		pool.hooks = DeviceHooks{}
+	}()
+
+	thinID, err := pool.CreateThinDevice(ctx, thinName, device1Size)
+	require.NoError(t, err, "failed hook must not fail create")
+
+	snapID, err := pool.CreateSnapshotDevice(ctx, thinName, snapName, device1Size)
+	require.NoError(t, err)
+
+	_, err = pool.CreateThinDevice(ctx, thinName, device1Size)
+	require.Error(t, err, "failed create doesn't call hooks")
+
+	require.NoError(t, pool.DeleteDevice(ctx, snapName))
+	require.NoError(t, pool.DeleteDevice(ctx, thinName))
+
+	assert.Equal(t, []string{
+		fmt.Sprintf("created %s %d %d ", thinName, thinID, device1Size),
+		fmt.Sprintf("snapshot %s %d %d %s", snapName, snapID, device1Size, thinName),
+		fmt.Sprintf("removed %s %d %d %s", snapName, snapID, device1Size, thinName),
+		fmt.Sprintf("removed %s %d %d ", thinName, thinID, device1Size),
+	}, events)
+}
+
+func testGetUsage(t *testing.T, pool *PoolDevice) {
+	const (
+		thinName = "thin-usage"
+		snapName = "snap-usage"
+		size     = 4 * 1024 * 1024
+	)
+
+	ctx := context.Background()
+
+	_, err := pool.CreateThinDevice(ctx, thinName, size)
+	require.NoError(t, err)
+
+	usage, err := pool.GetUsage(ctx, thinName)
+	require.NoError(t, err)
+	assert.Zero(t, usage, "new device has no mapped blocks")
+
+	writeDevice := func(name string, data []byte) {
+		file, err := os.OpenFile(dmsetup.GetFullDevicePath(name), os.O_WRONLY, 0)
+		require.NoError(t, err)
+		defer file.Close()
+
+		_, err = file.Write(data)
+		require.NoError(t, err)
+
+		// Flush commits pool metadata, so the metadata snapshot sees new mappings
+		require.NoError(t, file.Sync())
+	}
+
+	writeDevice(thinName, bytes.Repeat([]byte{1}, 1024*1024))
+
+	usage, err = pool.GetUsage(ctx, thinName)
+	require.NoError(t, err)
+	assert.True(t, usage >= 1024*1024, "written blocks must be counted, got %d", usage)
+
+	_, err = pool.CreateSnapshotDevice(ctx, thinName, snapName, size)
+	require.NoError(t, err)
+
+	usage, err = pool.GetUsage(ctx, snapName)
+	require.NoError(t, err)
+	assert.Zero(t, usage, "blocks shared with the parent aren't counted")
+
+	writeDevice(snapName, []byte{2})
+
+	usage, err = pool.GetUsage(ctx, snapName)
+	require.NoError(t, err)
+	assert.True(t, usage > 0 && usage < 1024*1024, "only overwritten block must be counted, got %d", usage)
+
+	_, err = pool.GetUsage(ctx, "missing")
+	assert.True(t, errors.Is(err, ErrDeviceNotFound))
+
+	for _, name := range []string{snapName, thinName} {
+		require.NoError(t, pool.DeleteDevice(ctx, name))
+	}
+}
+
+func testDiscardOnDelete(t *testing.T, pool *PoolDevice) {
+	const name = "thin-discard"
+	ctx := context.Background()
+
+	pool.discardOnDelete = true
+	pool.metrics = newPoolMetrics(pool.poolName, pool.metadata)
+	defer func() {
+		pool.discardOnDelete = false
+		pool.metrics = nil
+	}()
+
+	_, err := pool.CreateThinDevice(ctx, name, device1Size)
+	require.NoError(t, err)
+
+	err = pool.DeleteDevice(ctx, name)
+	require.NoError(t, err)
+
+	assert.EqualValues(t, device1Size, testutil.ToFloat64(pool.metrics.discardedBytes))
+
+	_, err = pool.metadata.GetDevice(ctx, name)
+	assert.Equal(t, ErrNotFound, errors.Cause(err))
+}
+
+func testConcurrentOperations(t *testing.T, pool *PoolDevice) {
+	const workers = 50
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			// Mix of thin devices and snapshots of the same base device
+			name := fmt.Sprintf("concurrent-%d", i)
+			var err error
+			if i%2 == 0 {
+				_, err = pool.CreateThinDevice(ctx, name, device1Size)
+			} else {
+				_, err = pool.CreateSnapshotDevice(ctx, thinDevice1, name, device1Size)
+			}
+
+			if err != nil {
+				errs <- errors.Wrapf(err, "failed to create %q", name)
+				return
+			}
+
+			if err := pool.RemoveDevice(ctx, name, false); err != nil {
+				errs <- errors.Wrapf(err, "failed to remove %q", name)
+				return
+			}
+
+			if err := pool.DeleteDevice(ctx, name); err != nil {
+				errs <- errors.Wrapf(err, "failed to delete %q", name)
+			}
+		}(i)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		assert.NoError(t, err)
+	}
+
+	assert.Empty(t, pool.deviceLocks.locks, "device locks should be released")
+}
+
+func testLoadExisting(t *testing.T, pool *PoolDevice) {
+	const (
+		name     = "out-of-band"
+		deviceID = 1000
+	)
+
+	ctx := context.Background()
+
+	// Create device bypassing the pool device, like dmsetup tooling would
+	err := dmsetup.CreateDevice(pool.poolName, deviceID)
+	require.NoError(t, err)
+
+	err = dmsetup.ActivateDevice(pool.poolName, name, deviceID, device1Size, "")
+	require.NoError(t, err)
+
+	loaded, err := pool.LoadExisting(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{name}, loaded, "devices known to metadata shouldn't be loaded again")
+
+	info, err := pool.metadata.GetDevice(ctx, name)
+	require.NoError(t, err)
+	assert.EqualValues(t, deviceID, info.DeviceID)
+	assert.EqualValues(t, device1Size, info.Size)
+	assert.True(t, info.IsActivated)
+
+	loaded, err = pool.LoadExisting(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, loaded)
+
+	err = pool.DeleteDevice(ctx, name)
+	assert.NoError(t, err)
+}
+
+func testRemoveThinDevice(t *testing.T, pool *PoolDevice) {
+	deviceList := []string{
+		thinDevice1,
+		thinDevice2,
+		snapDevice1,
+	}
+
+	for _, deviceName := range deviceList {
+		err := pool.RemoveDevice(context.Background(), deviceName, false)
+		assert.NoErrorf(t, err, "failed to remove '%s'", deviceName)
+	}
+
+	err := pool.RemoveDevice(context.Background(), "not-existing-device", false)
+	assert.Error(t, err, "should return an error if trying to remove not existing device")
+}
+
+func testCompactMetadata(t *testing.T, pool *PoolDevice) {
+	if _, err := exec.LookPath("thin_repair"); err != nil {
+		t.Skip("thin_repair is not available")
+	}
+
+	ctx := context.Background()
+
+	err := pool.ReactivateDevice(ctx, thinDevice1)
+	require.NoError(t, err)
+
+	err = pool.CompactMetadata(ctx)
+	assert.Error(t, err, "compaction should be refused while devices are active")
+
+	err = pool.RemoveDevice(ctx, thinDevice1, false)
+	require.NoError(t, err)
+
+	err = pool.CompactMetadata(ctx)
+	require.NoError(t, err)
+
+	// Devices must survive compaction
+	err = pool.ReactivateDevice(ctx, thinDevice1)
+	require.NoError(t, err)
+
+	err = pool.RemoveDevice(ctx, thinDevice1, false)
+	assert.NoError(t, err)
+}
+
+func testRepairPool(t *testing.T, pool *PoolDevice) {
+	if _, err := exec.LookPath("thin_check"); err != nil {
+		t.Skip("thin_check is not available")
+	}
+
+	ctx := context.Background()
+
+	err := pool.CheckPoolHealth(ctx)
+	require.NoError(t, err)
+
+	err = pool.ReactivateDevice(ctx, thinDevice1)
+	require.NoError(t, err)
+
+	err = pool.RepairPool(ctx)
+	assert.Error(t, err, "repair should be refused while devices are active")
+
+	err = pool.RemoveDevice(ctx, thinDevice1, false)
+	require.NoError(t, err)
+
+	// Metadata is consistent, so it's only checked
+	err = pool.RepairPool(ctx)
+	require.NoError(t, err)
+
+	err = pool.ReactivateDevice(ctx, thinDevice1)
+	require.NoError(t, err)
+
+	err = pool.RemoveDevice(ctx, thinDevice1, false)
+	assert.NoError(t, err)
+}
+
+func tempMountPath(t *testing.T) string {
+	path, err := ioutil.TempDir("", "devmapper-snapshotter-mount-")
+	require.NoError(t, err, "failed to get temp directory for mount")
+
+	return path
+}
+
+func createLoopbackDevice(t testing.TB, dir string) (string, string) {
+	file, err := ioutil.TempFile(dir, testsPrefix)
+	require.NoError(t, err)
+
+	size, err := units.RAMInBytes("128Mb")
+	require.NoError(t, err)
+
+	err = file.Truncate(size)
+	require.NoError(t, err)
+
+	err = file.Close()
+	require.NoError(t, err)
+
+	imagePath := file.Name()
+
+	loopDevice, err := losetup.AttachLoopDevice(imagePath)
+	require.NoError(t, err)
+
+	return imagePath, loopDevice
+}
+
+func TestRemovalOrder(t *testing.T) {
+	infos := []*DeviceInfo{
+		{Name: "snap-2", ParentName: "snap-1"},
+		{Name: "thin-1"},
+		{Name: "snap-1", ParentName: "thin-1"},
+		{Name: "thin-2"},
+		{Name: "snap-3", ParentName: "not-in-list"},
+	}
+
+	batches := removalOrder(infos)
+	require.Len(t, batches, 3)
+
+	assert.ElementsMatch(t, []string{"snap-2", "thin-2", "snap-3"}, batches[0])
+	assert.Equal(t, []string{"snap-1"}, batches[1])
+	assert.Equal(t, []string{"thin-1"}, batches[2])
+}
+
+func TestDiffDevicesDifferentOrigins(t *testing.T) {
+	tempDir, store := createStore(t)
+	defer cleanupStore(t, tempDir, store)
+
+	pool := &PoolDevice{poolName: "test-pool", metadata: store}
+	noop := func(uint32) error { return nil }
+
+	for _, info := range []*DeviceInfo{
+		{Name: "thin-1"},
+		{Name: "snap-1", ParentName: "thin-1"},
+		{Name: "snap-2", ParentName: "snap-1"},
+		{Name: "thin-2"},
+		{Name: "snap-3", ParentName: "thin-2"},
+	} {
+		err := store.AddDevice(context.Background(), info, noop)
+		require.NoError(t, err)
+	}
+
+	origin, err := pool.originName(context.Background(), &DeviceInfo{Name: "snap-2", ParentName: "snap-1"})
+	require.NoError(t, err)
+	assert.Equal(t, "thin-1", origin)
+
+	_, err = pool.DiffDevices(context.Background(), "snap-2", "snap-3")
+	assert.EqualError(t, err, `devices "snap-2" and "snap-3" have different origins ("thin-1" and "thin-2")`)
+
+	_, err = pool.DiffDevices(context.Background(), "snap-2", "missing")
+	assert.Error(t, err)
+}
+
+func TestCheckVersions(t *testing.T) {
+	ctx := context.Background()
+	config := &Config{ExtraFeatures: []string{dmsetup.FeatureErrorIfNoSpace}}
+
+	versions := &dmsetup.Versions{
+		Library:  dmsetup.VersionNumber{Major: 1, Minor: 2, Patch: 145},
+		Driver:   dmsetup.VersionNumber{Major: 4, Minor: 37, Patch: 0},
+		ThinPool: dmsetup.VersionNumber{Major: 1, Minor: 19, Patch: 0},
+	}
+
+	deferredRemoval, err := checkVersions(ctx, versions, config)
+	require.NoError(t, err)
+	assert.True(t, deferredRemoval)
+
+	versions.Driver = dmsetup.VersionNumber{Major: 4, Minor: 26, Patch: 0}
+	deferredRemoval, err = checkVersions(ctx, versions, config)
+	require.NoError(t, err)
+	assert.False(t, deferredRemoval, "deferred removal should be disabled on old driver")
+
+	versions.ThinPool = dmsetup.VersionNumber{Major: 1, Minor: 9, Patch: 0}
+	_, err = checkVersions(ctx, versions, config)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), dmsetup.FeatureErrorIfNoSpace)
+
+	versions.ThinPool = dmsetup.VersionNumber{}
+	_, err = checkVersions(ctx, versions, config)
+	assert.NoError(t, err, "feature checks should be skipped if thin-pool version is unknown")
+}
+
+func TestOverProvisioning(t *testing.T) {
+	tempDir, store := createStore(t)
+	defer cleanupStore(t, tempDir, store)
+
+	pool := &PoolDevice{poolName: "test-pool", metadata: store, maxVirtualSizeBytes: 300}
+	noop := func(uint32) error { return nil }
+
+	err := pool.addDevice(context.Background(), &DeviceInfo{Name: "thin-1", Size: 200}, noop)
+	require.NoError(t, err)
+
+	err = pool.addDevice(context.Background(), &DeviceInfo{Name: "snap-1", ParentName: "thin-1", Size: 200}, noop)
+	assert.Equal(t, ErrOverProvisioned, err)
+
+	_, err = store.GetDevice(context.Background(), "snap-1")
+	assert.Equal(t, ErrNotFound, errors.Cause(err), "device shouldn't be saved if limit exceeded")
+
+	err = pool.addDevice(context.Background(), &DeviceInfo{Name: "snap-2", ParentName: "thin-1", Size: 100}, noop)
+	assert.NoError(t, err)
+}
+
+func TestResizeInactiveDevice(t *testing.T) {
+	tempDir, store := createStore(t)
+	defer cleanupStore(t, tempDir, store)
+
+	ctx := context.Background()
+	pool := &PoolDevice{poolName: "test-pool", metadata: store, maxVirtualSizeBytes: 300}
+	noop := func(uint32) error { return nil }
+
+	err := pool.addDevice(ctx, &DeviceInfo{Name: "thin-1", Size: 100}, noop)
+	require.NoError(t, err)
+
+	err = pool.addDevice(ctx, &DeviceInfo{Name: "thin-2", Size: 100}, noop)
+	require.NoError(t, err)
+
+	err = pool.ResizeDevice(ctx, "thin-1", 50)
+	assert.Equal(t, ErrShrinkNotSupported, errors.Cause(err))
+
+	err = pool.ResizeDevice(ctx, "thin-1", 250)
+	assert.Equal(t, ErrOverProvisioned, err)
+
+	err = pool.ResizeDevice(ctx, "thin-1", 200)
+	require.NoError(t, err)
+
+	info, err := store.GetDevice(ctx, "thin-1")
+	require.NoError(t, err)
+	assert.EqualValues(t, 200, info.Size)
+
+	err = pool.ResizeDevice(ctx, "missing", 200)
+	assert.Equal(t, ErrNotFound, errors.Cause(err))
+}
+
+func TestApplyDmsetupSettings(t *testing.T) {
+	ctx := context.Background()
+
+	release1, err := applyDmsetupSettings(ctx, &Config{PoolName: "pool-1", UdevSyncMode: UdevSyncAuto})
+	require.NoError(t, err)
+
+	// Empty device directory is the default one
+	release2, err := applyDmsetupSettings(ctx, &Config{PoolName: "pool-2", DeviceDir: "/dev/mapper/"})
+	require.NoError(t, err)
+
+	_, err = applyDmsetupSettings(ctx, &Config{PoolName: "pool-3", UdevSyncMode: UdevSyncDisabled})
+	assert.Equal(t, ErrDmsetupConflict, errors.Cause(err))
+
+	_, err = applyDmsetupSettings(ctx, &Config{PoolName: "pool-3", DeviceDir: "/chroot/dev/mapper"})
+	assert.Equal(t, ErrDmsetupConflict, errors.Cause(err))
+
+	// Releasing twice doesn't free settings of the other pool
+	release1()
+	release1()
+
+	_, err = applyDmsetupSettings(ctx, &Config{PoolName: "pool-3", UdevSyncMode: UdevSyncDisabled})
+	assert.Equal(t, ErrDmsetupConflict, errors.Cause(err))
+
+	release2()
+
+	// Once all pools are closed, other settings can be used
+	release3, err := applyDmsetupSettings(ctx, &Config{PoolName: "pool-3", UdevSyncMode: UdevSyncDisabled})
+	require.NoError(t, err)
+	release3()
+
+	release4, err := applyDmsetupSettings(ctx, &Config{PoolName: "pool-4"})
+	require.NoError(t, err)
+	release4()
+}
+
+func TestCheckLowSpace(t *testing.T) {
+	var reported []*PoolStatus
+	pool := &PoolDevice{
+		poolName:          "test-pool",
+		lowSpaceThreshold: 80,
+		lowSpaceCallback: func(ctx context.Context, status *PoolStatus) {
+			reported = append(reported, status)
+		},
+	}
+
+	status := func(usedData, usedMetadata uint64) *PoolStatus {
+		return &PoolStatus{PoolStatus: dmsetup.PoolStatus{
+			UsedDataBlocks:      usedData,
+			TotalDataBlocks:     100,
+			UsedMetadataBlocks:  usedMetadata,
+			TotalMetadataBlocks: 100,
+		}}
+	}
+
+	ctx := context.Background()
+
+	pool.checkLowSpace(ctx, status(50, 50))
+	assert.Empty(t, reported)
+
+	low := status(80, 10)
+	pool.checkLowSpace(ctx, low)
+	require.Len(t, reported, 1)
+	assert.Equal(t, low, reported[0])
+
+	pool.checkLowSpace(ctx, status(90, 10))
+	assert.Len(t, reported, 1, "low space should be reported once it's crossed")
+
+	pool.checkLowSpace(ctx, &PoolStatus{PoolStatus: dmsetup.PoolStatus{Fail: true}})
+	assert.Len(t, reported, 1, "failed pool doesn't report usage")
+
+	pool.checkLowSpace(ctx, status(10, 10))
+	pool.checkLowSpace(ctx, status(10, 95))
+	assert.Len(t, reported, 2, "metadata space should be checked as well")
+}
+
+func TestNeedsExtend(t *testing.T) {
+	status := func(usedData uint64, mode string) *PoolStatus {
+		return &PoolStatus{PoolStatus: dmsetup.PoolStatus{
+			UsedDataBlocks:  usedData,
+			TotalDataBlocks: 100,
+			Mode:            mode,
+		}}
+	}
+
+	pool := &PoolDevice{extendThreshold: 90}
+	assert.False(t, pool.needsExtend(status(95, dmsetup.PoolModeReadWrite)), "auto extension is disabled")
+
+	pool.extendFunc = func(context.Context, uint64) (string, error) { return "", nil }
+	assert.False(t, pool.needsExtend(status(50, dmsetup.PoolModeReadWrite)))
+	assert.True(t, pool.needsExtend(status(90, dmsetup.PoolModeReadWrite)))
+	assert.True(t, pool.needsExtend(status(50, dmsetup.PoolModeOutOfDataSpace)), "pool out of space must be extended")
+	assert.False(t, pool.needsExtend(&PoolStatus{PoolStatus: dmsetup.PoolStatus{Fail: true}}), "failed pool can't be extended")
+}
+
+func TestPoolHealth(t *testing.T) {
+	for _, tc := range []struct {
+		status    dmsetup.PoolStatus
+		condition PoolCondition
+		message   string
+	}{
+		{
+			status: dmsetup.PoolStatus{Mode: dmsetup.PoolModeReadWrite},
+		},
+		{
+			status:    dmsetup.PoolStatus{Fail: true},
+			condition: PoolFailed,
+			message:   `pool "test-pool" has failed and needs repair`,
+		},
+		{
+			status:    dmsetup.PoolStatus{Mode: dmsetup.PoolModeReadOnly, NeedsCheck: true},
+			condition: PoolNeedsCheck,
+			message:   `pool "test-pool" has inconsistent metadata and needs repair`,
+		},
+		{
+			status:    dmsetup.PoolStatus{Mode: dmsetup.PoolModeOutOfDataSpace, UsedDataBlocks: 256, TotalDataBlocks: 256},
+			condition: PoolOutOfDataSpace,
+			message:   `pool "test-pool" is out of data space (256 of 256 data blocks used)`,
+		},
+		{
+			status:    dmsetup.PoolStatus{Mode: dmsetup.PoolModeReadOnly, UsedMetadataBlocks: 4096, TotalMetadataBlocks: 4096},
+			condition: PoolReadOnly,
+			message:   `pool "test-pool" is read_only (4096 of 4096 metadata blocks used)`,
+		},
+	} {
+		status := tc.status
+		err := poolHealth("test-pool", &status)
+
+		if tc.condition == "" {
+			assert.NoError(t, err)
+			continue
+		}
+
+		require.IsType(t, &PoolHealthError{}, err)
+		assert.Equal(t, tc.condition, err.(*PoolHealthError).Condition)
+		assert.Equal(t, tc.message, err.Error())
+
+		full := tc.condition == PoolOutOfDataSpace
+		assert.Equal(t, full, errors.Is(err, ErrPoolFull), "%s is full", tc.condition)
+		assert.Equal(t, !full, errors.Is(err, ErrPoolInError), "%s is in error", tc.condition)
+	}
+}
+
+func TestPoolSpaceHealth(t *testing.T) {
+	status := &dmsetup.PoolStatus{
+		Mode:                dmsetup.PoolModeReadWrite,
+		UsedDataBlocks:      80,
+		TotalDataBlocks:     100,
+		UsedMetadataBlocks:  10,
+		TotalMetadataBlocks: 100,
+	}
+
+	assert.NoError(t, poolSpaceHealth("test-pool", status, 0), "zero threshold is disabled")
+	assert.NoError(t, poolSpaceHealth("test-pool", status, 90))
+
+	err := poolSpaceHealth("test-pool", status, 80)
+	require.IsType(t, &PoolHealthError{}, err)
+	assert.Equal(t, PoolLowSpace, err.(*PoolHealthError).Condition)
+	assert.Equal(t, `pool "test-pool" is running out of space (data 80.0%, metadata 10.0% used, threshold 80%)`, err.Error())
+	assert.True(t, errors.Is(err, ErrPoolFull))
+	assert.False(t, errors.Is(err, ErrPoolInError))
+
+	status.UsedDataBlocks = 10
+	status.UsedMetadataBlocks = 95
+	assert.True(t, errors.Is(poolSpaceHealth("test-pool", status, 90), ErrPoolFull), "metadata usage counts too")
+}
+
+func TestHealthyMissingPool(t *testing.T) {
+	pool := &PoolDevice{poolName: "test-pool-missing"}
+
+	err := pool.Healthy(context.Background())
+	assert.True(t, errors.Is(err, ErrPoolMissing))
+	assert.False(t, errors.Is(err, ErrPoolInError))
+}
+
+func TestPoolStatusUsage(t *testing.T) {
+	status := &PoolStatus{PoolStatus: dmsetup.PoolStatus{
+		UsedDataBlocks:      25,
+		TotalDataBlocks:     100,
+		UsedMetadataBlocks:  1,
+		TotalMetadataBlocks: 8,
+	}}
+
+	assert.EqualValues(t, 25, status.DataUsage())
+	assert.EqualValues(t, 12.5, status.MetadataUsage())
+	assert.Zero(t, (&PoolStatus{}).DataUsage())
+}
+
+func TestReserveName(t *testing.T) {
+	tempDir, store := createStore(t)
+	defer cleanupStore(t, tempDir, store)
+
+	ctx := context.Background()
+	pool := &PoolDevice{poolName: "test-pool", metadata: store}
+
+	err := store.AddDevice(ctx, &DeviceInfo{Name: "thin-1"}, func(uint32) error { return nil })
+	require.NoError(t, err)
+
+	_, err = pool.reserveName(ctx, "thin-1")
+	assert.Equal(t, ErrAlreadyExists, errors.Cause(err), "name of existing device can't be reserved")
+
+	release, err := pool.reserveName(ctx, "thin-2")
+	require.NoError(t, err)
+
+	_, err = pool.reserveName(ctx, "thin-2")
+	assert.Equal(t, ErrAlreadyExists, errors.Cause(err), "name can't be reserved twice")
+
+	// Failed create frees the name
+	release()
+
+	release, err = pool.reserveName(ctx, "thin-2")
+	require.NoError(t, err)
+	release()
+}
+
+func TestValidateDeviceName(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		valid bool
+	}{
+		{name: "thin-1", valid: true},
+		{name: "ns-1-snap-2.tmp", valid: true},
+		{name: strings.Repeat("a", maxDeviceNameLength), valid: true},
+		{name: ""},
+		{name: "."},
+		{name: ".."},
+		{name: "../control"},
+		{name: "thin/1"},
+		{name: strings.Repeat("a", maxDeviceNameLength+1)},
+	} {
+		err := validateDeviceName(tc.name)
+		if tc.valid {
+			assert.NoErrorf(t, err, "%q must be valid", tc.name)
+		} else {
+			assert.Equalf(t, ErrInvalidDeviceName, errors.Cause(err), "%q must be invalid", tc.name)
+		}
+	}
+
+	pool := &PoolDevice{poolName: "test-pool"}
+	_, err := pool.CreateThinDevice(context.Background(), "../control", device1Size)
+	assert.Equal(t, ErrInvalidDeviceName, errors.Cause(err))
+}
+
+type testFreezer struct {
+	freezeErr error
+	frozen    int
+	thawed    int
+}
+
+func (f *testFreezer) Freeze(ctx context.Context) error {
+	if f.freezeErr != nil {
+		return f.freezeErr
+	}
+
+	f.frozen++
+	return nil
+}
+
+func (f *testFreezer) Thaw(ctx context.Context) error {
+	f.thawed++
+	return nil
+}
+
+func TestCreateSnapshotFreeze(t *testing.T) {
+	tempDir, store := createStore(t)
+	defer cleanupStore(t, tempDir, store)
+
+	ctx := context.Background()
+	pool := &PoolDevice{poolName: "test-pool-missing", dm: newFakeDeviceMapper("test-pool"), metadata: store}
+
+	err := store.AddDevice(ctx, &DeviceInfo{Name: "thin-1"}, func(uint32) error { return nil })
+	require.NoError(t, err)
+
+	freezer := &testFreezer{freezeErr: errors.New("agent unavailable")}
+	_, err = pool.CreateSnapshotDevice(ctx, "thin-1", "snap-1", device1Size, WithFreeze(freezer))
+	assert.Error(t, err, "snapshot shouldn't be taken if filesystem can't be frozen")
+	assert.Equal(t, 0, freezer.thawed)
+
+	// Pool doesn't exist, so snapshot fails after filesystem is frozen
+	freezer = &testFreezer{}
+	_, err = pool.CreateSnapshotDevice(ctx, "thin-1", "snap-1", device1Size, WithFreeze(freezer))
+	assert.Error(t, err)
+	assert.Equal(t, 1, freezer.frozen)
+	assert.Equal(t, 1, freezer.thawed, "filesystem should be thawed if snapshot fails")
+}
+
+func TestRemoveDevicesCancelled(t *testing.T) {
+	tempDir, store := createStore(t)
+	defer cleanupStore(t, tempDir, store)
+
+	pool := &PoolDevice{poolName: "test-pool", dm: newFakeDeviceMapper("test-pool"), metadata: store}
+	noop := func(uint32) error { return nil }
+
+	for _, info := range []*DeviceInfo{
+		{Name: "thin-1", IsActivated: true},
+		{Name: "snap-1", ParentName: "thin-1", IsActivated: true},
+		{Name: "thin-2", IsActivated: true},
+	} {
+		err := pool.addDevice(context.Background(), info, noop)
+		require.NoError(t, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := pool.RemovePool(ctx, false)
+	require.IsType(t, &multierror.Error{}, err)
+
+	// Every device which wasn't removed is listed, pool removal isn't attempted
+	errs := err.(*multierror.Error).Errors
+	require.Len(t, errs, 3)
+	for _, name := range []string{"thin-1", "snap-1", "thin-2"} {
+		assert.Contains(t, err.Error(), fmt.Sprintf("failed to remove %q: context canceled", name))
+	}
+
+	for _, name := range []string{"thin-1", "snap-1", "thin-2"} {
+		info, err := store.GetDevice(context.Background(), name)
+		require.NoError(t, err)
+		assert.True(t, info.IsActivated, "device should be kept for retry")
+	}
+}
+
+func TestSuspendInactiveDevice(t *testing.T) {
+	tempDir, store := createStore(t)
+	defer cleanupStore(t, tempDir, store)
+
+	ctx := context.Background()
+	pool := &PoolDevice{poolName: "test-pool", metadata: store}
+
+	err := store.AddDevice(ctx, &DeviceInfo{Name: "thin-1"}, func(uint32) error { return nil })
+	require.NoError(t, err)
+
+	err = pool.SuspendDevice(ctx, "thin-1")
+	assert.EqualError(t, err, `device "thin-1" is not activated`)
+
+	err = pool.ResumeDevice(ctx, "thin-1")
+	assert.EqualError(t, err, `device "thin-1" is not activated`)
+
+	err = pool.SuspendDevice(ctx, "missing")
+	assert.Equal(t, ErrNotFound, errors.Cause(err))
+}
+
+func TestPoolDeviceCloseTwice(t *testing.T) {
+	tempDir, store := createStore(t)
+	defer os.RemoveAll(tempDir)
+
+	pool := &PoolDevice{poolName: "test-pool", metadata: store}
+
+	err := pool.Close()
+	assert.NoError(t, err)
+
+	err = pool.Close()
+	assert.NoError(t, err, "second close should return the result of the first one")
+}
+
+func TestWaitForDeviceNode(t *testing.T) {
+	ctx := context.Background()
+
+	err := waitForDeviceNode(ctx, "/dev/null", time.Second)
+	assert.NoError(t, err)
+
+	tempDir, err := ioutil.TempDir("", testsPrefix)
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	path := filepath.Join(tempDir, "regular-file")
+	err = ioutil.WriteFile(path, nil, 0600)
+	require.NoError(t, err)
+
+	err = waitForDeviceNode(ctx, path, 50*time.Millisecond)
+	assert.Error(t, err, "regular file is not a device node")
+
+	err = waitForDeviceNode(ctx, filepath.Join(tempDir, "missing"), 50*time.Millisecond)
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, ErrDeviceNodeTimeout))
+	assert.Contains(t, err.Error(), "didn't appear")
+
+	// Node appearing while waiting is picked up
+	nodePath := filepath.Join(tempDir, "node")
+	go func() {
+		time.Sleep(30 * time.Millisecond)
+		_ = os.Symlink("/dev/null", nodePath)
+	}()
+
+	err = waitForDeviceNode(ctx, nodePath, time.Second)
+	assert.NoError(t, err)
+
+	// Caller giving up isn't a timeout
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+
+	err = waitForDeviceNode(cancelled, filepath.Join(tempDir, "missing"), time.Second)
+	assert.Equal(t, context.Canceled, errors.Cause(err))
+	assert.False(t, errors.Is(err, ErrDeviceNodeTimeout))
+}
+
+func TestPoolDeviceStats(t *testing.T) {
+	tempDir, store := createStore(t)
+	defer cleanupStore(t, tempDir, store)
+
+	ctx := context.Background()
+	pool := &PoolDevice{poolName: "test-pool", metadata: store, maxDevices: 3}
+
+	err := pool.addDevice(ctx, &DeviceInfo{Name: "thin-1", IsActivated: true}, testDevIDCallback)
+	require.NoError(t, err)
+
+	// Device ID taken out of band is not available
+	taken := true
+	err = pool.addDevice(ctx, &DeviceInfo{Name: "thin-2"}, func(uint32) error {
+		if taken {
+			taken = false
+			return ErrDeviceIDTaken
+		}
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	stats, err := pool.Stats(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, &PoolDeviceStats{
+		Devices:            2,
+		ActiveDevices:      1,
+		InactiveDevices:    1,
+		MaxDevices:         3,
+		AvailableDeviceIDs: maxDeviceID - 1 - 3,
+		RemainingDevices:   1,
+	}, stats)
+
+	err = pool.addDevice(ctx, &DeviceInfo{Name: "thin-3"}, testDevIDCallback)
+	require.NoError(t, err)
+
+	err = pool.addDevice(ctx, &DeviceInfo{Name: "thin-4"}, testDevIDCallback)
+	assert.True(t, errors.Is(err, ErrPoolAtCapacity))
+
+	stats, err = pool.Stats(ctx)
+	require.NoError(t, err)
+	assert.Zero(t, stats.RemainingDevices)
+
+	// Deleted device frees the slot
+	err = store.RemoveDevice(ctx, "thin-3", testDevInfoCallback)
+	require.NoError(t, err)
+
+	err = pool.addDevice(ctx, &DeviceInfo{Name: "thin-4"}, testDevIDCallback)
+	assert.NoError(t, err)
+}
+
+func TestListDevices(t *testing.T) {
+	tempDir, store := createStore(t)
+	defer cleanupStore(t, tempDir, store)
+
+	ctx := context.Background()
+	pool := &PoolDevice{poolName: "test-pool", metadata: store}
+
+	err := pool.addDevice(ctx, &DeviceInfo{Name: "thin-1", Size: 1024}, testDevIDCallback)
+	require.NoError(t, err)
+
+	err = pool.addDevice(ctx, &DeviceInfo{Name: "snap-1", Size: 2048, ParentName: "thin-1", IsActivated: true}, testDevIDCallback)
+	require.NoError(t, err)
+
+	// Device saved by older versions has no creation time
+	err = store.ImportDevice(ctx, &DeviceInfo{Name: "thin-old", DeviceID: 100})
+	require.NoError(t, err)
+
+	err = store.UpdateDevice(ctx, "thin-old", func(info *DeviceInfo) error {
+		info.CreatedAt = time.Time{}
+		return nil
+	})
+	require.NoError(t, err)
+
+	summaries, err := pool.ListDevices(ctx)
+	require.NoError(t, err)
+	require.Len(t, summaries, 3)
+
+	snap := summaries[0]
+	assert.Equal(t, "snap-1", snap.Name)
+	assert.Equal(t, "thin-1", snap.ParentName)
+	assert.EqualValues(t, 2048, snap.Size)
+	assert.True(t, snap.IsActivated)
+	assert.False(t, snap.ActivatedAt.IsZero())
+	assert.True(t, snap.Age >= 0)
+
+	assert.Equal(t, "thin-1", summaries[1].Name)
+	assert.False(t, summaries[1].IsActivated)
+	assert.True(t, summaries[1].ActivatedAt.IsZero())
+
+	assert.Equal(t, "thin-old", summaries[2].Name)
+	assert.Zero(t, summaries[2].Age, "age of device without creation time is unknown")
+}
+
+func TestRenameReservedName(t *testing.T) {
+	tempDir, store := createStore(t)
+	defer cleanupStore(t, tempDir, store)
+
+	ctx := context.Background()
+	pool := &PoolDevice{poolName: "test-pool", metadata: store, reservedNames: make(map[string]struct{})}
+
+	err := pool.addDevice(ctx, &DeviceInfo{Name: "thin-1"}, testDevIDCallback)
+	require.NoError(t, err)
+
+	release, err := pool.reserveName(ctx, "thin-2")
+	require.NoError(t, err)
+
+	err = pool.RenameDevice(ctx, "thin-1", "thin-2")
+	assert.True(t, errors.Is(err, ErrAlreadyExists), "name of device being created is taken")
+
+	release()
+
+	err = pool.RenameDevice(ctx, "thin-1", "thin-2")
+	require.NoError(t, err, "inactive device is renamed in metadata only")
+
+	_, err = pool.reserveName(ctx, "thin-1")
+	assert.NoError(t, err, "old name is free once renamed")
+}
+
+func TestCreateOptionsDeviceNodeTimeout(t *testing.T) {
+	assert.Equal(t, deviceNodeTimeout, makeCreateOptions(nil).nodeTimeout)
+	assert.Zero(t, makeCreateOptions([]CreateOpt{WithDeviceNodeTimeout(0)}).nodeTimeout)
+
+	pool := &PoolDevice{}
+	_, err := pool.CreateThinDevice(context.Background(), "thin-1", device1Size, WithFilesystem("ext4"), WithDeviceNodeTimeout(0))
+	assert.Error(t, err, "mkfs needs device node")
+}
+
+func TestCheckThinPoolMetadata(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", testsPrefix)
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	superblock := make([]byte, 4096)
+	binary.LittleEndian.PutUint64(superblock[thinPoolMetadataMagicOffset:], thinPoolMetadataMagic)
+
+	path := filepath.Join(tempDir, "metadata")
+	err = ioutil.WriteFile(path, superblock, 0600)
+	require.NoError(t, err)
+
+	err = checkThinPoolMetadata(path)
+	assert.NoError(t, err)
+
+	err = ioutil.WriteFile(path, make([]byte, 4096), 0600)
+	require.NoError(t, err)
+
+	err = checkThinPoolMetadata(path)
+	assert.Error(t, err, "zeroed device has no metadata")
+
+	err = ioutil.WriteFile(path, superblock[:16], 0600)
+	require.NoError(t, err)
+
+	err = checkThinPoolMetadata(path)
+	assert.Error(t, err, "device is too small to fit superblock")
+}
+
+func TestNewPoolDeviceBlockSize(t *testing.T) {
+	for _, sectors := range []uint32{127, 129, 2097152 + 128} {
+		_, err := NewPoolDevice(context.Background(), &Config{PoolName: "test-pool", DataBlockSizeSectors: sectors})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "invalid data block size", "%d sectors must be rejected before creating pool", sectors)
+	}
+}
+
+func TestCheckMetadataVolume(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", testsPrefix)
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	path := filepath.Join(tempDir, "metadata")
+	err = ioutil.WriteFile(path, make([]byte, 8192), 0600)
+	require.NoError(t, err)
+
+	err = checkMetadataVolume(context.Background(), path, false)
+	assert.NoError(t, err, "zeroed metadata is formatted by the pool and isn't checked")
+
+	superblock := make([]byte, 8192)
+	binary.LittleEndian.PutUint64(superblock[thinPoolMetadataMagicOffset:], thinPoolMetadataMagic)
+	err = ioutil.WriteFile(path, superblock, 0600)
+	require.NoError(t, err)
+
+	err = checkMetadataVolume(context.Background(), path, false)
+	assert.Error(t, err, "superblock without metadata behind it must fail thin_check")
+
+	err = ioutil.WriteFile(path, make([]byte, 16), 0600)
+	require.NoError(t, err)
+
+	err = checkMetadataVolume(context.Background(), path, false)
+	assert.Error(t, err, "device is too small to fit superblock")
+}
+
+func TestRoundUpToBlocks(t *testing.T) {
+	for _, tc := range []struct {
+		size     uint64
+		sectors  uint32
+		expected uint64
+	}{
+		{size: 1, sectors: 128, expected: 65536},
+		{size: 65536, sectors: 128, expected: 65536},
+		{size: 65537, sectors: 128, expected: 131072},
+		{size: 100000, sectors: 128, expected: 131072},
+		{size: 1 << 30, sectors: 2048, expected: 1 << 30},
+		{size: 100000, sectors: 0, expected: 100000},
+	} {
+		assert.Equal(t, tc.expected, roundUpToBlocks(tc.size, tc.sectors), "%d bytes, %d sectors block", tc.size, tc.sectors)
+	}
 }
@@ -0,0 +1,184 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package devmapper
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrPoolNotFound is returned when the manager has no pool with the given name
+	ErrPoolNotFound = errors.New("pool not found")
+
+	// ErrPoolAlreadyExists is returned by CreatePool when the manager already has a pool with the same name
+	ErrPoolAlreadyExists = errors.New("pool already exists")
+)
+
+// PoolManager owns several thin-pools on one host and routes device operations to them by pool name.
+// Device IDs are allocated per pool, so pools don't coordinate with each other.
+type PoolManager struct {
+	// Serializes pool creation, so the same pool isn't created twice
+	createMutex sync.Mutex
+
+	mutex sync.RWMutex
+	pools map[string]*PoolDevice
+
+	// Configs of managed pools, new pools must agree with them on process-wide dmsetup settings
+	configs map[string]*Config
+
+	// Creates pool devices, replaced in tests
+	newPool func(ctx context.Context, config *Config, opts ...PoolOpt) (*PoolDevice, error)
+}
+
+// NewPoolManager creates manager without pools, add them with CreatePool
+func NewPoolManager() *PoolManager {
+	return &PoolManager{
+		pools:   make(map[string]*PoolDevice),
+		configs: make(map[string]*Config),
+		newPool: NewPoolDevice,
+	}
+}
+
+// CreatePool creates (or reloads existing) thin-pool with NewPoolDevice and starts managing it.
+// Returns ErrPoolAlreadyExists if the manager already has a pool with the same name, and ErrDmsetupConflict if
+// udev_sync_mode or device_dir differs from managed pools (dmsetup applies them to the whole process).
+func (m *PoolManager) CreatePool(ctx context.Context, config *Config, opts ...PoolOpt) (*PoolDevice, error) {
+	m.createMutex.Lock()
+	defer m.createMutex.Unlock()
+
+	if _, err := m.Pool(config.PoolName); err == nil {
+		return nil, errors.Wrapf(ErrPoolAlreadyExists, "pool %q", config.PoolName)
+	}
+
+	if err := m.checkDmsetupSettings(config); err != nil {
+		return nil, err
+	}
+
+	pool, err := m.newPool(ctx, config, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.pools[config.PoolName] = pool
+	m.configs[config.PoolName] = config
+	return pool, nil
+}
+
+// checkDmsetupSettings fails if udev sync mode or device directory of config differs from any managed pool
+func (m *PoolManager) checkDmsetupSettings(config *Config) error {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	udevSync, deviceDir := dmsetupSettingsOf(config)
+	for name, managed := range m.configs {
+		managedUdevSync, managedDeviceDir := dmsetupSettingsOf(managed)
+		if udevSync != managedUdevSync {
+			return errors.Wrapf(ErrDmsetupConflict, "udev_sync_mode of pool %q is %q, pool %q uses %q",
+				config.PoolName, config.UdevSyncMode, name, managed.UdevSyncMode)
+		}
+
+		if deviceDir != managedDeviceDir {
+			return errors.Wrapf(ErrDmsetupConflict, "device_dir of pool %q is %q, pool %q uses %q",
+				config.PoolName, deviceDir, name, managedDeviceDir)
+		}
+	}
+
+	return nil
+}
+
+// Pool returns managed pool by name, ErrPoolNotFound if there is no such pool
+func (m *PoolManager) Pool(poolName string) (*PoolDevice, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	pool, ok := m.pools[poolName]
+	if !ok {
+		return nil, errors.Wrapf(ErrPoolNotFound, "pool %q", poolName)
+	}
+
+	return pool, nil
+}
+
+// PoolNames returns sorted names of managed pools
+func (m *PoolManager) PoolNames() []string {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	names := make([]string, 0, len(m.pools))
+	for name := range m.pools {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// CreateThinDevice creates thin device in the given pool, see PoolDevice.CreateThinDevice
+func (m *PoolManager) CreateThinDevice(ctx context.Context, poolName, deviceName string, virtualSizeBytes uint64, opts ...CreateOpt) (uint32, error) {
+	pool, err := m.Pool(poolName)
+	if err != nil {
+		return 0, err
+	}
+
+	return pool.CreateThinDevice(ctx, deviceName, virtualSizeBytes, opts...)
+}
+
+// RemoveDevice deactivates device of the given pool, see PoolDevice.RemoveDevice
+func (m *PoolManager) RemoveDevice(ctx context.Context, poolName, deviceName string, deferred bool) error {
+	pool, err := m.Pool(poolName)
+	if err != nil {
+		return err
+	}
+
+	return pool.RemoveDevice(ctx, deviceName, deferred)
+}
+
+// DeleteDevice deletes device of the given pool, see PoolDevice.DeleteDevice
+func (m *PoolManager) DeleteDevice(ctx context.Context, poolName, deviceName string) error {
+	pool, err := m.Pool(poolName)
+	if err != nil {
+		return err
+	}
+
+	return pool.DeleteDevice(ctx, deviceName)
+}
+
+// Close closes all managed pools (pools themselves are kept) and stops managing them.
+// Errors of all pools are returned as multierror.
+func (m *PoolManager) Close() error {
+	m.createMutex.Lock()
+	defer m.createMutex.Unlock()
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var result *multierror.Error
+	for name, pool := range m.pools {
+		if err := pool.Close(); err != nil {
+			result = multierror.Append(result, errors.Wrapf(err, "failed to close pool %q", name))
+		}
+	}
+
+	m.pools = make(map[string]*PoolDevice)
+	m.configs = make(map[string]*Config)
+	return result.ErrorOrNil()
+}
@@ -0,0 +1,161 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package devmapper
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPoolManager(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "pool-manager-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	var (
+		mutex   sync.Mutex
+		created = make(map[string]int)
+	)
+
+	manager := NewPoolManager()
+	manager.newPool = func(ctx context.Context, config *Config, opts ...PoolOpt) (*PoolDevice, error) {
+		mutex.Lock()
+		created[config.PoolName]++
+		mutex.Unlock()
+
+		// Give concurrent creates of the same pool a chance to overlap
+		time.Sleep(10 * time.Millisecond)
+
+		store, err := NewPoolMetadata(filepath.Join(tempDir, config.PoolName+".db"))
+		if err != nil {
+			return nil, err
+		}
+
+		return &PoolDevice{poolName: config.PoolName, metadata: store}, nil
+	}
+
+	ctx := context.Background()
+	poolNames := []string{"pool-a", "pool-b"}
+
+	var (
+		wg        sync.WaitGroup
+		successes = make([]int, len(poolNames))
+	)
+
+	for i := 0; i < 10; i++ {
+		for idx, name := range poolNames {
+			wg.Add(1)
+			go func(idx int, name string) {
+				defer wg.Done()
+
+				_, err := manager.CreatePool(ctx, &Config{PoolName: name})
+				if err == nil {
+					mutex.Lock()
+					successes[idx]++
+					mutex.Unlock()
+					return
+				}
+
+				assert.Equal(t, ErrPoolAlreadyExists, errors.Cause(err))
+			}(idx, name)
+		}
+	}
+
+	wg.Wait()
+
+	assert.Equal(t, []int{1, 1}, successes, "each pool must be created once")
+	assert.Equal(t, map[string]int{"pool-a": 1, "pool-b": 1}, created)
+	assert.Equal(t, poolNames, manager.PoolNames())
+
+	// Operations are routed to the pool owning the device
+	poolA, err := manager.Pool("pool-a")
+	require.NoError(t, err)
+
+	err = poolA.metadata.AddDevice(ctx, &DeviceInfo{Name: "thin-1"}, func(uint32) error { return nil })
+	require.NoError(t, err)
+
+	err = manager.RemoveDevice(ctx, "pool-a", "thin-1", false)
+	assert.NoError(t, err, "inactive device removal is a no-op")
+
+	err = manager.RemoveDevice(ctx, "pool-b", "thin-1", false)
+	assert.Equal(t, ErrNotFound, errors.Cause(err), "device belongs to another pool")
+	assert.True(t, errors.Is(err, ErrDeviceNotFound))
+
+	_, err = manager.CreateThinDevice(ctx, "pool-c", "thin-1", device1Size)
+	assert.Equal(t, ErrPoolNotFound, errors.Cause(err))
+
+	err = manager.Close()
+	assert.NoError(t, err)
+	assert.Empty(t, manager.PoolNames())
+
+	_, err = manager.Pool("pool-a")
+	assert.Equal(t, ErrPoolNotFound, errors.Cause(err))
+}
+
+func TestPoolManagerCreateFailed(t *testing.T) {
+	manager := NewPoolManager()
+	manager.newPool = func(ctx context.Context, config *Config, opts ...PoolOpt) (*PoolDevice, error) {
+		return nil, errors.New("create failed")
+	}
+
+	_, err := manager.CreatePool(context.Background(), &Config{PoolName: "pool-a"})
+	assert.EqualError(t, err, "create failed")
+
+	_, err = manager.Pool("pool-a")
+	assert.Equal(t, ErrPoolNotFound, errors.Cause(err), "failed pool must not be managed")
+}
+
+func TestPoolManagerDmsetupConflict(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "pool-manager-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	manager := NewPoolManager()
+	manager.newPool = func(ctx context.Context, config *Config, opts ...PoolOpt) (*PoolDevice, error) {
+		store, err := NewPoolMetadata(filepath.Join(tempDir, config.PoolName+".db"))
+		if err != nil {
+			return nil, err
+		}
+
+		return &PoolDevice{poolName: config.PoolName, metadata: store}, nil
+	}
+
+	defer manager.Close()
+
+	ctx := context.Background()
+
+	_, err = manager.CreatePool(ctx, &Config{PoolName: "pool-a", UdevSyncMode: UdevSyncAuto, DeviceDir: "/dev/mapper"})
+	require.NoError(t, err)
+
+	// Empty values are defaults, so they match
+	_, err = manager.CreatePool(ctx, &Config{PoolName: "pool-b"})
+	require.NoError(t, err)
+
+	_, err = manager.CreatePool(ctx, &Config{PoolName: "pool-c", UdevSyncMode: UdevSyncDisabled})
+	assert.Equal(t, ErrDmsetupConflict, errors.Cause(err))
+
+	_, err = manager.CreatePool(ctx, &Config{PoolName: "pool-c", DeviceDir: "/chroot/dev/mapper"})
+	assert.Equal(t, ErrDmsetupConflict, errors.Cause(err))
+
+	assert.Equal(t, []string{"pool-a", "pool-b"}, manager.PoolNames(), "conflicting pool must not be managed")
+}
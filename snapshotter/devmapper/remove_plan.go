@@ -0,0 +1,190 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package devmapper
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/containerd/containerd/log"
+	"github.com/pkg/errors"
+
+	"github.com/firecracker-microvm/firecracker-containerd/snapshotter/pkg/dmsetup"
+)
+
+var (
+	// mountInfoPath lists mounts with device numbers of their sources
+	mountInfoPath = "/proc/self/mountinfo"
+
+	// sysDevBlockPath has sysfs directories of block devices by device number
+	sysDevBlockPath = "/sys/dev/block"
+)
+
+// DeviceRemovalInfo describes a device of the pool and what would keep RemovePool from removing it right away
+type DeviceRemovalInfo struct {
+	Name     string
+	DeviceID uint32
+	// Active is set if device-mapper has live table for the device, inactive devices have nothing to remove
+	Active bool
+	// OpenCount is the number of open references to the device
+	OpenCount uint32
+	// MountPoints lists where the device is mounted
+	MountPoints []string
+	// Holders lists devices stacked on top of the device, by device-mapper name if they have one
+	Holders []string
+}
+
+// Busy reports whether the device is open, mounted or held by another device. Removal of busy device
+// is deferred until it's released, or fails if deferred removal is disabled.
+func (i *DeviceRemovalInfo) Busy() bool {
+	return i.OpenCount > 0 || len(i.MountPoints) > 0 || len(i.Holders) > 0
+}
+
+// PlanRemovePool reports devices RemovePool would remove and whether they're busy, without removing anything.
+// Devices are sorted by name.
+func (p *PoolDevice) PlanRemovePool(ctx context.Context) ([]DeviceRemovalInfo, error) {
+	deviceNames, err := p.metadata.GetDeviceNames(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't query device names")
+	}
+
+	// Query all devices, as dmsetup doesn't report a missing device with an error code
+	dmInfos, err := p.dm.Info("")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to query device-mapper devices")
+	}
+
+	active := make(map[string]*dmsetup.DeviceInfo, len(dmInfos))
+	for _, dmInfo := range dmInfos {
+		active[dmInfo.Name] = dmInfo
+	}
+
+	mounts, err := readMountPoints(mountInfoPath)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(deviceNames)
+
+	plan := make([]DeviceRemovalInfo, 0, len(deviceNames))
+	for _, name := range deviceNames {
+		info, err := p.metadata.GetDevice(ctx, name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to get device info %q", name)
+		}
+
+		removal := DeviceRemovalInfo{
+			Name:     info.Name,
+			DeviceID: info.DeviceID,
+		}
+
+		if dmInfo, ok := active[name]; ok && dmInfo.TableLive {
+			devNumber := fmt.Sprintf("%d:%d", dmInfo.Major, dmInfo.Minor)
+
+			removal.Active = true
+			removal.OpenCount = dmInfo.OpenCount
+			removal.MountPoints = mounts[devNumber]
+
+			removal.Holders, err = readHolders(filepath.Join(sysDevBlockPath, devNumber))
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		plan = append(plan, removal)
+	}
+
+	return plan, nil
+}
+
+// readMountPoints parses mountinfo file and returns mount points by "major:minor" of their source device
+func readMountPoints(path string) (map[string][]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open %q", path)
+	}
+
+	defer file.Close()
+
+	mounts := make(map[string][]string)
+
+	// Fields are mount ID, parent ID, major:minor, root, mount point, followed by options
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			continue
+		}
+
+		mounts[fields[2]] = append(mounts[fields[2]], unescapeMountPath(fields[4]))
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrapf(err, "failed to read %q", path)
+	}
+
+	return mounts, nil
+}
+
+// mountPathEscapes are octal escapes kernel uses for characters of mount paths which would break field parsing
+var mountPathEscapes = strings.NewReplacer(`\040`, " ", `\011`, "\t", `\012`, "\n", `\134`, `\`)
+
+func unescapeMountPath(path string) string {
+	return mountPathEscapes.Replace(path)
+}
+
+// readHolders lists holders of the block device in the given sysfs directory.
+// Device-mapper holders are reported by their device-mapper name.
+func readHolders(devicePath string) ([]string, error) {
+	entries, err := ioutil.ReadDir(filepath.Join(devicePath, "holders"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "failed to list holders of %q", devicePath)
+	}
+
+	var holders []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if dmName, err := ioutil.ReadFile(filepath.Join(devicePath, "holders", name, "dm", "name")); err == nil {
+			name = strings.TrimSpace(string(dmName))
+		}
+
+		holders = append(holders, name)
+	}
+
+	return holders, nil
+}
+
+// warnBusyDevices logs devices which RemovePool can't remove right away, so they're reported before teardown
+func (p *PoolDevice) warnBusyDevices(ctx context.Context) {
+	plan, err := p.PlanRemovePool(ctx)
+	if err != nil {
+		log.G(ctx).WithError(err).Warn("failed to check whether devices are busy")
+		return
+	}
+
+	for _, removal := range plan {
+		if removal.Busy() {
+			log.G(ctx).Warnf("device %q is busy (open count %d, mounted at %v, held by %v), its removal is deferred or fails",
+				removal.Name, removal.OpenCount, removal.MountPoints, removal.Holders)
+		}
+	}
+}
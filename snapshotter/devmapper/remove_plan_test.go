@@ -0,0 +1,80 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package devmapper
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadMountPoints(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", testsPrefix)
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	mountInfo := `22 1 253:3 / /mnt/thin-1 rw,relatime shared:1 - ext4 /dev/mapper/thin-1 rw
+23 1 253:3 / /run/vm\040rootfs rw,relatime shared:2 - ext4 /dev/mapper/thin-1 rw
+24 1 0:21 / /proc rw,nosuid - proc proc rw
+truncated line
+`
+
+	path := filepath.Join(tempDir, "mountinfo")
+	err = ioutil.WriteFile(path, []byte(mountInfo), 0600)
+	require.NoError(t, err)
+
+	mounts, err := readMountPoints(path)
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"/mnt/thin-1", "/run/vm rootfs"}, mounts["253:3"])
+	assert.Equal(t, []string{"/proc"}, mounts["0:21"])
+	assert.Empty(t, mounts["253:4"])
+
+	_, err = readMountPoints(filepath.Join(tempDir, "missing"))
+	assert.Error(t, err)
+}
+
+func TestReadHolders(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", testsPrefix)
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	holders, err := readHolders(tempDir)
+	assert.NoError(t, err, "device without holders directory has no holders")
+	assert.Empty(t, holders)
+
+	err = os.MkdirAll(filepath.Join(tempDir, "holders", "dm-4", "dm"), 0700)
+	require.NoError(t, err)
+
+	err = ioutil.WriteFile(filepath.Join(tempDir, "holders", "dm-4", "dm", "name"), []byte("crypt-1\n"), 0600)
+	require.NoError(t, err)
+
+	err = os.MkdirAll(filepath.Join(tempDir, "holders", "md0"), 0700)
+	require.NoError(t, err)
+
+	holders, err = readHolders(tempDir)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"crypt-1", "md0"}, holders)
+}
+
+func TestDeviceRemovalInfoBusy(t *testing.T) {
+	assert.False(t, (&DeviceRemovalInfo{Name: "thin-1", Active: true}).Busy())
+	assert.True(t, (&DeviceRemovalInfo{Name: "thin-1", Active: true, OpenCount: 1}).Busy())
+	assert.True(t, (&DeviceRemovalInfo{Name: "thin-1", Active: true, MountPoints: []string{"/mnt"}}).Busy())
+	assert.True(t, (&DeviceRemovalInfo{Name: "thin-1", Active: true, Holders: []string{"crypt-1"}}).Busy())
+}
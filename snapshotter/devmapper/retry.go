@@ -0,0 +1,146 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package devmapper
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+
+	"github.com/firecracker-microvm/firecracker-containerd/snapshotter/pkg/dmsetup"
+)
+
+const (
+	// Defaults used when remove_retries and remove_retry_delay aren't configured
+	defaultRemoveRetries    = 3
+	defaultRemoveRetryDelay = 500 * time.Millisecond
+
+	// Longest delay between two retries, however many retries are configured
+	maxRemoveRetryDelay = 30 * time.Second
+)
+
+// removeRetry defines how removal of a busy device and transiently failed activation are retried
+type removeRetry struct {
+	retries int
+	delay   time.Duration
+	timeout time.Duration
+}
+
+// newRemoveRetry makes retry settings from config, zero values are replaced with defaults
+// as config may be created without LoadConfig
+func newRemoveRetry(config *Config) removeRetry {
+	r := removeRetry{
+		retries: config.RemoveRetries,
+		delay:   config.RemoveRetryDelayDuration,
+		timeout: config.RemoveRetryTimeoutDuration,
+	}
+
+	if r.retries == 0 {
+		r.retries = defaultRemoveRetries
+	} else if r.retries < 0 {
+		r.retries = 0
+	}
+
+	if r.delay == 0 {
+		r.delay = defaultRemoveRetryDelay
+	}
+
+	return r
+}
+
+// backoff returns delay before the given retry (starting from zero). The delay doubles with each retry up to
+// maxRemoveRetryDelay and is randomized within [d/2, d), so concurrent removals don't retry in lockstep.
+func (r removeRetry) backoff(retry int) time.Duration {
+	d := r.delay
+	for i := 0; i < retry && d < maxRemoveRetryDelay; i++ {
+		d *= 2
+	}
+
+	if d > maxRemoveRetryDelay {
+		d = maxRemoveRetryDelay
+	}
+
+	half := d / 2
+	if half <= 0 {
+		return d
+	}
+
+	return half + time.Duration(rand.Int63n(int64(d-half)))
+}
+
+// removeWithRetries removes device-mapper device, retrying while it's busy (like when unmount is still in progress)
+func (p *PoolDevice) removeWithRetries(ctx context.Context, deviceName string, opts ...dmsetup.RemoveDeviceOpt) error {
+	return p.withRetries(ctx, "removal", deviceName, isBusyError, func() error {
+		return p.dm.RemoveDevice(ctx, deviceName, opts...)
+	})
+}
+
+// activateWithRetries activates thin device, retrying while udev still holds or hasn't settled device-mapper
+// nodes of the table just loaded. Other errors (like invalid size or table) fail the same way on retry.
+func (p *PoolDevice) activateWithRetries(ctx context.Context, info *DeviceInfo, opts ...dmsetup.ActivateDeviceOpt) error {
+	return p.withRetries(ctx, "activation", info.Name, isTransientActivateError, func() error {
+		return p.dm.ActivateDevice(p.poolName, info.Name, info.DeviceID, info.Size, info.ExternalOrigin, opts...)
+	})
+}
+
+func isBusyError(err error) bool {
+	return errors.Cause(err) == unix.EBUSY
+}
+
+// isTransientActivateError reports whether activation failed because device nodes were busy or not there yet
+func isTransientActivateError(err error) bool {
+	switch errors.Cause(err) {
+	case unix.EBUSY, unix.ENXIO:
+		return true
+	default:
+		return false
+	}
+}
+
+// withRetries calls fn until it succeeds or fails with an error which isn't transient, retrying with backoff
+// of removeRetry settings. what names the operation in log and error messages.
+func (p *PoolDevice) withRetries(ctx context.Context, what, deviceName string, transient func(error) bool, fn func() error) error {
+	settings := p.currentRemoveRetry()
+
+	var deadline time.Time
+	if settings.timeout > 0 {
+		deadline = time.Now().Add(settings.timeout)
+	}
+
+	for retry := 0; ; retry++ {
+		err := fn()
+		if err == nil || !transient(err) || retry >= settings.retries {
+			return err
+		}
+
+		delay := settings.backoff(retry)
+		if !deadline.IsZero() && time.Now().Add(delay).After(deadline) {
+			return errors.Wrapf(err, "%s of device %q still fails after %s", what, deviceName, settings.timeout)
+		}
+
+		log.G(ctx).WithError(err).Debugf("%s of device %q failed, retrying in %s", what, deviceName, delay)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
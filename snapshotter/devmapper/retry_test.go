@@ -0,0 +1,63 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package devmapper
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewRemoveRetry(t *testing.T) {
+	r := newRemoveRetry(&Config{})
+	assert.Equal(t, removeRetry{retries: defaultRemoveRetries, delay: defaultRemoveRetryDelay}, r)
+
+	r = newRemoveRetry(&Config{
+		RemoveRetries:              10,
+		RemoveRetryDelayDuration:   time.Second,
+		RemoveRetryTimeoutDuration: time.Minute,
+	})
+	assert.Equal(t, removeRetry{retries: 10, delay: time.Second, timeout: time.Minute}, r)
+
+	r = newRemoveRetry(&Config{RemoveRetries: -1})
+	assert.Equal(t, 0, r.retries, "negative retries disable retrying")
+}
+
+func TestRemoveRetryBackoff(t *testing.T) {
+	r := removeRetry{delay: 100 * time.Millisecond}
+
+	for _, tc := range []struct {
+		retry int
+		max   time.Duration
+	}{
+		{retry: 0, max: 100 * time.Millisecond},
+		{retry: 1, max: 200 * time.Millisecond},
+		{retry: 2, max: 400 * time.Millisecond},
+		{retry: 5, max: 3200 * time.Millisecond},
+		{retry: 9, max: maxRemoveRetryDelay},
+		// Must not overflow
+		{retry: 100, max: maxRemoveRetryDelay},
+	} {
+		for i := 0; i < 100; i++ {
+			delay := r.backoff(tc.retry)
+			assert.Truef(t, delay >= tc.max/2 && delay < tc.max,
+				"delay %s of retry %d must be in [%s, %s)", delay, tc.retry, tc.max/2, tc.max)
+		}
+	}
+
+	// Too short to be randomized
+	r.delay = time.Nanosecond
+	assert.Equal(t, time.Nanosecond, r.backoff(0))
+}
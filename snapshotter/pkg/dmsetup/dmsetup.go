@@ -14,8 +14,11 @@
 package dmsetup
 
 import (
+	"context"
 	"fmt"
+	"os"
 	"os/exec"
+	"path/filepath"
 	"strconv"
 	"strings"
 
@@ -44,7 +47,15 @@ type DeviceInfo struct {
 	EventNumber     uint32 // Last event sequence number (used by wait)
 }
 
-var errTable map[string]unix.Errno
+var (
+	errTable map[string]unix.Errno
+
+	// noUdevSync disables udev synchronization for all dmsetup invocations (see SetUdevSync)
+	noUdevSync bool
+
+	// deviceDir is the directory with device-mapper nodes, with trailing slash (see SetDeviceDir)
+	deviceDir = DevMapperDir
+)
 
 func init() {
 	// Precompute map of <text>=<errno> for optimal lookup
@@ -54,9 +65,27 @@ func init() {
 	}
 }
 
-// CreatePool creates a device with the given name, data and metadata file and block size (see "dmsetup create")
-func CreatePool(poolName, dataFile, metaFile string, blockSizeSectors uint32) error {
-	thinPool, err := makeThinPoolMapping(dataFile, metaFile, blockSizeSectors)
+// SetUdevSync enables or disables udev synchronization (see "dmsetup --noudevsync").
+// If disabled, dmsetup won't wait for udev to create/remove device nodes, which avoids
+// long hangs on hosts without udevd running. Should be called before issuing any other command.
+func SetUdevSync(enabled bool) {
+	noUdevSync = !enabled
+}
+
+// SetDeviceDir changes the directory where device-mapper nodes are (default is /dev/mapper), for example
+// when running in a chroot. If the directory is named "mapper", dmsetup creates nodes there (DM_DEV_DIR is set
+// to its parent), otherwise the nodes are expected to be provided externally.
+// Should be called before issuing any other command.
+func SetDeviceDir(dir string) {
+	deviceDir = strings.TrimSuffix(filepath.Clean(dir), "/") + "/"
+}
+
+// CreatePool creates a device with the given name, data and metadata file and block size (see "dmsetup create").
+// Kernel raises a dm event once free data blocks drop to lowWaterMarkBlocks, zero means DefaultLowWaterMark.
+// Extra thin-pool features (like "error_if_no_space") are appended to the default feature set.
+// Newly provisioned blocks are zeroed only if zeroNewBlocks is set (see ThinPoolFeatures).
+func CreatePool(poolName, dataFile, metaFile string, blockSizeSectors uint32, lowWaterMarkBlocks uint64, zeroNewBlocks bool, extraFeatures ...string) error {
+	thinPool, err := makeThinPoolMapping(dataFile, metaFile, blockSizeSectors, lowWaterMarkBlocks, zeroNewBlocks, extraFeatures)
 	if err != nil {
 		return err
 	}
@@ -66,8 +95,8 @@ func CreatePool(poolName, dataFile, metaFile string, blockSizeSectors uint32) er
 }
 
 // ReloadPool reloads existing thin-pool (see "dmsetup reload")
-func ReloadPool(deviceName, dataFile, metaFile string, blockSizeSectors uint32) error {
-	thinPool, err := makeThinPoolMapping(dataFile, metaFile, blockSizeSectors)
+func ReloadPool(deviceName, dataFile, metaFile string, blockSizeSectors uint32, lowWaterMarkBlocks uint64, zeroNewBlocks bool, extraFeatures ...string) error {
+	thinPool, err := makeThinPoolMapping(dataFile, metaFile, blockSizeSectors, lowWaterMarkBlocks, zeroNewBlocks, extraFeatures)
 	if err != nil {
 		return err
 	}
@@ -77,17 +106,84 @@ func ReloadPool(deviceName, dataFile, metaFile string, blockSizeSectors uint32)
 }
 
 const (
-	lowWaterMark = 32768                // Picked arbitrary, might need tuning
-	skipZeroing  = "skip_block_zeroing" // Skipping zeroing to reduce latency for device creation
+	// DefaultLowWaterMark is the low water mark of thin-pool in data blocks, used unless specified
+	DefaultLowWaterMark = 32768 // Picked arbitrary, might need tuning
+)
+
+// Optional thin-pool features, see https://www.kernel.org/doc/Documentation/device-mapper/thin-provisioning.txt
+const (
+	// FeatureIgnoreDiscard disables discard support
+	FeatureIgnoreDiscard = "ignore_discard"
+	// FeatureNoDiscardPassdown doesn't pass discards down to the underlying data device
+	FeatureNoDiscardPassdown = "no_discard_passdown"
+	// FeatureReadOnly doesn't allow any changes to be made to the pool metadata
+	FeatureReadOnly = "read_only"
+	// FeatureErrorIfNoSpace errors IOs, instead of queueing, if no space
+	FeatureErrorIfNoSpace = "error_if_no_space"
+	// FeatureSkipBlockZeroing doesn't zero newly provisioned blocks, enabled by default to reduce latency of writes.
+	// Blocks freed by deleted devices keep their data, so new devices may read data of deleted ones.
+	FeatureSkipBlockZeroing = "skip_block_zeroing"
 )
 
+var thinPoolFeatures = map[string]bool{
+	FeatureSkipBlockZeroing:  true,
+	FeatureIgnoreDiscard:     true,
+	FeatureNoDiscardPassdown: true,
+	FeatureReadOnly:          true,
+	FeatureErrorIfNoSpace:    true,
+}
+
+// IsThinPoolFeature reports whether the feature is known to thin-pool target
+func IsThinPoolFeature(feature string) bool {
+	return thinPoolFeatures[feature]
+}
+
+// ThinPoolFeatures returns the effective feature arguments of thin-pool created with the given extra features.
+// FeatureSkipBlockZeroing is added unless zeroNewBlocks is set, in which case it's dropped from extra features.
+func ThinPoolFeatures(zeroNewBlocks bool, extraFeatures []string) []string {
+	var features []string
+	if !zeroNewBlocks {
+		features = append(features, FeatureSkipBlockZeroing)
+	}
+
+	for _, feature := range extraFeatures {
+		if zeroNewBlocks && feature == FeatureSkipBlockZeroing {
+			continue
+		}
+
+		duplicate := false
+		for _, existing := range features {
+			if feature == existing {
+				duplicate = true
+				break
+			}
+		}
+
+		if !duplicate {
+			features = append(features, feature)
+		}
+	}
+
+	return features
+}
+
 // makeThinPoolMapping makes thin-pool table entry
-func makeThinPoolMapping(dataFile, metaFile string, blockSizeSectors uint32) (string, error) {
+func makeThinPoolMapping(dataFile, metaFile string, blockSizeSectors uint32, lowWaterMarkBlocks uint64, zeroNewBlocks bool, extraFeatures []string) (string, error) {
+	for _, feature := range extraFeatures {
+		if !IsThinPoolFeature(feature) {
+			return "", errors.Errorf("unknown thin-pool feature %q", feature)
+		}
+	}
+
 	dataDeviceSizeBytes, err := BlockDeviceSize(dataFile)
 	if err != nil {
 		return "", errors.Wrapf(err, "failed to get block device size: %s", dataFile)
 	}
 
+	if lowWaterMarkBlocks == 0 {
+		lowWaterMarkBlocks = DefaultLowWaterMark
+	}
+
 	// Thin-pool mapping target has the following format:
 	// start - starting block in virtual device
 	// length - length of this segment
@@ -98,32 +194,205 @@ func makeThinPoolMapping(dataFile, metaFile string, blockSizeSectors uint32) (st
 	// feature_args - the number of feature arguments
 	// args
 	lengthSectors := dataDeviceSizeBytes / SectorSize
-	target := fmt.Sprintf("0 %d thin-pool %s %s %d %d 1 %s",
+	features := ThinPoolFeatures(zeroNewBlocks, extraFeatures)
+	target := fmt.Sprintf("0 %d thin-pool %s %s %d %d %d %s",
 		lengthSectors,
 		metaFile,
 		dataFile,
 		blockSizeSectors,
-		lowWaterMark,
-		skipZeroing)
+		lowWaterMarkBlocks,
+		len(features),
+		strings.Join(features, " "))
 
 	return target, nil
 }
 
+// ThinPoolTable represents thin-pool target parameters as returned by "dmsetup table"
+type ThinPoolTable struct {
+	LengthSectors    uint64
+	MetadataDevice   string
+	DataDevice       string
+	BlockSizeSectors uint32
+	LowWaterMark     uint64
+	Features         []string
+}
+
+// ZeroesNewBlocks reports whether the pool zeroes newly provisioned blocks (FeatureSkipBlockZeroing isn't set)
+func (t *ThinPoolTable) ZeroesNewBlocks() bool {
+	for _, feature := range t.Features {
+		if feature == FeatureSkipBlockZeroing {
+			return false
+		}
+	}
+
+	return true
+}
+
+// GetThinPoolTable returns thin-pool target parameters of the given pool device
+func GetThinPoolTable(poolName string) (*ThinPoolTable, error) {
+	table, err := Table(poolName)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseThinPoolTable(table)
+}
+
+// parseThinPoolTable parses thin-pool table entry (see makeThinPoolMapping for format description)
+func parseThinPoolTable(table string) (*ThinPoolTable, error) {
+	var (
+		start        uint64
+		target       string
+		featureCount int
+		result       = &ThinPoolTable{}
+	)
+
+	fields := strings.Fields(table)
+	if len(fields) < 8 {
+		return nil, errors.Errorf("unexpected thin-pool table format: %q", table)
+	}
+
+	_, err := fmt.Sscan(strings.Join(fields[:8], " "),
+		&start,
+		&result.LengthSectors,
+		&target,
+		&result.MetadataDevice,
+		&result.DataDevice,
+		&result.BlockSizeSectors,
+		&result.LowWaterMark,
+		&featureCount)
+
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse thin-pool table %q", table)
+	}
+
+	if target != "thin-pool" {
+		return nil, errors.Errorf("unexpected target type %q, expected thin-pool", target)
+	}
+
+	if featureCount != len(fields)-8 {
+		return nil, errors.Errorf("unexpected thin-pool feature count %d: %q", featureCount, table)
+	}
+
+	result.Features = fields[8:]
+	return result, nil
+}
+
+// ThinTable represents thin target parameters as returned by "dmsetup table"
+type ThinTable struct {
+	LengthSectors  uint64
+	PoolDevice     string
+	DeviceID       uint32
+	ExternalOrigin string
+}
+
+// ListThinDevices returns tables of all active thin devices by device name (see "dmsetup table --target thin")
+func ListThinDevices() (map[string]string, error) {
+	output, err := dmsetup("table", "--target", "thin")
+	if err != nil {
+		return nil, err
+	}
+
+	return parseThinDevices(output), nil
+}
+
+// parseThinDevices parses "<name>: <table>" lines, dmsetup prints "No devices found" if there are none
+func parseThinDevices(output string) map[string]string {
+	tables := make(map[string]string)
+	for _, line := range strings.Split(output, "\n") {
+		idx := strings.Index(line, ": ")
+		if idx <= 0 {
+			continue
+		}
+
+		tables[line[:idx]] = strings.TrimSpace(line[idx+2:])
+	}
+
+	return tables
+}
+
+// ParseThinTable parses thin table entry (see ThinMapping for format description)
+func ParseThinTable(table string) (*ThinTable, error) {
+	var (
+		start  uint64
+		target string
+		result = &ThinTable{}
+	)
+
+	fields := strings.Fields(table)
+	if len(fields) != 5 && len(fields) != 6 {
+		return nil, errors.Errorf("unexpected thin table format: %q", table)
+	}
+
+	_, err := fmt.Sscan(strings.Join(fields[:5], " "),
+		&start,
+		&result.LengthSectors,
+		&target,
+		&result.PoolDevice,
+		&result.DeviceID)
+
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse thin table %q", table)
+	}
+
+	if target != "thin" {
+		return nil, errors.Errorf("unexpected target type %q, expected thin", target)
+	}
+
+	if len(fields) == 6 {
+		result.ExternalOrigin = fields[5]
+	}
+
+	return result, nil
+}
+
 // CreateDevice sends "create_thin <deviceID>" message to the given thin-pool
 func CreateDevice(poolName string, deviceID uint32) error {
 	_, err := dmsetup("message", poolName, "0", fmt.Sprintf("create_thin %d", deviceID))
 	return err
 }
 
+// ActivateDeviceOpt represents command line arguments for "dmsetup create" command
+type ActivateDeviceOpt string
+
+const (
+	// ActivateReadOnly creates the device in read-only mode, so no writes are possible through it
+	ActivateReadOnly ActivateDeviceOpt = "--readonly"
+)
+
 // ActivateDevice activates the given thin-device using the 'thin' target
-func ActivateDevice(poolName string, deviceName string, deviceID uint32, size uint64, external string) error {
-	mapping := makeThinMapping(poolName, deviceID, size, external)
-	_, err := dmsetup("create", deviceName, "--table", mapping)
+func ActivateDevice(poolName string, deviceName string, deviceID uint32, size uint64, external string, opts ...ActivateDeviceOpt) error {
+	mapping := ThinMapping(poolName, deviceID, size, external)
+
+	args := []string{"create"}
+	for _, opt := range opts {
+		args = append(args, string(opt))
+	}
+
+	args = append(args, deviceName, "--table", mapping)
+
+	_, err := dmsetup(args...)
 	return err
 }
 
-// makeThinMapping makes thin target table entry
-func makeThinMapping(poolName string, deviceID uint32, sizeBytes uint64, externalOriginDevice string) string {
+// ReloadDevice loads new thin table with the given size for active thin-device (see "dmsetup reload").
+// The table takes effect once device is suspended and resumed.
+func ReloadDevice(poolName string, deviceName string, deviceID uint32, size uint64, external string, opts ...ActivateDeviceOpt) error {
+	mapping := ThinMapping(poolName, deviceID, size, external)
+
+	args := []string{"reload"}
+	for _, opt := range opts {
+		args = append(args, string(opt))
+	}
+
+	args = append(args, deviceName, "--table", mapping)
+
+	_, err := dmsetup(args...)
+	return err
+}
+
+// ThinMapping makes thin target table entry, externalOriginDevice is empty if device has no external origin
+func ThinMapping(poolName string, deviceID uint32, sizeBytes uint64, externalOriginDevice string) string {
 	lengthSectors := sizeBytes / SectorSize
 
 	// Thin target has the following format:
@@ -136,9 +405,25 @@ func makeThinMapping(poolName string, deviceID uint32, sizeBytes uint64, externa
 	return strings.TrimSpace(target)
 }
 
+// SuspendDeviceOpt represents command line arguments for "dmsetup suspend" command
+type SuspendDeviceOpt string
+
+const (
+	// SuspendNoFlush suspends the device without flushing outstanding I/O, which is requeued on resume.
+	// Needed for thin-pool which is out of data space, as queued writes can't complete until it's extended.
+	SuspendNoFlush SuspendDeviceOpt = "--noflush"
+)
+
 // SuspendDevice suspends the given device (see "dmsetup suspend")
-func SuspendDevice(deviceName string) error {
-	_, err := dmsetup("suspend", deviceName)
+func SuspendDevice(deviceName string, opts ...SuspendDeviceOpt) error {
+	args := []string{"suspend"}
+	for _, opt := range opts {
+		args = append(args, string(opt))
+	}
+
+	args = append(args, deviceName)
+
+	_, err := dmsetup(args...)
 	return err
 }
 
@@ -148,6 +433,12 @@ func ResumeDevice(deviceName string) error {
 	return err
 }
 
+// RenameDevice renames the given device (see "dmsetup rename")
+func RenameDevice(deviceName, newName string) error {
+	_, err := dmsetup("rename", deviceName, newName)
+	return err
+}
+
 // Table returns the current table for the device
 func Table(deviceName string) (string, error) {
 	return dmsetup("table", deviceName)
@@ -175,8 +466,9 @@ const (
 	RemoveDeferred    RemoveDeviceOpt = "--deferred"
 )
 
-// RemoveDevice removes a device (see "dmsetup remove")
-func RemoveDevice(deviceName string, opts ...RemoveDeviceOpt) error {
+// RemoveDevice removes a device (see "dmsetup remove").
+// dmsetup is killed if the context is cancelled (like while it's retrying with RemoveWithRetries).
+func RemoveDevice(ctx context.Context, deviceName string, opts ...RemoveDeviceOpt) error {
 	args := []string{
 		"remove",
 	}
@@ -187,14 +479,115 @@ func RemoveDevice(deviceName string, opts ...RemoveDeviceOpt) error {
 
 	args = append(args, GetFullDevicePath(deviceName))
 
-	_, err := dmsetup(args...)
+	_, err := dmsetupContext(ctx, args...)
+	return err
+}
+
+// ClearTable removes inactive table loaded with "dmsetup reload" (see "dmsetup clear")
+func ClearTable(deviceName string) error {
+	_, err := dmsetup("clear", deviceName)
+	return err
+}
+
+// Status returns the current status of the device (see "dmsetup status")
+func Status(deviceName string) (string, error) {
+	return dmsetup("status", deviceName)
+}
+
+// PoolStatus represents thin-pool status as returned by "dmsetup status".
+// See https://www.kernel.org/doc/Documentation/device-mapper/thin-provisioning.txt for details on each field.
+type PoolStatus struct {
+	TransactionID       uint64
+	UsedMetadataBlocks  uint64
+	TotalMetadataBlocks uint64
+	UsedDataBlocks      uint64
+	TotalDataBlocks     uint64
+	HeldMetadataRoot    string
+	Mode                string // One of "rw", "ro" or "out_of_data_space"
+	DiscardPassdown     bool
+	ErrorIfNoSpace      bool
+	NeedsCheck          bool
+	Fail                bool // Pool encountered an error and status can't be reported
+}
+
+// Thin-pool modes reported by "dmsetup status"
+const (
+	PoolModeReadWrite      = "rw"
+	PoolModeReadOnly       = "ro"
+	PoolModeOutOfDataSpace = "out_of_data_space"
+)
+
+// GetPoolStatus queries and parses thin-pool status
+func GetPoolStatus(poolName string) (*PoolStatus, error) {
+	output, err := Status(poolName)
+	if err != nil {
+		return nil, err
+	}
+
+	return parsePoolStatus(output)
+}
+
+// parsePoolStatus parses thin-pool status line which has the following format:
+// <start> <length> thin-pool <transaction id> <used metadata blocks>/<total metadata blocks>
+// <used data blocks>/<total data blocks> <held metadata root> ro|rw|out_of_data_space
+// [no_]discard_passdown [error|queue]_if_no_space needs_check|- [metadata_low_watermark]
+func parsePoolStatus(output string) (*PoolStatus, error) {
+	fields := strings.Fields(output)
+	if len(fields) < 4 || fields[2] != "thin-pool" {
+		return nil, errors.Errorf("unexpected thin-pool status format: %q", output)
+	}
+
+	status := &PoolStatus{}
+
+	if fields[3] == "Fail" {
+		status.Fail = true
+		return status, nil
+	}
+
+	if len(fields) < 8 {
+		return nil, errors.Errorf("unexpected thin-pool status format: %q", output)
+	}
+
+	_, err := fmt.Sscanf(strings.Join(fields[3:6], " "), "%d %d/%d %d/%d",
+		&status.TransactionID,
+		&status.UsedMetadataBlocks,
+		&status.TotalMetadataBlocks,
+		&status.UsedDataBlocks,
+		&status.TotalDataBlocks)
+
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse thin-pool status %q", output)
+	}
+
+	status.HeldMetadataRoot = fields[6]
+	status.Mode = fields[7]
+
+	// Optional fields, might be missing on older kernels
+	for _, field := range fields[8:] {
+		switch field {
+		case "discard_passdown":
+			status.DiscardPassdown = true
+		case "error_if_no_space":
+			status.ErrorIfNoSpace = true
+		case "needs_check":
+			status.NeedsCheck = true
+		}
+	}
+
+	return status, nil
+}
+
+// WaitEvent blocks until the event counter of the given device exceeds eventNumber (see "dmsetup wait").
+// Current event number can be obtained via Info call.
+func WaitEvent(ctx context.Context, deviceName string, eventNumber uint32) error {
+	_, err := dmsetupContext(ctx, "wait", deviceName, strconv.FormatUint(uint64(eventNumber), 10))
 	return err
 }
 
 // Info outputs device information (see "dmsetup info").
 // If device name is empty, all device infos will be returned.
 func Info(deviceName string) ([]*DeviceInfo, error) {
-	output, err := dmsetup(
+	args := []string{
 		"info",
 		"--columns",
 		"--noheadings",
@@ -202,8 +595,14 @@ func Info(deviceName string) ([]*DeviceInfo, error) {
 		"name,blkdevname,attr,major,minor,open,segments,events",
 		"--separator",
 		" ",
-		deviceName)
+	}
+
+	// Empty argument would be treated as a device name
+	if deviceName != "" {
+		args = append(args, deviceName)
+	}
 
+	output, err := dmsetup(args...)
 	if err != nil {
 		return nil, err
 	}
@@ -252,11 +651,11 @@ func Version() (string, error) {
 
 // GetFullDevicePath returns full path for the given device name (like "/dev/mapper/name")
 func GetFullDevicePath(deviceName string) string {
-	if strings.HasPrefix(deviceName, DevMapperDir) {
+	if strings.HasPrefix(deviceName, deviceDir) || strings.HasPrefix(deviceName, DevMapperDir) {
 		return deviceName
 	}
 
-	return DevMapperDir + deviceName
+	return deviceDir + deviceName
 }
 
 // BlockDeviceSize returns size of block device in bytes
@@ -264,17 +663,56 @@ func BlockDeviceSize(devicePath string) (uint64, error) {
 	data, err := exec.Command("blockdev", "--getsize64", "-q", devicePath).CombinedOutput()
 	output := string(data)
 	if err != nil {
-		return 0, errors.Wrapf(err, output)
+		return 0, errors.Wrap(err, output)
 	}
 
 	output = strings.TrimSuffix(output, "\n")
 	return strconv.ParseUint(output, 10, 64)
 }
 
+// BlockDeviceReadOnly reports whether block device is read-only (see "blockdev --getro")
+func BlockDeviceReadOnly(devicePath string) (bool, error) {
+	data, err := exec.Command("blockdev", "--getro", devicePath).CombinedOutput()
+	output := string(data)
+	if err != nil {
+		return false, errors.Wrap(err, output)
+	}
+
+	return strings.TrimSpace(output) == "1", nil
+}
+
+// DiscardBlocks discards all blocks of the block device (see "blkdiscard"), so the storage underneath can reclaim them
+func DiscardBlocks(devicePath string) error {
+	data, err := exec.Command("blkdiscard", devicePath).CombinedOutput()
+	if err != nil {
+		return errors.Wrap(err, string(data))
+	}
+
+	return nil
+}
+
 func dmsetup(args ...string) (string, error) {
-	data, err := exec.Command("dmsetup", args...).CombinedOutput()
+	return dmsetupContext(context.Background(), args...)
+}
+
+func dmsetupContext(ctx context.Context, args ...string) (string, error) {
+	if noUdevSync {
+		args = append([]string{"--noudevsync"}, args...)
+	}
+
+	cmd := exec.CommandContext(ctx, "dmsetup", args...)
+	if deviceDir != DevMapperDir && filepath.Base(deviceDir) == "mapper" {
+		// DM_DEV_DIR is the parent of "mapper" directory (like "/dev")
+		cmd.Env = append(os.Environ(), "DM_DEV_DIR="+filepath.Dir(filepath.Clean(deviceDir)))
+	}
+
+	data, err := cmd.CombinedOutput()
 	output := string(data)
 	if err != nil {
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+
 		// Try find Linux error code otherwise return generic error with dmsetup output
 		if errno, ok := tryGetUnixError(output); ok {
 			return "", errno
@@ -14,12 +14,14 @@
 package dmsetup
 
 import (
+	"context"
 	"io/ioutil"
 	"os"
 	"strings"
 	"testing"
 
 	"github.com/docker/go-units"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"golang.org/x/sys/unix"
@@ -55,7 +57,7 @@ func TestDMSetup(t *testing.T) {
 	}()
 
 	t.Run("CreatePool", func(t *testing.T) {
-		err := CreatePool(testPoolName, loopDataDevice, loopMetaDevice, 128)
+		err := CreatePool(testPoolName, loopDataDevice, loopMetaDevice, 128, 0, false)
 		require.NoErrorf(t, err, "failed to create thin-pool")
 
 		table, err := Table(testPoolName)
@@ -66,10 +68,22 @@ func TestDMSetup(t *testing.T) {
 	})
 
 	t.Run("ReloadPool", func(t *testing.T) {
-		err := ReloadPool(testPoolName, loopDataDevice, loopMetaDevice, 256)
+		err := ReloadPool(testPoolName, loopDataDevice, loopMetaDevice, 256, 0, false)
 		assert.NoErrorf(t, err, "failed to reload thin-pool")
 	})
 
+	t.Run("ReloadLowWaterMark", func(t *testing.T) {
+		err := ReloadPool(testPoolName, loopDataDevice, loopMetaDevice, 128, 1024, false)
+		require.NoError(t, err)
+
+		err = ResumeDevice(testPoolName)
+		require.NoError(t, err)
+
+		table, err := GetThinPoolTable(testPoolName)
+		require.NoError(t, err)
+		assert.EqualValues(t, 1024, table.LowWaterMark)
+	})
+
 	t.Run("CreateDevice", testCreateDevice)
 
 	t.Run("CreateSnapshot", testCreateSnapshot)
@@ -80,7 +94,7 @@ func TestDMSetup(t *testing.T) {
 	t.Run("RemoveDevice", testRemoveDevice)
 
 	t.Run("RemovePool", func(t *testing.T) {
-		err = RemoveDevice(testPoolName, RemoveWithForce, RemoveWithRetries)
+		err = RemoveDevice(context.Background(), testPoolName, RemoveWithForce, RemoveWithRetries)
 		require.NoErrorf(t, err, "failed to remove thin-pool")
 	})
 
@@ -154,10 +168,10 @@ func testSuspendResumeDevice(t *testing.T) {
 }
 
 func testRemoveDevice(t *testing.T) {
-	err := RemoveDevice(testPoolName)
+	err := RemoveDevice(context.Background(), testPoolName)
 	assert.EqualValues(t, unix.EBUSY, err, "removing thin-pool with dependencies shouldn't be allowed")
 
-	err = RemoveDevice(testDeviceName, RemoveWithRetries)
+	err = RemoveDevice(context.Background(), testDeviceName, RemoveWithRetries)
 	assert.NoErrorf(t, err, "failed to remove thin-device")
 }
 
@@ -187,3 +201,230 @@ func createLoopbackDevice(t *testing.T, dir string) (string, string) {
 
 	return imagePath, loopDevice
 }
+
+func TestParseThinPoolTable(t *testing.T) {
+	table, err := parseThinPoolTable("0 32768 thin-pool 7:1 7:0 128 32768 1 skip_block_zeroing")
+	require.NoError(t, err)
+
+	assert.EqualValues(t, 32768, table.LengthSectors)
+	assert.Equal(t, "7:1", table.MetadataDevice)
+	assert.Equal(t, "7:0", table.DataDevice)
+	assert.EqualValues(t, 128, table.BlockSizeSectors)
+	assert.EqualValues(t, 32768, table.LowWaterMark)
+	assert.Equal(t, []string{"skip_block_zeroing"}, table.Features)
+	assert.False(t, table.ZeroesNewBlocks())
+
+	table, err = parseThinPoolTable("0 32768 thin-pool 7:1 7:0 256 1024 0")
+	require.NoError(t, err)
+	assert.EqualValues(t, 256, table.BlockSizeSectors)
+	assert.Empty(t, table.Features)
+	assert.True(t, table.ZeroesNewBlocks())
+
+	_, err = parseThinPoolTable("0 1024 thin 253:0 1")
+	assert.Error(t, err)
+
+	_, err = parseThinPoolTable("0 32768 linear 7:1 7:0 128 32768 0")
+	assert.Error(t, err)
+
+	_, err = parseThinPoolTable("0 32768 thin-pool 7:1 7:0 128 32768 2 skip_block_zeroing")
+	assert.Error(t, err)
+}
+
+func TestRemoveDeviceCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := RemoveDevice(ctx, testDeviceName, RemoveWithRetries)
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestParseThinDevices(t *testing.T) {
+	assert.Empty(t, parseThinDevices("No devices found\n"))
+
+	tables := parseThinDevices("pool-snap-1: 0 2048 thin 253:0 1\npool-snap-2: 0 4096 thin 253:0 2 7:2\n")
+	assert.Equal(t, map[string]string{
+		"pool-snap-1": "0 2048 thin 253:0 1",
+		"pool-snap-2": "0 4096 thin 253:0 2 7:2",
+	}, tables)
+}
+
+func TestParseThinTable(t *testing.T) {
+	table, err := ParseThinTable("0 2048 thin 253:0 17")
+	require.NoError(t, err)
+	assert.EqualValues(t, 2048, table.LengthSectors)
+	assert.Equal(t, "253:0", table.PoolDevice)
+	assert.EqualValues(t, 17, table.DeviceID)
+	assert.Empty(t, table.ExternalOrigin)
+
+	table, err = ParseThinTable("0 2048 thin 253:0 17 7:2")
+	require.NoError(t, err)
+	assert.Equal(t, "7:2", table.ExternalOrigin)
+
+	_, err = ParseThinTable("0 32768 thin-pool 7:1 7:0 128 32768 0")
+	assert.Error(t, err)
+
+	_, err = ParseThinTable("0 2048 linear 253:0 17")
+	assert.Error(t, err)
+
+	_, err = ParseThinTable("0 2048 thin 253:0 id")
+	assert.Error(t, err)
+}
+
+func TestThinMapping(t *testing.T) {
+	assert.Equal(t, "0 2048 thin /dev/mapper/pool 17", ThinMapping("pool", 17, 2048*SectorSize, ""))
+	assert.Equal(t, "0 2048 thin /dev/mapper/pool 17 /dev/loop2", ThinMapping("pool", 17, 2048*SectorSize, "/dev/loop2"))
+
+	table, err := ParseThinTable(ThinMapping("pool", 17, 2048*SectorSize, "/dev/loop2"))
+	require.NoError(t, err)
+	assert.Equal(t, "/dev/loop2", table.ExternalOrigin)
+}
+
+func TestThinPoolFeatures(t *testing.T) {
+	assert.Equal(t, []string{"skip_block_zeroing"}, ThinPoolFeatures(false, nil))
+	assert.Equal(t, []string{"skip_block_zeroing", "error_if_no_space", "no_discard_passdown"},
+		ThinPoolFeatures(false, []string{"error_if_no_space", "skip_block_zeroing", "no_discard_passdown", "error_if_no_space"}))
+
+	// Zeroing pool has no skip_block_zeroing, even if it's passed in
+	assert.Empty(t, ThinPoolFeatures(true, nil))
+	assert.Equal(t, []string{"error_if_no_space"}, ThinPoolFeatures(true, []string{"skip_block_zeroing", "error_if_no_space"}))
+
+	assert.True(t, IsThinPoolFeature(FeatureErrorIfNoSpace))
+	assert.False(t, IsThinPoolFeature("queue_if_no_space"))
+
+	_, err := makeThinPoolMapping("/dev/loop0", "/dev/loop1", 128, 0, false, []string{"unknown"})
+	assert.Error(t, err)
+}
+
+func TestParsePoolStatus(t *testing.T) {
+	status, err := parsePoolStatus("0 32768 thin-pool 1 160/4096 12/256 - rw discard_passdown queue_if_no_space - 1024")
+	require.NoError(t, err)
+
+	assert.EqualValues(t, 1, status.TransactionID)
+	assert.EqualValues(t, 160, status.UsedMetadataBlocks)
+	assert.EqualValues(t, 4096, status.TotalMetadataBlocks)
+	assert.EqualValues(t, 12, status.UsedDataBlocks)
+	assert.EqualValues(t, 256, status.TotalDataBlocks)
+	assert.Equal(t, "-", status.HeldMetadataRoot)
+	assert.Equal(t, PoolModeReadWrite, status.Mode)
+	assert.True(t, status.DiscardPassdown)
+	assert.False(t, status.ErrorIfNoSpace)
+	assert.False(t, status.NeedsCheck)
+	assert.False(t, status.Fail)
+
+	status, err = parsePoolStatus("0 32768 thin-pool 5 4096/4096 256/256 10 out_of_data_space no_discard_passdown error_if_no_space needs_check")
+	require.NoError(t, err)
+	assert.Equal(t, PoolModeOutOfDataSpace, status.Mode)
+	assert.False(t, status.DiscardPassdown)
+	assert.True(t, status.ErrorIfNoSpace)
+	assert.True(t, status.NeedsCheck)
+
+	status, err = parsePoolStatus("0 32768 thin-pool Fail")
+	require.NoError(t, err)
+	assert.True(t, status.Fail)
+
+	_, err = parsePoolStatus("0 1024 thin 10 1023")
+	assert.Error(t, err)
+
+	_, err = parsePoolStatus("0 32768 thin-pool 1 x/4096 12/256 - rw")
+	assert.Error(t, err)
+}
+
+func TestParseThinDelta(t *testing.T) {
+	output := `<superblock uuid="" time="1" transaction="2" data_block_size="128" nr_data_blocks="0">
+  <diff left="1" right="2">
+    <same begin="0" length="16"/>
+    <different begin="16" length="4"/>
+    <right_only begin="20" length="1"/>
+    <same begin="21" length="10"/>
+    <left_only begin="31" length="2"/>
+  </diff>
+</superblock>`
+
+	result, err := parseThinDelta([]byte(output))
+	require.NoError(t, err)
+
+	assert.EqualValues(t, 128, result.DataBlockSizeSectors)
+	assert.Equal(t, []BlockRange{{Begin: 16, Length: 5}, {Begin: 31, Length: 2}}, result.Ranges)
+	assert.EqualValues(t, 2, result.LeftOnlyBlocks)
+
+	result, err = parseThinDelta([]byte(`<superblock data_block_size="128"><diff left="1" right="2"></diff></superblock>`))
+	require.NoError(t, err)
+	assert.Empty(t, result.Ranges)
+
+	_, err = parseThinDelta([]byte(`<superblock><diff><unknown begin="0" length="1"/></diff></superblock>`))
+	assert.Error(t, err)
+
+	_, err = parseThinDelta([]byte(`not xml`))
+	assert.Error(t, err)
+}
+
+func TestParseThinDump(t *testing.T) {
+	output := `<superblock uuid="" time="1" transaction="2" data_block_size="128" nr_data_blocks="1024">
+  <device dev_id="1" mapped_blocks="20" transaction="0" creation_time="0" snap_time="1">
+    <range_mapping origin_begin="0" data_begin="0" length="20" time="0"/>
+  </device>
+  <device dev_id="2" mapped_blocks="3" transaction="1" creation_time="1" snap_time="1">
+    <single_mapping origin_block="0" data_block="20" time="1"/>
+  </device>
+</superblock>`
+
+	result, err := parseThinDump(strings.NewReader(output), 2)
+	require.NoError(t, err)
+	assert.Equal(t, &ThinDeviceMapping{DataBlockSizeSectors: 128, MappedBlocks: 3}, result)
+
+	_, err = parseThinDump(strings.NewReader(output), 3)
+	assert.True(t, errors.Is(err, ErrThinDeviceNotFound), "device is not in the dump")
+
+	_, err = parseThinDump(strings.NewReader(`<superblock data_block_size="128"><device dev_id="1" mapped_blocks="x"/></superblock>`), 1)
+	assert.Error(t, err)
+
+	_, err = parseThinDump(strings.NewReader(`not xml`), 1)
+	assert.Error(t, err)
+}
+
+func TestParseThinLs(t *testing.T) {
+	ids, err := parseThinLs(strings.NewReader("1\n  2\n\n16777214\n"))
+	require.NoError(t, err)
+	assert.Equal(t, []uint32{1, 2, 16777214}, ids)
+
+	ids, err = parseThinLs(strings.NewReader(""))
+	require.NoError(t, err)
+	assert.Empty(t, ids)
+
+	_, err = parseThinLs(strings.NewReader("1 /dev/mapper/thin\n"))
+	assert.Error(t, err)
+}
+
+func TestParseVersion(t *testing.T) {
+	versions, err := parseVersion("Library version:   1.02.145 (2017-11-03)\nDriver version:    4.37.0\n")
+	require.NoError(t, err)
+	assert.Equal(t, VersionNumber{1, 2, 145}, versions.Library)
+	assert.Equal(t, VersionNumber{4, 37, 0}, versions.Driver)
+
+	_, err = parseVersion("Library version:   1.02.145 (2017-11-03)\n")
+	assert.Error(t, err, "driver version is missing")
+
+	version, err := parseTargetVersion("thin-pool        v1.19.0\nthin             v1.19.0\nstriped          v1.6.0\n", "thin-pool")
+	require.NoError(t, err)
+	assert.Equal(t, VersionNumber{1, 19, 0}, version)
+
+	version, err = parseTargetVersion("striped          v1.6.0\n", "thin-pool")
+	require.NoError(t, err)
+	assert.True(t, version.IsZero())
+
+	assert.True(t, VersionNumber{4, 26, 0}.Less(VersionNumber{4, 27, 0}))
+	assert.False(t, VersionNumber{1, 2, 145}.Less(VersionNumber{1, 2, 89}))
+	assert.Equal(t, "1.2.89", VersionNumber{1, 2, 89}.String())
+}
+
+func TestGetFullDevicePath(t *testing.T) {
+	assert.Equal(t, "/dev/mapper/test", GetFullDevicePath("test"))
+	assert.Equal(t, "/dev/mapper/test", GetFullDevicePath("/dev/mapper/test"))
+
+	SetDeviceDir("/srv/jailer/dev/mapper/")
+	defer SetDeviceDir(DevMapperDir)
+
+	assert.Equal(t, "/srv/jailer/dev/mapper/test", GetFullDevicePath("test"))
+	assert.Equal(t, "/srv/jailer/dev/mapper/test", GetFullDevicePath("/srv/jailer/dev/mapper/test"))
+	assert.Equal(t, "/dev/mapper/test", GetFullDevicePath("/dev/mapper/test"))
+}
@@ -0,0 +1,32 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package dmsetup
+
+import (
+	"os/exec"
+
+	"github.com/pkg/errors"
+)
+
+// ThinCheck runs "thin_check" to verify thin-pool metadata on the given device.
+// If metadata is consistent, "needs_check" flag set by kernel is cleared, so the pool can be used read-write again.
+// Metadata must not be in use by a live pool.
+func ThinCheck(metadataDevice string) error {
+	data, err := exec.Command("thin_check", "--clear-needs-check-flag", metadataDevice).CombinedOutput()
+	if err != nil {
+		return errors.Wrapf(err, "thin_check failed: %s", string(data))
+	}
+
+	return nil
+}
@@ -0,0 +1,123 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package dmsetup
+
+import (
+	"encoding/xml"
+	"os/exec"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// BlockRange represents a range of thin-pool data blocks
+type BlockRange struct {
+	Begin  uint64
+	Length uint64
+}
+
+// ThinDeltaResult represents blocks that differ between two thin devices
+type ThinDeltaResult struct {
+	// DataBlockSizeSectors is the size of a single block in ranges
+	DataBlockSizeSectors uint32
+	// Ranges are block ranges of the devices with different contents, sorted and non-overlapping
+	Ranges []BlockRange
+	// LeftOnlyBlocks is the number of blocks in Ranges mapped by the first device only
+	LeftOnlyBlocks uint64
+}
+
+// ReserveMetadataSnapshot sends "reserve_metadata_snap" message to the given thin-pool,
+// so its metadata can be read by userspace tools while the pool is live
+func ReserveMetadataSnapshot(poolName string) error {
+	_, err := dmsetup("message", poolName, "0", "reserve_metadata_snap")
+	return err
+}
+
+// ReleaseMetadataSnapshot sends "release_metadata_snap" message to the given thin-pool
+func ReleaseMetadataSnapshot(poolName string) error {
+	_, err := dmsetup("message", poolName, "0", "release_metadata_snap")
+	return err
+}
+
+// ThinDelta runs "thin_delta" against reserved metadata snapshot of a pool to find blocks which differ
+// between two thin devices. Metadata snapshot must be reserved with ReserveMetadataSnapshot beforehand.
+func ThinDelta(metadataDevice string, deviceID1, deviceID2 uint32) (*ThinDeltaResult, error) {
+	args := []string{
+		"--metadata-snap",
+		"--snap1", strconv.FormatUint(uint64(deviceID1), 10),
+		"--snap2", strconv.FormatUint(uint64(deviceID2), 10),
+		metadataDevice,
+	}
+
+	data, err := exec.Command("thin_delta", args...).CombinedOutput()
+	if err != nil {
+		return nil, errors.Wrapf(err, "thin_delta failed: %s", string(data))
+	}
+
+	return parseThinDelta(data)
+}
+
+// parseThinDelta parses thin_delta XML output, which looks like:
+//
+//	<superblock uuid="" time="1" transaction="2" data_block_size="128" nr_data_blocks="0">
+//	  <diff left="1" right="2">
+//	    <same begin="0" length="16"/>
+//	    <different begin="16" length="4"/>
+//	    <right_only begin="20" length="1"/>
+//	  </diff>
+//	</superblock>
+//
+// All but "same" ranges are reported as changed, adjacent ranges are merged.
+func parseThinDelta(output []byte) (*ThinDeltaResult, error) {
+	var doc struct {
+		XMLName       xml.Name `xml:"superblock"`
+		DataBlockSize uint32   `xml:"data_block_size,attr"`
+		Diff          struct {
+			Ranges []struct {
+				XMLName xml.Name
+				Begin   uint64 `xml:"begin,attr"`
+				Length  uint64 `xml:"length,attr"`
+			} `xml:",any"`
+		} `xml:"diff"`
+	}
+
+	if err := xml.Unmarshal(output, &doc); err != nil {
+		return nil, errors.Wrap(err, "failed to parse thin_delta output")
+	}
+
+	result := &ThinDeltaResult{DataBlockSizeSectors: doc.DataBlockSize}
+	for _, r := range doc.Diff.Ranges {
+		switch r.XMLName.Local {
+		case "same":
+			continue
+		case "left_only":
+			result.LeftOnlyBlocks += r.Length
+		case "different", "right_only":
+		default:
+			return nil, errors.Errorf("unexpected thin_delta range %q", r.XMLName.Local)
+		}
+
+		if n := len(result.Ranges); n > 0 {
+			last := &result.Ranges[n-1]
+			if last.Begin+last.Length == r.Begin {
+				last.Length += r.Length
+				continue
+			}
+		}
+
+		result.Ranges = append(result.Ranges, BlockRange{Begin: r.Begin, Length: r.Length})
+	}
+
+	return result, nil
+}
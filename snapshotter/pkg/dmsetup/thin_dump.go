@@ -0,0 +1,134 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package dmsetup
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"os/exec"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// ErrThinDeviceNotFound is returned by ThinDump when pool metadata has no device with the given ID
+var ErrThinDeviceNotFound = errors.New("thin device not found in pool metadata")
+
+// ThinDeviceMapping describes how much pool data space is mapped by a thin device
+type ThinDeviceMapping struct {
+	// DataBlockSizeSectors is the size of a single data block of the pool
+	DataBlockSizeSectors uint32
+	// MappedBlocks is the number of data blocks mapped by the device, including blocks shared with snapshots
+	MappedBlocks uint64
+}
+
+// ThinDump runs "thin_dump" against reserved metadata snapshot of a pool and returns the number of blocks
+// mapped by the given thin device. Metadata snapshot must be reserved with ReserveMetadataSnapshot beforehand.
+// The output is read until the device header, mappings of the device are skipped.
+func ThinDump(metadataDevice string, deviceID uint32) (*ThinDeviceMapping, error) {
+	var stderr bytes.Buffer
+
+	cmd := exec.Command("thin_dump", "--metadata-snap", "--dev-id", strconv.FormatUint(uint64(deviceID), 10), metadataDevice)
+	cmd.Stderr = &stderr
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, errors.Wrap(err, "failed to start thin_dump")
+	}
+
+	result, parseErr := parseThinDump(stdout, deviceID)
+	if parseErr == nil {
+		// Mappings aren't needed, don't wait for the rest of the dump
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return result, nil
+	}
+
+	// Parse error is kept, so a missing device can be told apart
+	if err := cmd.Wait(); err != nil {
+		return nil, errors.Wrapf(parseErr, "thin_dump failed (%s): %s", err, stderr.String())
+	}
+
+	return nil, parseErr
+}
+
+// parseThinDump reads thin_dump XML output up to the header of the given device, which looks like:
+//
+//	<superblock uuid="" time="1" transaction="2" data_block_size="128" nr_data_blocks="1024">
+//	  <device dev_id="2" mapped_blocks="3" transaction="1" creation_time="1" snap_time="1">
+//	    <single_mapping origin_block="0" data_block="20" time="1"/>
+//	  </device>
+//	</superblock>
+func parseThinDump(r io.Reader, deviceID uint32) (*ThinDeviceMapping, error) {
+	var (
+		decoder = xml.NewDecoder(r)
+		result  = &ThinDeviceMapping{}
+		devID   = strconv.FormatUint(uint64(deviceID), 10)
+	)
+
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return nil, errors.Wrapf(ErrThinDeviceNotFound, "device %d", deviceID)
+		} else if err != nil {
+			return nil, errors.Wrap(err, "failed to parse thin_dump output")
+		}
+
+		elem, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+
+		switch elem.Name.Local {
+		case "superblock":
+			value, err := strconv.ParseUint(xmlAttr(elem, "data_block_size"), 10, 32)
+			if err != nil {
+				return nil, errors.Wrap(err, "failed to parse data block size")
+			}
+
+			result.DataBlockSizeSectors = uint32(value)
+		case "device":
+			if xmlAttr(elem, "dev_id") != devID {
+				if err := decoder.Skip(); err != nil {
+					return nil, errors.Wrap(err, "failed to parse thin_dump output")
+				}
+
+				continue
+			}
+
+			result.MappedBlocks, err = strconv.ParseUint(xmlAttr(elem, "mapped_blocks"), 10, 64)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to parse mapped blocks of device %d", deviceID)
+			}
+
+			return result, nil
+		}
+	}
+}
+
+// xmlAttr returns value of the element attribute, or empty string if there is no such attribute
+func xmlAttr(elem xml.StartElement, name string) string {
+	for _, attr := range elem.Attr {
+		if attr.Name.Local == name {
+			return attr.Value
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,69 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package dmsetup
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ThinDeviceIDs runs "thin_ls" against reserved metadata snapshot of a pool and returns IDs of all thin devices
+// in pool metadata. Metadata snapshot must be reserved with ReserveMetadataSnapshot beforehand.
+func ThinDeviceIDs(metadataDevice string) ([]uint32, error) {
+	var stdout, stderr bytes.Buffer
+
+	cmd := exec.Command("thin_ls", "--metadata-snap", "--no-headers", "--format", "DEV", metadataDevice)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, errors.Wrapf(err, "thin_ls failed: %s", stderr.String())
+	}
+
+	return parseThinLs(&stdout)
+}
+
+// parseThinLs reads device IDs from thin_ls output with DEV column only, one ID per line
+func parseThinLs(r io.Reader) ([]uint32, error) {
+	var (
+		ids     []uint32
+		scanner = bufio.NewScanner(r)
+	)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		id, err := strconv.ParseUint(line, 10, 32)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse device id %q of thin_ls output", line)
+		}
+
+		ids = append(ids, uint32(id))
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to read thin_ls output")
+	}
+
+	return ids, nil
+}
@@ -0,0 +1,31 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package dmsetup
+
+import (
+	"os/exec"
+
+	"github.com/pkg/errors"
+)
+
+// ThinRepair runs "thin_repair" to read thin-pool metadata from input and write it densely packed to output.
+// Output must be at least as large as the input. Metadata must not be in use by a live pool.
+func ThinRepair(input, output string) error {
+	data, err := exec.Command("thin_repair", "-i", input, "-o", output).CombinedOutput()
+	if err != nil {
+		return errors.Wrapf(err, "thin_repair failed: %s", string(data))
+	}
+
+	return nil
+}
@@ -0,0 +1,151 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package dmsetup
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// VersionNumber represents dotted version of device-mapper components (like "4.37.0")
+type VersionNumber struct {
+	Major int
+	Minor int
+	Patch int
+}
+
+// ParseVersionNumber parses version in "1.02.145" or "v1.19.0" format
+func ParseVersionNumber(value string) (VersionNumber, error) {
+	var (
+		version VersionNumber
+		parts   = strings.Split(strings.TrimPrefix(value, "v"), ".")
+		fields  = []*int{&version.Major, &version.Minor, &version.Patch}
+	)
+
+	if len(parts) != len(fields) {
+		return version, errors.Errorf("unexpected version format %q", value)
+	}
+
+	for i, part := range parts {
+		number, err := strconv.Atoi(part)
+		if err != nil {
+			return version, errors.Wrapf(err, "unexpected version format %q", value)
+		}
+
+		*fields[i] = number
+	}
+
+	return version, nil
+}
+
+// Less reports whether the version is older than other version
+func (v VersionNumber) Less(other VersionNumber) bool {
+	if v.Major != other.Major {
+		return v.Major < other.Major
+	}
+
+	if v.Minor != other.Minor {
+		return v.Minor < other.Minor
+	}
+
+	return v.Patch < other.Patch
+}
+
+// IsZero reports whether the version is unknown
+func (v VersionNumber) IsZero() bool {
+	return v == VersionNumber{}
+}
+
+func (v VersionNumber) String() string {
+	return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+}
+
+// Versions represents versions of device-mapper library, kernel driver and thin-pool target
+type Versions struct {
+	Library VersionNumber
+	Driver  VersionNumber
+	// ThinPool is zero if thin-pool target is not loaded yet (it's usually loaded on first use)
+	ThinPool VersionNumber
+}
+
+// GetVersions queries device-mapper component versions (see "dmsetup version" and "dmsetup targets")
+func GetVersions() (*Versions, error) {
+	output, err := Version()
+	if err != nil {
+		return nil, err
+	}
+
+	versions, err := parseVersion(output)
+	if err != nil {
+		return nil, err
+	}
+
+	targets, err := dmsetup("targets")
+	if err != nil {
+		return nil, err
+	}
+
+	if versions.ThinPool, err = parseTargetVersion(targets, "thin-pool"); err != nil {
+		return nil, err
+	}
+
+	return versions, nil
+}
+
+// parseVersion parses "dmsetup version" output:
+// Library version:   1.02.145 (2017-11-03)
+// Driver version:    4.37.0
+func parseVersion(output string) (*Versions, error) {
+	versions := &Versions{}
+
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[1] != "version:" {
+			continue
+		}
+
+		version, err := ParseVersionNumber(fields[2])
+		if err != nil {
+			return nil, err
+		}
+
+		switch fields[0] {
+		case "Library":
+			versions.Library = version
+		case "Driver":
+			versions.Driver = version
+		}
+	}
+
+	if versions.Library.IsZero() || versions.Driver.IsZero() {
+		return nil, errors.Errorf("failed to parse dmsetup version output: %q", output)
+	}
+
+	return versions, nil
+}
+
+// parseTargetVersion finds version of the target in "dmsetup targets" output (like "thin-pool        v1.19.0")
+func parseTargetVersion(output, target string) (VersionNumber, error) {
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == target {
+			return ParseVersionNumber(fields[1])
+		}
+	}
+
+	return VersionNumber{}, nil
+}
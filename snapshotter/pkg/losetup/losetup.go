@@ -46,6 +46,26 @@ func DetachLoopDevice(loopDevice ...string) error {
 	return err
 }
 
+// GetBackingFile returns path of the image a loop device is attached to
+func GetBackingFile(loopDevice string) (string, error) {
+	output, err := losetup("--list", "--output", "BACK-FILE", "--noheadings", loopDevice)
+	if err != nil {
+		return "", err
+	}
+
+	if output == "" {
+		return "", errors.Errorf("loop device %q is not attached", loopDevice)
+	}
+
+	return strings.TrimSpace(output), nil
+}
+
+// RefreshCapacity makes loop device pick up new size of its image after the image was resized
+func RefreshCapacity(loopDevice string) error {
+	_, err := losetup("--set-capacity", loopDevice)
+	return err
+}
+
 // RemoveLoopDevicesAssociatedWithImage detaches all loop devices attached to a given sparse image
 func RemoveLoopDevicesAssociatedWithImage(imagePath string) error {
 	loopDevices, err := FindAssociatedLoopDevices(imagePath)
@@ -16,6 +16,8 @@ package losetup
 import (
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/docker/go-units"
@@ -66,6 +68,25 @@ func TestLosetup(t *testing.T) {
 		assert.Empty(t, devices)
 	})
 
+	t.Run("GetBackingFile", func(t *testing.T) {
+		file, err := GetBackingFile(loopDevice1)
+		assert.NoError(t, err)
+		assert.Equal(t, imagePath, file)
+	})
+
+	t.Run("RefreshCapacity", func(t *testing.T) {
+		err := os.Truncate(imagePath, 32*units.MiB)
+		require.NoError(t, err)
+
+		err = RefreshCapacity(loopDevice1)
+		assert.NoError(t, err)
+
+		// Size in sectors
+		data, err := ioutil.ReadFile(filepath.Join("/sys/block", filepath.Base(loopDevice1), "size"))
+		require.NoError(t, err)
+		assert.Equal(t, "65536", strings.TrimSpace(string(data)))
+	})
+
 	t.Run("DetachLoopDevice", func(t *testing.T) {
 		err := DetachLoopDevice(loopDevice2)
 		require.NoErrorf(t, err, "failed to detach %q", loopDevice2)
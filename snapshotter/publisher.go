@@ -0,0 +1,63 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package snapshotter
+
+import (
+	"bytes"
+	"context"
+	"os/exec"
+
+	"github.com/containerd/containerd/events"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/typeurl"
+	"github.com/pkg/errors"
+)
+
+// remotePublisher publishes events to containerd by running "containerd publish", the same way shims do
+type remotePublisher struct {
+	address string
+	binary  string
+}
+
+// NewRemotePublisher returns events.Publisher which sends events to containerd listening on the given address.
+// binary is containerd executable to run. Events are published to namespace of the context, "default" if none.
+func NewRemotePublisher(address, binary string) events.Publisher {
+	return &remotePublisher{address: address, binary: binary}
+}
+
+func (p *remotePublisher) Publish(ctx context.Context, topic string, event events.Event) error {
+	ns, ok := namespaces.Namespace(ctx)
+	if !ok {
+		ns = namespaces.Default
+	}
+
+	encoded, err := typeurl.MarshalAny(event)
+	if err != nil {
+		return errors.Wrapf(err, "failed to marshal %s event", topic)
+	}
+
+	data, err := encoded.Marshal()
+	if err != nil {
+		return errors.Wrapf(err, "failed to marshal %s event", topic)
+	}
+
+	cmd := exec.CommandContext(ctx, p.binary, "--address", p.address, "publish", "--topic", topic, "--namespace", ns)
+	cmd.Stdin = bytes.NewReader(data)
+
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return errors.Wrapf(err, "failed to publish %s event: %s", topic, string(output))
+	}
+
+	return nil
+}
@@ -32,6 +32,12 @@ import (
 
 type CreateFunc func(ctx context.Context) (snapshots.Snapshotter, error)
 
+// Reloader is implemented by snapshotters which can apply configuration changes without restart.
+// Run calls Reload on SIGHUP, snapshotters which don't implement it are stopped by SIGHUP instead.
+type Reloader interface {
+	Reload(ctx context.Context) error
+}
+
 // Run runs snapshotter ttrpc server for containerd (somewhat similar to shim.Run).
 // snapInit should create concrete snapshotter implementation such as naive or devmapper.
 // There are two command line parameters available out of the box:
@@ -54,7 +60,7 @@ func Run(snapInit CreateFunc) {
 	}
 
 	stop := make(chan os.Signal, 1)
-	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM, syscall.SIGPIPE, syscall.SIGHUP, syscall.SIGQUIT)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM, syscall.SIGPIPE, syscall.SIGQUIT)
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -68,6 +74,14 @@ func Run(snapInit CreateFunc) {
 		log.G(ctx).WithError(err).Fatal("failed to create snapshotter")
 	}
 
+	reload := make(chan os.Signal, 1)
+	reloader, canReload := snap.(Reloader)
+	if canReload {
+		signal.Notify(reload, syscall.SIGHUP)
+	} else {
+		signal.Notify(stop, syscall.SIGHUP)
+	}
+
 	// Convert the snapshotter interface to gRPC service and run server
 	log.G(ctx).WithField("unix_addr", unixAddr).Info("running gRPC server")
 	service := snapshotservice.FromSnapshotter(snap)
@@ -97,6 +111,10 @@ func Run(snapInit CreateFunc) {
 			case <-stop:
 				cancel()
 				return nil
+			case <-reload:
+				if err := reloader.Reload(ctx); err != nil {
+					log.G(ctx).WithError(err).Error("failed to reload snapshotter configuration")
+				}
 			case <-ctx.Done():
 				return ctx.Err()
 			}